@@ -0,0 +1,413 @@
+package blueconfig
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sfi2k7/microweb"
+	"go.etcd.io/bbolt"
+)
+
+// ============================================================================
+// Constants
+// ============================================================================
+
+const (
+	ACLNode   = "__acl" // users and roles, see SetRole and CreateUser
+	ACLPath   = "root/" + ACLNode
+	PermRead  = "read"
+	PermWrite = "write"
+)
+
+const (
+	aclUsersNode = "users" // users/<name>: roles (JSON list), password (hash)
+	aclRolesNode = "roles" // roles/<name>: rules (JSON list of ACLRule)
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrRoleNotFound = errors.New("role not found")
+)
+
+// ============================================================================
+// Types
+// ============================================================================
+
+// ACLRule grants permissions on the paths matching a glob pattern such as
+// root/services/a/**. As with Glob, wildcards do not reach internal nodes
+// like __acl unless the pattern names them.
+type ACLRule struct {
+	Path        string   `json:"path"`
+	Permissions []string `json:"permissions"` // PermRead and/or PermWrite
+}
+
+// Role is a named set of ACL rules
+type Role struct {
+	Name  string    `json:"name"`
+	Rules []ACLRule `json:"rules"`
+}
+
+// User is an account that logs in with a password and holds roles
+type User struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// Identity is the authenticated caller of an HTTP request. Admin callers,
+// those using the static token or the tree password, are not restricted.
+// API key callers are limited by the key's scopes instead of roles.
+type Identity struct {
+	User   string   `json:"user,omitempty"`
+	Admin  bool     `json:"admin,omitempty"`
+	APIKey string   `json:"api_key,omitempty"` // key ID
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// identityKey is the request context key authMiddleware stores the Identity under
+type identityKey struct{}
+
+// ============================================================================
+// Roles
+// ============================================================================
+
+// SetRole creates or replaces a role.
+// Example: SetRole("team-a", []ACLRule{{"root/services/a/**", []string{"read", "write"}}})
+func (t *Tree) SetRole(name string, rules []ACLRule) error {
+	if err := validACLName(name); err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if _, err := compileGlob(rule.Path); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.Path, err)
+		}
+		for _, perm := range rule.Permissions {
+			if perm != PermRead && perm != PermWrite {
+				return fmt.Errorf("rule %s: unknown permission %q", rule.Path, perm)
+			}
+		}
+	}
+
+	rulesJSON, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return t.writeTxn(func(txn *Transaction) error {
+		b, err := txn.createBucketAt(ACLPath + "/" + aclRolesNode + "/" + name)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("rules"), rulesJSON)
+	})
+}
+
+// DeleteRole removes a role; users holding it lose its rules
+func (t *Tree) DeleteRole(name string) error {
+	return t.writeTxn(func(txn *Transaction) error {
+		roles, err := txn.bucketAt(ACLPath + "/" + aclRolesNode)
+		if err != nil || roles.Bucket([]byte(name)) == nil {
+			return fmt.Errorf("%w: %s", ErrRoleNotFound, name)
+		}
+		return roles.DeleteBucket([]byte(name))
+	})
+}
+
+// ListRoles returns all roles sorted by name
+func (t *Tree) ListRoles() ([]Role, error) {
+	roles := []Role{}
+	err := t.readTxn(func(txn *Transaction) error {
+		b, err := txn.bucketAt(ACLPath + "/" + aclRolesNode)
+		if err != nil {
+			return nil // No roles yet
+		}
+		return b.ForEachBucket(func(k []byte) error {
+			role, err := readRole(b.Bucket(k), string(k))
+			if err != nil {
+				return err
+			}
+			roles = append(roles, role)
+			return nil
+		})
+	})
+	return roles, err
+}
+
+func readRole(b *bbolt.Bucket, name string) (Role, error) {
+	role := Role{Name: name, Rules: []ACLRule{}}
+	if v := b.Get([]byte("rules")); v != nil {
+		if err := json.Unmarshal(v, &role.Rules); err != nil {
+			return role, fmt.Errorf("role %s: %v", name, err)
+		}
+	}
+	return role, nil
+}
+
+// ============================================================================
+// Users
+// ============================================================================
+
+// CreateUser adds a user with a password and existing roles
+func (t *Tree) CreateUser(name, password string, roles []string) error {
+	if err := validACLName(name); err != nil {
+		return err
+	}
+	if password == "" {
+		return fmt.Errorf("password is required")
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return t.writeTxn(func(txn *Transaction) error {
+		users, err := txn.createBucketAt(ACLPath + "/" + aclUsersNode)
+		if err != nil {
+			return err
+		}
+		if users.Bucket([]byte(name)) != nil {
+			return fmt.Errorf("user already exists: %s", name)
+		}
+		b, err := users.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("password"), []byte(hash)); err != nil {
+			return err
+		}
+		return txn.putUserRoles(b, roles)
+	})
+}
+
+// SetUserRoles replaces the roles of a user
+func (t *Tree) SetUserRoles(name string, roles []string) error {
+	return t.writeTxn(func(txn *Transaction) error {
+		b, err := txn.userBucket(name)
+		if err != nil {
+			return err
+		}
+		return txn.putUserRoles(b, roles)
+	})
+}
+
+// SetUserPassword replaces the password of a user
+func (t *Tree) SetUserPassword(name, password string) error {
+	if password == "" {
+		return fmt.Errorf("password is required")
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return t.writeTxn(func(txn *Transaction) error {
+		b, err := txn.userBucket(name)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("password"), []byte(hash))
+	})
+}
+
+// DeleteUser removes a user and ends their sessions
+func (t *Tree) DeleteUser(name string) error {
+	err := t.writeTxn(func(txn *Transaction) error {
+		if _, err := txn.userBucket(name); err != nil {
+			return err
+		}
+		users, _ := txn.bucketAt(ACLPath + "/" + aclUsersNode)
+		return users.DeleteBucket([]byte(name))
+	})
+	if err != nil {
+		return err
+	}
+
+	t.sessions.mu.Lock()
+	defer t.sessions.mu.Unlock()
+	for token, s := range t.sessions.sessions {
+		if s.identity.User == name {
+			delete(t.sessions.sessions, token)
+		}
+	}
+	return nil
+}
+
+// ListUsers returns all users sorted by name
+func (t *Tree) ListUsers() ([]User, error) {
+	users := []User{}
+	err := t.readTxn(func(txn *Transaction) error {
+		b, err := txn.bucketAt(ACLPath + "/" + aclUsersNode)
+		if err != nil {
+			return nil // No users yet
+		}
+		return b.ForEachBucket(func(k []byte) error {
+			users = append(users, User{Name: string(k), Roles: userRoles(b.Bucket(k))})
+			return nil
+		})
+	})
+	return users, err
+}
+
+// LoginUser checks a user's password and issues a session token for them
+func (t *Tree) LoginUser(name, password string) (string, time.Time, error) {
+	var hash string
+	err := t.readTxn(func(txn *Transaction) error {
+		b, err := txn.userBucket(name)
+		if err != nil {
+			return err
+		}
+		hash = string(b.Get([]byte("password")))
+		return nil
+	})
+	if errors.Is(err, ErrUserNotFound) || (err == nil && !VerifyPassword(hash, password)) {
+		return "", time.Time{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return t.newSession(Identity{User: name})
+}
+
+// userExists reports whether a user account exists
+func (t *Tree) userExists(name string) bool {
+	return t.readTxn(func(txn *Transaction) error {
+		_, err := txn.userBucket(name)
+		return err
+	}) == nil
+}
+
+func (txn *Transaction) userBucket(name string) (*bbolt.Bucket, error) {
+	users, err := txn.bucketAt(ACLPath + "/" + aclUsersNode)
+	if err != nil || name == "" || users.Bucket([]byte(name)) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUserNotFound, name)
+	}
+	return users.Bucket([]byte(name)), nil
+}
+
+// putUserRoles stores roles on a user bucket after checking they exist
+func (txn *Transaction) putUserRoles(b *bbolt.Bucket, roles []string) error {
+	if roles == nil {
+		roles = []string{}
+	}
+	for _, role := range roles {
+		if _, err := txn.bucketAt(ACLPath + "/" + aclRolesNode + "/" + role); err != nil || role == "" {
+			return fmt.Errorf("%w: %s", ErrRoleNotFound, role)
+		}
+	}
+	rolesJSON, err := json.Marshal(roles)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte("roles"), rolesJSON)
+}
+
+func userRoles(b *bbolt.Bucket) []string {
+	roles := []string{}
+	json.Unmarshal(b.Get([]byte("roles")), &roles)
+	return roles
+}
+
+// validACLName checks a user or role name can be stored as a single node
+func validACLName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid name: %q", name)
+	}
+	return nil
+}
+
+// ============================================================================
+// Authorization
+// ============================================================================
+
+// Allowed reports whether id holds perm on path p through its roles
+func (t *Tree) Allowed(id Identity, p, perm string) (bool, error) {
+	if id.Admin {
+		return true, nil
+	}
+	parts := strings.Split(fixpath(p), "/")
+
+	allowed := false
+	err := t.readTxn(func(txn *Transaction) error {
+		b, err := txn.userBucket(id.User)
+		if err != nil {
+			return nil // Unknown users hold nothing
+		}
+		for _, name := range userRoles(b) {
+			rb, err := txn.bucketAt(ACLPath + "/" + aclRolesNode + "/" + name)
+			if err != nil {
+				continue // Deleted role
+			}
+			role, err := readRole(rb, name)
+			if err != nil {
+				return err
+			}
+			for _, rule := range role.Rules {
+				if !slices.Contains(rule.Permissions, perm) {
+					continue
+				}
+				if segments, err := compileGlob(rule.Path); err == nil && matchGlob(segments, parts) {
+					allowed = true
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	return allowed, err
+}
+
+// requestIdentity returns the identity authMiddleware attached to a request
+func requestIdentity(c *microweb.Context) (Identity, bool) {
+	id, ok := c.R.Context().Value(identityKey{}).(Identity)
+	return id, ok
+}
+
+func withIdentity(c *microweb.Context, id Identity) {
+	c.R = c.R.WithContext(context.WithValue(c.R.Context(), identityKey{}, id))
+}
+
+// permitted reports whether the caller holds perm on p. Requests that did
+// not pass through authMiddleware carry no identity and are denied; open
+// trees attach an admin identity there instead.
+func (t *Tree) permitted(c *microweb.Context, p, perm string) bool {
+	id, ok := requestIdentity(c)
+	if !ok {
+		return false
+	}
+	if id.APIKey != "" {
+		return scopesAllow(id.Scopes, routeArea(c.R.URL.Path), p, perm)
+	}
+	allowed, err := t.Allowed(id, p, perm)
+	return err == nil && allowed
+}
+
+// authorize answers 403 and returns false when the caller lacks perm on p
+func (t *Tree) authorize(c *microweb.Context, p, perm string) bool {
+	if t.permitted(c, p, perm) {
+		return true
+	}
+	id, _ := requestIdentity(c)
+	writeStatusJSON(c, http.StatusForbidden, response{
+		Error: "forbidden",
+		Details: map[string]string{
+			"user":       id.User,
+			"api_key":    id.APIKey,
+			"path":       fixpath(p),
+			"permission": perm,
+		},
+	})
+	return false
+}
+
+// guard wraps a handler so it only runs when the caller holds perm on the
+// path target derives from the request
+func (t *Tree) guard(perm string, target func(c *microweb.Context) string, h func(c *microweb.Context)) func(c *microweb.Context) {
+	return func(c *microweb.Context) {
+		if t.authorize(c, target(c), perm) {
+			h(c)
+		}
+	}
+}
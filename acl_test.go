@@ -0,0 +1,246 @@
+package blueconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sfi2k7/microweb"
+)
+
+// bearerRequest makes a request authenticated with an Authorization header
+func bearerRequest(t *testing.T, method, url string, body interface{}, token string) *http.Response {
+	t.Helper()
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	return resp
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"root/services/a/**", "root/services/a", true},
+		{"root/services/a/**", "root/services/a/http/port", true},
+		{"root/services/a/**", "root/services/b", false},
+		{"services/*/http", "root/services/b/http", true},
+		{"services/*/http", "root/services/b/grpc", false},
+		{"root/{a,b}", "root/b", true},
+		{"root/**", "root/__acl/users", false},
+		{"root/*", "root/__acl", false},
+		{"root/__acl/**", "root/__acl/users", true},
+		{"root/**/port", "root/x/y/port", true},
+	}
+
+	for _, tt := range tests {
+		segments, err := compileGlob(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileGlob(%q): %v", tt.pattern, err)
+		}
+		if got := matchGlob(segments, strings.Split(tt.path, "/")); got != tt.expected {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.path, got, tt.expected)
+		}
+	}
+}
+
+func TestUsersAndRoles(t *testing.T) {
+	fastPasswordHashing(t)
+
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	if err := tr.SetRole("bad", []ACLRule{{Path: "root/a", Permissions: []string{"delete"}}}); err == nil {
+		t.Error("expected error for unknown permission")
+	}
+	if err := tr.SetRole("bad/name", nil); err == nil {
+		t.Error("expected error for invalid role name")
+	}
+	if err := tr.CreateUser("alice", "pw", []string{"team-a"}); !errors.Is(err, ErrRoleNotFound) {
+		t.Errorf("CreateUser with unknown role: got %v", err)
+	}
+
+	tr.SetRole("team-a", []ACLRule{
+		{Path: "root/services/a/**", Permissions: []string{PermRead, PermWrite}},
+		{Path: "root/shared/**", Permissions: []string{PermRead}},
+	})
+	tr.SetRole("ops", []ACLRule{{Path: "root/**", Permissions: []string{PermRead}}})
+	if err := tr.CreateUser("alice", "pw", []string{"team-a"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if err := tr.CreateUser("alice", "pw", nil); err == nil {
+		t.Error("expected error for duplicate user")
+	}
+
+	alice := Identity{User: "alice"}
+	tests := []struct {
+		id       Identity
+		path     string
+		perm     string
+		expected bool
+	}{
+		{alice, "services/a/http", PermWrite, true},
+		{alice, "root/services/a", PermRead, true},
+		{alice, "root/shared/cfg", PermRead, true},
+		{alice, "root/shared/cfg", PermWrite, false},
+		{alice, "root/services/b", PermRead, false},
+		{alice, "root", PermRead, false},
+		{Identity{User: "nobody"}, "root/services/a", PermRead, false},
+		{Identity{Admin: true}, "root/__acl", PermWrite, true},
+	}
+	for _, tt := range tests {
+		if got, err := tr.Allowed(tt.id, tt.path, tt.perm); err != nil || got != tt.expected {
+			t.Errorf("Allowed(%+v, %s, %s) = %v, %v; want %v", tt.id, tt.path, tt.perm, got, err, tt.expected)
+		}
+	}
+
+	tr.SetUserRoles("alice", []string{"team-a", "ops"})
+	if ok, _ := tr.Allowed(alice, "root/services/b", PermRead); !ok {
+		t.Error("second role not applied")
+	}
+	tr.DeleteRole("ops")
+	if ok, _ := tr.Allowed(alice, "root/services/b", PermRead); ok {
+		t.Error("deleted role still applied")
+	}
+
+	if users, _ := tr.ListUsers(); fmt.Sprint(users) != "[{alice [team-a ops]}]" {
+		t.Errorf("ListUsers = %v", users)
+	}
+	if roles, _ := tr.ListRoles(); len(roles) != 1 || roles[0].Name != "team-a" || len(roles[0].Rules) != 2 {
+		t.Errorf("ListRoles = %+v", roles)
+	}
+
+	if _, _, err := tr.LoginUser("alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("LoginUser with wrong password: got %v", err)
+	}
+	if _, _, err := tr.LoginUser("bob", "pw"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("LoginUser with unknown user: got %v", err)
+	}
+	tr.SetUserPassword("alice", "pw2")
+	token, _, err := tr.LoginUser("alice", "pw2")
+	if err != nil {
+		t.Fatalf("LoginUser: %v", err)
+	}
+	if id, ok := tr.sessionIdentity(token); !ok || id.User != "alice" || id.Admin {
+		t.Errorf("sessionIdentity = %+v, %v", id, ok)
+	}
+
+	tr.DeleteUser("alice")
+	if tr.ValidSession(token) {
+		t.Error("session should end when the user is deleted")
+	}
+}
+
+func TestHTTP_AccessControl(t *testing.T) {
+	fastPasswordHashing(t)
+
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+	server := strings.TrimSuffix(baseURL, "/db/mydb/tables/users")
+
+	tr.SetValue("/services/a/port", "80")
+	tr.SetValue("/services/b/port", "81")
+	tr.SetRole("team-a", []ACLRule{
+		{Path: "root/services/a/**", Permissions: []string{PermRead, PermWrite}},
+		{Path: "root/mydb/**", Permissions: []string{PermRead}},
+	})
+	tr.CreateUser("alice", "pw", []string{"team-a"})
+
+	login := parseResponse(t, makeRequest(t, "POST", server+"/login", map[string]string{"user": "alice", "password": "pw"}, ""))
+	result, _ := login["result"].(map[string]interface{})
+	token, _ := result["token"].(string)
+	if token == "" {
+		t.Fatalf("login = %v", login)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   interface{}
+		status int
+	}{
+		{"read own node", "GET", server + "/root/services/a/values", nil, http.StatusOK},
+		{"write own node", "POST", server + "/root/services/a/save", map[string]string{"port": "8080"}, http.StatusOK},
+		{"read other node", "GET", server + "/root/services/b/port/value", nil, http.StatusForbidden},
+		{"write other node", "POST", server + "/root/services/b/create", nil, http.StatusForbidden},
+		{"copy into other node", "POST", server + "/root/services/a/copy?to=services/b/a", nil, http.StatusForbidden},
+		{"read rows", "GET", baseURL + "/rows/user1", nil, http.StatusOK},
+		{"write rows", "DELETE", baseURL + "/rows/user1", nil, http.StatusForbidden},
+		{"timeseries", "GET", server + "/timeseries/sensors", nil, http.StatusForbidden},
+		{"purge trash", "POST", server + "/trash/purge", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := bearerRequest(t, tt.method, tt.url, tt.body, token)
+			result := parseResponse(t, resp)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("%s %s = %d %v, want %d", tt.method, tt.url, resp.StatusCode, result, tt.status)
+			}
+			if tt.status == http.StatusForbidden {
+				details, _ := result["details"].(map[string]interface{})
+				if result["error"] != "forbidden" || details["user"] != "alice" || details["path"] == "" {
+					t.Errorf("403 body = %v", result)
+				}
+			}
+		})
+	}
+
+	// Listings leave out what the caller may not read
+	glob := parseResponse(t, bearerRequest(t, "GET", server+"/glob?p=services/*", nil, token))
+	if fmt.Sprint(glob["result"]) != "[root/services/a]" {
+		t.Errorf("glob = %v", glob)
+	}
+
+	// The static token keeps full access
+	resp := makeRequest(t, "GET", server+"/root/services/b/port/value", nil, "test-token")
+	if result := parseResponse(t, resp); resp.StatusCode != http.StatusOK || result["result"] != "81" {
+		t.Errorf("static token read = %d %v", resp.StatusCode, result)
+	}
+}
+
+// adminContext wraps a request the way authMiddleware does for an admin, for
+// tests that call handlers directly
+func adminContext(r *http.Request, w http.ResponseWriter) *microweb.Context {
+	c := &microweb.Context{R: r, W: w}
+	withIdentity(c, Identity{Admin: true})
+	return c
+}
+
+func TestPermittedWithoutIdentity(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+	tr.SetValue("/services/a/port", "80")
+
+	// Handlers reached without authMiddleware fail closed
+	w := httptest.NewRecorder()
+	tr.handleGetRequest(&microweb.Context{R: httptest.NewRequest("GET", "/root/services/a/port/value", nil), W: w})
+	if w.Code != http.StatusForbidden || strings.Contains(w.Body.String(), `"80"`) {
+		t.Errorf("GET without identity = %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	tr.handleGetRequest(adminContext(httptest.NewRequest("GET", "/root/services/a/port/value", nil), w))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"80"`) {
+		t.Errorf("GET as admin = %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,326 @@
+package blueconfig
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ============================================================================
+// Constants
+// ============================================================================
+
+const (
+	APIKeysNode            = "__apikeys" // apikeys/<id>: name, hash, scopes, created_at, expires_at, last_used
+	APIKeysPath            = "root/" + APIKeysNode
+	APIKeyHeader           = "X-API-Key"
+	APIKeyPrefix           = "bck_" // keys are bck_<id>_<secret>
+	DefaultAPIKeyRateLimit = 600    // requests per minute per key
+)
+
+// API key scope areas, one per group of HTTP routes
+const (
+	ScopeConfig     = "config"     // core node routes and trash
+	ScopeDB         = "db"         // /db routes
+	ScopeTimeseries = "timeseries" // /timeseries routes
+)
+
+// apiKeyTouchInterval limits how often last_used is written for a busy key
+const apiKeyTouchInterval = time.Minute
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	ErrAPIKeyExpired  = errors.New("api key expired")
+)
+
+// ============================================================================
+// Types
+// ============================================================================
+
+// APIKey describes a key; the key itself is only returned by CreateAPIKey
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	LastUsed  time.Time `json:"last_used,omitzero"`
+}
+
+// rateLimiter is a token bucket per API key allowing perMinute requests
+// a minute with bursts of the same size
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	buckets   map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ============================================================================
+// Key Management
+// ============================================================================
+
+// CreateAPIKey issues a key holding scopes of the form area:permission or
+// area:permission:pattern, where area is config, db or timeseries and the
+// glob pattern limits the paths. Internal nodes such as __acl are only
+// reachable through a pattern that names them. A zero expiresAt never
+// expires. Only a hash is stored, the returned key can not be recovered later.
+// Example: CreateAPIKey("deploy", []string{"config:read:root/services/**"}, time.Time{})
+func (t *Tree) CreateAPIKey(name string, scopes []string, expiresAt time.Time) (string, APIKey, error) {
+	for _, scope := range scopes {
+		if _, _, _, err := parseScope(scope); err != nil {
+			return "", APIKey{}, err
+		}
+	}
+	if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+		return "", APIKey{}, fmt.Errorf("expiry is in the past")
+	}
+
+	idBytes := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	id := hex.EncodeToString(idBytes)
+	key := APIKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret)
+
+	if scopes == nil {
+		scopes = []string{}
+	}
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	info := APIKey{ID: id, Name: name, Scopes: scopes, CreatedAt: time.Unix(time.Now().Unix(), 0), ExpiresAt: expiresAt}
+
+	err = t.writeTxn(func(txn *Transaction) error {
+		b, err := txn.createBucketAt(APIKeysPath + "/" + id)
+		if err != nil {
+			return err
+		}
+		var expires int64
+		if !expiresAt.IsZero() {
+			expires = expiresAt.Unix()
+		}
+		for k, v := range map[string]string{
+			"name":       name,
+			"hash":       hashAPIKey(key),
+			"scopes":     string(scopesJSON),
+			"created_at": strconv.FormatInt(info.CreatedAt.Unix(), 10),
+			"expires_at": strconv.FormatInt(expires, 10),
+		} {
+			if err := b.Put([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	return key, info, nil
+}
+
+// RevokeAPIKey deletes a key by its ID
+func (t *Tree) RevokeAPIKey(id string) error {
+	return t.writeTxn(func(txn *Transaction) error {
+		keys, err := txn.bucketAt(APIKeysPath)
+		if err != nil || id == "" || keys.Bucket([]byte(id)) == nil {
+			return fmt.Errorf("%w: %s", ErrAPIKeyNotFound, id)
+		}
+		return keys.DeleteBucket([]byte(id))
+	})
+}
+
+// ListAPIKeys returns all keys, including expired ones, sorted by ID
+func (t *Tree) ListAPIKeys() ([]APIKey, error) {
+	keys := []APIKey{}
+	err := t.readTxn(func(txn *Transaction) error {
+		b, err := txn.bucketAt(APIKeysPath)
+		if err != nil {
+			return nil // No keys yet
+		}
+		return b.ForEachBucket(func(k []byte) error {
+			keys = append(keys, apiKeyInfo(string(k), b.Bucket(k)))
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// VerifyAPIKey returns the key's details when key is valid and not expired,
+// and records it as used
+func (t *Tree) VerifyAPIKey(key string) (APIKey, error) {
+	id, _, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, APIKeyPrefix) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	var info APIKey
+	err := t.readTxn(func(txn *Transaction) error {
+		b, err := txn.bucketAt(APIKeysPath + "/" + id)
+		if err != nil {
+			return ErrAPIKeyNotFound
+		}
+		if subtle.ConstantTimeCompare(b.Get([]byte("hash")), []byte(hashAPIKey(key))) != 1 {
+			return ErrAPIKeyNotFound
+		}
+		info = apiKeyInfo(id, b)
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	if !info.ExpiresAt.IsZero() && time.Now().After(info.ExpiresAt) {
+		return APIKey{}, ErrAPIKeyExpired
+	}
+
+	// Busy keys are only written back once per interval
+	if time.Since(info.LastUsed) >= apiKeyTouchInterval {
+		now := time.Now()
+		err := t.writeTxn(func(txn *Transaction) error {
+			b, err := txn.bucketAt(APIKeysPath + "/" + id)
+			if err != nil {
+				return nil // Revoked meanwhile
+			}
+			return b.Put([]byte("last_used"), []byte(strconv.FormatInt(now.Unix(), 10)))
+		})
+		if err != nil {
+			return APIKey{}, err
+		}
+		info.LastUsed = time.Unix(now.Unix(), 0)
+	}
+	return info, nil
+}
+
+func apiKeyInfo(id string, b *bbolt.Bucket) APIKey {
+	info := APIKey{ID: id, Name: string(b.Get([]byte("name"))), Scopes: []string{}}
+	json.Unmarshal(b.Get([]byte("scopes")), &info.Scopes)
+	info.CreatedAt = unixProp(b, "created_at")
+	info.ExpiresAt = unixProp(b, "expires_at")
+	info.LastUsed = unixProp(b, "last_used")
+	return info
+}
+
+// unixProp reads a unix seconds property; missing or zero is the zero time
+func unixProp(b *bbolt.Bucket, name string) time.Time {
+	secs, _ := strconv.ParseInt(string(b.Get([]byte(name))), 10, 64)
+	if secs == 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// hashAPIKey hashes a key for storage. Keys carry 256 random bits, so a
+// fast hash is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ============================================================================
+// Scopes
+// ============================================================================
+
+// parseScope splits area:permission[:pattern] and validates its parts
+func parseScope(scope string) (area, perm, pattern string, err error) {
+	parts := strings.SplitN(scope, ":", 3)
+	if len(parts) < 2 {
+		return "", "", "", fmt.Errorf("invalid scope %q, expected area:permission[:pattern]", scope)
+	}
+	area, perm = parts[0], parts[1]
+	if area != ScopeConfig && area != ScopeDB && area != ScopeTimeseries {
+		return "", "", "", fmt.Errorf("invalid scope %q: unknown area %q", scope, area)
+	}
+	if perm != PermRead && perm != PermWrite {
+		return "", "", "", fmt.Errorf("invalid scope %q: unknown permission %q", scope, perm)
+	}
+	if len(parts) == 3 {
+		pattern = parts[2]
+		if _, err := compileGlob(pattern); err != nil {
+			return "", "", "", fmt.Errorf("invalid scope %q: %v", scope, err)
+		}
+	}
+	return area, perm, pattern, nil
+}
+
+// scopesAllow reports whether any scope grants perm on path p in area. A
+// scope without a pattern covers root/**, so like any wildcard it does not
+// reach internal nodes such as __acl or __apikeys.
+func scopesAllow(scopes []string, area, p, perm string) bool {
+	parts := strings.Split(fixpath(p), "/")
+	for _, scope := range scopes {
+		a, sp, pattern, err := parseScope(scope)
+		if err != nil || a != area || sp != perm {
+			continue
+		}
+		if pattern == "" {
+			pattern = "root/**"
+		}
+		if segments, err := compileGlob(pattern); err == nil && matchGlob(segments, parts) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeArea returns the scope area of a request path
+func routeArea(urlPath string) string {
+	switch {
+	case urlPath == "/db" || strings.HasPrefix(urlPath, "/db/"):
+		return ScopeDB
+	case urlPath == "/timeseries" || strings.HasPrefix(urlPath, "/timeseries/"):
+		return ScopeTimeseries
+	}
+	return ScopeConfig
+}
+
+// ============================================================================
+// Rate Limiting
+// ============================================================================
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{perMinute: perMinute, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token for key, reporting false when it has none left.
+// A limiter of zero or fewer requests per minute allows everything.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil || l.perMinute <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.perMinute), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(float64(l.perMinute), b.tokens+now.Sub(b.last).Minutes()*float64(l.perMinute))
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
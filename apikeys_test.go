@@ -0,0 +1,194 @@
+package blueconfig
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiKeyRequest makes a request authenticated with an API key header
+func apiKeyRequest(t *testing.T, method, url, key string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(nil))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set(APIKeyHeader, key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	return resp
+}
+
+func TestAPIKeys(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	for _, scopes := range [][]string{{"config"}, {"files:read"}, {"db:delete"}, {"config:read:root/{a"}} {
+		if _, _, err := tr.CreateAPIKey("bad", scopes, time.Time{}); err == nil {
+			t.Errorf("CreateAPIKey(%v) expected error", scopes)
+		}
+	}
+	if _, _, err := tr.CreateAPIKey("old", nil, time.Now().Add(-time.Hour)); err == nil {
+		t.Error("expected error for expiry in the past")
+	}
+
+	key, info, err := tr.CreateAPIKey("deploy", []string{"config:read:root/services/**", "db:read"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	if !strings.HasPrefix(key, APIKeyPrefix+info.ID+"_") {
+		t.Errorf("key = %q, id = %q", key, info.ID)
+	}
+	if hash, _ := tr.GetValue(APIKeysPath + "/" + info.ID + "/hash"); hash == "" || strings.Contains(hash, key) {
+		t.Errorf("stored hash = %q", hash)
+	}
+
+	verified, err := tr.VerifyAPIKey(key)
+	if err != nil || verified.Name != "deploy" || len(verified.Scopes) != 2 || verified.LastUsed.IsZero() {
+		t.Fatalf("VerifyAPIKey = %+v, %v", verified, err)
+	}
+	for _, bad := range []string{"", "nope", key + "x", APIKeyPrefix + "0000000000000000_" + strings.Repeat("A", 43)} {
+		if _, err := tr.VerifyAPIKey(bad); !errors.Is(err, ErrAPIKeyNotFound) {
+			t.Errorf("VerifyAPIKey(%q): got %v", bad, err)
+		}
+	}
+
+	keys, _ := tr.ListAPIKeys()
+	if len(keys) != 1 || keys[0].ID != info.ID || keys[0].LastUsed.IsZero() {
+		t.Errorf("ListAPIKeys = %+v", keys)
+	}
+
+	tr.SetValue(APIKeysPath+"/"+info.ID+"/expires_at", strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	if _, err := tr.VerifyAPIKey(key); !errors.Is(err, ErrAPIKeyExpired) {
+		t.Errorf("VerifyAPIKey of an expired key: got %v", err)
+	}
+
+	if err := tr.RevokeAPIKey(info.ID); err != nil {
+		t.Fatalf("RevokeAPIKey: %v", err)
+	}
+	if _, err := tr.VerifyAPIKey(key); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("VerifyAPIKey of a revoked key: got %v", err)
+	}
+	if err := tr.RevokeAPIKey(info.ID); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Errorf("RevokeAPIKey twice: got %v", err)
+	}
+}
+
+func TestScopesAllow(t *testing.T) {
+	scopes := []string{"timeseries:write", "db:read", "config:read:root/services/**"}
+	tests := []struct {
+		area     string
+		path     string
+		perm     string
+		expected bool
+	}{
+		{ScopeTimeseries, SensorsPath + "/cpu", PermWrite, true},
+		{ScopeTimeseries, SensorsPath + "/cpu", PermRead, false},
+		{ScopeDB, "root/mydb/users", PermRead, true},
+		{ScopeDB, "root/mydb/users", PermWrite, false},
+		{ScopeConfig, "root/services/a", PermRead, true},
+		{ScopeConfig, "root/other", PermRead, false},
+		{ScopeConfig, "root/services/a", PermWrite, false},
+	}
+	for _, tt := range tests {
+		if got := scopesAllow(scopes, tt.area, tt.path, tt.perm); got != tt.expected {
+			t.Errorf("scopesAllow(%s, %s, %s) = %v, want %v", tt.area, tt.path, tt.perm, got, tt.expected)
+		}
+	}
+
+	// Scopes without a pattern do not reach internal nodes unless one names them
+	internal := []string{"config:write", "config:read:root/__acl/**"}
+	for p, expected := range map[string]bool{
+		"root/other":                  true,
+		ACLPath:                       false,
+		APIKeysPath + "/abc":          false,
+		"root/__storeinfo/__password": false,
+		"root/services/__secret":      false,
+	} {
+		if got := scopesAllow(internal, ScopeConfig, p, PermWrite); got != expected {
+			t.Errorf("scopesAllow(config:write, %s) = %v, want %v", p, got, expected)
+		}
+	}
+	if !scopesAllow(internal, ScopeConfig, ACLPath+"/users/alice", PermRead) {
+		t.Error("a pattern naming __acl should reach it")
+	}
+
+	for p, area := range map[string]string{"/db/mydb/info": ScopeDB, "/timeseries/sensors": ScopeTimeseries, "/root/dbx": ScopeConfig, "/dbx": ScopeConfig} {
+		if got := routeArea(p); got != area {
+			t.Errorf("routeArea(%s) = %s, want %s", p, got, area)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2)
+	if !l.allow("a") || !l.allow("a") {
+		t.Fatal("burst should be allowed")
+	}
+	if l.allow("a") {
+		t.Error("third request should be limited")
+	}
+	if !l.allow("b") {
+		t.Error("keys are limited separately")
+	}
+
+	// A minute refills the bucket
+	l.buckets["a"].last = time.Now().Add(-time.Minute)
+	if !l.allow("a") {
+		t.Error("bucket should refill")
+	}
+
+	if unlimited := newRateLimiter(-1); !unlimited.allow("a") || !unlimited.allow("a") || !unlimited.allow("a") {
+		t.Error("negative limit should not limit")
+	}
+}
+
+func TestHTTP_APIKeys(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+	server := strings.TrimSuffix(baseURL, "/db/mydb/tables/users")
+
+	tr.SetValue("/services/a/port", "80")
+	tr.SetValue("/other/port", "81")
+	key, _, _ := tr.CreateAPIKey("reader", []string{"config:read:root/services/**", "db:read"}, time.Time{})
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		key    string
+		status int
+	}{
+		{"scoped read", "GET", server + "/root/services/a/port/value", key, http.StatusOK},
+		{"outside pattern", "GET", server + "/root/other/port/value", key, http.StatusForbidden},
+		{"write without scope", "POST", server + "/root/services/a/create", key, http.StatusForbidden},
+		{"db read", "GET", baseURL + "/rows/user1", key, http.StatusOK},
+		{"db write", "DELETE", baseURL + "/rows/user1", key, http.StatusForbidden},
+		{"other area", "GET", server + "/timeseries/sensors", key, http.StatusForbidden},
+		{"unknown key", "GET", server + "/root/services/a/port/value", key + "x", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := apiKeyRequest(t, tt.method, tt.url, tt.key)
+			result := parseResponse(t, resp)
+			if resp.StatusCode != tt.status {
+				t.Errorf("%s %s = %d %v, want %d", tt.method, tt.url, resp.StatusCode, result, tt.status)
+			}
+		})
+	}
+
+	tr.keyLimiter = newRateLimiter(1)
+	if resp := apiKeyRequest(t, "GET", server+"/root/services/a/port/value", key); resp.StatusCode != http.StatusOK {
+		t.Errorf("first request = %d", resp.StatusCode)
+	}
+	if resp := apiKeyRequest(t, "GET", server+"/root/services/a/port/value", key); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request over the limit = %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,237 @@
+package blueconfig
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/argon2"
+)
+
+// ============================================================================
+// Constants
+// ============================================================================
+
+const (
+	StoreInfoPath     = "root/__storeinfo"
+	PasswordPath      = StoreInfoPath + "/__password"
+	DefaultSessionTTL = 12 * time.Hour
+)
+
+// passwordHashPrefix starts stored hashes, which use the PHC string format:
+// $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<hash>
+const passwordHashPrefix = "$argon2id$"
+
+// passwordHashParams are the argon2id costs for new hashes; stored hashes
+// carry their own so they can be raised later
+var passwordHashParams = argon2Params{memory: 64 * 1024, time: 3, threads: 2}
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrLoginDisabled      = errors.New("login is not enabled: no password set")
+)
+
+// ============================================================================
+// Types
+// ============================================================================
+
+// sessionStore holds the session tokens issued by Login and LoginUser
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session // by token
+}
+
+type session struct {
+	identity Identity
+	expires  time.Time
+}
+
+// argon2Params are the costs of an argon2id hash
+type argon2Params struct {
+	memory  uint32 // KiB
+	time    uint32
+	threads uint8
+}
+
+// ============================================================================
+// Password Hashing
+// ============================================================================
+
+// HashPassword derives a salted argon2id hash of password for storage
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	p := passwordHashParams
+	hash := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, 32)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", passwordHashPrefix, argon2.Version, p.memory, p.time, p.threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// VerifyPassword reports whether password matches a hash from HashPassword
+func VerifyPassword(encoded, password string) bool {
+	if !IsPasswordHash(encoded) {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(encoded, passwordHashPrefix), "$")
+	if len(parts) != 4 {
+		return false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[0], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var p argon2Params
+	if _, err := fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &p.memory, &p.time, &p.threads); err != nil ||
+		p.time == 0 || p.threads == 0 || p.memory < 8*uint32(p.threads) {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(want) == 0 {
+		return false
+	}
+
+	got := argon2.IDKey([]byte(password), salt, p.time, p.memory, p.threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// IsPasswordHash reports whether a stored password is hashed
+func IsPasswordHash(s string) bool {
+	return strings.HasPrefix(s, passwordHashPrefix)
+}
+
+// ============================================================================
+// Tree Password
+// ============================================================================
+
+// SetPassword hashes password into root/__storeinfo/__password; an empty
+// password removes it and disables login
+func (t *Tree) SetPassword(password string) error {
+	if password == "" {
+		return t.rwbucket(StoreInfoPath, func(b *bbolt.Bucket) error {
+			return b.Delete([]byte("__password"))
+		})
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	return t.SetValue(PasswordPath, hash)
+}
+
+// HasPassword reports whether the tree has a password set
+func (t *Tree) HasPassword() bool {
+	stored, _ := t.GetValue(PasswordPath)
+	return stored != ""
+}
+
+// CheckPassword verifies password against the stored one. A password stored
+// in plaintext by older versions is compared directly and, when it matches,
+// replaced by its hash.
+func (t *Tree) CheckPassword(password string) (bool, error) {
+	stored, _ := t.GetValue(PasswordPath)
+	if stored == "" {
+		return false, ErrLoginDisabled
+	}
+	if IsPasswordHash(stored) {
+		return VerifyPassword(stored, password), nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(password)) != 1 {
+		return false, nil
+	}
+	return true, t.SetPassword(password)
+}
+
+// ============================================================================
+// Sessions
+// ============================================================================
+
+// Login checks password and issues a session token valid for the tree's
+// session TTL. Tokens are held in memory and end with the process.
+func (t *Tree) Login(password string) (string, time.Time, error) {
+	ok, err := t.CheckPassword(password)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !ok {
+		return "", time.Time{}, ErrInvalidCredentials
+	}
+	return t.newSession(Identity{Admin: true})
+}
+
+// newSession issues a session token for id
+func (t *Tree) newSession(id Identity) (string, time.Time, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(raw)
+	expires := time.Now().Add(t.sessionTTL)
+
+	t.sessions.mu.Lock()
+	defer t.sessions.mu.Unlock()
+	if t.sessions.sessions == nil {
+		t.sessions.sessions = make(map[string]session)
+	}
+	// Drop expired sessions while we are here
+	for tok, s := range t.sessions.sessions {
+		if time.Now().After(s.expires) {
+			delete(t.sessions.sessions, tok)
+		}
+	}
+	t.sessions.sessions[token] = session{identity: id, expires: expires}
+	return token, expires, nil
+}
+
+// Logout ends a session
+func (t *Tree) Logout(token string) {
+	t.sessions.mu.Lock()
+	defer t.sessions.mu.Unlock()
+	delete(t.sessions.sessions, token)
+}
+
+// ValidSession reports whether token is a live session token
+func (t *Tree) ValidSession(token string) bool {
+	_, ok := t.sessionIdentity(token)
+	return ok
+}
+
+// sessionIdentity returns who a live session token was issued to
+func (t *Tree) sessionIdentity(token string) (Identity, bool) {
+	t.sessions.mu.Lock()
+	defer t.sessions.mu.Unlock()
+
+	s, ok := t.sessions.sessions[token]
+	if !ok {
+		return Identity{}, false
+	}
+	if time.Now().After(s.expires) {
+		delete(t.sessions.sessions, token)
+		return Identity{}, false
+	}
+	return s.identity, true
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(header string) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
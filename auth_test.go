@@ -0,0 +1,198 @@
+package blueconfig
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sfi2k7/microweb"
+)
+
+// fastPasswordHashing lowers the argon2id costs for the duration of a test
+func fastPasswordHashing(t *testing.T) {
+	old := passwordHashParams
+	passwordHashParams = argon2Params{memory: 1024, time: 1, threads: 1}
+	t.Cleanup(func() { passwordHashParams = old })
+}
+
+func TestHashPassword(t *testing.T) {
+	fastPasswordHashing(t)
+
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if !IsPasswordHash(hash) || strings.Contains(hash, "hunter2") {
+		t.Errorf("hash = %q", hash)
+	}
+	if other, _ := HashPassword("hunter2"); other == hash {
+		t.Error("hashes of the same password should differ by salt")
+	}
+
+	if !VerifyPassword(hash, "hunter2") {
+		t.Error("VerifyPassword rejected the right password")
+	}
+	for _, tt := range []struct{ hash, password string }{
+		{hash, "hunter3"},
+		{hash, ""},
+		{"hunter2", "hunter2"},
+		{"$argon2id$v=19$m=x,t=1,p=1$salt$hash", "hunter2"},
+		{strings.Replace(hash, "$v=19$", "$v=16$", 1), "hunter2"},
+		{strings.Replace(hash, ",t=1,", ",t=2,", 1), "hunter2"},
+	} {
+		if VerifyPassword(tt.hash, tt.password) {
+			t.Errorf("VerifyPassword(%q, %q) = true", tt.hash, tt.password)
+		}
+	}
+}
+
+func TestTreePasswordAndLogin(t *testing.T) {
+	fastPasswordHashing(t)
+
+	tr, err := NewOrOpenTree(TreeOptions{
+		StorageLocationOnDisk: filepath.Join(t.TempDir(), "test.db"),
+		SessionTTL:            50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup(t, tr)
+
+	if _, _, err := tr.Login("anything"); !errors.Is(err, ErrLoginDisabled) {
+		t.Errorf("Login without password: got %v", err)
+	}
+
+	// Plaintext passwords from older stores are upgraded on first use
+	tr.SetValue(PasswordPath, "legacy")
+	if ok, err := tr.CheckPassword("legacy"); !ok || err != nil {
+		t.Fatalf("CheckPassword legacy = %v, %v", ok, err)
+	}
+	if stored, _ := tr.GetValue(PasswordPath); !IsPasswordHash(stored) {
+		t.Errorf("legacy password not upgraded: %q", stored)
+	}
+
+	tr.SetPassword("s3cret")
+	if _, _, err := tr.Login("wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Login with wrong password: got %v", err)
+	}
+	token, expires, err := tr.Login("s3cret")
+	if err != nil || token == "" || !expires.After(time.Now()) {
+		t.Fatalf("Login = %q, %v, %v", token, expires, err)
+	}
+	if !tr.ValidSession(token) || tr.ValidSession("other") {
+		t.Error("ValidSession mismatch")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if tr.ValidSession(token) {
+		t.Error("session should have expired")
+	}
+
+	token, _, _ = tr.Login("s3cret")
+	tr.Logout(token)
+	if tr.ValidSession(token) {
+		t.Error("session should end on logout")
+	}
+
+	tr.SetPassword("")
+	if tr.HasPassword() {
+		t.Error("empty password should remove it")
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	fastPasswordHashing(t)
+
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+	tr.SetPassword("s3cret")
+
+	web := microweb.New()
+	web.Use(tr.authMiddleware)
+	web.Post("/login", tr.handleLogin)
+	web.Post("/logout", tr.handleLogout)
+	web.Get("/", tr.handleGetRequest)
+
+	serve := func(method, path, body, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		web.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := serve("POST", "/login", `{"password": "wrong"}`, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with wrong password = %d %s", w.Code, w.Body.String())
+	}
+	w := serve("POST", "/login", `{"password": "s3cret"}`, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"token":"`) {
+		t.Fatalf("login = %d %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+	token := body[strings.Index(body, `"token":"`)+9:]
+	token = token[:strings.Index(token, `"`)]
+
+	tests := []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+	}{
+		{"session bearer", "/root", "Bearer " + token, http.StatusOK},
+		{"static token bearer", "/root", "Bearer test-token", http.StatusOK},
+		{"static token query", "/root?token=test-token", "", http.StatusUnauthorized},
+		{"session in query", "/root?token=" + token, "", http.StatusUnauthorized},
+		{"unknown bearer", "/root", "Bearer nope", http.StatusUnauthorized},
+		{"basic scheme", "/root", "Basic " + token, http.StatusUnauthorized},
+		{"no credentials", "/root", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve("GET", tt.path, "", tt.auth); w.Code != tt.status {
+				t.Errorf("GET %s = %d, want %d (%s)", tt.path, w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+
+	serve("POST", "/logout", "", "Bearer "+token)
+	if w := serve("GET", "/root", "", "Bearer "+token); w.Code != http.StatusUnauthorized {
+		t.Errorf("session after logout = %d", w.Code)
+	}
+}
+
+func TestOpenTree(t *testing.T) {
+	tr, err := NewOrOpenTree(TreeOptions{StorageLocationOnDisk: filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatalf("NewOrOpenTree: %v", err)
+	}
+	defer cleanup(t, tr)
+
+	open := func() bool {
+		c := &microweb.Context{R: httptest.NewRequest("GET", "/root", nil), W: httptest.NewRecorder()}
+		return tr.authMiddleware(c)
+	}
+	if !open() {
+		t.Fatal("a tree without credentials should be open")
+	}
+
+	// Any kind of credential closes the tree
+	_, info, _ := tr.CreateAPIKey("deploy", []string{"config:read"}, time.Time{})
+	if open() {
+		t.Error("a tree with an API key should not be open")
+	}
+	tr.RevokeAPIKey(info.ID)
+	tr.SetRole("readers", []ACLRule{{Path: "root/**", Permissions: []string{PermRead}}})
+	if open() {
+		t.Error("a tree with a role should not be open")
+	}
+	tr.DeleteRole("readers")
+	if !open() {
+		t.Error("a tree should be open again once its credentials are gone")
+	}
+}
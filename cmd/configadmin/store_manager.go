@@ -102,9 +102,12 @@ func (csm *ConfigStoreManager) Create(name, displayName, description, password s
 	tree.SetValue("root/__storeinfo/__icon", "fa-database")
 	tree.SetValue("root/__storeinfo/__color", "#3498db")
 
-	// Password (if provided)
+	// Password (if provided), stored as a hash
 	if password != "" {
-		tree.SetValue("root/__storeinfo/__password", password)
+		if err := tree.SetPassword(password); err != nil {
+			tree.Close()
+			return fmt.Errorf("failed to set password: %v", err)
+		}
 	}
 
 	// Regular metadata
@@ -267,13 +270,26 @@ func (csm *ConfigStoreManager) getStoreInfo(name string) (StoreInfo, error) {
 	return info, nil
 }
 
-// UpdateStoreInfo updates store metadata
+// UpdateStoreInfo updates store metadata. Changing "__password" on a store
+// that already has one requires its current value as "currentPassword";
+// an empty "__password" removes the password.
 func (csm *ConfigStoreManager) UpdateStoreInfo(name string, updates map[string]string) error {
 	tree, err := csm.Load(name)
 	if err != nil {
 		return err
 	}
 
+	if password, ok := updates["__password"]; ok {
+		if tree.HasPassword() {
+			if valid, err := tree.CheckPassword(updates["currentPassword"]); err != nil || !valid {
+				return fmt.Errorf("current password is incorrect")
+			}
+		}
+		if err := tree.SetPassword(password); err != nil {
+			return fmt.Errorf("failed to set password: %v", err)
+		}
+	}
+
 	// Update allowed fields
 	allowedFields := map[string]bool{
 		"displayName": true,
@@ -281,7 +297,6 @@ func (csm *ConfigStoreManager) UpdateStoreInfo(name string, updates map[string]s
 		"__icon":      true,
 		"__color":     true,
 		"__title":     true,
-		"__password":  true,
 	}
 
 	for key, value := range updates {
@@ -295,6 +310,25 @@ func (csm *ConfigStoreManager) UpdateStoreInfo(name string, updates map[string]s
 	return nil
 }
 
+// Login checks a store's password and returns a session token for it
+func (csm *ConfigStoreManager) Login(name, password string) (string, time.Time, error) {
+	tree, err := csm.Load(name)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tree.Login(password)
+}
+
+// Authorize reports whether token is a live session of the store.
+// Stores without a password need no session.
+func (csm *ConfigStoreManager) Authorize(name, token string) bool {
+	tree, err := csm.Load(name)
+	if err != nil {
+		return false
+	}
+	return !tree.HasPassword() || tree.ValidSession(token)
+}
+
 // Delete removes a store
 func (csm *ConfigStoreManager) Delete(name string) error {
 	csm.mu.Lock()
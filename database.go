@@ -1,11 +1,18 @@
 package blueconfig
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"maps"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sfi2k7/blueconfig/models"
@@ -24,9 +31,12 @@ const (
 )
 
 const (
-	SchemaNode  = "__schema"
-	IndicesNode = "__indices"
-	StatsNode   = "__stats"
+	SchemaNode       = "__schema"
+	IndicesNode      = "__indices"
+	StatsNode        = "__stats"
+	ForeignKeysNode  = "__foreign_keys"
+	ReferencedByNode = "__referenced_by"
+	VersionField     = "__version" // bumped on every write to a row or saved node
 )
 
 // ============================================================================
@@ -35,11 +45,43 @@ const (
 
 // TableSchema represents the dynamic schema of a table
 type TableSchema struct {
-	Fields      map[string]string `json:"fields"`       // field_name -> type
-	FlatFields  []string          `json:"flat_fields"`  // all flattened field names
-	Version     int               `json:"version"`      // schema version
-	Created     string            `json:"created"`      // timestamp
-	LastUpdated string            `json:"last_updated"` // timestamp
+	Fields      map[string]string          `json:"fields"`                // field_name -> type
+	FlatFields  []string                   `json:"flat_fields"`           // all flattened field names
+	Version     int                        `json:"version"`               // schema version
+	Created     string                     `json:"created"`               // timestamp
+	LastUpdated string                     `json:"last_updated"`          // timestamp
+	Strict      bool                       `json:"strict"`                // declared schema, unknown fields rejected
+	Constraints map[string]FieldConstraint `json:"constraints,omitempty"` // field_name -> validators
+}
+
+// FieldConstraint declares validators for one field of a declared schema.
+// Min and Max bound numeric values, or the length of string values.
+type FieldConstraint struct {
+	Required bool        `json:"required,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+	Enum     []string    `json:"enum,omitempty"`
+	Min      *float64    `json:"min,omitempty"`
+	Max      *float64    `json:"max,omitempty"`
+	Pattern  string      `json:"pattern,omitempty"`
+}
+
+// FieldError describes one field that failed schema validation
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// SchemaValidationError lists every field that failed validation
+type SchemaValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *SchemaValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Message
+	}
+	return strings.Join(msgs, "; ")
 }
 
 // DatabaseInfo represents database metadata
@@ -135,7 +177,7 @@ func (t *Tree) GetDatabaseInfo(path string) (*DatabaseInfo, error) {
 		return nil, errors.New("path is not a database")
 	}
 
-	props, err := t.GetAllPropsWithValues(path)
+	props, err := t.rawProps(path)
 	if err != nil {
 		return nil, err
 	}
@@ -280,7 +322,7 @@ func (t *Tree) GetTableInfo(path string) (*TableInfo, error) {
 		return nil, errors.New("path is not a table")
 	}
 
-	props, err := t.GetAllPropsWithValues(path)
+	props, err := t.rawProps(path)
 	if err != nil {
 		return nil, err
 	}
@@ -352,40 +394,8 @@ func (t *Tree) RenameTable(dbPath, oldName, newName string) error {
 		return errors.New("table with new name already exists")
 	}
 
-	// Get all data from old table
-	props, err := t.GetAllPropsWithValues(oldPath)
-	if err != nil {
-		return err
-	}
-
-	// Convert to map[string]interface{}
-	propsInterface := make(map[string]interface{})
-	for k, v := range props {
-		propsInterface[k] = v
-	}
-
-	// Create new table
-	err = t.CreateNodeWithProps(newPath, propsInterface)
-	if err != nil {
-		return err
-	}
-
-	// Update name property
-	err = t.SetValue(newPath+"/__name", newName)
-	if err != nil {
-		return err
-	}
-
-	// TODO: Copy all child nodes (rows, schema, indices, stats)
-	// Recursive copy implementation needed for complete rename
-
-	// Delete old table
-	err = t.DeleteNode(oldPath, true)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	// Rows, schema, indexes and foreign keys move with the table
+	return t.MoveNode(oldPath, newPath)
 }
 
 // ============================================================================
@@ -435,14 +445,20 @@ func (t *Tree) GetTableSchema(tablePath string) (*TableSchema, error) {
 	}
 
 	// Get schema properties
-	props, err := t.GetAllPropsWithValues(schemaPath)
+	props, err := t.rawProps(schemaPath)
 	if err != nil {
 		return nil, err
 	}
 
+	return parseTableSchema(props)
+}
+
+// parseTableSchema builds a schema from the properties of a __schema node
+func parseTableSchema(props map[string]string) (*TableSchema, error) {
 	schema := &TableSchema{
 		Created:     props["created"],
 		LastUpdated: props["last_updated"],
+		Strict:      props["strict"] == "true",
 	}
 
 	// Parse version
@@ -452,7 +468,7 @@ func (t *Tree) GetTableSchema(tablePath string) (*TableSchema, error) {
 
 	// Parse fields JSON
 	if fieldsJSON := props["fields"]; fieldsJSON != "" {
-		err = json.Unmarshal([]byte(fieldsJSON), &schema.Fields)
+		err := json.Unmarshal([]byte(fieldsJSON), &schema.Fields)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse schema fields: %v", err)
 		}
@@ -460,49 +476,130 @@ func (t *Tree) GetTableSchema(tablePath string) (*TableSchema, error) {
 
 	// Parse flat_fields JSON
 	if flatFieldsJSON := props["flat_fields"]; flatFieldsJSON != "" {
-		err = json.Unmarshal([]byte(flatFieldsJSON), &schema.FlatFields)
+		err := json.Unmarshal([]byte(flatFieldsJSON), &schema.FlatFields)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse flat fields: %v", err)
 		}
 	}
 
+	// Parse constraints JSON
+	if constraintsJSON := props["constraints"]; constraintsJSON != "" {
+		err := json.Unmarshal([]byte(constraintsJSON), &schema.Constraints)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse schema constraints: %v", err)
+		}
+	}
+
 	return schema, nil
 }
 
+// SetTableSchema declares the schema of a table, replacing the inferred one.
+// A strict schema is never widened by inserts and rejects unknown fields;
+// constraints are enforced either way.
+func (t *Tree) SetTableSchema(tablePath string, schema TableSchema, strict bool) error {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return err
+	}
+	if len(schema.Fields) == 0 {
+		return errors.New("schema must declare at least one field")
+	}
+
+	for field, c := range schema.Constraints {
+		if _, exists := schema.Fields[field]; !exists {
+			return fmt.Errorf("constraint on undeclared field '%s'", field)
+		}
+		if c.Pattern != "" {
+			if _, err := regexp.Compile(c.Pattern); err != nil {
+				return fmt.Errorf("field '%s' has invalid pattern: %v", field, err)
+			}
+		}
+		if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+			return fmt.Errorf("field '%s' has min greater than max", field)
+		}
+	}
+
+	existing, err := t.GetTableSchema(tablePath)
+	if err != nil {
+		return err
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	declared := &TableSchema{
+		Fields:      schema.Fields,
+		FlatFields:  make([]string, 0, len(schema.Fields)),
+		Version:     1,
+		Created:     now,
+		LastUpdated: now,
+		Strict:      strict,
+		Constraints: schema.Constraints,
+	}
+	if existing != nil {
+		declared.Version = existing.Version + 1
+		declared.Created = existing.Created
+	}
+	for field := range schema.Fields {
+		declared.FlatFields = append(declared.FlatFields, field)
+	}
+	sort.Strings(declared.FlatFields)
+
+	// Declared defaults must satisfy their own constraints
+	defaults := make(models.Row)
+	for field, c := range schema.Constraints {
+		if c.Default != nil {
+			defaults[field] = models.NewValue(c.Default)
+		}
+	}
+	if err := t.validateRow(defaults, declared, true); err != nil {
+		return fmt.Errorf("invalid default: %w", err)
+	}
+
+	return t.saveSchemaToStorage(tablePath, declared)
+}
+
 // UpdateSchemaWithNewRow updates schema when a new row introduces new fields
 func (t *Tree) UpdateSchemaWithNewRow(tablePath string, row models.Row) (*TableSchema, error) {
-	existingSchema, err := t.GetTableSchema(tablePath)
+	var schema *TableSchema
+	err := t.writeTxn(func(txn *Transaction) error {
+		var err error
+		schema, err = txn.evolveSchema(tablePath, row)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+	return schema, nil
+}
 
-	if existingSchema == nil {
-		// No schema exists, create new one
-		newSchema, err := t.InferSchemaFromRow(row)
-		if err != nil {
-			return nil, err
-		}
-		// Save the new schema
-		err = t.saveSchemaToStorage(tablePath, newSchema)
-		if err != nil {
-			return nil, err
-		}
-		return newSchema, nil
+// evolveSchema widens the table schema with the fields of row within the
+// transaction, so concurrent writers never lose each other's fields
+func (txn *Transaction) evolveSchema(tablePath string, row models.Row) (*TableSchema, error) {
+	existingSchema, err := txn.tableSchema(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if existingSchema != nil && existingSchema.Strict {
+		return existingSchema, nil // Declared schemas never widen
 	}
 
 	// Infer schema from new row
-	newSchema, err := t.InferSchemaFromRow(row)
+	newSchema, err := txn.tree.InferSchemaFromRow(row)
 	if err != nil {
 		return nil, err
 	}
 
-	// Merge schemas
-	merged := t.MergeSchemas(existingSchema, newSchema)
+	if existingSchema == nil {
+		// No schema exists, save the inferred one
+		if err := txn.saveSchema(tablePath, newSchema); err != nil {
+			return nil, err
+		}
+		return newSchema, nil
+	}
 
-	// Save if schema changed
+	// Merge schemas and save if changed
+	merged := txn.tree.MergeSchemas(existingSchema, newSchema)
 	if merged.Version > existingSchema.Version {
-		err = t.saveSchemaToStorage(tablePath, merged)
-		if err != nil {
+		if err := txn.saveSchema(tablePath, merged); err != nil {
 			return nil, err
 		}
 	}
@@ -518,6 +615,8 @@ func (t *Tree) MergeSchemas(existing, new *TableSchema) *TableSchema {
 		Version:     existing.Version,
 		Created:     existing.Created,
 		LastUpdated: strconv.FormatInt(time.Now().Unix(), 10),
+		Strict:      existing.Strict,
+		Constraints: existing.Constraints,
 	}
 
 	// Copy existing fields
@@ -549,27 +648,137 @@ func (t *Tree) MergeSchemas(existing, new *TableSchema) *TableSchema {
 	return merged
 }
 
-// ValidateRowAgainstSchema validates a row against the table schema
+// ValidateRowAgainstSchema validates a complete row against the table schema.
+// All failing fields are reported in a *SchemaValidationError.
 func (t *Tree) ValidateRowAgainstSchema(row models.Row, schema *TableSchema) error {
+	return t.validateRow(row, schema, false)
+}
+
+// validate checks types, strictness and constraints. A partial row (a field
+// update) skips required fields it does not mention.
+func (t *Tree) validateRow(row models.Row, schema *TableSchema, partial bool) error {
 	if schema == nil {
 		return nil // No schema to validate against
 	}
 
-	// Check type compatibility for existing fields
-	for key, val := range row {
-		if expectedType, exists := schema.Fields[key]; exists {
-			inferredType := val.InferredType()
+	var fieldErrors []FieldError
+	fail := func(field, format string, args ...interface{}) {
+		fieldErrors = append(fieldErrors, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	keys := make([]string, 0, len(row))
+	for key := range row {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		val := row[key]
+		expectedType, exists := schema.Fields[key]
+		if !exists {
+			// New fields are allowed unless the schema is declared strict
+			if schema.Strict && !strings.HasPrefix(key, "__") {
+				fail(key, "field '%s' is not in the schema", key)
+			}
+			continue
+		}
+
+		if val == nil || val.IsNull() {
+			if schema.Constraints[key].Required {
+				fail(key, "field '%s' is required", key)
+			}
+			continue
+		}
+
+		// Allow type compatibility (e.g., int can be stored as string)
+		inferredType := val.InferredType()
+		if !t.isTypeCompatible(inferredType, expectedType) {
+			fail(key, "field '%s' type mismatch: expected %s, got %s", key, expectedType, inferredType)
+			continue
+		}
 
-			// Allow type compatibility (e.g., int can be stored as string)
-			if !t.isTypeCompatible(inferredType, expectedType) {
-				return fmt.Errorf("field '%s' type mismatch: expected %s, got %s",
-					key, expectedType, inferredType)
+		if c, ok := schema.Constraints[key]; ok {
+			for _, msg := range c.check(val) {
+				fail(key, "field '%s' %s", key, msg)
 			}
 		}
-		// New fields are allowed (schema will evolve)
 	}
 
-	return nil
+	if !partial {
+		required := make([]string, 0)
+		for field, c := range schema.Constraints {
+			if _, present := row[field]; c.Required && !present {
+				required = append(required, field)
+			}
+		}
+		sort.Strings(required)
+		for _, field := range required {
+			fail(field, "field '%s' is required", field)
+		}
+	}
+
+	if len(fieldErrors) == 0 {
+		return nil
+	}
+	return &SchemaValidationError{Errors: fieldErrors}
+}
+
+// check applies enum, min/max and pattern validators to a non-null value
+func (c FieldConstraint) check(val *models.RowValue) []string {
+	var msgs []string
+	str := fmt.Sprintf("%v", val.Val())
+
+	if len(c.Enum) > 0 {
+		allowed := false
+		for _, e := range c.Enum {
+			if e == str {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			msgs = append(msgs, fmt.Sprintf("must be one of [%s], got %q", strings.Join(c.Enum, ", "), str))
+		}
+	}
+
+	if c.Min != nil || c.Max != nil {
+		measure, what := float64(len(str)), "length"
+		if n, err := strconv.ParseFloat(str, 64); err == nil && val.InferredType() != "string" {
+			measure, what = n, "value"
+		}
+		if c.Min != nil && measure < *c.Min {
+			msgs = append(msgs, fmt.Sprintf("%s %v is below minimum %v", what, measure, *c.Min))
+		}
+		if c.Max != nil && measure > *c.Max {
+			msgs = append(msgs, fmt.Sprintf("%s %v is above maximum %v", what, measure, *c.Max))
+		}
+	}
+
+	if c.Pattern != "" {
+		if re, err := regexp.Compile(c.Pattern); err != nil || !re.MatchString(str) {
+			msgs = append(msgs, fmt.Sprintf("does not match pattern %s", c.Pattern))
+		}
+	}
+
+	return msgs
+}
+
+// withDefaults returns the row with declared defaults filled in for missing fields
+func (schema *TableSchema) withDefaults(row models.Row) models.Row {
+	if schema == nil || len(schema.Constraints) == 0 {
+		return row
+	}
+
+	filled := make(models.Row, len(row))
+	for k, v := range row {
+		filled[k] = v
+	}
+	for field, c := range schema.Constraints {
+		if _, present := filled[field]; !present && c.Default != nil {
+			filled[field] = models.NewValue(c.Default)
+		}
+	}
+	return filled
 }
 
 // isTypeCompatible checks if two types are compatible
@@ -595,44 +804,63 @@ func (t *Tree) isTypeCompatible(actual, expected string) bool {
 
 // saveSchemaToStorage saves schema to __schema node
 func (t *Tree) saveSchemaToStorage(tablePath string, schema *TableSchema) error {
-	schemaPath := tablePath + "/" + SchemaNode
+	return t.writeTxn(func(txn *Transaction) error {
+		return txn.saveSchema(tablePath, schema)
+	})
+}
 
-	// Create schema node
-	err := t.CreatePath(schemaPath)
+// saveSchema writes the __schema node and table metadata within the transaction
+func (txn *Transaction) saveSchema(tablePath string, schema *TableSchema) error {
+	// Serialize fields to JSON
+	fieldsJSON, err := json.Marshal(schema.Fields)
 	if err != nil {
 		return err
 	}
 
-	// Serialize fields to JSON
-	fieldsJSON, err := json.Marshal(schema.Fields)
+	flatFieldsJSON, err := json.Marshal(schema.FlatFields)
 	if err != nil {
 		return err
 	}
 
-	flatFieldsJSON, err := json.Marshal(schema.FlatFields)
+	constraintsJSON, err := json.Marshal(schema.Constraints)
+	if err != nil {
+		return err
+	}
+
+	b, err := txn.createBucketAt(tablePath + "/" + SchemaNode)
 	if err != nil {
 		return err
 	}
 
 	// Store schema properties
-	schemaProps := map[string]interface{}{
+	schemaProps := map[string]string{
 		"version":      strconv.Itoa(schema.Version),
 		"created":      schema.Created,
 		"last_updated": schema.LastUpdated,
 		"fields":       string(fieldsJSON),
 		"flat_fields":  string(flatFieldsJSON),
+		"strict":       strconv.FormatBool(schema.Strict),
+		"constraints":  string(constraintsJSON),
+	}
+	for k, v := range schemaProps {
+		if err := b.Put([]byte(k), []byte(v)); err != nil {
+			return err
+		}
 	}
 
-	err = t.SetValues(schemaPath, schemaProps)
+	// Update table metadata
+	table, err := txn.bucketAt(tablePath)
 	if err != nil {
 		return err
 	}
+	if err := table.Put([]byte("__has_schema"), []byte("true")); err != nil {
+		return err
+	}
+	if err := table.Put([]byte("__lastupdated"), []byte(schema.LastUpdated)); err != nil {
+		return err
+	}
 
-	// Update table metadata
-	t.SetValue(tablePath+"/__has_schema", "true")
-	t.SetValue(tablePath+"/__lastupdated", schema.LastUpdated)
-
-	return nil
+	return txn.failpoint("schema")
 }
 
 // GetSchemaAsModelsSchema returns schema in models.Schema format for Object creation
@@ -717,6 +945,39 @@ func (t *Tree) SetRowCount(tablePath string, count int) error {
 	return t.SetValue(tablePath+"/__row_count", strconv.Itoa(count))
 }
 
+// adjustRowCount adds delta to the table's row count within the transaction
+func (txn *Transaction) adjustRowCount(tablePath string, delta int) error {
+	table, err := txn.bucketAt(tablePath)
+	if err != nil {
+		return err
+	}
+
+	count, _ := strconv.Atoi(string(table.Get([]byte("__row_count"))))
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+
+	if err := table.Put([]byte("__row_count"), []byte(strconv.Itoa(count))); err != nil {
+		return err
+	}
+	if err := txn.touchTable(tablePath); err != nil {
+		return err
+	}
+
+	return txn.failpoint("count")
+}
+
+// touchTable updates the table's last updated timestamp within the transaction
+func (txn *Transaction) touchTable(tablePath string) error {
+	table, err := txn.bucketAt(tablePath)
+	if err != nil {
+		return err
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	return table.Put([]byte("__lastupdated"), []byte(now))
+}
+
 // ============================================================================
 // Helper Functions
 // ============================================================================
@@ -794,50 +1055,11 @@ func (t *Tree) schemaHasNewFields(existing, new *TableSchema) bool {
 // InsertRow inserts a new row into a table with automatic schema evolution
 // Returns the generated row ID
 func (t *Tree) InsertRow(tablePath string, row models.Row) (string, error) {
-	// Validate table path
-	if err := t.ValidateTablePath(tablePath); err != nil {
-		return "", err
-	}
-
 	// Generate unique row ID
 	rowID := t.GenerateRowID()
-	rowPath := tablePath + "/" + rowID
-
-	// Update schema with new row (adds new fields if any)
-	_, err := t.UpdateSchemaWithNewRow(tablePath, row)
-	if err != nil {
-		return "", fmt.Errorf("failed to update schema: %v", err)
-	}
-
-	// Validate row against schema
-	schema, _ := t.GetTableSchema(tablePath)
-	if err := t.ValidateRowAgainstSchema(row, schema); err != nil {
-		return "", fmt.Errorf("row validation failed: %v", err)
-	}
-
-	// Convert Row to map[string]interface{} for storage
-	rowData := make(map[string]interface{})
-	for key, val := range row {
-		rowData[key] = val.Val()
-	}
-
-	// Store the row
-	err = t.CreateNodeWithProps(rowPath, rowData)
-	if err != nil {
-		return "", fmt.Errorf("failed to store row: %v", err)
-	}
-
-	// Increment row count
-	if err := t.IncrementRowCount(tablePath); err != nil {
-		return "", fmt.Errorf("failed to update row count: %v", err)
-	}
 
-	// Add to all applicable indexes
-	if err := t.addToIndex(tablePath, rowID, row); err != nil {
-		// Rollback: remove the row
-		t.DeleteNode(rowPath, true)
-		t.DecrementRowCount(tablePath)
-		return "", fmt.Errorf("failed to update indexes: %v", err)
+	if err := t.InsertRowWithID(tablePath, rowID, row); err != nil {
+		return "", err
 	}
 
 	return rowID, nil
@@ -850,56 +1072,10 @@ func (t *Tree) InsertRowWithID(tablePath, rowID string, row models.Row) error {
 		return err
 	}
 
-	rowPath := tablePath + "/" + rowID
-
-	// Check if row already exists
-	children, err := t.GetNodesInPath(tablePath)
-	if err == nil {
-		for _, child := range children {
-			if child == rowID {
-				return fmt.Errorf("row with ID %s already exists", rowID)
-			}
-		}
-	}
-
-	// Update schema with new row
-	_, err = t.UpdateSchemaWithNewRow(tablePath, row)
-	if err != nil {
-		return fmt.Errorf("failed to update schema: %v", err)
-	}
-
-	// Validate row against schema
-	schema, _ := t.GetTableSchema(tablePath)
-	if err := t.ValidateRowAgainstSchema(row, schema); err != nil {
-		return fmt.Errorf("row validation failed: %v", err)
-	}
-
-	// Convert Row to map[string]interface{}
-	rowData := make(map[string]interface{})
-	for key, val := range row {
-		rowData[key] = val.Val()
-	}
-
-	// Store the row
-	err = t.CreateNodeWithProps(rowPath, rowData)
-	if err != nil {
-		return fmt.Errorf("failed to store row: %v", err)
-	}
-
-	// Increment row count
-	if err := t.IncrementRowCount(tablePath); err != nil {
-		return fmt.Errorf("failed to update row count: %v", err)
-	}
-
-	// Add to all applicable indexes
-	if err := t.addToIndex(tablePath, rowID, row); err != nil {
-		// Rollback: remove the row
-		t.DeleteNode(rowPath, true)
-		t.DecrementRowCount(tablePath)
-		return fmt.Errorf("failed to update indexes: %v", err)
-	}
-
-	return nil
+	// Schema, row, indexes and row count commit together
+	return t.writeTxn(func(txn *Transaction) error {
+		return txn.insertRow(tablePath, rowID, row)
+	})
 }
 
 // GetRow retrieves a row by ID
@@ -912,7 +1088,7 @@ func (t *Tree) GetRow(tablePath, rowID string) (models.Row, error) {
 	rowPath := tablePath + "/" + rowID
 
 	// Get all properties of the row
-	props, err := t.GetAllPropsWithValues(rowPath)
+	props, err := t.rawProps(rowPath)
 	if err != nil {
 		return nil, fmt.Errorf("row not found: %v", err)
 	}
@@ -920,9 +1096,12 @@ func (t *Tree) GetRow(tablePath, rowID string) (models.Row, error) {
 	// Get table schema for type information
 	schema, _ := t.GetTableSchema(tablePath)
 
-	// Convert to Row
+	// Convert to Row; the version is exposed through RowVersion only
 	row := make(models.Row)
 	for key, value := range props {
+		if key == VersionField {
+			continue
+		}
 		rowVal := models.NewValue(value)
 
 		// Set schema type if available
@@ -938,141 +1117,46 @@ func (t *Tree) GetRow(tablePath, rowID string) (models.Row, error) {
 	return row, nil
 }
 
-// UpdateRow updates an existing row (replaces all fields)
-func (t *Tree) UpdateRow(tablePath, rowID string, row models.Row) error {
+// UpdateRow updates an existing row (replaces all fields). With an expected
+// version the update fails with ErrVersionConflict unless the row is still at
+// that version.
+func (t *Tree) UpdateRow(tablePath, rowID string, row models.Row, expectedVersion ...int64) error {
 	// Validate table path
 	if err := t.ValidateTablePath(tablePath); err != nil {
 		return err
 	}
 
-	rowPath := tablePath + "/" + rowID
-
-	// Get old row for index maintenance
-	oldRow, err := t.GetRow(tablePath, rowID)
-	if err != nil {
-		return fmt.Errorf("row not found: %s", rowID)
-	}
+	return t.writeTxn(func(txn *Transaction) error {
+		return txn.updateRow(tablePath, rowID, rowToMap(row), false, expectedVersion)
+	})
+}
 
-	// Update schema with new row (in case new fields are added)
-	_, err = t.UpdateSchemaWithNewRow(tablePath, row)
-	if err != nil {
-		return fmt.Errorf("failed to update schema: %v", err)
+// UpdateRowFields updates specific fields in a row (partial update). An
+// expected version is checked as in UpdateRow.
+func (t *Tree) UpdateRowFields(tablePath, rowID string, fields map[string]interface{}, expectedVersion ...int64) error {
+	// Validate table path
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return err
 	}
 
-	// Validate row against schema
-	schema, _ := t.GetTableSchema(tablePath)
-	if err := t.ValidateRowAgainstSchema(row, schema); err != nil {
-		return fmt.Errorf("row validation failed: %v", err)
-	}
+	return t.writeTxn(func(txn *Transaction) error {
+		return txn.updateRow(tablePath, rowID, fields, true, expectedVersion)
+	})
+}
 
-	// Convert Row to map[string]interface{}
-	rowData := make(map[string]interface{})
-	for key, val := range row {
-		rowData[key] = val.Val()
+// DeleteRow deletes a row from a table, applying the on-delete action of
+// every foreign key that references it
+func (t *Tree) DeleteRow(tablePath, rowID string) error {
+	// Validate table path
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return err
 	}
 
-	// Update all properties (this will overwrite existing values)
-	err = t.SetValues(rowPath, rowData)
-	if err != nil {
-		return fmt.Errorf("failed to update row: %v", err)
-	}
-
-	// Update indexes
-	if err := t.updateIndex(tablePath, rowID, oldRow, row); err != nil {
-		return fmt.Errorf("failed to update indexes: %v", err)
-	}
-
-	// Update last updated timestamp
-	now := strconv.FormatInt(time.Now().Unix(), 10)
-	t.SetValue(tablePath+"/__lastupdated", now)
-
-	return nil
-}
-
-// UpdateRowFields updates specific fields in a row (partial update)
-func (t *Tree) UpdateRowFields(tablePath, rowID string, fields map[string]interface{}) error {
-	// Validate table path
-	if err := t.ValidateTablePath(tablePath); err != nil {
-		return err
-	}
-
-	rowPath := tablePath + "/" + rowID
-
-	// Get old row for index maintenance
-	oldRow, err := t.GetRow(tablePath, rowID)
-	if err != nil {
-		return fmt.Errorf("row not found: %s", rowID)
-	}
-
-	// Create a Row from the fields for schema validation
-	row := make(models.Row)
-	for key, val := range fields {
-		row[key] = models.NewValue(val)
-	}
-
-	// Update schema if needed
-	_, err = t.UpdateSchemaWithNewRow(tablePath, row)
-	if err != nil {
-		return fmt.Errorf("failed to update schema: %v", err)
-	}
-
-	// Update the fields
-	err = t.SetValues(rowPath, fields)
-	if err != nil {
-		return fmt.Errorf("failed to update fields: %v", err)
-	}
-
-	// Get updated row for index maintenance
-	newRow, err := t.GetRow(tablePath, rowID)
-	if err != nil {
-		return fmt.Errorf("failed to retrieve updated row: %v", err)
-	}
-
-	// Update indexes
-	if err := t.updateIndex(tablePath, rowID, oldRow, newRow); err != nil {
-		return fmt.Errorf("failed to update indexes: %v", err)
-	}
-
-	// Update last updated timestamp
-	now := strconv.FormatInt(time.Now().Unix(), 10)
-	t.SetValue(tablePath+"/__lastupdated", now)
-
-	return nil
-}
-
-// DeleteRow deletes a row from a table
-func (t *Tree) DeleteRow(tablePath, rowID string) error {
-	// Validate table path
-	if err := t.ValidateTablePath(tablePath); err != nil {
-		return err
-	}
-
-	rowPath := tablePath + "/" + rowID
-
-	// Get row data before deletion for index maintenance
-	row, err := t.GetRow(tablePath, rowID)
-	if err != nil {
-		return fmt.Errorf("row not found: %s", rowID)
-	}
-
-	// Remove from indexes first
-	if err := t.removeFromIndex(tablePath, rowID, row); err != nil {
-		return fmt.Errorf("failed to update indexes: %v", err)
-	}
-
-	// Delete the row node
-	err = t.DeleteNode(rowPath, true)
-	if err != nil {
-		return fmt.Errorf("failed to delete row: %v", err)
-	}
-
-	// Decrement row count
-	if err := t.DecrementRowCount(tablePath); err != nil {
-		return fmt.Errorf("failed to update row count: %v", err)
-	}
-
-	return nil
-}
+	// The row, its cascades and every affected count commit together
+	return t.writeTxn(func(txn *Transaction) error {
+		return txn.deleteRow(tablePath, rowID)
+	})
+}
 
 // ListRows returns all row IDs in a table
 func (t *Tree) ListRows(tablePath string) ([]string, error) {
@@ -1118,7 +1202,7 @@ func (t *Tree) GetAllRows(tablePath string) (map[string]models.Row, error) {
 	for _, rowID := range rowIDs {
 		rowPath := tablePath + "/" + rowID
 
-		props, err := t.GetAllPropsWithValues(rowPath)
+		props, err := t.rawProps(rowPath)
 		if err != nil {
 			continue // Skip rows that can't be read
 		}
@@ -1126,6 +1210,9 @@ func (t *Tree) GetAllRows(tablePath string) (map[string]models.Row, error) {
 		// Convert to Row
 		row := make(models.Row)
 		for key, value := range props {
+			if key == VersionField {
+				continue
+			}
 			rowVal := models.NewValue(value)
 
 			// Set schema type if available
@@ -1165,6 +1252,9 @@ func (t *Tree) ScanRows(tablePath string, callback func(rowID string, row models
 		// Convert props to Row
 		row := make(models.Row)
 		for key, value := range nodeInfo.Props {
+			if key == VersionField {
+				continue
+			}
 			rowVal := models.NewValue(value)
 
 			// Set schema type if available
@@ -1239,18 +1329,6 @@ func (t *Tree) CreateIndex(tablePath, indexName string, fields []string, unique
 		return errors.New("invalid index name")
 	}
 
-	indexPath := tablePath + "/" + IndicesNode + "/" + indexName
-
-	// Check if index already exists
-	children, err := t.GetNodesInPath(tablePath + "/" + IndicesNode)
-	if err == nil {
-		for _, child := range children {
-			if child == indexName {
-				return fmt.Errorf("index %s already exists", indexName)
-			}
-		}
-	}
-
 	// Determine index type
 	indexType := IndexTypeSingle
 	if len(fields) > 1 {
@@ -1259,7 +1337,7 @@ func (t *Tree) CreateIndex(tablePath, indexName string, fields []string, unique
 
 	// Create index metadata
 	now := strconv.FormatInt(time.Now().Unix(), 10)
-	metadata := map[string]interface{}{
+	metadata := map[string]string{
 		"__type":        indexType,
 		"__unique":      strconv.FormatBool(unique),
 		"__created":     now,
@@ -1272,87 +1350,62 @@ func (t *Tree) CreateIndex(tablePath, indexName string, fields []string, unique
 		metadata[fmt.Sprintf("__field_%d", i)] = field
 	}
 
-	// Create index node with metadata
-	err = t.CreateNodeWithProps(indexPath, metadata)
-	if err != nil {
-		return fmt.Errorf("failed to create index metadata: %v", err)
-	}
-
-	// Create entries bucket
-	err = t.CreatePath(indexPath + "/" + IndexEntriesNode)
-	if err != nil {
-		return fmt.Errorf("failed to create index entries: %v", err)
-	}
-
-	// Build index from existing data
-	err = t.buildIndex(tablePath, indexPath, fields, unique)
-	if err != nil {
-		// Rollback: delete index on failure
-		t.DeleteNode(indexPath, true)
-		return fmt.Errorf("failed to build index: %v", err)
-	}
-
-	return nil
-}
-
-// buildIndex scans table and populates index entries
-func (t *Tree) buildIndex(tablePath, indexPath string, fields []string, unique bool) error {
-	entriesPath := indexPath + "/" + IndexEntriesNode
-
-	// First pass: collect all index entries in memory
-	indexEntries := make(map[string][]string) // indexKey -> []rowIDs
-
-	err := t.ScanRows(tablePath, func(rowID string, row models.Row) error {
-		// Extract index key from row
-		indexKey, err := t.buildIndexKey(row, fields)
+	// The index is created and filled in one transaction, so rows written
+	// meanwhile are indexed exactly once and a failed build leaves nothing
+	return t.writeTxn(func(txn *Transaction) error {
+		indices, err := txn.createBucketAt(tablePath + "/" + IndicesNode)
 		if err != nil {
 			return err
 		}
-
-		// Skip if any field is null
-		if indexKey == "" {
-			return nil
+		if indices.Bucket([]byte(indexName)) != nil {
+			return fmt.Errorf("index %s already exists", indexName)
 		}
-
-		// For unique indexes, check for duplicates
-		if unique {
-			if _, exists := indexEntries[indexKey]; exists {
-				return fmt.Errorf("duplicate value for unique index: %s", indexKey)
+		b, err := indices.CreateBucket([]byte(indexName))
+		if err != nil {
+			return fmt.Errorf("failed to create index metadata: %v", err)
+		}
+		for k, v := range metadata {
+			if err := b.Put([]byte(k), []byte(v)); err != nil {
+				return fmt.Errorf("failed to create index metadata: %v", err)
 			}
 		}
+		if _, err := b.CreateBucket([]byte(IndexEntriesNode)); err != nil {
+			return fmt.Errorf("failed to create index entries: %v", err)
+		}
 
-		// Add to in-memory map
-		indexEntries[indexKey] = append(indexEntries[indexKey], rowID)
+		if err := txn.buildIndex(tablePath, tableIndex{name: indexName, fields: fields, unique: unique, bucket: b}); err != nil {
+			return fmt.Errorf("failed to build index: %w", err)
+		}
 		return nil
 	})
+}
 
+// buildIndex adds every row of a table to an empty index
+func (txn *Transaction) buildIndex(tablePath string, idx tableIndex) error {
+	table, err := txn.bucketAt(tablePath)
 	if err != nil {
 		return err
 	}
 
-	// Second pass: write all index entries to storage
-	entryCount := 0
-	for indexKey, rowIDs := range indexEntries {
-		keyPath := entriesPath + "/" + indexKey
-
-		// Create bucket for this key
-		err := t.CreatePath(keyPath)
+	c := table.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil || txn.tree.isSpecialNode(string(k)) {
+			continue
+		}
+		rowID := string(k)
+		indexKey, err := txn.tree.buildIndexKey(rowFromBucket(table.Bucket(k)), idx.fields)
 		if err != nil {
 			return err
 		}
-
-		// Add all row IDs for this key
-		for _, rowID := range rowIDs {
-			err = t.SetValue(keyPath+"/"+rowID, "")
-			if err != nil {
-				return err
+		if idx.unique && indexKey != "" {
+			if holder := idx.holder(indexKey, rowID); holder != "" {
+				return &ErrUniqueViolation{Index: idx.name, Key: indexKey, ConflictingRowID: holder}
 			}
-			entryCount++
+		}
+		if err := idx.add(indexKey, rowID); err != nil {
+			return err
 		}
 	}
-
-	// Update entry count
-	t.SetValue(indexPath+"/__entry_count", strconv.Itoa(entryCount))
 	return nil
 }
 
@@ -1364,8 +1417,8 @@ func (t *Tree) buildIndexKey(row models.Row, fields []string) (string, error) {
 
 	for _, field := range fields {
 		val, exists := row[field]
-		if !exists || val.IsNull() {
-			// Null values are not indexed
+		if !exists || val.IsNull() || val.Base() == storedNull {
+			// Null values are not indexed, including nulls read back from storage
 			return "", nil
 		}
 
@@ -1434,7 +1487,7 @@ func (t *Tree) GetIndexInfo(tablePath, indexName string) (*IndexInfo, error) {
 	indexPath := tablePath + "/" + IndicesNode + "/" + indexName
 
 	// Get index metadata
-	props, err := t.GetAllPropsWithValues(indexPath)
+	props, err := t.rawProps(indexPath)
 	if err != nil {
 		return nil, fmt.Errorf("index %s not found", indexName)
 	}
@@ -1493,118 +1546,223 @@ func (t *Tree) RebuildIndex(tablePath, indexName string) error {
 	return t.CreateIndex(tablePath, indexName, info.Fields, info.Unique)
 }
 
-// addToIndex adds a row to all applicable indexes
-func (t *Tree) addToIndex(tablePath, rowID string, row models.Row) error {
-	indexes, err := t.ListIndexes(tablePath)
-	if err != nil || len(indexes) == 0 {
-		return nil // No indexes, nothing to do
-	}
+// ErrUniqueViolation is returned when a write would duplicate the key of a
+// unique index. ConflictingRowID is the row that already holds the key.
+type ErrUniqueViolation struct {
+	Index            string
+	Key              string
+	ConflictingRowID string
+}
 
-	for _, indexName := range indexes {
-		indexPath := tablePath + "/" + IndicesNode + "/" + indexName
-		info, err := t.GetIndexInfo(tablePath, indexName)
-		if err != nil {
-			continue
-		}
+func (e *ErrUniqueViolation) Error() string {
+	return fmt.Sprintf("duplicate value for unique index %s: %s (held by row %s)", e.Index, e.Key, e.ConflictingRowID)
+}
 
-		// Build index key for this row
-		indexKey, err := t.buildIndexKey(row, info.Fields)
-		if err != nil || indexKey == "" {
-			continue // Skip if key can't be built or is null
-		}
+// tableIndex is index metadata loaded inside a transaction
+type tableIndex struct {
+	name   string
+	fields []string
+	unique bool
+	bucket *bbolt.Bucket
+}
 
-		entriesPath := indexPath + "/" + IndexEntriesNode
-		keyPath := entriesPath + "/" + indexKey
+// tableIndexes loads the indexes of a table within the transaction
+func (txn *Transaction) tableIndexes(tablePath string) ([]tableIndex, error) {
+	indices, err := txn.bucketAt(tablePath + "/" + IndicesNode)
+	if err != nil {
+		return nil, nil // No indexes
+	}
 
-		// For unique indexes, check for duplicates
-		if info.Unique {
-			props, err := t.GetAllPropsWithValues(keyPath)
-			if err == nil && len(props) > 0 {
-				return fmt.Errorf("duplicate value for unique index %s: %s", indexName, indexKey)
+	var indexes []tableIndex
+	err = indices.ForEachBucket(func(k []byte) error {
+		if txn.tree.isSpecialNode(string(k)) {
+			return nil
+		}
+		b := indices.Bucket(k)
+		idx := tableIndex{
+			name:   string(k),
+			unique: string(b.Get([]byte("__unique"))) == "true",
+			bucket: b,
+		}
+		for i := 0; ; i++ {
+			field := b.Get([]byte(fmt.Sprintf("__field_%d", i)))
+			if field == nil {
+				break
 			}
+			idx.fields = append(idx.fields, string(field))
 		}
+		indexes = append(indexes, idx)
+		return nil
+	})
+	return indexes, err
+}
 
-		// Create bucket for this key if needed
-		t.CreatePath(keyPath)
+// indexRow moves a row's index entries from oldRow to newRow; either may be nil.
+// Every unique index is checked before any entry is written. The table's
+// search index, if any, is updated as well.
+func (txn *Transaction) indexRow(tablePath, rowID string, oldRow, newRow models.Row) error {
+	if err := txn.searchRow(tablePath, rowID, newRow); err != nil {
+		return fmt.Errorf("search index: %v", err)
+	}
 
-		// Add row ID to this key
-		t.SetValue(keyPath+"/"+rowID, "")
+	indexes, err := txn.tableIndexes(tablePath)
+	if err != nil || len(indexes) == 0 {
+		return err
+	}
 
-		// Increment entry count
-		if countStr, _ := t.GetValue(indexPath + "/__entry_count"); countStr != "" {
-			if count, err := strconv.Atoi(countStr); err == nil {
-				t.SetValue(indexPath+"/__entry_count", strconv.Itoa(count+1))
+	type keyChange struct {
+		idx            tableIndex
+		oldKey, newKey string
+	}
+	var changes []keyChange
+	for _, idx := range indexes {
+		var oldKey, newKey string
+		if oldRow != nil {
+			oldKey, _ = txn.tree.buildIndexKey(oldRow, idx.fields)
+		}
+		if newRow != nil {
+			newKey, _ = txn.tree.buildIndexKey(newRow, idx.fields)
+		}
+		if oldKey == newKey {
+			continue
+		}
+		if idx.unique && newKey != "" {
+			if holder := idx.holder(newKey, rowID); holder != "" {
+				return &ErrUniqueViolation{Index: idx.name, Key: newKey, ConflictingRowID: holder}
 			}
 		}
+		changes = append(changes, keyChange{idx: idx, oldKey: oldKey, newKey: newKey})
 	}
 
+	for _, c := range changes {
+		if err := c.idx.remove(c.oldKey, rowID); err != nil {
+			return fmt.Errorf("index %s: %v", c.idx.name, err)
+		}
+		if err := c.idx.add(c.newKey, rowID); err != nil {
+			return fmt.Errorf("index %s: %v", c.idx.name, err)
+		}
+	}
 	return nil
 }
 
-// removeFromIndex removes a row from all applicable indexes
-func (t *Tree) removeFromIndex(tablePath, rowID string, row models.Row) error {
-	indexes, err := t.ListIndexes(tablePath)
-	if err != nil || len(indexes) == 0 {
-		return nil
+// holder returns a row other than rowID that holds key, or ""
+func (idx tableIndex) holder(key, rowID string) string {
+	entries := idx.bucket.Bucket([]byte(IndexEntriesNode))
+	if entries == nil {
+		return ""
 	}
-
-	for _, indexName := range indexes {
-		indexPath := tablePath + "/" + IndicesNode + "/" + indexName
-		info, err := t.GetIndexInfo(tablePath, indexName)
-		if err != nil {
-			continue
-		}
-
-		// Build index key for this row
-		indexKey, err := t.buildIndexKey(row, info.Fields)
-		if err != nil || indexKey == "" {
-			continue
+	keyBucket := entries.Bucket([]byte(sanitizeBucketName(key)))
+	if keyBucket == nil {
+		return ""
+	}
+	c := keyBucket.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if string(k) != rowID {
+			return string(k)
 		}
+	}
+	return ""
+}
 
-		entriesPath := indexPath + "/" + IndexEntriesNode
-		keyPath := entriesPath + "/" + indexKey
-
-		// Remove row ID from this key
-		t.DeleteValue(keyPath, rowID)
-
-		// If this was the last row for this key, remove the key bucket
-		props, err := t.GetAllPropsWithValues(keyPath)
-		if err == nil && len(props) == 0 {
-			t.DeleteNode(keyPath, true)
-		}
+// rowIDs returns the rows recorded under key in sorted order
+func (idx tableIndex) rowIDs(key string) []string {
+	ids := []string{}
+	entries := idx.bucket.Bucket([]byte(IndexEntriesNode))
+	if entries == nil {
+		return ids
+	}
+	keyBucket := entries.Bucket([]byte(sanitizeBucketName(key)))
+	if keyBucket == nil {
+		return ids
+	}
+	keyBucket.ForEach(func(k, _ []byte) error {
+		ids = append(ids, string(k))
+		return nil
+	})
+	return ids
+}
 
-		// Decrement entry count
-		if countStr, _ := t.GetValue(indexPath + "/__entry_count"); countStr != "" {
-			if count, err := strconv.Atoi(countStr); err == nil && count > 0 {
-				t.SetValue(indexPath+"/__entry_count", strconv.Itoa(count-1))
-			}
-		}
+// keys returns the index's entry keys in sorted order
+func (idx tableIndex) keys() []string {
+	var keys []string
+	if entries := idx.bucket.Bucket([]byte(IndexEntriesNode)); entries != nil {
+		entries.ForEachBucket(func(k []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
 	}
+	return keys
+}
 
-	return nil
+// add records rowID under key
+func (idx tableIndex) add(key, rowID string) error {
+	if key == "" {
+		return nil // Null values are not indexed
+	}
+	entries, err := idx.bucket.CreateBucketIfNotExists([]byte(IndexEntriesNode))
+	if err != nil {
+		return err
+	}
+	keyBucket, err := entries.CreateBucketIfNotExists([]byte(sanitizeBucketName(key)))
+	if err != nil {
+		return err
+	}
+	if k, _ := keyBucket.Cursor().Seek([]byte(rowID)); k != nil && string(k) == rowID {
+		return nil
+	}
+	if err := keyBucket.Put([]byte(rowID), []byte("")); err != nil {
+		return err
+	}
+	return idx.adjustEntryCount(1)
 }
 
-// updateIndex updates indexes when a row is modified
-func (t *Tree) updateIndex(tablePath, rowID string, oldRow, newRow models.Row) error {
-	// Remove old index entries
-	if oldRow != nil {
-		if err := t.removeFromIndex(tablePath, rowID, oldRow); err != nil {
+// remove drops rowID from key, deleting the key once it is empty
+func (idx tableIndex) remove(key, rowID string) error {
+	if key == "" {
+		return nil
+	}
+	entries := idx.bucket.Bucket([]byte(IndexEntriesNode))
+	if entries == nil {
+		return nil
+	}
+	name := []byte(sanitizeBucketName(key))
+	keyBucket := entries.Bucket(name)
+	if keyBucket == nil {
+		return nil
+	}
+	if k, _ := keyBucket.Cursor().Seek([]byte(rowID)); k == nil || string(k) != rowID {
+		return nil
+	}
+	if err := keyBucket.Delete([]byte(rowID)); err != nil {
+		return err
+	}
+	if k, _ := keyBucket.Cursor().First(); k == nil {
+		if err := entries.DeleteBucket(name); err != nil {
 			return err
 		}
 	}
+	return idx.adjustEntryCount(-1)
+}
 
-	// Add new index entries
-	return t.addToIndex(tablePath, rowID, newRow)
+// adjustEntryCount updates the __entry_count metadata
+func (idx tableIndex) adjustEntryCount(delta int) error {
+	count, _ := strconv.Atoi(string(idx.bucket.Get([]byte("__entry_count"))))
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+	return idx.bucket.Put([]byte("__entry_count"), []byte(strconv.Itoa(count)))
 }
 
 // lookupIndex finds row IDs matching an index key
 func (t *Tree) lookupIndex(tablePath, indexName, indexKey string) ([]string, error) {
 	indexPath := tablePath + "/" + IndicesNode + "/" + indexName
 	entriesPath := indexPath + "/" + IndexEntriesNode
-	keyPath := entriesPath + "/" + indexKey
+	// Entry buckets are created with sanitized names, so look them up the same way
+	keyPath := entriesPath + "/" + sanitizeBucketName(indexKey)
 
 	// Get all row IDs for this key (stored as properties)
-	props, err := t.GetAllPropsWithValues(keyPath)
+	props, err := t.rawProps(keyPath)
 	if err != nil {
 		return []string{}, nil // Key not found, return empty
 	}
@@ -1614,6 +1772,7 @@ func (t *Tree) lookupIndex(tablePath, indexName, indexKey string) ([]string, err
 	for rowID := range props {
 		rowIDs = append(rowIDs, rowID)
 	}
+	sort.Strings(rowIDs)
 
 	return rowIDs, nil
 }
@@ -1635,7 +1794,7 @@ func (t *Tree) lookupIndexRange(tablePath, indexName, startKey, endKey string) (
 		if (startKey == "" || key >= startKey) && (endKey == "" || key <= endKey) {
 			keyPath := entriesPath + "/" + key
 			// Get row IDs stored as properties
-			props, err := t.GetAllPropsWithValues(keyPath)
+			props, err := t.rawProps(keyPath)
 			if err == nil {
 				for rowID := range props {
 					result = append(result, rowID)
@@ -2097,13 +2256,58 @@ const (
 
 // QueryPlan describes how a query will be executed
 type QueryPlan struct {
-	Strategy      QueryStrategy
-	TablePath     string
-	Query         parser.Query
-	IndexName     string   // For index-based strategies
-	IndexKey      string   // For exact match index lookups
-	RequiredFields []string // Fields needed for query evaluation
-	EstimatedRows int      // Estimated result size
+	Strategy       QueryStrategy
+	TablePath      string
+	Query          parser.Query
+	IndexName      string                       // For index-based strategies
+	IndexKey       string                       // For exact match index lookups
+	RequiredFields []string                     // Fields needed for query evaluation
+	EstimatedRows  int                          // Estimated result size
+	Vars           map[string]interface{}       // Values for $variables referenced in the query
+	Functions      map[string]models.MethodFunc // Custom functions callable from the query
+}
+
+// RegisterFunction makes a custom function callable from query expressions,
+// e.g. RegisterFunction("domain", fn) allows "domain(email) == 'example.com'".
+// A registered function takes precedence over a built-in with the same name.
+func (t *Tree) RegisterFunction(name string, fn models.MethodFunc) error {
+	if name == "" {
+		return fmt.Errorf("function name cannot be empty")
+	}
+	if fn == nil {
+		return fmt.Errorf("function %s cannot be nil", name)
+	}
+
+	t.funcMu.Lock()
+	defer t.funcMu.Unlock()
+
+	if t.functions == nil {
+		t.functions = make(map[string]models.MethodFunc)
+	}
+	t.functions[name] = fn
+	return nil
+}
+
+// UnregisterFunction removes a custom query function
+func (t *Tree) UnregisterFunction(name string) {
+	t.funcMu.Lock()
+	defer t.funcMu.Unlock()
+	delete(t.functions, name)
+}
+
+// queryFunctions returns a snapshot of the registered query functions
+func (t *Tree) queryFunctions() map[string]models.MethodFunc {
+	t.funcMu.RLock()
+	defer t.funcMu.RUnlock()
+
+	if len(t.functions) == 0 {
+		return nil
+	}
+	functions := make(map[string]models.MethodFunc, len(t.functions))
+	for name, fn := range t.functions {
+		functions[name] = fn
+	}
+	return functions
 }
 
 // AnalyzeQuery examines a query and determines the optimal execution strategy.
@@ -2115,11 +2319,12 @@ func (t *Tree) AnalyzeQuery(tablePath string, query parser.Query) (*QueryPlan, e
 	}
 
 	plan := &QueryPlan{
-		Strategy:   StrategyFullScan, // Default to full scan
-		TablePath:  tablePath,
-		Query:      query,
-		IndexName:  "",
-		IndexKey:   "",
+		Strategy:  StrategyFullScan, // Default to full scan
+		TablePath: tablePath,
+		Query:     query,
+		IndexName: "",
+		IndexKey:  "",
+		Functions: t.queryFunctions(),
 	}
 
 	// Extract required fields from query
@@ -2229,7 +2434,7 @@ func (t *Tree) ExecuteQueryPlan(plan *QueryPlan) ([]string, error) {
 		}
 
 		// Create Object for query matching
-		obj := models.NewObject(partialRow)
+		obj := models.NewObjectWithContext(partialRow, nil, plan.Functions, plan.Vars)
 
 		// Check if row matches query
 		if match, err := obj.Match(plan.Query); err == nil && match {
@@ -2246,22 +2451,42 @@ func (t *Tree) ExecuteQueryPlan(plan *QueryPlan) ([]string, error) {
 
 // QueryOptions provides options for query execution (pagination, sorting, etc.)
 type QueryOptions struct {
-	Limit      int         // Maximum rows to return (0 = no limit)
-	Skip       int         // Number of rows to skip (offset)
-	SortFields []SortField // Fields to sort by
+	Limit      int                    // Maximum rows to return (0 = no limit)
+	Skip       int                    // Number of rows to skip (offset)
+	SortFields []SortField            // Fields to sort by
+	Vars       map[string]interface{} // Values for $variables referenced in the query
+	Fields     []string               // Fields to load (projection); empty loads full rows
 }
 
 // FindRows executes a query and returns matching rows.
 // This is the main query execution method with automatic index usage.
+// tablePath may also be a database when the query names its table with USE.
 func (t *Tree) FindRows(tablePath string, queryStr string, opts *QueryOptions) ([]models.Row, error) {
 	// Parse query
-	query := parser.ParseExprQuery(queryStr)
+	query, err := parser.Parse(queryStr)
+	if err != nil {
+		return nil, fmt.Errorf("query parse failed: %w", err)
+	}
+
+	tablePath, err = t.resolveQueryTable(tablePath, query.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.findRows(tablePath, query, opts)
+}
 
+// findRows executes a parsed query against a table.
+// An empty query matches every row.
+func (t *Tree) findRows(tablePath string, query parser.Query, opts *QueryOptions) ([]models.Row, error) {
 	// Analyze and create execution plan
 	plan, err := t.AnalyzeQuery(tablePath, query)
 	if err != nil {
 		return nil, fmt.Errorf("query analysis failed: %v", err)
 	}
+	if opts != nil {
+		plan.Vars = opts.Vars
+	}
 
 	// Execute query plan to get matching row IDs
 	rowIDs, err := t.ExecuteQueryPlan(plan)
@@ -2281,16 +2506,23 @@ func (t *Tree) FindRows(tablePath string, queryStr string, opts *QueryOptions) (
 	if opts != nil {
 		if opts.Skip > 0 && opts.Skip < len(rowIDs) {
 			rowIDs = rowIDs[opts.Skip:]
+		} else if opts.Skip >= len(rowIDs) {
+			rowIDs = nil
 		}
 		if opts.Limit > 0 && opts.Limit < len(rowIDs) {
 			rowIDs = rowIDs[:opts.Limit]
 		}
 	}
 
-	// Load full rows for results
+	// Load rows for results (projected when Fields is set)
 	results := make([]models.Row, 0, len(rowIDs))
 	for _, rowID := range rowIDs {
-		row, err := t.GetRow(tablePath, rowID)
+		var row models.Row
+		if opts != nil && len(opts.Fields) > 0 {
+			row, err = t.GetRowFields(tablePath, rowID, opts.Fields)
+		} else {
+			row, err = t.GetRow(tablePath, rowID)
+		}
 		if err != nil {
 			continue // Skip rows that can't be loaded
 		}
@@ -2300,17 +2532,52 @@ func (t *Tree) FindRows(tablePath string, queryStr string, opts *QueryOptions) (
 	return results, nil
 }
 
+// resolveQueryTable returns the table a query runs against.
+// When path is a database, collection (from USE) names the table inside it;
+// when path is already a table, a USE collection must match its name.
+func (t *Tree) resolveQueryTable(path string, collection string) (string, error) {
+	if collection == "" {
+		return path, nil
+	}
+
+	isDB, _ := t.IsDatabase(path)
+	if isDB {
+		tablePath := path + "/" + collection
+		if err := t.ValidateTablePath(tablePath); err != nil {
+			return "", fmt.Errorf("collection %s not found in database %s", collection, path)
+		}
+		return tablePath, nil
+	}
+
+	parts := strings.Split(fixpath(path), "/")
+	if parts[len(parts)-1] != collection {
+		return "", fmt.Errorf("query uses collection %s but path %s is a different table", collection, path)
+	}
+	return path, nil
+}
+
 // FindRowsCursor executes a query and returns a cursor for memory-efficient iteration.
 // This is the cursor-based version of FindRows - more memory efficient for large results.
 func (t *Tree) FindRowsCursor(tablePath string, queryStr string, opts *QueryOptions) (*QueryCursor, error) {
 	// Parse query
-	query := parser.ParseExprQuery(queryStr)
+	query, err := parser.Parse(queryStr)
+	if err != nil {
+		return nil, fmt.Errorf("query parse failed: %w", err)
+	}
+
+	tablePath, err = t.resolveQueryTable(tablePath, query.Collection)
+	if err != nil {
+		return nil, err
+	}
 
 	// Analyze and create execution plan
 	plan, err := t.AnalyzeQuery(tablePath, query)
 	if err != nil {
 		return nil, fmt.Errorf("query analysis failed: %v", err)
 	}
+	if opts != nil {
+		plan.Vars = opts.Vars
+	}
 
 	// Execute query plan to get matching row IDs
 	rowIDs, err := t.ExecuteQueryPlan(plan)
@@ -2344,15 +2611,25 @@ func (t *Tree) FindRowsCursor(tablePath string, queryStr string, opts *QueryOpti
 
 // CountWhere counts rows matching a query without loading data.
 // This is more efficient than FindRows when you only need the count.
-func (t *Tree) CountWhere(tablePath string, queryStr string) (int, error) {
+// vars supplies values for $variables referenced in the query, or is nil.
+func (t *Tree) CountWhere(tablePath string, queryStr string, vars map[string]interface{}) (int, error) {
 	// Parse query
-	query := parser.ParseExprQuery(queryStr)
+	query, err := parser.Parse(queryStr)
+	if err != nil {
+		return 0, fmt.Errorf("query parse failed: %w", err)
+	}
+
+	tablePath, err = t.resolveQueryTable(tablePath, query.Collection)
+	if err != nil {
+		return 0, err
+	}
 
 	// Analyze and create execution plan
 	plan, err := t.AnalyzeQuery(tablePath, query)
 	if err != nil {
 		return 0, fmt.Errorf("query analysis failed: %v", err)
 	}
+	plan.Vars = vars
 
 	// Execute query plan to get matching row IDs
 	rowIDs, err := t.ExecuteQueryPlan(plan)
@@ -2364,18 +2641,27 @@ func (t *Tree) CountWhere(tablePath string, queryStr string) (int, error) {
 }
 
 // UpdateRowsWhere updates all rows matching a query.
-// Returns the number of rows updated.
-func (t *Tree) UpdateRowsWhere(tablePath string, queryStr string, updates map[string]interface{}) (int, error) {
+// Returns the number of rows updated. vars is used as in CountWhere.
+func (t *Tree) UpdateRowsWhere(tablePath string, queryStr string, updates map[string]interface{}, vars map[string]interface{}) (int, error) {
 	// Parse query
-	query := parser.ParseExprQuery(queryStr)
-
-	// Analyze and create execution plan
-	plan, err := t.AnalyzeQuery(tablePath, query)
+	query, err := parser.Parse(queryStr)
 	if err != nil {
-		return 0, fmt.Errorf("query analysis failed: %v", err)
+		return 0, fmt.Errorf("query parse failed: %w", err)
 	}
 
-	// Execute query plan to get matching row IDs
+	tablePath, err = t.resolveQueryTable(tablePath, query.Collection)
+	if err != nil {
+		return 0, err
+	}
+
+	// Analyze and create execution plan
+	plan, err := t.AnalyzeQuery(tablePath, query)
+	if err != nil {
+		return 0, fmt.Errorf("query analysis failed: %v", err)
+	}
+	plan.Vars = vars
+
+	// Execute query plan to get matching row IDs
 	rowIDs, err := t.ExecuteQueryPlan(plan)
 	if err != nil {
 		return 0, fmt.Errorf("query execution failed: %v", err)
@@ -2394,16 +2680,25 @@ func (t *Tree) UpdateRowsWhere(tablePath string, queryStr string, updates map[st
 }
 
 // DeleteRowsWhere deletes all rows matching a query.
-// Returns the number of rows deleted.
-func (t *Tree) DeleteRowsWhere(tablePath string, queryStr string) (int, error) {
+// Returns the number of rows deleted. vars is used as in CountWhere.
+func (t *Tree) DeleteRowsWhere(tablePath string, queryStr string, vars map[string]interface{}) (int, error) {
 	// Parse query
-	query := parser.ParseExprQuery(queryStr)
+	query, err := parser.Parse(queryStr)
+	if err != nil {
+		return 0, fmt.Errorf("query parse failed: %w", err)
+	}
+
+	tablePath, err = t.resolveQueryTable(tablePath, query.Collection)
+	if err != nil {
+		return 0, err
+	}
 
 	// Analyze and create execution plan
 	plan, err := t.AnalyzeQuery(tablePath, query)
 	if err != nil {
 		return 0, fmt.Errorf("query analysis failed: %v", err)
 	}
+	plan.Vars = vars
 
 	// Execute query plan to get matching row IDs
 	rowIDs, err := t.ExecuteQueryPlan(plan)
@@ -2445,14 +2740,53 @@ func (t *Tree) FirstRow(tablePath string, queryStr string, sortFields []SortFiel
 
 // ExistsWhere checks if any rows match a query without loading data.
 // This is more efficient than CountWhere when you only need to know if matches exist.
-func (t *Tree) ExistsWhere(tablePath string, queryStr string) (bool, error) {
-	count, err := t.CountWhere(tablePath, queryStr)
+// vars is used as in CountWhere.
+func (t *Tree) ExistsWhere(tablePath string, queryStr string, vars map[string]interface{}) (bool, error) {
+	count, err := t.CountWhere(tablePath, queryStr, vars)
 	if err != nil {
 		return false, err
 	}
 	return count > 0, nil
 }
 
+// ExecuteStatement parses and runs a SELECT statement such as
+// "USE users; SELECT name, address.city WHERE age > 30 ORDER BY name DESC LIMIT 10 OFFSET 20".
+// path is the database holding the USE collection, or the table itself.
+// Selected fields are loaded with GetRowFields; SELECT * loads full rows.
+func (t *Tree) ExecuteStatement(path string, statement string, vars map[string]interface{}) ([]models.Row, error) {
+	stmt, err := parser.ParseStatement(statement)
+	if err != nil {
+		return nil, fmt.Errorf("statement parse failed: %w", err)
+	}
+
+	tablePath, err := t.resolveQueryTable(path, stmt.Collection)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &QueryOptions{
+		Limit:  stmt.Limit,
+		Skip:   stmt.Offset,
+		Vars:   vars,
+		Fields: stmt.Fields,
+	}
+	for _, ob := range stmt.OrderBy {
+		direction := SortAsc
+		if ob.Desc {
+			direction = SortDesc
+		}
+		opts.SortFields = append(opts.SortFields, SortField{FieldName: ob.Field, Direction: direction})
+	}
+
+	// No WHERE clause matches every row
+	query := parser.Query{}
+	if stmt.Where != nil {
+		query = *stmt.Where
+	}
+
+	return t.findRows(tablePath, query, opts)
+}
+
 // ============================================================================
 // Transaction Support
 // ============================================================================
@@ -2460,10 +2794,12 @@ func (t *Tree) ExistsWhere(tablePath string, queryStr string) (bool, error) {
 // Transaction wraps a BoltDB transaction for ACID operations.
 // Provides explicit control over commit and rollback.
 type Transaction struct {
-	tree      *Tree
-	tx        *bbolt.Tx
-	committed bool
+	tree       *Tree
+	tx         *bbolt.Tx
+	committed  bool
 	rolledBack bool
+	managed    bool      // finished by Update/View, not by the caller
+	deadline   time.Time // zero when the transaction has no timeout
 }
 
 // BeginTransaction starts a new read-write transaction.
@@ -2507,9 +2843,35 @@ func (t *Tree) BeginReadTransaction() (*Transaction, error) {
 	}, nil
 }
 
+// writeTxn runs fn in a read-write transaction that commits when fn succeeds
+func (t *Tree) writeTxn(fn func(txn *Transaction) error) error {
+	return t.db.Update(func(tx *bbolt.Tx) error {
+		return fn(&Transaction{tree: t, tx: tx})
+	})
+}
+
+// readTxn runs fn in a read-only transaction
+func (t *Tree) readTxn(fn func(txn *Transaction) error) error {
+	return t.db.View(func(tx *bbolt.Tx) error {
+		return fn(&Transaction{tree: t, tx: tx})
+	})
+}
+
+// failpoint reports the failure injected through Tree.rowWriteFailpoint
+// for step, if any
+func (txn *Transaction) failpoint(step string) error {
+	if txn.tree.rowWriteFailpoint == nil {
+		return nil
+	}
+	return txn.tree.rowWriteFailpoint(step)
+}
+
 // Commit commits the transaction, making all changes permanent.
 // After commit, the transaction cannot be used again.
 func (txn *Transaction) Commit() error {
+	if txn.managed {
+		return errors.New("managed transaction cannot be committed manually")
+	}
 	if txn.committed {
 		return errors.New("transaction already committed")
 	}
@@ -2530,6 +2892,9 @@ func (txn *Transaction) Commit() error {
 // After rollback, the transaction cannot be used again.
 // Safe to call multiple times (idempotent).
 func (txn *Transaction) Rollback() error {
+	if txn.managed {
+		return errors.New("managed transaction cannot be rolled back manually")
+	}
 	if txn.committed {
 		return errors.New("cannot rollback committed transaction")
 	}
@@ -2551,6 +2916,134 @@ func (txn *Transaction) IsActive() bool {
 	return !txn.committed && !txn.rolledBack
 }
 
+// ============================================================================
+// Managed Transactions
+// ============================================================================
+
+// ErrTxnTimeout is returned when a managed transaction exceeds its timeout
+var ErrTxnTimeout = errors.New("transaction timed out")
+
+// TxnOptions configures managed transactions (Update, View and ModifyRow)
+type TxnOptions struct {
+	Timeout    time.Duration // Limit on waiting for and running the transaction (0 = no limit)
+	MaxRetries int           // ModifyRowOptimistic attempts after a version conflict (0 = default of 3)
+}
+
+// txnOptions returns the first of opts, or the zero options
+func txnOptions(opts []TxnOptions) TxnOptions {
+	if len(opts) == 0 {
+		return TxnOptions{}
+	}
+	return opts[0]
+}
+
+// Update runs fn in a read-write transaction. The transaction commits when fn
+// returns nil and rolls back when fn returns an error or panics; the panic is
+// re-raised after the rollback. fn must not call Commit or Rollback itself.
+//
+// With a Timeout, Update gives up with ErrTxnTimeout if the write lock is not
+// acquired in time, and rolls back instead of committing when fn finishes
+// after the deadline.
+func (t *Tree) Update(fn func(txn *Transaction) error, opts ...TxnOptions) error {
+	return t.managedTxn(true, fn, txnOptions(opts))
+}
+
+// View runs fn in a read-only transaction that is always rolled back.
+// Errors, panics and timeouts behave as in Update.
+func (t *Tree) View(fn func(txn *Transaction) error, opts ...TxnOptions) error {
+	return t.managedTxn(false, fn, txnOptions(opts))
+}
+
+// managedTxn begins a transaction, runs fn and finishes it
+func (t *Tree) managedTxn(writable bool, fn func(txn *Transaction) error, opts TxnOptions) error {
+	tx, err := t.beginWithin(writable, opts.Timeout)
+	if err != nil {
+		return err
+	}
+
+	txn := &Transaction{tree: t, tx: tx, managed: true}
+	if opts.Timeout > 0 {
+		txn.deadline = time.Now().Add(opts.Timeout)
+	}
+
+	finished := false
+	defer func() {
+		if !finished {
+			txn.finish(false) // fn panicked
+		}
+	}()
+
+	err = fn(txn)
+	finished = true
+	if err != nil {
+		txn.finish(false)
+		return err
+	}
+	if !txn.deadline.IsZero() && time.Now().After(txn.deadline) {
+		txn.finish(false)
+		return ErrTxnTimeout
+	}
+	return txn.finish(writable)
+}
+
+// beginWithin begins a bbolt transaction, waiting at most timeout for it
+func (t *Tree) beginWithin(writable bool, timeout time.Duration) (*bbolt.Tx, error) {
+	if timeout <= 0 {
+		tx, err := t.db.Begin(writable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		return tx, nil
+	}
+
+	type begun struct {
+		tx  *bbolt.Tx
+		err error
+	}
+	ch := make(chan begun, 1)
+	go func() {
+		tx, err := t.db.Begin(writable)
+		ch <- begun{tx, err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case b := <-ch:
+		if b.err != nil {
+			return nil, fmt.Errorf("failed to begin transaction: %v", b.err)
+		}
+		return b.tx, nil
+	case <-timer.C:
+		// Release the transaction once it is eventually acquired
+		go func() {
+			if b := <-ch; b.tx != nil {
+				b.tx.Rollback()
+			}
+		}()
+		return nil, ErrTxnTimeout
+	}
+}
+
+// finish commits or rolls back a managed transaction
+func (txn *Transaction) finish(commit bool) error {
+	if commit {
+		if err := txn.tx.Commit(); err != nil {
+			txn.rolledBack = true
+			return fmt.Errorf("failed to commit transaction: %v", err)
+		}
+		txn.committed = true
+		return nil
+	}
+
+	txn.rolledBack = true
+	if err := txn.tx.Rollback(); err != nil {
+		return fmt.Errorf("failed to rollback transaction: %v", err)
+	}
+	return nil
+}
+
 // ============================================================================
 // Transaction CRUD Operations
 // ============================================================================
@@ -2571,191 +3064,2384 @@ func (txn *Transaction) InsertRow(tablePath string, row models.Row) (string, err
 }
 
 // InsertRowWithID inserts a row with a specific ID within the transaction.
+// Schema evolution, indexes, unique checks and the row count are applied
+// exactly as Tree.InsertRowWithID does.
 func (txn *Transaction) InsertRowWithID(tablePath, rowID string, row models.Row) error {
 	if !txn.IsActive() {
 		return errors.New("transaction is not active")
 	}
 
-	if err := txn.tree.ValidateTablePath(tablePath); err != nil {
+	if err := txn.validateTable(tablePath); err != nil {
 		return err
 	}
 
-	// Build full path and normalize it
-	rowPath := tablePath + "/" + rowID
+	return txn.insertRow(tablePath, rowID, row)
+}
 
-	// Normalize path similar to fixpath() in db.go
-	rowPath = strings.ReplaceAll(rowPath, "//", "/")
-	rowPath = strings.TrimPrefix(rowPath, "/")
-	rowPath = strings.TrimSuffix(rowPath, "/")
+// UpdateRow updates an entire row within the transaction. An expected
+// version is checked as in Tree.UpdateRow.
+func (txn *Transaction) UpdateRow(tablePath, rowID string, row models.Row, expectedVersion ...int64) error {
+	if !txn.IsActive() {
+		return errors.New("transaction is not active")
+	}
 
-	if !strings.HasPrefix(rowPath, "root/") && rowPath != "root" {
-		rowPath = "root/" + rowPath
+	if err := txn.validateTable(tablePath); err != nil {
+		return err
 	}
 
-	// Split into segments
-	segments := strings.Split(rowPath, "/")
+	return txn.updateRow(tablePath, rowID, rowToMap(row), false, expectedVersion)
+}
 
-	var b *bbolt.Bucket
-	var err error
+// UpdateRowFields updates specific fields of a row within the transaction.
+// An expected version is checked as in Tree.UpdateRow.
+func (txn *Transaction) UpdateRowFields(tablePath, rowID string, fields map[string]interface{}, expectedVersion ...int64) error {
+	if !txn.IsActive() {
+		return errors.New("transaction is not active")
+	}
 
-	// Navigate/create bucket hierarchy
-	for _, segment := range segments {
-		segment = strings.ReplaceAll(segment, " ", "_") // sanitize
-		if b == nil {
-			b, err = txn.tx.CreateBucketIfNotExists([]byte(segment))
-		} else {
-			b, err = b.CreateBucketIfNotExists([]byte(segment))
-		}
-		if err != nil {
-			return err
-		}
+	if err := txn.validateTable(tablePath); err != nil {
+		return err
 	}
 
-	// Save row fields using same format as CreateNodeWithProps
-	for fieldName, value := range row {
-		if value == nil {
-			continue
-		}
+	return txn.updateRow(tablePath, rowID, fields, true, expectedVersion)
+}
 
-		// Use fmt.Sprintf like CreateNodeWithProps does, not JSON
-		var data string
-		if value.IsNull() {
-			data = "null"
-		} else {
-			data = fmt.Sprintf("%v", value.Val())
-		}
+// DeleteRow deletes a row within the transaction, applying the on-delete
+// action of every foreign key that references it.
+func (txn *Transaction) DeleteRow(tablePath, rowID string) error {
+	if !txn.IsActive() {
+		return errors.New("transaction is not active")
+	}
 
-		if err := b.Put([]byte(fieldName), []byte(data)); err != nil {
-			return fmt.Errorf("failed to save field %s: %v", fieldName, err)
-		}
+	if err := txn.validateTable(tablePath); err != nil {
+		return err
 	}
 
+	return txn.deleteRow(tablePath, rowID)
+}
+
+// validateTable checks that tablePath is a table within the transaction
+func (txn *Transaction) validateTable(tablePath string) error {
+	b, err := txn.bucketAt(tablePath)
+	if err != nil || string(b.Get([]byte("__type"))) != TypeTable {
+		return errors.New("path is not a table")
+	}
 	return nil
 }
 
-// UpdateRow updates an entire row within the transaction.
-func (txn *Transaction) UpdateRow(tablePath, rowID string, row models.Row) error {
-	if !txn.IsActive() {
-		return errors.New("transaction is not active")
+// insertRow creates a row with its schema evolution, index entries and row
+// count in the transaction
+func (txn *Transaction) insertRow(tablePath, rowID string, row models.Row) error {
+	if b, _ := txn.bucketAt(tablePath + "/" + rowID); b != nil {
+		return fmt.Errorf("row with ID %s already exists", rowID)
 	}
 
-	return txn.UpdateRowFields(tablePath, rowID, rowToMap(row))
-}
+	// Fill in declared defaults
+	declared, err := txn.tableSchema(tablePath)
+	if err != nil {
+		return err
+	}
+	row = declared.withDefaults(row)
+	if _, exists := row[VersionField]; exists {
+		row = maps.Clone(row)
+		delete(row, VersionField)
+	}
 
-// UpdateRowFields updates specific fields of a row within the transaction.
-func (txn *Transaction) UpdateRowFields(tablePath, rowID string, fields map[string]interface{}) error {
-	if !txn.IsActive() {
-		return errors.New("transaction is not active")
+	// Referenced parent rows must exist
+	if err := txn.checkForeignKeys(tablePath, rowID, rowToMap(row)); err != nil {
+		return err
+	}
+
+	// Update schema with new row (adds new fields if any)
+	schema, err := txn.evolveSchema(tablePath, row)
+	if err != nil {
+		return fmt.Errorf("failed to update schema: %w", err)
+	}
+	if err := txn.tree.ValidateRowAgainstSchema(row, schema); err != nil {
+		return fmt.Errorf("row validation failed: %w", err)
+	}
+
+	if err := txn.putRow(tablePath, rowID, rowToMap(row), true); err != nil {
+		return fmt.Errorf("failed to store row: %w", err)
 	}
 
-	if err := txn.tree.ValidateTablePath(tablePath); err != nil {
+	if err := txn.adjustRowCount(tablePath, 1); err != nil {
+		return fmt.Errorf("failed to update row count: %w", err)
+	}
+
+	return nil
+}
+
+// updateRow writes fields to an existing row with its schema evolution and
+// index entries in the transaction. A partial update only validates the
+// fields it sets; a non-empty expected holds the version the row must be at.
+func (txn *Transaction) updateRow(tablePath, rowID string, fields map[string]interface{}, partial bool, expected []int64) error {
+	b, _ := txn.bucketAt(tablePath + "/" + rowID)
+	if b == nil {
+		return fmt.Errorf("row not found: %s", rowID)
+	}
+	if err := checkVersion(tablePath+"/"+rowID, b, expected); err != nil {
 		return err
 	}
 
-	rowPath := tablePath + "/" + rowID
+	// Check foreign keys in both directions
+	if err := txn.checkForeignKeys(tablePath, rowID, fields); err != nil {
+		return err
+	}
 
-	// Normalize path
-	rowPath = strings.ReplaceAll(rowPath, "//", "/")
-	rowPath = strings.TrimPrefix(rowPath, "/")
-	rowPath = strings.TrimSuffix(rowPath, "/")
-	if !strings.HasPrefix(rowPath, "root/") && rowPath != "root" {
-		rowPath = "root/" + rowPath
+	row := make(models.Row)
+	for key, val := range fields {
+		if key != VersionField {
+			row[key] = models.NewValue(val)
+		}
 	}
 
-	segments := strings.Split(rowPath, "/")
-	b, err := txn.getBucket(segments)
+	// Update schema if needed
+	schema, err := txn.evolveSchema(tablePath, row)
 	if err != nil {
-		return fmt.Errorf("row not found: %v", err)
+		return fmt.Errorf("failed to update schema: %w", err)
+	}
+	if err := txn.tree.validateRow(row, schema, partial); err != nil {
+		return fmt.Errorf("row validation failed: %w", err)
 	}
 
-	// Update fields using same format as CreateNodeWithProps
-	for fieldName, value := range fields {
-		// Use fmt.Sprintf like CreateNodeWithProps does, not JSON
-		var data string
-		if value == nil {
-			data = "null"
-		} else {
-			data = fmt.Sprintf("%v", value)
-		}
+	if err := txn.putRow(tablePath, rowID, fields, false); err != nil {
+		return fmt.Errorf("failed to update row: %w", err)
+	}
+
+	return txn.touchTable(tablePath)
+}
 
-		if err := b.Put([]byte(fieldName), []byte(data)); err != nil {
-			return fmt.Errorf("failed to update field %s: %v", fieldName, err)
+// upsertRow updates a row if it exists and inserts it otherwise, deciding
+// within the transaction. A partial upsert only writes the given fields of an
+// existing row. Returns true when the row was inserted.
+func (txn *Transaction) upsertRow(tablePath, rowID string, row models.Row, partial bool) (bool, error) {
+	if b, _ := txn.bucketAt(tablePath + "/" + rowID); b != nil {
+		if err := txn.updateRow(tablePath, rowID, rowToMap(row), partial, nil); err != nil {
+			return false, fmt.Errorf("failed to update row: %w", err)
 		}
+		return false, nil
 	}
 
-	return nil
+	if err := txn.insertRow(tablePath, rowID, row); err != nil {
+		return false, fmt.Errorf("failed to insert row: %w", err)
+	}
+	return true, nil
 }
 
-// DeleteRow deletes a row within the transaction.
-func (txn *Transaction) DeleteRow(tablePath, rowID string) error {
-	if !txn.IsActive() {
-		return errors.New("transaction is not active")
+// deleteRow removes a row in the transaction, applying the on-delete action
+// of every foreign key that references it
+func (txn *Transaction) deleteRow(tablePath, rowID string) error {
+	if b, _ := txn.bucketAt(tablePath + "/" + rowID); b == nil {
+		return fmt.Errorf("row not found: %s", rowID)
 	}
 
-	if err := txn.tree.ValidateTablePath(tablePath); err != nil {
+	// Resolve restrict/cascade/set-null for referencing rows
+	plan, err := txn.planDelete(tablePath, rowID)
+	if err != nil {
 		return err
 	}
 
-	path := tablePath + "/" + rowID
+	for _, ref := range plan.nulls {
+		if plan.deleted(ref.Table, ref.RowID) {
+			continue
+		}
+		if err := txn.clearField(ref.Table, ref.RowID, ref.Field); err != nil {
+			return fmt.Errorf("failed to set null on %s/%s: %w", ref.Table, ref.RowID, err)
+		}
+	}
 
-	// Normalize path
-	path = strings.ReplaceAll(path, "//", "/")
-	path = strings.TrimPrefix(path, "/")
-	path = strings.TrimSuffix(path, "/")
-	if !strings.HasPrefix(path, "root/") && path != "root" {
-		path = "root/" + path
+	for _, ref := range plan.deletes {
+		if err := txn.removeRow(ref.Table, ref.RowID); err != nil {
+			return fmt.Errorf("failed to cascade delete to %s/%s: %w", ref.Table, ref.RowID, err)
+		}
 	}
 
-	segments := strings.Split(path, "/")
+	return txn.removeRow(tablePath, rowID)
+}
+
+// removeRow deletes a row bucket, its index entries and one from the row count
+func (txn *Transaction) removeRow(tablePath, rowID string) error {
+	if err := txn.deleteRowBucket(tablePath, rowID); err != nil {
+		return err
+	}
+	if err := txn.adjustRowCount(tablePath, -1); err != nil {
+		return fmt.Errorf("failed to update row count: %w", err)
+	}
+	return nil
+}
 
+// deleteRowBucket removes a row bucket and its index entries within the transaction
+func (txn *Transaction) deleteRowBucket(tablePath, rowID string) error {
+	segments := strings.Split(fixpath(tablePath+"/"+rowID), "/")
 	if len(segments) < 2 {
 		return errors.New("invalid row path")
 	}
 
 	nodeToDelete := segments[len(segments)-1]
-	parentSegments := segments[:len(segments)-1]
-
-	parentBucket, err := txn.getBucket(parentSegments)
+	parentBucket, err := txn.getBucket(segments[:len(segments)-1])
 	if err != nil {
 		return fmt.Errorf("parent bucket not found: %v", err)
 	}
 
-	if err := parentBucket.DeleteBucket([]byte(nodeToDelete)); err != nil {
+	row := parentBucket.Bucket([]byte(sanitizeBucketName(nodeToDelete)))
+	if row == nil {
+		return fmt.Errorf("row not found: %s", rowID)
+	}
+	if err := txn.indexRow(tablePath, rowID, rowFromBucket(row), nil); err != nil {
+		return fmt.Errorf("failed to update indexes: %v", err)
+	}
+	if err := txn.failpoint("indexes"); err != nil {
+		return err
+	}
+
+	if err := parentBucket.DeleteBucket([]byte(sanitizeBucketName(nodeToDelete))); err != nil {
 		return fmt.Errorf("failed to delete row: %v", err)
 	}
 
+	return txn.failpoint("row")
+}
+
+// putRow writes fields to a row and moves its index entries in the same
+// transaction. Unique indexes are checked before anything is written. With
+// create the row is created when missing.
+func (txn *Transaction) putRow(tablePath, rowID string, fields map[string]interface{}, create bool) error {
+	rowPath := tablePath + "/" + rowID
+	b, _ := txn.bucketAt(rowPath)
+	if b == nil && !create {
+		return fmt.Errorf("row not found: %s", rowID)
+	}
+
+	oldRow := rowFromBucket(b)
+	newRow := make(models.Row, len(oldRow)+len(fields))
+	for k, v := range oldRow {
+		newRow[k] = v
+	}
+	for k, v := range fields {
+		if k != VersionField {
+			newRow[k] = models.NewValue(storedValue(v))
+		}
+	}
+
+	if err := txn.indexRow(tablePath, rowID, oldRow, newRow); err != nil {
+		return err
+	}
+	if err := txn.failpoint("indexes"); err != nil {
+		return err
+	}
+
+	if b == nil {
+		var err error
+		if b, err = txn.createBucketAt(rowPath); err != nil {
+			return err
+		}
+	}
+	for fieldName, value := range fields {
+		if fieldName == VersionField {
+			continue // Maintained by bumpVersion
+		}
+		if err := b.Put([]byte(fieldName), []byte(storedValue(value))); err != nil {
+			return fmt.Errorf("failed to save field %s: %v", fieldName, err)
+		}
+	}
+	if _, err := bumpVersion(b); err != nil {
+		return err
+	}
+
+	return txn.failpoint("row")
+}
+
+// bumpVersion increments the version of a row bucket; unversioned rows start at 0
+func bumpVersion(b *bbolt.Bucket) (int64, error) {
+	version := bucketVersion(b) + 1
+	if err := b.Put([]byte(VersionField), []byte(strconv.FormatInt(version, 10))); err != nil {
+		return 0, fmt.Errorf("failed to save version: %v", err)
+	}
+	return version, nil
+}
+
+// bucketVersion reads the version of a row or node bucket
+func bucketVersion(b *bbolt.Bucket) int64 {
+	version, _ := strconv.ParseInt(string(b.Get([]byte(VersionField))), 10, 64)
+	return version
+}
+
+// checkVersion fails with a *VersionConflictError when expected is set and
+// differs from the bucket's version
+func checkVersion(path string, b *bbolt.Bucket, expected []int64) error {
+	if len(expected) == 0 {
+		return nil
+	}
+	if current := bucketVersion(b); current != expected[0] {
+		return &VersionConflictError{Path: path, Current: current, Expected: expected[0]}
+	}
 	return nil
 }
 
-// getBucket navigates to a bucket using the transaction's tx
-func (txn *Transaction) getBucket(segments []string) (*bbolt.Bucket, error) {
-	var b *bbolt.Bucket
+// clearField removes a field from a row and its index entries
+func (txn *Transaction) clearField(tablePath, rowID, field string) error {
+	b, err := txn.bucketAt(tablePath + "/" + rowID)
+	if err != nil {
+		return fmt.Errorf("row not found: %s", rowID)
+	}
 
-	for _, segment := range segments {
-		segment = strings.ReplaceAll(segment, " ", "_") // sanitize
-		if b == nil {
-			b = txn.tx.Bucket([]byte(segment))
-		} else {
-			b = b.Bucket([]byte(segment))
+	oldRow := rowFromBucket(b)
+	newRow := make(models.Row, len(oldRow))
+	for k, v := range oldRow {
+		if k != field {
+			newRow[k] = v
 		}
+	}
 
-		if b == nil {
-			return nil, fmt.Errorf("bucket not found: %s", segment)
+	if err := txn.indexRow(tablePath, rowID, oldRow, newRow); err != nil {
+		return err
+	}
+	if err := b.Delete([]byte(field)); err != nil {
+		return err
+	}
+	_, err = bumpVersion(b)
+	return err
+}
+
+// rowFromBucket reads the stored fields of a row bucket, leaving out its
+// version; nil yields an empty row
+func rowFromBucket(b *bbolt.Bucket) models.Row {
+	row := make(models.Row)
+	if b == nil {
+		return row
+	}
+	b.ForEach(func(k, v []byte) error {
+		if v != nil && string(k) != VersionField {
+			row[string(k)] = models.NewValue(string(v))
+		}
+		return nil
+	})
+	return row
+}
+
+// storedNull is how a null field value is stored
+const storedNull = "null"
+
+// storedValue formats a field value the way rows are stored
+func storedValue(v interface{}) string {
+	if v == nil {
+		return storedNull
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// getBucket navigates to a bucket using the transaction's tx
+func (txn *Transaction) getBucket(segments []string) (*bbolt.Bucket, error) {
+	var b *bbolt.Bucket
+
+	for _, segment := range segments {
+		segment = sanitizeBucketName(segment)
+		if b == nil {
+			b = txn.tx.Bucket([]byte(segment))
+		} else {
+			b = b.Bucket([]byte(segment))
+		}
+
+		if b == nil {
+			return nil, fmt.Errorf("bucket not found: %s", segment)
+		}
+	}
+
+	return b, nil
+}
+
+// rowToMap converts a models.Row to a map[string]interface{}
+func rowToMap(row models.Row) map[string]interface{} {
+	result := make(map[string]interface{})
+	for k, v := range row {
+		if v != nil {
+			result[k] = v.Val()
+		}
+	}
+	return result
+}
+
+// tableSchema reads a table's schema within the transaction
+func (txn *Transaction) tableSchema(tablePath string) (*TableSchema, error) {
+	b, err := txn.bucketAt(tablePath + "/" + SchemaNode)
+	if err != nil {
+		return nil, nil // No schema yet
+	}
+
+	props := make(map[string]string)
+	b.ForEach(func(k, v []byte) error {
+		if v != nil {
+			props[string(k)] = string(v)
+		}
+		return nil
+	})
+	return parseTableSchema(props)
+}
+
+// bucketAt navigates to the bucket at a tree path using the transaction's tx
+func (txn *Transaction) bucketAt(path string) (*bbolt.Bucket, error) {
+	return txn.getBucket(strings.Split(fixpath(path), "/"))
+}
+
+// createBucketAt navigates to the bucket at a tree path, creating missing buckets
+func (txn *Transaction) createBucketAt(path string) (*bbolt.Bucket, error) {
+	var b *bbolt.Bucket
+	var err error
+	for _, segment := range strings.Split(fixpath(path), "/") {
+		segment = sanitizeBucketName(segment)
+		if b == nil {
+			b, err = txn.tx.CreateBucketIfNotExists([]byte(segment))
+		} else {
+			b, err = b.CreateBucketIfNotExists([]byte(segment))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// ============================================================================
+// Transaction Reads
+// ============================================================================
+
+// GetRow retrieves a row by ID from the transaction's snapshot, including
+// writes made earlier in the same transaction.
+func (txn *Transaction) GetRow(tablePath, rowID string) (models.Row, error) {
+	if !txn.IsActive() {
+		return nil, errors.New("transaction is not active")
+	}
+
+	if err := txn.validateTable(tablePath); err != nil {
+		return nil, err
+	}
+
+	schema, err := txn.tableSchema(tablePath)
+	if err != nil {
+		return nil, err
+	}
+	return txn.readRow(tablePath, rowID, schema, nil)
+}
+
+// ScanRows calls callback for every row in the transaction's snapshot.
+// Row IDs are collected up front, so the callback may write through the
+// same transaction.
+func (txn *Transaction) ScanRows(tablePath string, callback func(rowID string, row models.Row) error) error {
+	if !txn.IsActive() {
+		return errors.New("transaction is not active")
+	}
+
+	if err := txn.validateTable(tablePath); err != nil {
+		return err
+	}
+
+	schema, err := txn.tableSchema(tablePath)
+	if err != nil {
+		return err
+	}
+
+	rowIDs, err := txn.rowIDs(tablePath)
+	if err != nil {
+		return err
+	}
+	for _, rowID := range rowIDs {
+		row, err := txn.readRow(tablePath, rowID, schema, nil)
+		if err != nil {
+			continue // Removed by an earlier callback
+		}
+		if err := callback(rowID, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindRows executes a query against the transaction's snapshot. Equality
+// conditions on a single-field index use that index; options behave as in
+// Tree.FindRows.
+func (txn *Transaction) FindRows(tablePath string, queryStr string, opts *QueryOptions) ([]models.Row, error) {
+	if !txn.IsActive() {
+		return nil, errors.New("transaction is not active")
+	}
+
+	query, err := parser.Parse(queryStr)
+	if err != nil {
+		return nil, fmt.Errorf("query parse failed: %w", err)
+	}
+
+	tablePath, err = txn.resolveQueryTable(tablePath, query.Collection)
+	if err != nil {
+		return nil, err
+	}
+	if err := txn.validateTable(tablePath); err != nil {
+		return nil, err
+	}
+
+	schema, err := txn.tableSchema(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	candidateIDs, err := txn.queryCandidates(tablePath, query)
+	if err != nil {
+		return nil, fmt.Errorf("query execution failed: %v", err)
+	}
+
+	var vars map[string]interface{}
+	if opts != nil {
+		vars = opts.Vars
+	}
+	functions := txn.tree.queryFunctions()
+
+	var ids []string
+	var rows []models.Row
+	for _, rowID := range candidateIDs {
+		row, err := txn.readRow(tablePath, rowID, schema, nil)
+		if err != nil {
+			continue // Skip rows that can't be loaded
+		}
+		obj := models.NewObjectWithContext(row, nil, functions, vars)
+		if match, err := obj.Match(query); err == nil && match {
+			ids = append(ids, rowID)
+			rows = append(rows, row)
+		}
+	}
+
+	if opts == nil {
+		return rows, nil
+	}
+
+	// Apply sorting if requested
+	if len(opts.SortFields) > 0 {
+		order := make([]int, len(rows))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return compareSortFields(rows[order[i]], rows[order[j]], opts.SortFields) < 0
+		})
+		sortedIDs := make([]string, len(order))
+		sortedRows := make([]models.Row, len(order))
+		for i, o := range order {
+			sortedIDs[i], sortedRows[i] = ids[o], rows[o]
+		}
+		ids, rows = sortedIDs, sortedRows
+	}
+
+	// Apply pagination (skip/limit)
+	if opts.Skip > 0 && opts.Skip < len(rows) {
+		ids, rows = ids[opts.Skip:], rows[opts.Skip:]
+	} else if opts.Skip >= len(rows) {
+		ids, rows = nil, nil
+	}
+	if opts.Limit > 0 && opts.Limit < len(rows) {
+		ids, rows = ids[:opts.Limit], rows[:opts.Limit]
+	}
+
+	// Project the requested fields
+	if len(opts.Fields) > 0 {
+		for i, rowID := range ids {
+			if row, err := txn.readRow(tablePath, rowID, schema, opts.Fields); err == nil {
+				rows[i] = row
+			}
+		}
+	}
+
+	if rows == nil {
+		rows = []models.Row{}
+	}
+	return rows, nil
+}
+
+// compareSortFields orders two rows by sortFields; missing fields sort as null
+func compareSortFields(a, b models.Row, sortFields []SortField) int {
+	for _, sf := range sortFields {
+		v1, v2 := a[sf.FieldName], b[sf.FieldName]
+		if v1 == nil {
+			v1 = models.NewValue(nil)
+		}
+		if v2 == nil {
+			v2 = models.NewValue(nil)
+		}
+		cmp := compareValues(*v1, *v2)
+		if cmp == 0 {
+			continue
+		}
+		if sf.Direction == SortDesc {
+			cmp = -cmp
+		}
+		return cmp
+	}
+	return 0
+}
+
+// resolveQueryTable mirrors Tree.resolveQueryTable within the transaction
+func (txn *Transaction) resolveQueryTable(path string, collection string) (string, error) {
+	if collection == "" {
+		return path, nil
+	}
+
+	if b, err := txn.bucketAt(path); err == nil && string(b.Get([]byte("__type"))) == TypeDatabase {
+		tablePath := path + "/" + collection
+		if err := txn.validateTable(tablePath); err != nil {
+			return "", fmt.Errorf("collection %s not found in database %s", collection, path)
+		}
+		return tablePath, nil
+	}
+
+	parts := strings.Split(fixpath(path), "/")
+	if parts[len(parts)-1] != collection {
+		return "", fmt.Errorf("query uses collection %s but path %s is a different table", collection, path)
+	}
+	return path, nil
+}
+
+// queryCandidates returns the rows a query has to evaluate: the entries of a
+// single-field index matched by an equality condition, or every row
+func (txn *Transaction) queryCandidates(tablePath string, query parser.Query) ([]string, error) {
+	indexes, err := txn.tableIndexes(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, condition := range query.Conditions {
+		if condition.Op != "==" || condition.Left == nil || condition.Left.Property == "" ||
+			condition.Right == nil || condition.Right.Value == nil {
+			continue
+		}
+		for _, idx := range indexes {
+			if len(idx.fields) == 1 && idx.fields[0] == condition.Left.Property {
+				return idx.rowIDs(fmt.Sprintf("%v", condition.Right.Value)), nil
+			}
+		}
+	}
+
+	return txn.rowIDs(tablePath)
+}
+
+// rowIDs lists the row IDs of a table within the transaction
+func (txn *Transaction) rowIDs(tablePath string) ([]string, error) {
+	table, err := txn.bucketAt(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	err = table.ForEachBucket(func(k []byte) error {
+		if !txn.tree.isSpecialNode(string(k)) {
+			ids = append(ids, string(k))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// readRow loads a row with schema types applied. When fields is set only
+// those fields are loaded, missing ones as null.
+func (txn *Transaction) readRow(tablePath, rowID string, schema *TableSchema, fields []string) (models.Row, error) {
+	b, err := txn.bucketAt(tablePath + "/" + rowID)
+	if err != nil {
+		return nil, fmt.Errorf("row not found: %s", rowID)
+	}
+
+	stored := rowFromBucket(b)
+	row := stored
+	if len(fields) > 0 {
+		row = make(models.Row, len(fields))
+		for _, field := range fields {
+			if val, exists := stored[field]; exists {
+				row[field] = val
+			} else {
+				row[field] = models.NewValue(nil)
+			}
+		}
+	}
+
+	if schema != nil {
+		for key, val := range row {
+			if schemaType, exists := schema.Fields[key]; exists && !val.IsNull() {
+				val.SetSchemaType(schemaType)
+			}
+		}
+	}
+	return row, nil
+}
+
+// ============================================================================
+// Foreign Keys
+// ============================================================================
+
+// ForeignKeyAction is applied to child rows when their parent row is deleted
+type ForeignKeyAction string
+
+const (
+	FKRestrict ForeignKeyAction = "restrict" // refuse to delete a referenced parent
+	FKCascade  ForeignKeyAction = "cascade"  // delete the referencing child rows
+	FKSetNull  ForeignKeyAction = "set_null" // clear the referencing field
+)
+
+// ErrForeignKeyViolation is wrapped by every error caused by a foreign key
+var ErrForeignKeyViolation = errors.New("foreign key violation")
+
+// ForeignKey links a child table field to a parent table field.
+// An empty ParentField references the parent row ID.
+type ForeignKey struct {
+	ChildTable  string           `json:"child_table"`
+	Field       string           `json:"field"`
+	ParentTable string           `json:"parent_table"`
+	ParentField string           `json:"parent_field"`
+	OnDelete    ForeignKeyAction `json:"on_delete"`
+}
+
+// AddForeignKey constrains childTable.field to values of parentTable.parentField
+// (or parent row IDs when parentField is empty). Existing child rows must already
+// satisfy the constraint. The constraint is stored in the child's __foreign_keys
+// node and mirrored in the parent's __referenced_by node.
+func (t *Tree) AddForeignKey(childTable, field, parentTable, parentField string, onDelete ForeignKeyAction) error {
+	if err := t.ValidateTablePath(childTable); err != nil {
+		return fmt.Errorf("child table: %v", err)
+	}
+	if err := t.ValidateTablePath(parentTable); err != nil {
+		return fmt.Errorf("parent table: %v", err)
+	}
+	if field == "" {
+		return errors.New("foreign key field is required")
+	}
+
+	switch onDelete {
+	case "":
+		onDelete = FKRestrict
+	case FKRestrict, FKCascade, FKSetNull:
+	default:
+		return fmt.Errorf("unknown on delete action: %s", onDelete)
+	}
+
+	fk := ForeignKey{
+		ChildTable:  fixpath(childTable),
+		Field:       field,
+		ParentTable: fixpath(parentTable),
+		ParentField: parentField,
+		OnDelete:    onDelete,
+	}
+
+	// Existing rows must already reference parents
+	err := t.readTxn(func(txn *Transaction) error {
+		children, err := txn.bucketAt(fk.ChildTable)
+		if err != nil {
+			return err
+		}
+		return children.ForEachBucket(func(k []byte) error {
+			if t.isSpecialNode(string(k)) {
+				return nil
+			}
+			value, ok := foreignKeyValue(string(children.Bucket(k).Get([]byte(field))))
+			if !ok {
+				return nil
+			}
+			return txn.checkParentExists(fk, value)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	fkJSON, err := json.Marshal(fk)
+	if err != nil {
+		return err
+	}
+
+	if err := t.SetValues(childTable+"/"+ForeignKeysNode, map[string]interface{}{field: string(fkJSON)}); err != nil {
+		return err
+	}
+	return t.SetValues(parentTable+"/"+ReferencedByNode, map[string]interface{}{fk.referenceKey(): string(fkJSON)})
+}
+
+// DropForeignKey removes the foreign key on childTable.field
+func (t *Tree) DropForeignKey(childTable, field string) error {
+	fks, err := t.GetForeignKeys(childTable)
+	if err != nil {
+		return err
+	}
+
+	for _, fk := range fks {
+		if fk.Field != field {
+			continue
+		}
+		if err := t.DeleteValue(childTable+"/"+ForeignKeysNode, field); err != nil {
+			return err
+		}
+		return t.DeleteValue(fk.ParentTable+"/"+ReferencedByNode, fk.referenceKey())
+	}
+
+	return fmt.Errorf("foreign key on %s does not exist", field)
+}
+
+// GetForeignKeys returns the foreign keys declared on a child table
+func (t *Tree) GetForeignKeys(tablePath string) ([]ForeignKey, error) {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return nil, err
+	}
+
+	var fks []ForeignKey
+	err := t.readTxn(func(txn *Transaction) error {
+		var err error
+		fks, err = txn.foreignKeys(tablePath, ForeignKeysNode)
+		return err
+	})
+	return fks, err
+}
+
+// referenceKey names the constraint inside the parent's __referenced_by node
+func (fk ForeignKey) referenceKey() string {
+	return fk.ChildTable + "#" + fk.Field
+}
+
+// foreignKeyValue formats a field value for comparison; null values are never checked
+func foreignKeyValue(v interface{}) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	s := fmt.Sprintf("%v", v)
+	if s == "" || s == "null" || s == "<nil>" {
+		return "", false
+	}
+	return s, true
+}
+
+// foreignKeys loads the constraints stored in a table's foreign key node
+func (txn *Transaction) foreignKeys(tablePath, node string) ([]ForeignKey, error) {
+	b, err := txn.bucketAt(tablePath + "/" + node)
+	if err != nil {
+		return nil, nil // No constraints
+	}
+
+	var fks []ForeignKey
+	err = b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		var fk ForeignKey
+		if err := json.Unmarshal(v, &fk); err != nil {
+			return fmt.Errorf("failed to parse foreign key %s: %v", k, err)
+		}
+		fks = append(fks, fk)
+		return nil
+	})
+	return fks, err
+}
+
+// checkForeignKeys verifies that written fields reference existing parents and
+// that a referenced parent key is not changed while child rows still use it
+func (txn *Transaction) checkForeignKeys(tablePath, rowID string, fields map[string]interface{}) error {
+	fks, err := txn.foreignKeys(tablePath, ForeignKeysNode)
+	if err != nil {
+		return err
+	}
+	for _, fk := range fks {
+		value, ok := foreignKeyValue(fields[fk.Field])
+		if !ok {
+			continue
+		}
+		if err := txn.checkParentExists(fk, value); err != nil {
+			return err
+		}
+	}
+
+	refs, err := txn.foreignKeys(tablePath, ReferencedByNode)
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	row, err := txn.bucketAt(tablePath + "/" + rowID)
+	if err != nil {
+		return nil // New row, nothing references it yet
+	}
+	for _, fk := range refs {
+		newValue, changed := fields[fk.ParentField]
+		if fk.ParentField == "" || !changed {
+			continue
+		}
+		oldValue, ok := foreignKeyValue(string(row.Get([]byte(fk.ParentField))))
+		if !ok || oldValue == fmt.Sprintf("%v", newValue) {
+			continue
+		}
+		children, err := txn.childRowIDs(fk, oldValue)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return fmt.Errorf("%w: %s.%s = %q is referenced by %s/%s",
+				ErrForeignKeyViolation, tablePath, fk.ParentField, oldValue, fk.ChildTable, children[0])
+		}
+	}
+
+	return nil
+}
+
+// checkParentExists returns a violation unless a parent row holds value
+func (txn *Transaction) checkParentExists(fk ForeignKey, value string) error {
+	parents, err := txn.bucketAt(fk.ParentTable)
+	if err == nil {
+		if fk.ParentField == "" {
+			if parents.Bucket([]byte(value)) != nil {
+				return nil
+			}
+		} else if len(txn.rowsWithValue(fk.ParentTable, fk.ParentField, value, 1)) > 0 {
+			return nil
+		}
+	}
+
+	parentField := fk.ParentField
+	if parentField == "" {
+		parentField = "id"
+	}
+	return fmt.Errorf("%w: %s = %q has no matching row in %s.%s",
+		ErrForeignKeyViolation, fk.Field, value, fk.ParentTable, parentField)
+}
+
+// childRowIDs returns the child rows whose foreign key field equals value
+func (txn *Transaction) childRowIDs(fk ForeignKey, value string) ([]string, error) {
+	return txn.rowsWithValue(fk.ChildTable, fk.Field, value, 0), nil
+}
+
+// rowsWithValue returns up to limit (0 = all) rows of a table whose stored
+// field equals value. An index on exactly that field is used when the table
+// has one; otherwise every row is scanned.
+func (txn *Transaction) rowsWithValue(tablePath, field, value string, limit int) []string {
+	table, err := txn.bucketAt(tablePath)
+	if err != nil {
+		return nil
+	}
+	matches := func(rowID []byte) bool {
+		row := table.Bucket(rowID)
+		return row != nil && string(row.Get([]byte(field))) == value
+	}
+
+	var rowIDs []string
+	indexes, _ := txn.tableIndexes(tablePath)
+	for _, idx := range indexes {
+		if len(idx.fields) != 1 || idx.fields[0] != field {
+			continue
+		}
+		for _, id := range idx.rowIDs(value) {
+			if matches([]byte(id)) {
+				if rowIDs = append(rowIDs, id); len(rowIDs) == limit {
+					break
+				}
+			}
+		}
+		return rowIDs
+	}
+
+	c := table.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v != nil || txn.tree.isSpecialNode(string(k)) || !matches(k) {
+			continue
+		}
+		if rowIDs = append(rowIDs, string(k)); len(rowIDs) == limit {
+			break
+		}
+	}
+	return rowIDs
+}
+
+// foreignKeyRow identifies a row touched by an on-delete action
+type foreignKeyRow struct {
+	Table string
+	RowID string
+	Field string // set-null only
+}
+
+// onDeletePlan lists the rows affected by deleting a parent row
+type onDeletePlan struct {
+	deletes []foreignKeyRow // cascaded rows, children before parents
+	nulls   []foreignKeyRow // rows whose Field is cleared
+	seen    map[string]bool // rows being deleted, including the root
+}
+
+// deleted reports whether a row is removed by the plan
+func (p *onDeletePlan) deleted(tablePath, rowID string) bool {
+	return p.seen[fixpath(tablePath)+"/"+rowID]
+}
+
+// planDelete walks the rows referencing tablePath/rowID, failing on restrict
+func (txn *Transaction) planDelete(tablePath, rowID string) (*onDeletePlan, error) {
+	plan := &onDeletePlan{seen: make(map[string]bool)}
+	if err := txn.collectOnDelete(tablePath, rowID, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// collectOnDelete adds the dependents of one row to the plan
+func (txn *Transaction) collectOnDelete(tablePath, rowID string, plan *onDeletePlan) error {
+	plan.seen[fixpath(tablePath)+"/"+rowID] = true
+
+	refs, err := txn.foreignKeys(tablePath, ReferencedByNode)
+	if err != nil || len(refs) == 0 {
+		return err
+	}
+	row, err := txn.bucketAt(tablePath + "/" + rowID)
+	if err != nil {
+		return nil
+	}
+
+	for _, fk := range refs {
+		value := rowID
+		if fk.ParentField != "" {
+			var ok bool
+			if value, ok = foreignKeyValue(string(row.Get([]byte(fk.ParentField)))); !ok {
+				continue
+			}
+		}
+
+		children, err := txn.childRowIDs(fk, value)
+		if err != nil {
+			return err
+		}
+		for _, childID := range children {
+			if plan.deleted(fk.ChildTable, childID) {
+				continue
+			}
+			switch fk.OnDelete {
+			case FKCascade:
+				if err := txn.collectOnDelete(fk.ChildTable, childID, plan); err != nil {
+					return err
+				}
+				plan.deletes = append(plan.deletes, foreignKeyRow{Table: fk.ChildTable, RowID: childID})
+			case FKSetNull:
+				plan.nulls = append(plan.nulls, foreignKeyRow{Table: fk.ChildTable, RowID: childID, Field: fk.Field})
+			default:
+				return fmt.Errorf("%w: %s/%s is referenced by %s/%s",
+					ErrForeignKeyViolation, tablePath, rowID, fk.ChildTable, childID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ============================================================================
+// Trash (Soft Delete)
+// ============================================================================
+
+// TrashNode holds soft-deleted subtrees until they are restored or purged
+const TrashNode = "__trash"
+
+// Kinds of trash entries
+const (
+	TrashKindNode = "node"
+	TrashKindRow  = "row"
+)
+
+// ErrPathInUse is returned when a node already exists where one would be written
+var ErrPathInUse = errors.New("path is in use")
+
+// TrashEntry describes a soft-deleted node or row
+type TrashEntry struct {
+	ID           string    `json:"id"`
+	OriginalPath string    `json:"original_path"`
+	Kind         string    `json:"kind"`
+	DeletedAt    time.Time `json:"deleted_at"`
+}
+
+// SoftDeleteNode moves a node and its subtree into root/__trash and returns
+// the trash ID to restore it with. A row path is soft deleted as by
+// SoftDeleteRow.
+func (t *Tree) SoftDeleteNode(p string) (string, error) {
+	p = fixpath(p)
+	if p == "root" {
+		return "", errors.New("can not delete root node")
+	}
+	if trashPath := "root/" + TrashNode; p == trashPath || strings.HasPrefix(p, trashPath+"/") {
+		return "", errors.New("node is already in the trash")
+	}
+
+	var trashID string
+	err := t.writeTxn(func(txn *Transaction) error {
+		parentPath, name := path.Split(p)
+		parentPath = strings.TrimSuffix(parentPath, "/")
+
+		// Rows go through the table so counts and indexes stay consistent
+		if err := txn.validateTable(parentPath); err == nil && !t.isSpecialNode(name) {
+			var err error
+			trashID, err = txn.trashRow(parentPath, name)
+			return err
+		}
+
+		parent, err := txn.bucketAt(parentPath)
+		if err != nil || parent.Bucket([]byte(sanitizeBucketName(name))) == nil {
+			return errors.New("node does not exist")
+		}
+		if trashID, err = txn.copyToTrash(p, TrashKindNode); err != nil {
+			return err
+		}
+		if err := parent.DeleteBucket([]byte(sanitizeBucketName(name))); err != nil {
+			return err
+		}
+		return txn.searchProps(p, true)
+	})
+	if err != nil {
+		return "", err
+	}
+	return trashID, nil
+}
+
+// SoftDeleteRow moves a row into root/__trash, removing its index entries and
+// one from the row count. Rows still referenced through a foreign key cannot
+// be soft deleted, since cascades could not be restored with them.
+func (t *Tree) SoftDeleteRow(tablePath, rowID string) (string, error) {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return "", err
+	}
+
+	var trashID string
+	err := t.writeTxn(func(txn *Transaction) error {
+		var err error
+		trashID, err = txn.trashRow(tablePath, rowID)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return trashID, nil
+}
+
+// trashRow copies a row into the trash and removes it from its table
+func (txn *Transaction) trashRow(tablePath, rowID string) (string, error) {
+	if b, _ := txn.bucketAt(tablePath + "/" + rowID); b == nil {
+		return "", fmt.Errorf("row not found: %s", rowID)
+	}
+
+	plan, err := txn.planDelete(tablePath, rowID)
+	if err != nil {
+		return "", err
+	}
+	if len(plan.deletes) > 0 || len(plan.nulls) > 0 {
+		return "", fmt.Errorf("%w: row %s is referenced by other rows; use DeleteRow", ErrForeignKeyViolation, rowID)
+	}
+
+	trashID, err := txn.copyToTrash(fixpath(tablePath+"/"+rowID), TrashKindRow)
+	if err != nil {
+		return "", err
+	}
+	if err := txn.removeRow(tablePath, rowID); err != nil {
+		return "", err
+	}
+	return trashID, nil
+}
+
+// copyToTrash copies the bucket at p into a new trash entry
+func (txn *Transaction) copyToTrash(p, kind string) (string, error) {
+	src, err := txn.bucketAt(p)
+	if err != nil {
+		return "", errors.New("node does not exist")
+	}
+
+	trash, err := txn.createBucketAt("root/" + TrashNode)
+	if err != nil {
+		return "", err
+	}
+	trashID := fmt.Sprintf("trash_%d", time.Now().UnixNano())
+	for n := 1; trash.Bucket([]byte(trashID)) != nil; n++ {
+		trashID = fmt.Sprintf("trash_%d_%d", time.Now().UnixNano(), n)
+	}
+
+	entry, err := trash.CreateBucket([]byte(trashID))
+	if err != nil {
+		return "", err
+	}
+	meta := map[string]string{
+		"original_path": p,
+		"kind":          kind,
+		"deleted_at":    strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	for k, v := range meta {
+		if err := entry.Put([]byte(k), []byte(v)); err != nil {
+			return "", err
+		}
+	}
+
+	content, err := entry.CreateBucket([]byte("content"))
+	if err != nil {
+		return "", err
+	}
+	if err := copyBucket(content, src); err != nil {
+		return "", fmt.Errorf("failed to copy %s to trash: %v", p, err)
+	}
+	return trashID, nil
+}
+
+// copyBucket recursively copies the properties and nested buckets of src into dst
+func copyBucket(dst, src *bbolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			child, err := dst.CreateBucketIfNotExists(bytes.Clone(k))
+			if err != nil {
+				return err
+			}
+			return copyBucket(child, src.Bucket(k))
+		}
+		return dst.Put(bytes.Clone(k), bytes.Clone(v))
+	})
+}
+
+// ListTrash returns the trash entries, most recently deleted first
+func (t *Tree) ListTrash() ([]TrashEntry, error) {
+	entries := []TrashEntry{}
+	err := t.readTxn(func(txn *Transaction) error {
+		trash, err := txn.bucketAt("root/" + TrashNode)
+		if err != nil {
+			return nil // Nothing deleted yet
+		}
+		return trash.ForEachBucket(func(k []byte) error {
+			entries = append(entries, trashEntry(string(k), trash.Bucket(k)))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].DeletedAt.Equal(entries[j].DeletedAt) {
+			return entries[i].DeletedAt.After(entries[j].DeletedAt)
+		}
+		return entries[i].ID > entries[j].ID
+	})
+	return entries, nil
+}
+
+// trashEntry reads the metadata of a trash entry bucket
+func trashEntry(id string, b *bbolt.Bucket) TrashEntry {
+	deletedAt, _ := strconv.ParseInt(string(b.Get([]byte("deleted_at"))), 10, 64)
+	return TrashEntry{
+		ID:           id,
+		OriginalPath: string(b.Get([]byte("original_path"))),
+		Kind:         string(b.Get([]byte("kind"))),
+		DeletedAt:    time.Unix(deletedAt, 0),
+	}
+}
+
+// Restore moves a trash entry back to its original path. It fails with
+// ErrPathInUse when that path has been reused since the delete. A restored
+// row gets its index entries and row count back and must still satisfy its
+// unique indexes and foreign keys.
+func (t *Tree) Restore(trashID string) error {
+	return t.writeTxn(func(txn *Transaction) error {
+		trash, err := txn.bucketAt("root/" + TrashNode)
+		if err != nil || trash.Bucket([]byte(trashID)) == nil {
+			return fmt.Errorf("trash entry not found: %s", trashID)
+		}
+		b := trash.Bucket([]byte(trashID))
+		entry := trashEntry(trashID, b)
+		content := b.Bucket([]byte("content"))
+		if content == nil {
+			return fmt.Errorf("trash entry %s has no content", trashID)
+		}
+
+		if existing, _ := txn.bucketAt(entry.OriginalPath); existing != nil {
+			return fmt.Errorf("%w: %s", ErrPathInUse, entry.OriginalPath)
+		}
+
+		if entry.Kind == TrashKindRow {
+			err = txn.restoreRow(entry.OriginalPath, content)
+		} else {
+			var dst *bbolt.Bucket
+			if dst, err = txn.createBucketAt(entry.OriginalPath); err == nil {
+				err = copyBucket(dst, content)
+			}
+			if err == nil {
+				err = txn.searchProps(entry.OriginalPath, true)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", entry.OriginalPath, err)
+		}
+
+		return trash.DeleteBucket([]byte(trashID))
+	})
+}
+
+// restoreRow writes a trashed row back with its index entries and row count.
+// The version continues from where it was, so old ETags stay stale.
+func (txn *Transaction) restoreRow(rowPath string, content *bbolt.Bucket) error {
+	tablePath, rowID := path.Split(rowPath)
+	tablePath = strings.TrimSuffix(tablePath, "/")
+	if err := txn.validateTable(tablePath); err != nil {
+		return err
+	}
+
+	fields := make(map[string]interface{})
+	content.ForEach(func(k, v []byte) error {
+		if v != nil && string(k) != VersionField {
+			fields[string(k)] = string(v)
+		}
+		return nil
+	})
+	version := bucketVersion(content)
+
+	if err := txn.checkForeignKeys(tablePath, rowID, fields); err != nil {
+		return err
+	}
+	if err := txn.putRow(tablePath, rowID, fields, true); err != nil {
+		return err
+	}
+	if err := txn.adjustRowCount(tablePath, 1); err != nil {
+		return err
+	}
+
+	b, err := txn.bucketAt(rowPath)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(VersionField), []byte(strconv.FormatInt(version+1, 10)))
+}
+
+// PurgeTrash permanently removes trash entries deleted more than olderThan
+// ago; zero purges everything. Returns the number of entries removed.
+func (t *Tree) PurgeTrash(olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	purged := 0
+	err := t.writeTxn(func(txn *Transaction) error {
+		trash, err := txn.bucketAt("root/" + TrashNode)
+		if err != nil {
+			return nil // Nothing deleted yet
+		}
+
+		var expired [][]byte
+		trash.ForEachBucket(func(k []byte) error {
+			if !trashEntry(string(k), trash.Bucket(k)).DeletedAt.After(cutoff) {
+				expired = append(expired, bytes.Clone(k))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := trash.DeleteBucket(k); err != nil {
+				return err
+			}
+			purged++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+// ============================================================================
+// Copy and Move
+// ============================================================================
+
+// CopyNode recursively copies the node at src, with its properties and nested
+// nodes, to dst in one transaction. An existing dst fails with ErrPathInUse
+// unless overwrite is set, in which case it is replaced. Copied tables keep
+// their rows, schema and indexes; their foreign keys point at the copied
+// parents when those were copied too, and references from tables outside src
+// stay with the original.
+func (t *Tree) CopyNode(src, dst string, overwrite bool) error {
+	return t.relocateNode(src, dst, overwrite, false)
+}
+
+// MoveNode moves the node at src to dst in one transaction; dst must not
+// exist. Foreign keys of moved tables are re-pointed in both directions.
+func (t *Tree) MoveNode(src, dst string) error {
+	return t.relocateNode(src, dst, false, true)
+}
+
+// relocateNode copies src to dst and, for a move, removes src
+func (t *Tree) relocateNode(src, dst string, overwrite, move bool) error {
+	src, dst = fixpath(src), fixpath(dst)
+	if src == "root" || dst == "root" {
+		return errors.New("can not copy or move the root node")
+	}
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return errors.New("can not copy or move a node into itself")
+	}
+
+	srcParent, srcName := path.Split(src)
+	dstParent, dstName := path.Split(dst)
+	srcParent, dstParent = strings.TrimSuffix(srcParent, "/"), strings.TrimSuffix(dstParent, "/")
+
+	err := t.writeTxn(func(txn *Transaction) error {
+		// Rows and table internals only change through the table
+		if txn.validateTable(srcParent) == nil || txn.validateTable(dstParent) == nil {
+			return errors.New("rows can not be copied or moved as nodes")
+		}
+
+		srcBucket, err := txn.bucketAt(src)
+		if err != nil {
+			return errors.New("node does not exist")
+		}
+
+		var replaced int64
+		if existing, _ := txn.bucketAt(dst); existing != nil {
+			if !overwrite {
+				return fmt.Errorf("%w: %s", ErrPathInUse, dst)
+			}
+			replaced = bucketVersion(existing)
+			if err := txn.detachTables(dst); err != nil {
+				return err
+			}
+			parent, _ := txn.bucketAt(dstParent)
+			if err := parent.DeleteBucket([]byte(sanitizeBucketName(dstName))); err != nil {
+				return err
+			}
+		}
+
+		dstBucket, err := txn.createBucketAt(dst)
+		if err != nil {
+			return err
+		}
+		if err := copyBucket(dstBucket, srcBucket); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", src, err)
+		}
+		if string(dstBucket.Get([]byte("__type"))) == TypeTable {
+			if err := dstBucket.Put([]byte("__name"), []byte(dstName)); err != nil {
+				return err
+			}
+		}
+
+		// A replaced node moves past its old version so If-Match on it fails
+		if replaced > 0 {
+			version := max(replaced, bucketVersion(dstBucket)) + 1
+			if err := dstBucket.Put([]byte(VersionField), []byte(strconv.FormatInt(version, 10))); err != nil {
+				return err
+			}
+		}
+
+		if err := txn.repointForeignKeys(src, dst, move); err != nil {
+			return err
+		}
+
+		if move {
+			parent, _ := txn.bucketAt(srcParent)
+			if err := parent.DeleteBucket([]byte(sanitizeBucketName(srcName))); err != nil {
+				return err
+			}
+			if err := txn.searchProps(src, true); err != nil {
+				return err
+			}
+		}
+		return txn.searchProps(dst, true)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Databases that gained or lost a table recount them
+	for _, parent := range []string{srcParent, dstParent} {
+		if isDB, _ := t.IsDatabase(parent); isDB {
+			t.updateDatabaseTableCount(parent)
+		}
+	}
+	return nil
+}
+
+// tablesUnder lists the tables at or below p
+func (txn *Transaction) tablesUnder(p string) []string {
+	var tables []string
+	var walk func(p string, b *bbolt.Bucket)
+	walk = func(p string, b *bbolt.Bucket) {
+		if string(b.Get([]byte("__type"))) == TypeTable {
+			tables = append(tables, p)
+			return // Tables hold rows, not other tables
+		}
+		b.ForEachBucket(func(k []byte) error {
+			walk(p+"/"+string(k), b.Bucket(k))
+			return nil
+		})
+	}
+	if b, err := txn.bucketAt(p); err == nil {
+		walk(p, b)
+	}
+	return tables
+}
+
+// within reports whether p is prefix or below it
+func within(p, prefix string) bool {
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// detachTables unregisters the foreign keys of the tables under p before p
+// is overwritten. Tables referenced from outside p can not be overwritten.
+func (txn *Transaction) detachTables(p string) error {
+	for _, table := range txn.tablesUnder(p) {
+		refs, err := txn.foreignKeys(table, ReferencedByNode)
+		if err != nil {
+			return err
+		}
+		for _, fk := range refs {
+			if !within(fk.ChildTable, p) {
+				return fmt.Errorf("%w: %s is referenced by %s", ErrForeignKeyViolation, table, fk.ChildTable)
+			}
+		}
+
+		fks, err := txn.foreignKeys(table, ForeignKeysNode)
+		if err != nil {
+			return err
+		}
+		for _, fk := range fks {
+			if within(fk.ParentTable, p) {
+				continue
+			}
+			if refs, err := txn.bucketAt(fk.ParentTable + "/" + ReferencedByNode); err == nil {
+				if err := refs.Delete([]byte(fk.referenceKey())); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// repointForeignKeys rewrites the foreign keys of the tables copied or moved
+// from src to dst. A copy leaves references to the original alone; a move
+// also re-points tables outside src that reference the moved tables.
+func (txn *Transaction) repointForeignKeys(src, dst string, move bool) error {
+	relocate := func(p string) string {
+		if within(p, src) {
+			return dst + strings.TrimPrefix(p, src)
+		}
+		return p
+	}
+
+	// Reference entries are rebuilt from the child side below
+	var external []ForeignKey
+	for _, table := range txn.tablesUnder(dst) {
+		refs, err := txn.foreignKeys(table, ReferencedByNode)
+		if err != nil {
+			return err
+		}
+		for _, fk := range refs {
+			if !within(fk.ChildTable, src) {
+				external = append(external, fk)
+			}
+		}
+		if b, err := txn.bucketAt(table); err == nil && b.Bucket([]byte(ReferencedByNode)) != nil {
+			if err := b.DeleteBucket([]byte(ReferencedByNode)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Children outside src follow a moved parent
+	if move {
+		for _, fk := range external {
+			fk.ParentTable = relocate(fk.ParentTable)
+			if err := txn.putForeignKey(fk); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, table := range txn.tablesUnder(dst) {
+		fks, err := txn.foreignKeys(table, ForeignKeysNode)
+		if err != nil {
+			return err
+		}
+		for _, fk := range fks {
+			if move && !within(fk.ParentTable, src) {
+				// The outside parent drops the entry for the old child path
+				if refs, err := txn.bucketAt(fk.ParentTable + "/" + ReferencedByNode); err == nil {
+					if err := refs.Delete([]byte(fk.referenceKey())); err != nil {
+						return err
+					}
+				}
+			}
+			fk.ChildTable = table
+			fk.ParentTable = relocate(fk.ParentTable)
+			if err := txn.putForeignKey(fk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putForeignKey stores a foreign key on its child and mirrors it on its parent
+func (txn *Transaction) putForeignKey(fk ForeignKey) error {
+	fkJSON, err := json.Marshal(fk)
+	if err != nil {
+		return err
+	}
+
+	fks, err := txn.createBucketAt(fk.ChildTable + "/" + ForeignKeysNode)
+	if err != nil {
+		return err
+	}
+	if err := fks.Put([]byte(fk.Field), fkJSON); err != nil {
+		return err
+	}
+
+	refs, err := txn.createBucketAt(fk.ParentTable + "/" + ReferencedByNode)
+	if err != nil {
+		return err
+	}
+	return refs.Put([]byte(fk.referenceKey()), fkJSON)
+}
+
+// ============================================================================
+// Schema Migrations
+// ============================================================================
+
+// MigrationsNode holds the applied migration records of a table
+const MigrationsNode = "__migrations"
+
+// MigrationStepType identifies a row rewrite performed by a migration step
+type MigrationStepType string
+
+const (
+	StepRenameField MigrationStepType = "rename_field" // Field -> To
+	StepDropField   MigrationStepType = "drop_field"   // remove Field
+	StepChangeType  MigrationStepType = "change_type"  // convert Field to type To
+	StepSplitField  MigrationStepType = "split_field"  // split Field on Separator into Into
+	StepBackfill    MigrationStepType = "backfill"     // set Field from Expr
+)
+
+// MigrationStep is one row rewrite. Convert overrides the built-in cast of a
+// change-type step and Reverse undoes it; a backfill only fills missing or
+// null values unless Overwrite is set. Convert, Reverse and backfill
+// functions run inside the batch transaction and must not write to the tree.
+type MigrationStep struct {
+	Type      MigrationStepType
+	Field     string
+	To        string
+	Into      []string
+	Separator string
+	Expr      string
+	Vars      map[string]interface{} // values for $variables in Expr
+	Overwrite bool
+	Convert   func(value interface{}) (interface{}, error)
+	Reverse   func(value interface{}) (interface{}, error)
+
+	expr *parser.ConditionTerm
+}
+
+// Migration is a versioned list of steps applied to every row of a table
+type Migration struct {
+	Version int
+	Name    string
+	Steps   []MigrationStep
+}
+
+// MigrationOptions controls how a migration is run
+type MigrationOptions struct {
+	BatchSize int  // rows per transaction (default 500)
+	DryRun    bool // only count the rows that would change
+}
+
+// MigrationResult reports what a migration did (or would do)
+type MigrationResult struct {
+	Version        int      `json:"version"`
+	Name           string   `json:"name"`
+	DryRun         bool     `json:"dry_run"`
+	RowsScanned    int      `json:"rows_scanned"`
+	RowsAffected   int      `json:"rows_affected"`
+	Batches        int      `json:"batches"`
+	IndexesRebuilt []string `json:"indexes_rebuilt,omitempty"`
+	IndexesDropped []string `json:"indexes_dropped,omitempty"`
+}
+
+// AppliedMigration is the record kept in the table's __migrations node
+type AppliedMigration struct {
+	Version        int               `json:"version"`
+	Name           string            `json:"name"`
+	AppliedAt      string            `json:"applied_at"`
+	RowsAffected   int               `json:"rows_affected"`
+	PreviousFields map[string]string `json:"previous_fields,omitempty"` // schema before the migration
+}
+
+// migrationProgressKey is the table prop that records how far a migration
+// got, so an interrupted run resumes after its last committed batch
+const migrationProgressKey = "__migration_progress"
+
+// migrationProgress is written with every batch and removed once the
+// migration is recorded
+type migrationProgress struct {
+	Version      int    `json:"version"`
+	Rollback     bool   `json:"rollback,omitempty"`
+	LastRow      string `json:"last_row"`
+	RowsScanned  int    `json:"rows_scanned"`
+	RowsAffected int    `json:"rows_affected"`
+	Batches      int    `json:"batches"`
+}
+
+// rowMigrator applies prepared migration steps to the rows of a table
+type rowMigrator struct {
+	tablePath string
+	steps     []MigrationStep
+	schema    *TableSchema
+	functions map[string]models.MethodFunc
+}
+
+// RunMigration applies a migration to every row of a table. The rows are
+// streamed through the steps once without writing, so a failing step aborts
+// before anything changes; they are then rewritten in batched transactions
+// that each record their progress, so re-running an interrupted migration
+// resumes where it stopped. Affected indexes are rebuilt and the schema update
+// and migration record are committed together.
+func (t *Tree) RunMigration(tablePath string, m Migration, opts *MigrationOptions) (*MigrationResult, error) {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &MigrationOptions{}
+	}
+
+	applied, err := t.AppliedMigrations(tablePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) > 0 && m.Version <= applied[len(applied)-1].Version {
+		return nil, fmt.Errorf("migration version %d is not newer than applied version %d",
+			m.Version, applied[len(applied)-1].Version)
+	}
+	if m.Version <= 0 {
+		return nil, errors.New("migration version must be positive")
+	}
+
+	schema, err := t.GetTableSchema(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := t.migrateRows(tablePath, m, schema, opts, false)
+	if err != nil || opts.DryRun {
+		return result, err
+	}
+
+	record := AppliedMigration{
+		Version:      m.Version,
+		Name:         m.Name,
+		AppliedAt:    strconv.FormatInt(time.Now().Unix(), 10),
+		RowsAffected: result.RowsAffected,
+	}
+	if schema != nil {
+		record.PreviousFields = schema.Fields
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return result, err
+	}
+
+	err = t.writeTxn(func(txn *Transaction) error {
+		if schema != nil {
+			if err := txn.saveSchema(tablePath, migrateSchema(schema, m.Steps, nil)); err != nil {
+				return fmt.Errorf("failed to update schema: %v", err)
+			}
+		}
+
+		records, err := txn.createBucketAt(tablePath + "/" + MigrationsNode)
+		if err != nil {
+			return err
+		}
+		if err := records.Put([]byte(migrationKey(m.Version)), recordJSON); err != nil {
+			return fmt.Errorf("failed to record migration: %v", err)
+		}
+		return txn.finishMigration(tablePath, m.Version)
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// RollbackMigration undoes the most recently applied migration, which must be
+// m. Renames, splits and change-type steps are reversible; drops and backfills
+// are not.
+func (t *Tree) RollbackMigration(tablePath string, m Migration, opts *MigrationOptions) (*MigrationResult, error) {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &MigrationOptions{}
+	}
+
+	applied, err := t.AppliedMigrations(tablePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(applied) == 0 || applied[len(applied)-1].Version != m.Version {
+		return nil, fmt.Errorf("migration %d is not the latest applied migration", m.Version)
+	}
+	record := applied[len(applied)-1]
+
+	// Inverse steps in reverse order
+	reverse := Migration{Version: m.Version, Name: m.Name}
+	for i := len(m.Steps) - 1; i >= 0; i-- {
+		steps, err := m.Steps[i].inverse(record.PreviousFields)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %v", i, err)
+		}
+		reverse.Steps = append(reverse.Steps, steps...)
+	}
+
+	schema, err := t.GetTableSchema(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := t.migrateRows(tablePath, reverse, schema, opts, true)
+	if err != nil || opts.DryRun {
+		return result, err
+	}
+
+	previous := 0
+	if len(applied) > 1 {
+		previous = applied[len(applied)-2].Version
+	}
+	err = t.writeTxn(func(txn *Transaction) error {
+		if schema != nil && record.PreviousFields != nil {
+			if err := txn.saveSchema(tablePath, migrateSchema(schema, nil, record.PreviousFields)); err != nil {
+				return fmt.Errorf("failed to update schema: %v", err)
+			}
+		}
+
+		records, err := txn.bucketAt(tablePath + "/" + MigrationsNode)
+		if err != nil {
+			return err
+		}
+		if err := records.Delete([]byte(migrationKey(m.Version))); err != nil {
+			return fmt.Errorf("failed to remove migration record: %v", err)
+		}
+		return txn.finishMigration(tablePath, previous)
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// AppliedMigrations returns the migrations recorded on a table, oldest first
+func (t *Tree) AppliedMigrations(tablePath string) ([]AppliedMigration, error) {
+	props, err := t.rawProps(tablePath + "/" + MigrationsNode)
+	if err != nil {
+		return []AppliedMigration{}, nil // No migrations yet
+	}
+
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	applied := make([]AppliedMigration, 0, len(keys))
+	for _, key := range keys {
+		var record AppliedMigration
+		if err := json.Unmarshal([]byte(props[key]), &record); err != nil {
+			return nil, fmt.Errorf("failed to parse migration %s: %v", key, err)
+		}
+		applied = append(applied, record)
+	}
+	return applied, nil
+}
+
+// migrationKey zero-pads versions so records sort in order
+func migrationKey(version int) string {
+	return fmt.Sprintf("%010d", version)
+}
+
+// migrateRows validates the steps against every row without writing, then
+// rewrites the rows in batches and rebuilds the indexes touched by the steps.
+// Each batch commits its rows together with the progress record, so a run
+// that failed midway continues after the last committed batch.
+func (t *Tree) migrateRows(tablePath string, m Migration, schema *TableSchema, opts *MigrationOptions, rollback bool) (*MigrationResult, error) {
+	steps := make([]MigrationStep, len(m.Steps))
+	for i, step := range m.Steps {
+		if err := step.prepare(); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i, err)
+		}
+		steps[i] = step
+	}
+
+	progress, err := t.migrationProgress(tablePath)
+	if err != nil {
+		return nil, err
+	}
+	if progress == nil {
+		progress = &migrationProgress{Version: m.Version, Rollback: rollback}
+	} else if progress.Version != m.Version || progress.Rollback != rollback {
+		return nil, fmt.Errorf("migration %d was interrupted and must be finished first", progress.Version)
+	}
+
+	result := &MigrationResult{Version: m.Version, Name: m.Name, DryRun: opts.DryRun}
+	migrator := &rowMigrator{tablePath: tablePath, steps: steps, schema: schema, functions: t.queryFunctions()}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	// Validation pass; rows already migrated by an interrupted run are skipped
+	result.RowsScanned, result.RowsAffected = progress.RowsScanned, progress.RowsAffected
+	for after := progress.LastRow; ; {
+		var scanned, affected int
+		err := t.readTxn(func(txn *Transaction) error {
+			var err error
+			after, scanned, affected, err = migrator.batch(txn, after, batchSize, false)
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		if scanned == 0 {
+			break
+		}
+		result.RowsScanned += scanned
+		result.RowsAffected += affected
+	}
+
+	if opts.DryRun {
+		return result, nil
+	}
+
+	for {
+		next := *progress
+		err := t.writeTxn(func(txn *Transaction) error {
+			last, scanned, affected, err := migrator.batch(txn, next.LastRow, batchSize, true)
+			if err != nil || scanned == 0 {
+				return err
+			}
+			next.LastRow = last
+			next.RowsScanned += scanned
+			next.RowsAffected += affected
+			next.Batches++
+			return txn.putMigrationProgress(tablePath, &next)
+		})
+		if err != nil {
+			return result, fmt.Errorf("batch %d: %v", progress.Batches, err)
+		}
+		if next.LastRow == progress.LastRow {
+			break
+		}
+		progress = &next
+	}
+	result.RowsScanned, result.RowsAffected, result.Batches = progress.RowsScanned, progress.RowsAffected, progress.Batches
+
+	if result.RowsAffected > 0 {
+		if err := t.rebuildMigratedIndexes(tablePath, steps, result); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// batch applies the steps to up to limit rows after the row ID after and,
+// when write is set, stores the changed ones. It returns the last row ID
+// visited with the number of rows scanned and changed.
+func (mr *rowMigrator) batch(txn *Transaction, after string, limit int, write bool) (string, int, int, error) {
+	rowIDs, err := txn.rowIDsAfter(mr.tablePath, after, limit)
+	if err != nil {
+		return after, 0, 0, err
+	}
+
+	affected := 0
+	for _, rowID := range rowIDs {
+		row, err := txn.readRow(mr.tablePath, rowID, mr.schema, nil)
+		if err != nil {
+			return after, 0, 0, err
+		}
+
+		changed := false
+		for i := range mr.steps {
+			stepChanged, err := mr.steps[i].apply(row, mr.schema, mr.functions)
+			if err != nil {
+				return after, 0, 0, fmt.Errorf("row %s, step %d: %v", rowID, i, err)
+			}
+			changed = changed || stepChanged
+		}
+		if !changed {
+			continue
+		}
+		affected++
+		if write {
+			if err := txn.rewriteRow(mr.tablePath, rowID, row); err != nil {
+				return after, 0, 0, err
+			}
+		}
+	}
+
+	if len(rowIDs) > 0 {
+		after = rowIDs[len(rowIDs)-1]
+	}
+	return after, len(rowIDs), affected, nil
+}
+
+// rowIDsAfter lists up to limit row IDs that sort after the given one
+func (txn *Transaction) rowIDsAfter(tablePath, after string, limit int) ([]string, error) {
+	table, err := txn.bucketAt(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	c := table.Cursor()
+	k, v := c.First()
+	if after != "" {
+		k, v = c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+	}
+	for ; k != nil && len(ids) < limit; k, v = c.Next() {
+		if v == nil && !txn.tree.isSpecialNode(string(k)) {
+			ids = append(ids, string(k))
+		}
+	}
+	return ids, nil
+}
+
+// rewriteRow replaces the fields of a row with the migrated ones
+func (txn *Transaction) rewriteRow(tablePath, rowID string, row models.Row) error {
+	b, err := txn.bucketAt(tablePath + "/" + rowID)
+	if err != nil {
+		return fmt.Errorf("row not found: %s", rowID)
+	}
+
+	var stale [][]byte
+	b.ForEach(func(k, v []byte) error {
+		if v != nil && !txn.tree.isSpecialNode(string(k)) {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, k := range stale {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	for field, val := range row {
+		if val == nil || val.IsNull() || txn.tree.isSpecialNode(field) {
+			continue
+		}
+		if err := b.Put([]byte(field), []byte(fmt.Sprintf("%v", val.Val()))); err != nil {
+			return fmt.Errorf("failed to save field %s: %v", field, err)
+		}
+	}
+	return txn.searchRow(tablePath, rowID, row)
+}
+
+// migrationProgress returns the progress of an interrupted migration, or nil
+func (t *Tree) migrationProgress(tablePath string) (*migrationProgress, error) {
+	var progress *migrationProgress
+	err := t.readTxn(func(txn *Transaction) error {
+		table, err := txn.bucketAt(tablePath)
+		if err != nil {
+			return err
+		}
+		data := table.Get([]byte(migrationProgressKey))
+		if data == nil {
+			return nil
+		}
+		progress = &migrationProgress{}
+		if err := json.Unmarshal(data, progress); err != nil {
+			return fmt.Errorf("failed to parse migration progress: %v", err)
+		}
+		return nil
+	})
+	return progress, err
+}
+
+// putMigrationProgress records the progress of a running migration
+func (txn *Transaction) putMigrationProgress(tablePath string, progress *migrationProgress) error {
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	table, err := txn.bucketAt(tablePath)
+	if err != nil {
+		return err
+	}
+	return table.Put([]byte(migrationProgressKey), data)
+}
+
+// finishMigration sets the table's migration version and clears the progress
+func (txn *Transaction) finishMigration(tablePath string, version int) error {
+	table, err := txn.bucketAt(tablePath)
+	if err != nil {
+		return err
+	}
+	if err := table.Put([]byte("__migration_version"), []byte(strconv.Itoa(version))); err != nil {
+		return err
+	}
+	return table.Delete([]byte(migrationProgressKey))
+}
+
+// rebuildMigratedIndexes re-points indexes at renamed fields, drops indexes on
+// removed fields and rebuilds every index over a touched field
+func (t *Tree) rebuildMigratedIndexes(tablePath string, steps []MigrationStep, result *MigrationResult) error {
+	indexes, err := t.ListIndexes(tablePath)
+	if err != nil {
+		return err
+	}
+
+	for _, indexName := range indexes {
+		info, err := t.GetIndexInfo(tablePath, indexName)
+		if err != nil {
+			continue
+		}
+
+		fields := append([]string(nil), info.Fields...)
+		touched, dropped := false, false
+		for _, step := range steps {
+			for i, field := range fields {
+				switch {
+				case field == step.Field:
+					touched = true
+					if step.Type == StepRenameField {
+						fields[i] = step.To
+					} else if step.Type == StepDropField || step.Type == StepSplitField {
+						dropped = true
+					}
+				case step.Type == StepSplitField && slices.Contains(step.Into, field):
+					touched = true
+				}
+			}
+		}
+		if !touched {
+			continue
+		}
+
+		if err := t.DropIndex(tablePath, indexName); err != nil {
+			return fmt.Errorf("failed to drop index %s: %v", indexName, err)
+		}
+		if dropped {
+			result.IndexesDropped = append(result.IndexesDropped, indexName)
+			continue
+		}
+		if err := t.CreateIndex(tablePath, indexName, fields, info.Unique); err != nil {
+			return fmt.Errorf("failed to rebuild index %s: %v", indexName, err)
+		}
+		result.IndexesRebuilt = append(result.IndexesRebuilt, indexName)
+	}
+
+	return nil
+}
+
+// migrateSchema applies the steps to a copy of the schema, or restores
+// previous fields when rolling back
+func migrateSchema(schema *TableSchema, steps []MigrationStep, previous map[string]string) *TableSchema {
+	migrated := *schema
+	migrated.Version++
+	migrated.LastUpdated = strconv.FormatInt(time.Now().Unix(), 10)
+	migrated.Fields = make(map[string]string, len(schema.Fields))
+	migrated.Constraints = make(map[string]FieldConstraint, len(schema.Constraints))
+
+	if previous != nil {
+		for k, v := range previous {
+			migrated.Fields[k] = v
+		}
+	} else {
+		for k, v := range schema.Fields {
+			migrated.Fields[k] = v
+		}
+	}
+	for k, v := range schema.Constraints {
+		migrated.Constraints[k] = v
+	}
+
+	for _, step := range steps {
+		switch step.Type {
+		case StepRenameField:
+			if typ, ok := migrated.Fields[step.Field]; ok {
+				migrated.Fields[step.To] = typ
+				delete(migrated.Fields, step.Field)
+			}
+			if c, ok := migrated.Constraints[step.Field]; ok {
+				migrated.Constraints[step.To] = c
+				delete(migrated.Constraints, step.Field)
+			}
+		case StepDropField:
+			delete(migrated.Fields, step.Field)
+			delete(migrated.Constraints, step.Field)
+		case StepChangeType:
+			migrated.Fields[step.Field] = step.To
+		case StepSplitField:
+			delete(migrated.Fields, step.Field)
+			delete(migrated.Constraints, step.Field)
+			for _, into := range step.Into {
+				if _, ok := migrated.Fields[into]; !ok {
+					migrated.Fields[into] = "string"
+				}
+			}
+		case StepBackfill:
+			if _, ok := migrated.Fields[step.Field]; !ok {
+				migrated.Fields[step.Field] = "string"
+			}
+		}
+	}
+
+	for field := range migrated.Constraints {
+		if _, ok := migrated.Fields[field]; !ok {
+			delete(migrated.Constraints, field)
+		}
+	}
+	migrated.FlatFields = make([]string, 0, len(migrated.Fields))
+	for field := range migrated.Fields {
+		migrated.FlatFields = append(migrated.FlatFields, field)
+	}
+	sort.Strings(migrated.FlatFields)
+
+	return &migrated
+}
+
+// prepare validates the step parameters and parses backfill expressions
+func (s *MigrationStep) prepare() error {
+	if s.Field == "" {
+		return fmt.Errorf("%s requires a field", s.Type)
+	}
+
+	switch s.Type {
+	case StepRenameField:
+		if s.To == "" || s.To == s.Field {
+			return errors.New("rename_field requires a new field name")
+		}
+	case StepDropField:
+	case StepChangeType:
+		if s.To == "" {
+			return errors.New("change_type requires a target type")
+		}
+	case StepSplitField:
+		if s.Separator == "" || len(s.Into) == 0 {
+			return errors.New("split_field requires a separator and target fields")
+		}
+	case StepBackfill:
+		term, err := parser.ParseValue(s.Expr)
+		if err != nil {
+			return fmt.Errorf("invalid backfill expression: %w", err)
+		}
+		s.expr = term
+	default:
+		return fmt.Errorf("unknown migration step: %s", s.Type)
+	}
+	return nil
+}
+
+// apply rewrites a row in place and reports whether it changed
+func (s *MigrationStep) apply(row models.Row, schema *TableSchema, functions map[string]models.MethodFunc) (bool, error) {
+	val, present := row[s.Field]
+	hasValue := present && val != nil && !val.IsNull()
+
+	switch s.Type {
+	case StepRenameField:
+		if !present {
+			return false, nil
+		}
+		if _, exists := row[s.To]; exists {
+			return false, fmt.Errorf("field %s already exists", s.To)
+		}
+		row[s.To] = val
+		delete(row, s.Field)
+		return true, nil
+
+	case StepDropField:
+		delete(row, s.Field)
+		return present, nil
+
+	case StepChangeType:
+		if !hasValue {
+			return false, nil
+		}
+		converted, err := convertMigrationValue(val, s.To, s.Convert)
+		if err != nil {
+			return false, fmt.Errorf("cannot convert %s: %v", s.Field, err)
+		}
+		row[s.Field] = models.NewValueWithSchema(converted, s.To)
+		return fmt.Sprintf("%v", converted) != fmt.Sprintf("%v", val.Val()), nil
+
+	case StepSplitField:
+		if !hasValue {
+			return false, nil
+		}
+		parts := strings.SplitN(fmt.Sprintf("%v", val.Val()), s.Separator, len(s.Into))
+		delete(row, s.Field)
+		for i, into := range s.Into {
+			if i < len(parts) {
+				row[into] = models.NewValue(parts[i])
+			}
+		}
+		return true, nil
+
+	case StepBackfill:
+		if hasValue && !s.Overwrite {
+			return false, nil
+		}
+		var schemaFields models.Schema
+		if schema != nil {
+			schemaFields = schema.Fields
+		}
+		obj := models.NewObjectWithContext(row, schemaFields, functions, s.Vars)
+		result, err := obj.Evaluate(s.expr)
+		if err != nil {
+			return false, err
+		}
+		if result == nil {
+			return false, nil
+		}
+		if hasValue && fmt.Sprintf("%v", result) == fmt.Sprintf("%v", val.Val()) {
+			return false, nil
+		}
+		row[s.Field] = models.NewValue(result)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// inverse returns the steps that undo s, given the schema fields before it ran
+func (s MigrationStep) inverse(previousFields map[string]string) ([]MigrationStep, error) {
+	switch s.Type {
+	case StepRenameField:
+		return []MigrationStep{{Type: StepRenameField, Field: s.To, To: s.Field}}, nil
+	case StepChangeType:
+		previousType := previousFields[s.Field]
+		if previousType == "" {
+			previousType = "string"
+		}
+		return []MigrationStep{{Type: StepChangeType, Field: s.Field, To: previousType, Convert: s.Reverse}}, nil
+	case StepSplitField:
+		steps := []MigrationStep{{
+			Type:  StepBackfill,
+			Field: s.Field,
+			Expr:  joinFieldsExpr(s.Into),
+			Vars:  map[string]interface{}{"separator": s.Separator},
+		}}
+		for _, into := range s.Into {
+			steps = append(steps, MigrationStep{Type: StepDropField, Field: into})
 		}
+		return steps, nil
 	}
+	return nil, fmt.Errorf("%s is not reversible", s.Type)
+}
 
-	return b, nil
+// joinFieldsExpr builds "concat_ws($separator, a, b)", skipping missing parts;
+// the separator is passed as a variable so any character is safe
+func joinFieldsExpr(fields []string) string {
+	return "concat_ws($separator, " + strings.Join(fields, ", ") + ")"
 }
 
-// rowToMap converts a models.Row to a map[string]interface{}
-func rowToMap(row models.Row) map[string]interface{} {
-	result := make(map[string]interface{})
-	for k, v := range row {
-		if v != nil {
-			result[k] = v.Val()
+// convertMigrationValue converts a value with fn, or casts it to typ
+func convertMigrationValue(val *models.RowValue, typ string, fn func(interface{}) (interface{}, error)) (interface{}, error) {
+	if fn != nil {
+		return fn(val.Val())
+	}
+
+	raw := models.NewValue(fmt.Sprintf("%v", val.Val()))
+	switch typ {
+	case "int", "int64", "integer":
+		if f, err := raw.AsFloat64(); err == nil && f == float64(int64(f)) {
+			return int64(f), nil
 		}
+		return raw.AsInt64()
+	case "float", "float64", "double":
+		return raw.AsFloat64()
+	case "bool", "boolean":
+		return raw.AsBool()
+	case "string", "text":
+		return raw.AsString(), nil
 	}
-	return result
+	return nil, fmt.Errorf("unsupported type %s", typ)
 }
 
 // ============================================================================
@@ -2763,32 +5449,24 @@ func rowToMap(row models.Row) map[string]interface{} {
 // ============================================================================
 
 // Upsert inserts a new row or updates an existing row if it already exists.
-// Returns (rowID, wasInserted, error) where wasInserted is true for insert, false for update.
+// Returns (wasInserted, error) where wasInserted is true for insert, false for update.
 func (t *Tree) Upsert(tablePath, rowID string, row models.Row) (bool, error) {
-	// Check if row exists
-	exists, err := t.RowExists(tablePath, rowID)
-	if err != nil {
-		return false, fmt.Errorf("failed to check row existence: %v", err)
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return false, err
 	}
 
-	if exists {
-		// Update existing row
-		err = t.UpdateRow(tablePath, rowID, row)
-		if err != nil {
-			return false, fmt.Errorf("failed to update row: %v", err)
-		}
-		return false, nil // Was updated
-	} else {
-		// Insert new row
-		err = t.InsertRowWithID(tablePath, rowID, row)
-		if err != nil {
-			return false, fmt.Errorf("failed to insert row: %v", err)
-		}
-		return true, nil // Was inserted
-	}
+	// The existence check and the write commit together
+	var inserted bool
+	err := t.writeTxn(func(txn *Transaction) error {
+		var err error
+		inserted, err = txn.upsertRow(tablePath, rowID, row, false)
+		return err
+	})
+	return inserted, err
 }
 
-// UpsertMany performs upsert operations on multiple rows.
+// UpsertMany performs upsert operations on multiple rows in one transaction,
+// so either every row is written or none is.
 // Returns (insertCount, updateCount, error)
 func (t *Tree) UpsertMany(tablePath string, rows map[string]models.Row) (int, int, error) {
 	if err := t.ValidateTablePath(tablePath); err != nil {
@@ -2798,17 +5476,23 @@ func (t *Tree) UpsertMany(tablePath string, rows map[string]models.Row) (int, in
 	insertCount := 0
 	updateCount := 0
 
-	for rowID, row := range rows {
-		wasInserted, err := t.Upsert(tablePath, rowID, row)
-		if err != nil {
-			return insertCount, updateCount, fmt.Errorf("upsert failed for row %s: %v", rowID, err)
-		}
+	err := t.writeTxn(func(txn *Transaction) error {
+		for rowID, row := range rows {
+			wasInserted, err := txn.upsertRow(tablePath, rowID, row, false)
+			if err != nil {
+				return fmt.Errorf("upsert failed for row %s: %w", rowID, err)
+			}
 
-		if wasInserted {
-			insertCount++
-		} else {
-			updateCount++
+			if wasInserted {
+				insertCount++
+			} else {
+				updateCount++
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
 	}
 
 	return insertCount, updateCount, nil
@@ -2817,31 +5501,22 @@ func (t *Tree) UpsertMany(tablePath string, rows map[string]models.Row) (int, in
 // UpsertFields inserts a new row or updates specific fields if row exists.
 // Returns (wasInserted, error)
 func (t *Tree) UpsertFields(tablePath, rowID string, fields map[string]interface{}) (bool, error) {
-	// Check if row exists
-	exists, err := t.RowExists(tablePath, rowID)
-	if err != nil {
-		return false, fmt.Errorf("failed to check row existence: %v", err)
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return false, err
 	}
 
-	if exists {
-		// Update existing row fields
-		err = t.UpdateRowFields(tablePath, rowID, fields)
-		if err != nil {
-			return false, fmt.Errorf("failed to update fields: %v", err)
-		}
-		return false, nil // Was updated
-	} else {
-		// Insert new row with these fields
-		row := make(models.Row)
-		for k, v := range fields {
-			row[k] = models.NewValue(v)
-		}
-		err = t.InsertRowWithID(tablePath, rowID, row)
-		if err != nil {
-			return false, fmt.Errorf("failed to insert row: %v", err)
-		}
-		return true, nil // Was inserted
+	row := make(models.Row)
+	for k, v := range fields {
+		row[k] = models.NewValue(v)
 	}
+
+	var inserted bool
+	err := t.writeTxn(func(txn *Transaction) error {
+		var err error
+		inserted, err = txn.upsertRow(tablePath, rowID, row, true)
+		return err
+	})
+	return inserted, err
 }
 
 // ============================================================================
@@ -2871,7 +5546,7 @@ func (t *Tree) BulkInsert(tablePath string, rows map[string]models.Row) (int, er
 	for rowID, row := range rows {
 		err := txn.InsertRowWithID(tablePath, rowID, row)
 		if err != nil {
-			return successCount, fmt.Errorf("bulk insert failed at row %s: %v", rowID, err)
+			return successCount, fmt.Errorf("bulk insert failed at row %s: %w", rowID, err)
 		}
 		successCount++
 	}
@@ -2907,7 +5582,7 @@ func (t *Tree) BulkUpdate(tablePath string, updates map[string]models.Row) (int,
 	for rowID, row := range updates {
 		err := txn.UpdateRow(tablePath, rowID, row)
 		if err != nil {
-			return successCount, fmt.Errorf("bulk update failed at row %s: %v", rowID, err)
+			return successCount, fmt.Errorf("bulk update failed at row %s: %w", rowID, err)
 		}
 		successCount++
 	}
@@ -2943,7 +5618,7 @@ func (t *Tree) BulkUpdateFields(tablePath string, updates map[string]map[string]
 	for rowID, fields := range updates {
 		err := txn.UpdateRowFields(tablePath, rowID, fields)
 		if err != nil {
-			return successCount, fmt.Errorf("bulk update fields failed at row %s: %v", rowID, err)
+			return successCount, fmt.Errorf("bulk update fields failed at row %s: %w", rowID, err)
 		}
 		successCount++
 	}
@@ -2979,7 +5654,7 @@ func (t *Tree) BulkDelete(tablePath string, rowIDs []string) (int, error) {
 	for _, rowID := range rowIDs {
 		err := txn.DeleteRow(tablePath, rowID)
 		if err != nil {
-			return successCount, fmt.Errorf("bulk delete failed at row %s: %v", rowID, err)
+			return successCount, fmt.Errorf("bulk delete failed at row %s: %w", rowID, err)
 		}
 		successCount++
 	}
@@ -3007,13 +5682,6 @@ func (t *Tree) BulkUpsert(tablePath string, rows map[string]models.Row) (int, in
 	insertCount := 0
 	updateCount := 0
 
-	// Check which rows exist (batch check for efficiency)
-	existingRows := make(map[string]bool)
-	for rowID := range rows {
-		exists, _ := t.RowExists(tablePath, rowID)
-		existingRows[rowID] = exists
-	}
-
 	// Use a transaction for atomicity
 	txn, err := t.BeginTransaction()
 	if err != nil {
@@ -3021,21 +5689,20 @@ func (t *Tree) BulkUpsert(tablePath string, rows map[string]models.Row) (int, in
 	}
 	defer txn.Rollback()
 
+	if err := txn.validateTable(tablePath); err != nil {
+		return 0, 0, err
+	}
+
+	// Existence is checked inside the transaction, so no writer slips in between
 	for rowID, row := range rows {
-		if existingRows[rowID] {
-			// Update existing row
-			err := txn.UpdateRow(tablePath, rowID, row)
-			if err != nil {
-				return insertCount, updateCount, fmt.Errorf("bulk upsert failed at row %s: %v", rowID, err)
-			}
-			updateCount++
-		} else {
-			// Insert new row
-			err := txn.InsertRowWithID(tablePath, rowID, row)
-			if err != nil {
-				return insertCount, updateCount, fmt.Errorf("bulk upsert failed at row %s: %v", rowID, err)
-			}
+		wasInserted, err := txn.upsertRow(tablePath, rowID, row, false)
+		if err != nil {
+			return insertCount, updateCount, fmt.Errorf("bulk upsert failed at row %s: %w", rowID, err)
+		}
+		if wasInserted {
 			insertCount++
+		} else {
+			updateCount++
 		}
 	}
 
@@ -3325,39 +5992,154 @@ func (t *Tree) CountDistinct(tablePath, fieldName string) (int, error) {
 // Field-Level Atomic Operations
 // ============================================================================
 
-// IncrementField atomically increments a numeric field by a delta value.
-// Creates the field if it doesn't exist (starts from 0).
-func (t *Tree) IncrementField(tablePath, rowID, fieldName string, delta int64) (int64, error) {
-	if err := t.ValidateTablePath(tablePath); err != nil {
+// ErrVersionConflict is returned when a row or node changed after the
+// version a write expected
+var ErrVersionConflict = errors.New("version conflict")
+
+// VersionConflictError reports the version a write found instead of the one
+// it expected. It matches ErrVersionConflict with errors.Is.
+type VersionConflictError struct {
+	Path     string
+	Current  int64
+	Expected int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("%v: %s is at version %d, expected %d", ErrVersionConflict, e.Path, e.Current, e.Expected)
+}
+
+func (e *VersionConflictError) Unwrap() error {
+	return ErrVersionConflict
+}
+
+// RowVersion returns the version of a row. Every write bumps it by one; rows
+// written before versioning existed report 0 until their next write.
+func (t *Tree) RowVersion(tablePath, rowID string) (int64, error) {
+	var version int64
+	err := t.readTxn(func(txn *Transaction) error {
+		var err error
+		version, err = txn.RowVersion(tablePath, rowID)
+		return err
+	})
+	return version, err
+}
+
+// RowVersion returns the version of a row within the transaction
+func (txn *Transaction) RowVersion(tablePath, rowID string) (int64, error) {
+	b, err := txn.bucketAt(tablePath + "/" + rowID)
+	if err != nil {
+		return 0, fmt.Errorf("row not found: %s", rowID)
+	}
+	return bucketVersion(b), nil
+}
+
+// UpdateRowFieldsIfVersion updates fields only while the row is still at
+// version and returns the new version. A changed row yields ErrVersionConflict.
+func (txn *Transaction) UpdateRowFieldsIfVersion(tablePath, rowID string, version int64, fields map[string]interface{}) (int64, error) {
+	if err := txn.UpdateRowFields(tablePath, rowID, fields, version); err != nil {
 		return 0, err
 	}
+	return txn.RowVersion(tablePath, rowID)
+}
 
-	txn, err := t.BeginTransaction()
+// ModifyRow performs a read-modify-write in one write transaction, so
+// concurrent modifications of a row queue up instead of conflicting. fn
+// receives the current row and returns the fields to write (none skips the
+// write); it runs inside the transaction and must not call back into the
+// Tree. Returns the row's version after the write.
+func (t *Tree) ModifyRow(tablePath, rowID string, fn func(row models.Row) (map[string]interface{}, error), opts ...TxnOptions) (int64, error) {
+	var version int64
+	err := t.Update(func(txn *Transaction) error {
+		row, err := txn.GetRow(tablePath, rowID)
+		if err != nil {
+			return err
+		}
+		fields, err := fn(row)
+		if err != nil {
+			return err
+		}
+		if len(fields) > 0 {
+			if err := txn.UpdateRowFields(tablePath, rowID, fields); err != nil {
+				return err
+			}
+		}
+		version, err = txn.RowVersion(tablePath, rowID)
+		return err
+	}, opts...)
 	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+		return 0, err
 	}
-	defer txn.Rollback()
+	return version, nil
+}
 
-	// Get current value
-	currentValue := int64(0)
-	fields, err := t.GetRowFields(tablePath, rowID, []string{fieldName})
-	if err == nil && fields[fieldName] != nil {
-		currentValue, _ = fields[fieldName].AsInt64()
+// ModifyRowOptimistic is ModifyRow for an fn that is slow or needs the Tree.
+// fn receives the row as read, outside any transaction, and the write
+// commits only if the row's version is unchanged; otherwise the row is read
+// again and fn retried up to MaxRetries times before ErrVersionConflict is
+// returned. Returns the row's version after the write.
+func (t *Tree) ModifyRowOptimistic(tablePath, rowID string, fn func(row models.Row) (map[string]interface{}, error), opts ...TxnOptions) (int64, error) {
+	o := txnOptions(opts)
+	retries := o.MaxRetries
+	if retries <= 0 {
+		retries = 3
 	}
 
-	// Calculate new value
-	newValue := currentValue + delta
+	for attempt := 0; ; attempt++ {
+		var row models.Row
+		var version int64
+		err := t.View(func(txn *Transaction) error {
+			var err error
+			if row, err = txn.GetRow(tablePath, rowID); err != nil {
+				return err
+			}
+			version, err = txn.RowVersion(tablePath, rowID)
+			return err
+		}, o)
+		if err != nil {
+			return 0, err
+		}
 
-	// Update field
-	err = txn.UpdateRowFields(tablePath, rowID, map[string]interface{}{
-		fieldName: newValue,
-	})
-	if err != nil {
-		return 0, fmt.Errorf("failed to update field: %v", err)
+		fields, err := fn(row)
+		if err != nil {
+			return 0, err
+		}
+		if len(fields) == 0 {
+			return version, nil
+		}
+
+		err = t.Update(func(txn *Transaction) error {
+			version, err = txn.UpdateRowFieldsIfVersion(tablePath, rowID, version, fields)
+			return err
+		}, o)
+		if err == nil {
+			return version, nil
+		}
+		if !errors.Is(err, ErrVersionConflict) || attempt >= retries {
+			return 0, err
+		}
+	}
+}
+
+// IncrementField atomically increments a numeric field by a delta value.
+// Creates the field if it doesn't exist (starts from 0).
+func (t *Tree) IncrementField(tablePath, rowID, fieldName string, delta int64) (int64, error) {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return 0, err
 	}
 
-	if err := txn.Commit(); err != nil {
-		return 0, fmt.Errorf("failed to commit: %v", err)
+	var newValue int64
+	_, err := t.ModifyRow(tablePath, rowID, func(row models.Row) (map[string]interface{}, error) {
+		// Get current value
+		currentValue := int64(0)
+		if row[fieldName] != nil {
+			currentValue, _ = row[fieldName].AsInt64()
+		}
+
+		newValue = currentValue + delta
+		return map[string]interface{}{fieldName: newValue}, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update field: %w", err)
 	}
 
 	return newValue, nil
@@ -3375,188 +6157,609 @@ func (t *Tree) SetFieldIfNotExists(tablePath, rowID, fieldName string, value int
 		return false, err
 	}
 
-	// Check if field exists with a non-zero value
-	fields, err := t.GetRowFields(tablePath, rowID, []string{fieldName})
-	if err == nil && fields[fieldName] != nil && !fields[fieldName].IsNull() && !fields[fieldName].IsZero() {
-		return false, nil // Field already exists with a non-zero value
+	wasSet := false
+	_, err := t.ModifyRow(tablePath, rowID, func(row models.Row) (map[string]interface{}, error) {
+		// Leave a field that exists with a non-zero value
+		current := row[fieldName]
+		wasSet = current == nil || current.IsNull() || current.IsZero()
+		if !wasSet {
+			return nil, nil
+		}
+		return map[string]interface{}{fieldName: value}, nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to set field: %w", err)
+	}
+
+	return wasSet, nil
+}
+
+// ============================================================================
+// Join Operations
+// ============================================================================
+
+// JoinResult represents a joined row from two tables.
+type JoinResult struct {
+	LeftRow  models.Row
+	RightRow models.Row
+	LeftID   string
+	RightID  string
+}
+
+// InnerJoin performs an inner join between two tables on specified fields.
+// Returns only rows where the join condition matches in both tables.
+func (t *Tree) InnerJoin(leftTablePath, rightTablePath string, leftField, rightField string) ([]JoinResult, error) {
+	return t.collectJoin(JoinSpec{
+		LeftTable:   leftTablePath,
+		RightTable:  rightTablePath,
+		LeftFields:  []string{leftField},
+		RightFields: []string{rightField},
+		Type:        JoinInner,
+	})
+}
+
+// LeftJoin performs a left outer join between two tables on specified fields.
+// Returns all rows from the left table, with matching rows from the right table.
+// If no match is found, RightRow will be nil.
+func (t *Tree) LeftJoin(leftTablePath, rightTablePath string, leftField, rightField string) ([]JoinResult, error) {
+	return t.collectJoin(JoinSpec{
+		LeftTable:   leftTablePath,
+		RightTable:  rightTablePath,
+		LeftFields:  []string{leftField},
+		RightFields: []string{rightField},
+		Type:        JoinLeft,
+	})
+}
+
+// collectJoin runs a join and gathers all results in memory
+func (t *Tree) collectJoin(spec JoinSpec) ([]JoinResult, error) {
+	results := make([]JoinResult, 0)
+	err := t.Join(spec, func(r JoinResult) error {
+		results = append(results, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// JoinType selects the semantics used by Join.
+type JoinType int
+
+const (
+	JoinInner JoinType = iota // Rows with a match on both sides
+	JoinLeft                  // All left rows; RightRow is nil when unmatched
+	JoinRight                 // All right rows; LeftRow is nil when unmatched
+	JoinFull                  // All rows from both sides
+	JoinAnti                  // Left rows without any match (RightRow is nil)
+	JoinSemi                  // Left rows with at least one match, once each (RightRow is nil)
+)
+
+// JoinStrategy describes how Join finds matching rows.
+type JoinStrategy int
+
+const (
+	JoinStrategyHash  JoinStrategy = iota // Hash table built from the right side's join keys
+	JoinStrategyIndex                     // Index lookups on the right side per left row
+	JoinStrategyMerge                     // Merge of both sides' sorted index entries
+)
+
+// ErrStopJoin can be returned from a Join callback to stop early without an error.
+var ErrStopJoin = errors.New("stop join")
+
+// JoinSpec describes a join between two tables.
+type JoinSpec struct {
+	LeftTable   string
+	RightTable  string
+	LeftFields  []string               // Join key fields on the left table
+	RightFields []string               // Join key fields on the right table, paired with LeftFields
+	Type        JoinType               // Join semantics (default inner)
+	LeftWhere   string                 // Filter pushed down to the left table
+	RightWhere  string                 // Filter pushed down to the right table
+	LeftSelect  []string               // Left fields to load (empty loads full rows)
+	RightSelect []string               // Right fields to load (empty loads full rows)
+	Vars        map[string]interface{} // Values for $variables in the filters
+}
+
+// JoinPlan describes how a join will be executed.
+type JoinPlan struct {
+	Strategy   JoinStrategy
+	LeftIndex  string // Index used on the left table, if any
+	RightIndex string // Index used on the right table, if any
+}
+
+// swapped returns the spec with left and right exchanged
+func (spec JoinSpec) swapped() JoinSpec {
+	return JoinSpec{
+		LeftTable:   spec.RightTable,
+		RightTable:  spec.LeftTable,
+		LeftFields:  spec.RightFields,
+		RightFields: spec.LeftFields,
+		Type:        spec.Type,
+		LeftWhere:   spec.RightWhere,
+		RightWhere:  spec.LeftWhere,
+		LeftSelect:  spec.RightSelect,
+		RightSelect: spec.LeftSelect,
+		Vars:        spec.Vars,
+	}
+}
+
+// normalize validates the spec and rewrites right joins as left joins with
+// the sides exchanged. Returns true when the sides were swapped.
+func (t *Tree) normalizeJoin(spec JoinSpec) (JoinSpec, bool, error) {
+	if err := t.ValidateTablePath(spec.LeftTable); err != nil {
+		return spec, false, fmt.Errorf("invalid left table: %v", err)
+	}
+	if err := t.ValidateTablePath(spec.RightTable); err != nil {
+		return spec, false, fmt.Errorf("invalid right table: %v", err)
+	}
+	if len(spec.LeftFields) == 0 || len(spec.LeftFields) != len(spec.RightFields) {
+		return spec, false, fmt.Errorf("join requires the same number of left and right key fields")
+	}
+	if spec.Type < JoinInner || spec.Type > JoinSemi {
+		return spec, false, fmt.Errorf("unsupported join type: %d", spec.Type)
+	}
+
+	if spec.Type == JoinRight {
+		spec = spec.swapped()
+		spec.Type = JoinLeft
+		return spec, true, nil
+	}
+	return spec, false, nil
+}
+
+// findJoinIndex returns an index whose fields are exactly the join fields
+func (txn *Transaction) findJoinIndex(tablePath string, fields []string) (tableIndex, bool) {
+	indexes, _ := txn.tableIndexes(tablePath)
+	for _, idx := range indexes {
+		if slices.Equal(idx.fields, fields) {
+			return idx, true
+		}
+	}
+	return tableIndex{}, false
+}
+
+// PlanJoin chooses the join strategy. An index on the right join fields enables
+// index lookups (not for full joins, which must see every right row); inner and
+// semi joins with indexes on both sides are merged over the sorted index entries.
+func (t *Tree) PlanJoin(spec JoinSpec) (*JoinPlan, error) {
+	normalized, swapped, err := t.normalizeJoin(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan *JoinPlan
+	err = t.readTxn(func(txn *Transaction) error {
+		plan, _, _ = txn.planNormalizedJoin(normalized)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if swapped {
+		plan.LeftIndex, plan.RightIndex = plan.RightIndex, plan.LeftIndex
+	}
+	return plan, nil
+}
+
+// planNormalizedJoin plans a join whose right side is the lookup side.
+// Also returns the left and right indexes the plan uses.
+func (txn *Transaction) planNormalizedJoin(spec JoinSpec) (plan *JoinPlan, left, right tableIndex) {
+	plan = &JoinPlan{Strategy: JoinStrategyHash}
+	if spec.Type == JoinFull {
+		return plan, left, right
+	}
+
+	right, ok := txn.findJoinIndex(spec.RightTable, spec.RightFields)
+	if !ok {
+		return plan, left, right
+	}
+	plan.RightIndex = right.name
+
+	if spec.Type == JoinInner || spec.Type == JoinSemi {
+		if left, ok = txn.findJoinIndex(spec.LeftTable, spec.LeftFields); ok {
+			plan.Strategy = JoinStrategyMerge
+			plan.LeftIndex = left.name
+			return plan, left, right
+		}
+	}
+
+	plan.Strategy = JoinStrategyIndex
+	return plan, left, right
+}
+
+// Join streams the results of joining two tables to callback.
+// WHERE filters are applied to each side before matching, only join keys are
+// held in memory, and rows are loaded (projected by Left/RightSelect) as they
+// are emitted. Rows with a null join key never match. Return ErrStopJoin from
+// the callback to stop early. The whole join reads one snapshot: the callback
+// runs inside its read transaction and must not call back into the Tree.
+func (t *Tree) Join(spec JoinSpec, callback func(JoinResult) error) error {
+	normalized, swapped, err := t.normalizeJoin(spec)
+	if err != nil {
+		return err
+	}
+
+	emit := callback
+	if swapped {
+		emit = func(r JoinResult) error {
+			return callback(JoinResult{
+				LeftRow:  r.RightRow,
+				RightRow: r.LeftRow,
+				LeftID:   r.RightID,
+				RightID:  r.LeftID,
+			})
+		}
+	}
+
+	err = t.readTxn(func(txn *Transaction) error {
+		run := &joinRun{txn: txn, spec: normalized, emit: emit}
+		plan, left, right := txn.planNormalizedJoin(normalized)
+
+		switch plan.Strategy {
+		case JoinStrategyMerge:
+			return run.merge(left, right)
+		case JoinStrategyIndex:
+			return run.indexLookup(right)
+		default:
+			return run.hash()
+		}
+	})
+
+	if errors.Is(err, ErrStopJoin) {
+		return nil
+	}
+	return err
+}
+
+// joinRun holds the state of a single join execution
+type joinRun struct {
+	txn          *Transaction
+	spec         JoinSpec
+	emit         func(JoinResult) error
+	rightAllowed map[string]bool // Right rows passing RightWhere (nil = all)
+	rightMatched map[string]bool // Right rows matched so far (full joins)
+}
+
+// filteredRowIDs returns the IDs of rows matching where (all rows if empty)
+func (txn *Transaction) filteredRowIDs(tablePath, where string, vars map[string]interface{}) ([]string, error) {
+	if where == "" {
+		return txn.rowIDs(tablePath)
+	}
+
+	query, err := parser.Parse(where)
+	if err != nil {
+		return nil, fmt.Errorf("query parse failed: %w", err)
+	}
+	candidateIDs, err := txn.queryCandidates(tablePath, query)
+	if err != nil {
+		return nil, fmt.Errorf("query execution failed: %v", err)
+	}
+	schema, err := txn.tableSchema(tablePath)
+	if err != nil {
+		return nil, err
+	}
+
+	functions := txn.tree.queryFunctions()
+	ids := []string{}
+	for _, rowID := range candidateIDs {
+		row, err := txn.readRow(tablePath, rowID, schema, nil)
+		if err != nil {
+			continue
+		}
+		obj := models.NewObjectWithContext(row, nil, functions, vars)
+		if match, err := obj.Match(query); err == nil && match {
+			ids = append(ids, rowID)
+		}
 	}
+	return ids, nil
+}
 
-	// Set the field
-	err = t.UpdateRowFields(tablePath, rowID, map[string]interface{}{
-		fieldName: value,
-	})
+// rowKey loads the join key of a row; ok is false when any key field is null
+func (txn *Transaction) rowKey(tablePath, rowID string, fields []string) (parts []string, ok bool) {
+	row, err := txn.readRow(tablePath, rowID, nil, fields)
 	if err != nil {
-		return false, fmt.Errorf("failed to set field: %v", err)
+		return nil, false
 	}
-
-	return true, nil
+	parts = make([]string, len(fields))
+	for i, field := range fields {
+		val := row[field]
+		if val == nil || val.IsNull() {
+			return nil, false
+		}
+		parts[i] = val.AsString()
+	}
+	return parts, true
 }
 
-// ============================================================================
-// Join Operations
-// ============================================================================
-
-// JoinResult represents a joined row from two tables.
-type JoinResult struct {
-	LeftRow  models.Row
-	RightRow models.Row
-	LeftID   string
-	RightID  string
+// loadRow loads a row with the requested projection
+func (r *joinRun) loadRow(tablePath, rowID string, fields []string) (models.Row, error) {
+	schema, err := r.txn.tableSchema(tablePath)
+	if err != nil {
+		return nil, err
+	}
+	return r.txn.readRow(tablePath, rowID, schema, fields)
 }
 
-// InnerJoin performs an inner join between two tables on specified fields.
-// Returns only rows where the join condition matches in both tables.
-func (t *Tree) InnerJoin(leftTablePath, rightTablePath string, leftField, rightField string) ([]JoinResult, error) {
-	if err := t.ValidateTablePath(leftTablePath); err != nil {
-		return nil, fmt.Errorf("invalid left table: %v", err)
+// allowRight loads the set of right rows passing RightWhere
+func (r *joinRun) allowRight() ([]string, error) {
+	rightIDs, err := r.txn.filteredRowIDs(r.spec.RightTable, r.spec.RightWhere, r.spec.Vars)
+	if err != nil {
+		return nil, fmt.Errorf("right filter failed: %v", err)
 	}
-	if err := t.ValidateTablePath(rightTablePath); err != nil {
-		return nil, fmt.Errorf("invalid right table: %v", err)
+	if r.spec.RightWhere != "" {
+		r.rightAllowed = make(map[string]bool, len(rightIDs))
+		for _, id := range rightIDs {
+			r.rightAllowed[id] = true
+		}
 	}
+	return rightIDs, nil
+}
 
-	// Get all rows from left table
-	leftRowIDs, err := t.GetRowIDsOnly(leftTablePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get left table rows: %v", err)
+// emitLeft emits the results for one left row given its matching right rows
+func (r *joinRun) emitLeft(leftID string, matches []string) error {
+	switch r.spec.Type {
+	case JoinSemi:
+		if len(matches) == 0 {
+			return nil
+		}
+	case JoinAnti:
+		if len(matches) > 0 {
+			return nil
+		}
+	case JoinInner:
+		if len(matches) == 0 {
+			return nil
+		}
 	}
 
-	// Build index of right table by join field
-	rightIndex := make(map[string][]string) // field value -> list of row IDs
-	rightRowIDs, err := t.GetRowIDsOnly(rightTablePath)
+	leftRow, err := r.loadRow(r.spec.LeftTable, leftID, r.spec.LeftSelect)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get right table rows: %v", err)
+		return nil // Skip rows that can't be loaded
 	}
 
-	for _, rightID := range rightRowIDs {
-		fields, err := t.GetRowFields(rightTablePath, rightID, []string{rightField})
-		if err != nil || fields[rightField] == nil {
-			continue
-		}
-		key := fields[rightField].AsString()
-		rightIndex[key] = append(rightIndex[key], rightID)
+	if r.spec.Type == JoinSemi || r.spec.Type == JoinAnti || len(matches) == 0 {
+		return r.emit(JoinResult{LeftRow: leftRow, LeftID: leftID})
 	}
 
-	// Perform join
-	results := make([]JoinResult, 0)
-	for _, leftID := range leftRowIDs {
-		leftRow, err := t.GetRow(leftTablePath, leftID)
+	for _, rightID := range matches {
+		rightRow, err := r.loadRow(r.spec.RightTable, rightID, r.spec.RightSelect)
 		if err != nil {
 			continue
 		}
+		if r.rightMatched != nil {
+			r.rightMatched[rightID] = true
+		}
+		if err := r.emit(JoinResult{LeftRow: leftRow, RightRow: rightRow, LeftID: leftID, RightID: rightID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hash builds a key -> right row IDs table and probes it with each left row
+func (r *joinRun) hash() error {
+	rightIDs, err := r.allowRight()
+	if err != nil {
+		return err
+	}
 
-		leftVal, exists := leftRow[leftField]
-		if !exists || leftVal == nil {
+	table := make(map[string][]string)
+	for _, rightID := range rightIDs {
+		parts, ok := r.txn.rowKey(r.spec.RightTable, rightID, r.spec.RightFields)
+		if !ok {
 			continue
 		}
+		key := strings.Join(parts, "\x00")
+		table[key] = append(table[key], rightID)
+	}
 
-		leftKey := leftVal.AsString()
-		rightIDs, found := rightIndex[leftKey]
-		if !found {
-			continue
+	if r.spec.Type == JoinFull {
+		r.rightMatched = make(map[string]bool)
+	}
+
+	leftIDs, err := r.txn.filteredRowIDs(r.spec.LeftTable, r.spec.LeftWhere, r.spec.Vars)
+	if err != nil {
+		return fmt.Errorf("left filter failed: %v", err)
+	}
+
+	for _, leftID := range leftIDs {
+		var matches []string
+		if parts, ok := r.txn.rowKey(r.spec.LeftTable, leftID, r.spec.LeftFields); ok {
+			matches = table[strings.Join(parts, "\x00")]
+		}
+		if err := r.emitLeft(leftID, matches); err != nil {
+			return err
 		}
+	}
 
-		// Create join result for each matching right row
+	// Full joins also return right rows that never matched
+	if r.spec.Type == JoinFull {
 		for _, rightID := range rightIDs {
-			rightRow, err := t.GetRow(rightTablePath, rightID)
+			if r.rightMatched[rightID] {
+				continue
+			}
+			rightRow, err := r.loadRow(r.spec.RightTable, rightID, r.spec.RightSelect)
 			if err != nil {
 				continue
 			}
-
-			results = append(results, JoinResult{
-				LeftRow:  leftRow,
-				RightRow: rightRow,
-				LeftID:   leftID,
-				RightID:  rightID,
-			})
+			if err := r.emit(JoinResult{RightRow: rightRow, RightID: rightID}); err != nil {
+				return err
+			}
 		}
 	}
-
-	return results, nil
+	return nil
 }
 
-// LeftJoin performs a left outer join between two tables on specified fields.
-// Returns all rows from the left table, with matching rows from the right table.
-// If no match is found, RightRow will be nil.
-func (t *Tree) LeftJoin(leftTablePath, rightTablePath string, leftField, rightField string) ([]JoinResult, error) {
-	if err := t.ValidateTablePath(leftTablePath); err != nil {
-		return nil, fmt.Errorf("invalid left table: %v", err)
+// verifiedMatches filters index candidates by RightWhere and exact key equality
+// (index entry names are sanitized, so distinct keys can share an entry)
+func (r *joinRun) verifiedMatches(candidates []string, parts []string) []string {
+	var matches []string
+	for _, rightID := range candidates {
+		if r.rightAllowed != nil && !r.rightAllowed[rightID] {
+			continue
+		}
+		rightParts, ok := r.txn.rowKey(r.spec.RightTable, rightID, r.spec.RightFields)
+		if !ok || strings.Join(rightParts, "\x00") != strings.Join(parts, "\x00") {
+			continue
+		}
+		matches = append(matches, rightID)
 	}
-	if err := t.ValidateTablePath(rightTablePath); err != nil {
-		return nil, fmt.Errorf("invalid right table: %v", err)
+	return matches
+}
+
+// indexLookup probes the right table's index for each left row
+func (r *joinRun) indexLookup(right tableIndex) error {
+	if r.spec.RightWhere != "" {
+		if _, err := r.allowRight(); err != nil {
+			return err
+		}
 	}
 
-	// Get all rows from left table
-	leftRowIDs, err := t.GetRowIDsOnly(leftTablePath)
+	leftIDs, err := r.txn.filteredRowIDs(r.spec.LeftTable, r.spec.LeftWhere, r.spec.Vars)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get left table rows: %v", err)
+		return fmt.Errorf("left filter failed: %v", err)
 	}
 
-	// Build index of right table by join field
-	rightIndex := make(map[string][]string)
-	rightRowIDs, err := t.GetRowIDsOnly(rightTablePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get right table rows: %v", err)
+	for _, leftID := range leftIDs {
+		var matches []string
+		if parts, ok := r.txn.rowKey(r.spec.LeftTable, leftID, r.spec.LeftFields); ok {
+			// Index keys use the same format as buildIndexKey
+			candidates := right.rowIDs(strings.Join(parts, "|"))
+			matches = r.verifiedMatches(candidates, parts)
+		}
+		if err := r.emitLeft(leftID, matches); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	for _, rightID := range rightRowIDs {
-		fields, err := t.GetRowFields(rightTablePath, rightID, []string{rightField})
-		if err != nil || fields[rightField] == nil {
-			continue
+// merge walks both sides' sorted index entries and joins equal keys.
+// Only used for inner and semi joins, since null keys are not indexed.
+func (r *joinRun) merge(left, right tableIndex) error {
+	if r.spec.RightWhere != "" {
+		if _, err := r.allowRight(); err != nil {
+			return err
 		}
-		key := fields[rightField].AsString()
-		rightIndex[key] = append(rightIndex[key], rightID)
 	}
 
-	// Perform left join
-	results := make([]JoinResult, 0)
-	for _, leftID := range leftRowIDs {
-		leftRow, err := t.GetRow(leftTablePath, leftID)
+	var leftAllowed map[string]bool
+	if r.spec.LeftWhere != "" {
+		leftIDs, err := r.txn.filteredRowIDs(r.spec.LeftTable, r.spec.LeftWhere, r.spec.Vars)
 		if err != nil {
-			continue
+			return fmt.Errorf("left filter failed: %v", err)
 		}
-
-		leftVal, exists := leftRow[leftField]
-		if !exists || leftVal == nil {
-			// No join key, include with nil right side
-			results = append(results, JoinResult{
-				LeftRow:  leftRow,
-				RightRow: nil,
-				LeftID:   leftID,
-				RightID:  "",
-			})
-			continue
+		leftAllowed = make(map[string]bool, len(leftIDs))
+		for _, id := range leftIDs {
+			leftAllowed[id] = true
 		}
+	}
 
-		leftKey := leftVal.AsString()
-		rightIDs, found := rightIndex[leftKey]
-		if !found {
-			// No match, include with nil right side
-			results = append(results, JoinResult{
-				LeftRow:  leftRow,
-				RightRow: nil,
-				LeftID:   leftID,
-				RightID:  "",
-			})
-			continue
+	leftKeys, rightKeys := left.keys(), right.keys()
+
+	i, j := 0, 0
+	for i < len(leftKeys) && j < len(rightKeys) {
+		switch {
+		case leftKeys[i] < rightKeys[j]:
+			i++
+		case leftKeys[i] > rightKeys[j]:
+			j++
+		default:
+			key := leftKeys[i]
+			leftCandidates, rightCandidates := left.rowIDs(key), right.rowIDs(key)
+
+			for _, leftID := range leftCandidates {
+				if leftAllowed != nil && !leftAllowed[leftID] {
+					continue
+				}
+				parts, ok := r.txn.rowKey(r.spec.LeftTable, leftID, r.spec.LeftFields)
+				if !ok {
+					continue
+				}
+				if err := r.emitLeft(leftID, r.verifiedMatches(rightCandidates, parts)); err != nil {
+					return err
+				}
+			}
+			i++
+			j++
 		}
+	}
+	return nil
+}
 
-		// Create join result for each matching right row
-		for _, rightID := range rightIDs {
-			rightRow, err := t.GetRow(rightTablePath, rightID)
-			if err != nil {
-				continue
+// JoinResultCursor iterates over join results produced in the background.
+// The join holds a read transaction until it ends, so always Close the cursor
+// when done so the producer stops.
+type JoinResultCursor struct {
+	results   chan JoinResult
+	errc      chan error
+	done      chan struct{}
+	current   JoinResult
+	err       error
+	closeOnce sync.Once
+}
+
+// JoinCursor starts a join and returns a cursor over its results.
+// Spec errors are returned immediately; execution errors are reported by Err.
+func (t *Tree) JoinCursor(spec JoinSpec) (*JoinResultCursor, error) {
+	if _, _, err := t.normalizeJoin(spec); err != nil {
+		return nil, err
+	}
+
+	c := &JoinResultCursor{
+		results: make(chan JoinResult),
+		errc:    make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		err := t.Join(spec, func(r JoinResult) error {
+			select {
+			case c.results <- r:
+				return nil
+			case <-c.done:
+				return ErrStopJoin
 			}
+		})
+		c.errc <- err
+		close(c.results)
+	}()
 
-			results = append(results, JoinResult{
-				LeftRow:  leftRow,
-				RightRow: rightRow,
-				LeftID:   leftID,
-				RightID:  rightID,
-			})
+	return c, nil
+}
+
+// Next advances to the next result, returning false when exhausted or on error
+func (c *JoinResultCursor) Next() bool {
+	r, ok := <-c.results
+	if !ok {
+		select {
+		case err := <-c.errc:
+			c.err = err
+		default:
 		}
+		return false
 	}
+	c.current = r
+	return true
+}
 
-	return results, nil
+// Result returns the current join result
+func (c *JoinResultCursor) Result() JoinResult {
+	return c.current
+}
+
+// Err returns the error that ended iteration, if any
+func (c *JoinResultCursor) Err() error {
+	return c.err
+}
+
+// Close stops the join if it is still running
+func (c *JoinResultCursor) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
 }
 
 // ============================================================================
@@ -3750,12 +6953,304 @@ func (t *Tree) GroupBy(tablePath, groupByField, aggregateField string) (map[stri
 	return groups, nil
 }
 
+// Aggregate functions supported by GroupByQuery
+const (
+	AggCount         = "count"
+	AggSum           = "sum"
+	AggAvg           = "avg"
+	AggMin           = "min"
+	AggMax           = "max"
+	AggCountDistinct = "count_distinct"
+)
+
+// AggregateSpec describes one aggregate computed per group.
+type AggregateSpec struct {
+	Func  string // One of the Agg* constants
+	Field string // Field to aggregate; "*" or "" for count(*)
+	Alias string // Result name, defaults to "func_field" (or "count" for count(*))
+}
+
+// name returns the alias under which the aggregate is reported
+func (a AggregateSpec) name() string {
+	if a.Alias != "" {
+		return a.Alias
+	}
+	if a.Field == "" || a.Field == "*" {
+		return a.Func
+	}
+	return a.Func + "_" + a.Field
+}
+
+// GroupByOptions configures GroupByQuery.
+type GroupByOptions struct {
+	GroupBy    []string               // Group key fields (empty = one group for all rows)
+	Aggregates []AggregateSpec        // Aggregates computed per group
+	Where      string                 // Optional row filter (query expression)
+	Having     string                 // Optional group filter over key fields and aggregate aliases
+	Vars       map[string]interface{} // Values for $variables in Where and Having
+}
+
+// GroupRow is a single group produced by GroupByQuery.
+type GroupRow struct {
+	Keys       map[string]interface{} // Group key field -> value (nil for null)
+	Aggregates map[string]interface{} // Aggregate alias -> value
+}
+
+// aggregateState accumulates one aggregate for one group
+type aggregateState struct {
+	count    int
+	sum      float64
+	numeric  int
+	best     *models.RowValue
+	distinct map[string]struct{}
+}
+
+// groupState accumulates a single group while rows are streamed
+type groupState struct {
+	keys []*models.RowValue
+	aggs []*aggregateState
+}
+
+// GroupByQuery groups rows by one or more fields and computes several aggregates
+// in a single streamed pass over the table using ScanRowsWithFields.
+// Rows are filtered by Where before grouping, and groups by Having afterwards.
+// Null key values form their own group. Results are ordered by group keys.
+func (t *Tree) GroupByQuery(tablePath string, opts GroupByOptions) ([]GroupRow, error) {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return nil, err
+	}
+
+	// Validate aggregates and collect the fields to load
+	fieldSet := make(map[string]bool)
+	for _, key := range opts.GroupBy {
+		fieldSet[key] = true
+	}
+	aliases := make(map[string]bool)
+	for _, agg := range opts.Aggregates {
+		switch agg.Func {
+		case AggCount:
+		case AggSum, AggAvg, AggMin, AggMax, AggCountDistinct:
+			if agg.Field == "" || agg.Field == "*" {
+				return nil, fmt.Errorf("aggregate %s requires a field", agg.Func)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported aggregate function: %s", agg.Func)
+		}
+		if aliases[agg.name()] {
+			return nil, fmt.Errorf("duplicate aggregate name: %s", agg.name())
+		}
+		aliases[agg.name()] = true
+		if agg.Field != "" && agg.Field != "*" {
+			fieldSet[agg.Field] = true
+		}
+	}
+
+	functions := t.queryFunctions()
+
+	var where *parser.Query
+	if opts.Where != "" {
+		q, err := parser.Parse(opts.Where)
+		if err != nil {
+			return nil, fmt.Errorf("where parse failed: %w", err)
+		}
+		for _, field := range parser.ExtractQueryDependencies(q).Properties {
+			fieldSet[field] = true
+		}
+		where = &q
+	}
+
+	var having *parser.Query
+	if opts.Having != "" {
+		q, err := parser.Parse(opts.Having)
+		if err != nil {
+			return nil, fmt.Errorf("having parse failed: %w", err)
+		}
+		having = &q
+	}
+
+	fields := make([]string, 0, len(fieldSet))
+	for field := range fieldSet {
+		fields = append(fields, field)
+	}
+
+	groups := make(map[string]*groupState)
+	var order []*groupState
+
+	err := t.ScanRowsWithFields(tablePath, fields, func(rowID string, row models.Row) error {
+		if where != nil {
+			obj := models.NewObjectWithContext(row, nil, functions, opts.Vars)
+			if match, err := obj.Match(*where); err != nil || !match {
+				return nil
+			}
+		}
+
+		// Build composite group key; the prefix keeps null distinct from "<nil>"
+		var keyBuilder strings.Builder
+		for _, key := range opts.GroupBy {
+			val := row[key]
+			if val == nil || val.IsNull() {
+				keyBuilder.WriteString("n\x00")
+			} else {
+				keyBuilder.WriteString("v" + val.AsString() + "\x00")
+			}
+		}
+		groupKey := keyBuilder.String()
+
+		group, exists := groups[groupKey]
+		if !exists {
+			group = &groupState{
+				keys: make([]*models.RowValue, len(opts.GroupBy)),
+				aggs: make([]*aggregateState, len(opts.Aggregates)),
+			}
+			for i, key := range opts.GroupBy {
+				group.keys[i] = row[key]
+			}
+			for i := range opts.Aggregates {
+				group.aggs[i] = &aggregateState{}
+			}
+			groups[groupKey] = group
+			order = append(order, group)
+		}
+
+		for i, agg := range opts.Aggregates {
+			group.aggs[i].add(agg, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]GroupRow, 0, len(order))
+	for _, group := range order {
+		result := GroupRow{
+			Keys:       make(map[string]interface{}, len(opts.GroupBy)),
+			Aggregates: make(map[string]interface{}, len(opts.Aggregates)),
+		}
+		for i, key := range opts.GroupBy {
+			if group.keys[i] == nil || group.keys[i].IsNull() {
+				result.Keys[key] = nil
+			} else {
+				result.Keys[key] = group.keys[i].Val()
+			}
+		}
+		for i, agg := range opts.Aggregates {
+			result.Aggregates[agg.name()] = group.aggs[i].result(agg)
+		}
+
+		if having != nil {
+			havingRow := make(models.Row, len(result.Keys)+len(result.Aggregates))
+			for k, v := range result.Keys {
+				havingRow[k] = models.NewValue(v)
+			}
+			for k, v := range result.Aggregates {
+				havingRow[k] = models.NewValue(v)
+			}
+			obj := models.NewObjectWithContext(havingRow, nil, functions, opts.Vars)
+			match, err := obj.Match(*having)
+			if err != nil {
+				return nil, fmt.Errorf("having evaluation failed: %v", err)
+			}
+			if !match {
+				continue
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	// Order groups by their key values
+	sort.SliceStable(results, func(i, j int) bool {
+		for _, key := range opts.GroupBy {
+			a, b := results[i].Keys[key], results[j].Keys[key]
+			if a == nil || b == nil {
+				if (a == nil) != (b == nil) {
+					return a == nil
+				}
+				continue
+			}
+			va, vb := models.NewValue(a), models.NewValue(b)
+			if va.Equals(vb) {
+				continue
+			}
+			less, _ := va.Compare(vb, "<")
+			return less
+		}
+		return false
+	})
+
+	return results, nil
+}
+
+// add folds one row into the aggregate
+func (s *aggregateState) add(agg AggregateSpec, row models.Row) {
+	if agg.Func == AggCount && (agg.Field == "" || agg.Field == "*") {
+		s.count++
+		return
+	}
+
+	val := row[agg.Field]
+	if val == nil || val.IsNull() {
+		return
+	}
+	s.count++
+
+	switch agg.Func {
+	case AggSum, AggAvg:
+		if f, err := val.AsFloat64(); err == nil {
+			s.sum += f
+			s.numeric++
+		}
+	case AggMin:
+		if s.best == nil {
+			s.best = val
+		} else if less, _ := val.Compare(s.best, "<"); less {
+			s.best = val
+		}
+	case AggMax:
+		if s.best == nil {
+			s.best = val
+		} else if greater, _ := val.Compare(s.best, ">"); greater {
+			s.best = val
+		}
+	case AggCountDistinct:
+		if s.distinct == nil {
+			s.distinct = make(map[string]struct{})
+		}
+		s.distinct[val.AsString()] = struct{}{}
+	}
+}
+
+// result returns the final aggregate value
+func (s *aggregateState) result(agg AggregateSpec) interface{} {
+	switch agg.Func {
+	case AggCount:
+		return s.count
+	case AggSum:
+		return s.sum
+	case AggAvg:
+		if s.numeric == 0 {
+			return nil
+		}
+		return s.sum / float64(s.numeric)
+	case AggMin, AggMax:
+		if s.best == nil {
+			return nil
+		}
+		return s.best.Val()
+	case AggCountDistinct:
+		return len(s.distinct)
+	}
+	return nil
+}
+
 // ============================================================================
 // Subquery Support
 // ============================================================================
 
 // ExistsInSubquery checks if any row in the subquery table matches the condition.
 // The condition is: subqueryField == valueFromMainRow[mainField]
+// Implemented as a semi-join of the main table against the subquery table.
 func (t *Tree) ExistsInSubquery(mainTablePath, mainField, subqueryTablePath, subqueryField string) (map[string]bool, error) {
 	if err := t.ValidateTablePath(mainTablePath); err != nil {
 		return nil, fmt.Errorf("invalid main table: %v", err)
@@ -3764,55 +7259,45 @@ func (t *Tree) ExistsInSubquery(mainTablePath, mainField, subqueryTablePath, sub
 		return nil, fmt.Errorf("invalid subquery table: %v", err)
 	}
 
-	// Build set of values from subquery table
-	subqueryValues := make(map[string]bool)
-	subRowIDs, err := t.GetRowIDsOnly(subqueryTablePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get subquery rows: %v", err)
-	}
-
-	for _, rowID := range subRowIDs {
-		fields, err := t.GetRowFields(subqueryTablePath, rowID, []string{subqueryField})
-		if err != nil || fields[subqueryField] == nil {
-			continue
-		}
-		subqueryValues[fields[subqueryField].AsString()] = true
-	}
-
-	// Check main table rows
 	mainRowIDs, err := t.GetRowIDsOnly(mainTablePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get main table rows: %v", err)
 	}
 
-	results := make(map[string]bool)
+	results := make(map[string]bool, len(mainRowIDs))
 	for _, rowID := range mainRowIDs {
-		fields, err := t.GetRowFields(mainTablePath, rowID, []string{mainField})
-		if err != nil || fields[mainField] == nil {
-			results[rowID] = false
-			continue
-		}
+		results[rowID] = false
+	}
 
-		mainValue := fields[mainField].AsString()
-		results[rowID] = subqueryValues[mainValue]
+	matched, err := t.InSubquery(mainTablePath, mainField, subqueryTablePath, subqueryField)
+	if err != nil {
+		return nil, err
+	}
+	for _, rowID := range matched {
+		results[rowID] = true
 	}
 
 	return results, nil
 }
 
 // InSubquery returns row IDs from main table where mainField value exists in subquery results.
+// Implemented as a semi-join; an index on either field is used when available.
 func (t *Tree) InSubquery(mainTablePath, mainField, subqueryTablePath, subqueryField string) ([]string, error) {
-	existsMap, err := t.ExistsInSubquery(mainTablePath, mainField, subqueryTablePath, subqueryField)
+	results := make([]string, 0)
+	err := t.Join(JoinSpec{
+		LeftTable:   mainTablePath,
+		RightTable:  subqueryTablePath,
+		LeftFields:  []string{mainField},
+		RightFields: []string{subqueryField},
+		Type:        JoinSemi,
+		LeftSelect:  []string{mainField},
+	}, func(r JoinResult) error {
+		results = append(results, r.LeftID)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	results := make([]string, 0)
-	for rowID, exists := range existsMap {
-		if exists {
-			results = append(results, rowID)
-		}
-	}
-
 	return results, nil
 }
@@ -0,0 +1,413 @@
+package blueconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sfi2k7/blueconfig/models"
+)
+
+// ============================================================================
+// HTTP API Tests for Database Queries
+// ============================================================================
+
+func setupDatabaseHTTPServer(t *testing.T) (*Tree, string, string) {
+	tmpfile := fmt.Sprintf("/tmp/test_http_db_%d.db", time.Now().UnixNano())
+	tr, err := NewOrOpenTree(TreeOptions{
+		StorageLocationOnDisk: tmpfile,
+		Token:                 "test-token",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seed a users table
+	tr.CreateDatabase("root/mydb", nil)
+	tr.CreateTable("root/mydb", "users")
+	users := map[string]map[string]interface{}{
+		"user1": {"name": "Alice", "age": 30, "city": "NYC"},
+		"user2": {"name": "Bob", "age": 25, "city": "LA"},
+		"user3": {"name": "Charlie", "age": 35, "city": "NYC"},
+		"user4": {"name": "Diana", "age": 40, "city": "SF"},
+	}
+	for rowID, data := range users {
+		if err := tr.InsertRowWithID("root/mydb/users", rowID, models.NewRow(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(tr.routes())
+	t.Cleanup(srv.Close)
+
+	return tr, tmpfile, srv.URL + "/db/mydb/tables/users"
+}
+
+func cleanupDatabaseHTTPServer(tr *Tree, tmpfile string) {
+	tr.Close()
+	os.Remove(tmpfile)
+}
+
+func TestHTTP_QueryRows(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	body := map[string]interface{}{
+		"query":  "age > $minAge",
+		"vars":   map[string]interface{}{"minAge": 26},
+		"sort":   []map[string]string{{"field": "name", "direction": "desc"}},
+		"fields": []string{"name"},
+		"limit":  2,
+	}
+
+	result := parseResponse(t, makeRequest(t, "POST", baseURL+"/query", body, "test-token"))
+	if result["error"] != nil {
+		t.Fatalf("Expected no error, got %v", result["error"])
+	}
+
+	res := result["result"].(map[string]interface{})
+	if res["total"].(float64) != 3 {
+		t.Errorf("Expected total 3, got %v", res["total"])
+	}
+
+	rows := res["rows"].([]interface{})
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows with limit, got %d", len(rows))
+	}
+
+	first := rows[0].(map[string]interface{})
+	if first["id"] != "user4" {
+		t.Errorf("Expected first row user4 (Diana), got %v", first["id"])
+	}
+
+	data := first["data"].(map[string]interface{})
+	if data["name"] != "Diana" {
+		t.Errorf("Expected name Diana, got %v", data["name"])
+	}
+	if _, exists := data["age"]; exists {
+		t.Error("Expected projection to exclude age")
+	}
+}
+
+func TestHTTP_QueryRowsParseError(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	body := map[string]interface{}{"query": "age >> 'broken"}
+	result := parseResponse(t, makeRequest(t, "POST", baseURL+"/query", body, "test-token"))
+
+	if result["error"] == nil {
+		t.Fatal("Expected parse error")
+	}
+
+	details, ok := result["details"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected structured error details, got %v", result["details"])
+	}
+	if details["type"] != "parse_error" {
+		t.Errorf("Expected parse_error, got %v", details["type"])
+	}
+	if details["line"].(float64) != 1 || details["column"].(float64) != 8 {
+		t.Errorf("Expected error at 1:8, got %v:%v", details["line"], details["column"])
+	}
+	if details["token"] != "'" {
+		t.Errorf("Expected offending token ', got %v", details["token"])
+	}
+
+	// Server must still be alive after a bad query
+	result = parseResponse(t, makeRequest(t, "POST", baseURL+"/count", map[string]string{"query": "age > 0"}, "test-token"))
+	if result["error"] != nil {
+		t.Errorf("Expected no error after bad query, got %v", result["error"])
+	}
+}
+
+func TestHTTP_QueryRowsMissingQuery(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	result := parseResponse(t, makeRequest(t, "POST", baseURL+"/query", map[string]string{}, "test-token"))
+	details, ok := result["details"].(map[string]interface{})
+	if !ok || details["type"] != "invalid_request" {
+		t.Errorf("Expected invalid_request error, got %v", result)
+	}
+}
+
+func TestHTTP_CountWhere(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	body := map[string]string{"query": "city == 'NYC'"}
+	result := parseResponse(t, makeRequest(t, "POST", baseURL+"/count", body, "test-token"))
+
+	res := result["result"].(map[string]interface{})
+	if res["count"].(float64) != 2 {
+		t.Errorf("Expected count 2, got %v", res["count"])
+	}
+}
+
+func TestHTTP_CountWhereWithVarsAndFunction(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	tr.RegisterFunction("initial", func(args ...any) (any, error) {
+		name := fmt.Sprintf("%v", args[0])
+		return name[:1], nil
+	})
+
+	body := map[string]interface{}{
+		"query": "initial(name) == $letter || age > $maxAge",
+		"vars":  map[string]interface{}{"letter": "B", "maxAge": 38},
+	}
+	result := parseResponse(t, makeRequest(t, "POST", baseURL+"/count", body, "test-token"))
+
+	res := result["result"].(map[string]interface{})
+	if res["count"].(float64) != 2 {
+		t.Errorf("Expected count 2 (Bob, Diana), got %v", res["count"])
+	}
+}
+
+func TestHTTP_UpdateRowsWhere(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	body := map[string]interface{}{
+		"query":   "city == 'NYC'",
+		"updates": map[string]interface{}{"status": "east"},
+	}
+	result := parseResponse(t, makeRequest(t, "POST", baseURL+"/update-where", body, "test-token"))
+
+	res := result["result"].(map[string]interface{})
+	if res["updated"].(float64) != 2 {
+		t.Errorf("Expected 2 updated, got %v", res["updated"])
+	}
+
+	row, _ := tr.GetRow("root/mydb/users", "user1")
+	if row["status"] == nil || row["status"].AsString() != "east" {
+		t.Errorf("Expected status east, got %v", row["status"])
+	}
+}
+
+func TestHTTP_DeleteRowsWhere(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	body := map[string]string{"query": "age < 30"}
+	result := parseResponse(t, makeRequest(t, "POST", baseURL+"/delete-where", body, "test-token"))
+
+	res := result["result"].(map[string]interface{})
+	if res["deleted"].(float64) != 1 {
+		t.Errorf("Expected 1 deleted, got %v", res["deleted"])
+	}
+
+	if exists, _ := tr.RowExists("root/mydb/users", "user2"); exists {
+		t.Error("Expected user2 to be deleted")
+	}
+}
+
+func TestHTTP_DistinctAndAggregate(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	result := parseResponse(t, makeRequest(t, "GET", baseURL+"/distinct?field=city", nil, "test-token"))
+	values := result["result"].([]interface{})
+	if len(values) != 3 {
+		t.Errorf("Expected 3 distinct cities, got %d", len(values))
+	}
+
+	result = parseResponse(t, makeRequest(t, "GET", baseURL+"/aggregate?field=age", nil, "test-token"))
+	agg := result["result"].(map[string]interface{})
+	if agg["Count"].(float64) != 4 {
+		t.Errorf("Expected count 4, got %v", agg["Count"])
+	}
+	if agg["Sum"].(float64) != 130 {
+		t.Errorf("Expected sum 130, got %v", agg["Sum"])
+	}
+
+	result = parseResponse(t, makeRequest(t, "GET", baseURL+"/aggregate", nil, "test-token"))
+	if result["error"] == nil {
+		t.Error("Expected error when field is missing")
+	}
+}
+
+// makeIfMatchRequest sends a JSON request with an optional If-Match header
+func makeIfMatchRequest(t *testing.T, method, url string, body interface{}, ifMatch string) *http.Response {
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(reqBody))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer test-token")
+	req.Header.Set("Content-Type", "application/json")
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	return resp
+}
+
+func TestHTTP_RowETagIfMatch(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	rowURL := baseURL + "/rows/user1"
+
+	resp := makeRequest(t, "GET", rowURL, nil, "test-token")
+	result := parseResponse(t, resp)
+	if tag := resp.Header.Get("ETag"); tag != `"1"` {
+		t.Fatalf("GET ETag = %s, want \"1\"", tag)
+	}
+	if row, _ := result["result"].(map[string]interface{}); row == nil || row[VersionField] != nil {
+		t.Errorf("GET row = %v, want the version in the ETag only", result["result"])
+	}
+
+	full := map[string]interface{}{"name": "Alice", "age": 31, "city": "NYC"}
+	resp = makeIfMatchRequest(t, "PUT", rowURL, full, `"1"`)
+	result = parseResponse(t, resp)
+	if result["error"] != nil || resp.Header.Get("ETag") != `"2"` {
+		t.Fatalf("PUT with current version: %v, ETag %s", result["error"], resp.Header.Get("ETag"))
+	}
+
+	// A second editor still holding version 1 is rejected
+	resp = makeIfMatchRequest(t, "PATCH", rowURL, map[string]interface{}{"age": 99}, `"1"`)
+	result = parseResponse(t, resp)
+	if resp.StatusCode != http.StatusPreconditionFailed || resp.Header.Get("ETag") != `"2"` {
+		t.Fatalf("stale PATCH: status %d, ETag %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	details := result["details"].(map[string]interface{})
+	if details["current_version"].(float64) != 2 {
+		t.Errorf("current_version = %v, want 2", details["current_version"])
+	}
+	if row, _ := tr.GetRow("root/mydb/users", "user1"); row["age"].AsString() != "31" {
+		t.Errorf("stale PATCH changed the row: age %v", row["age"].Val())
+	}
+
+	resp = makeIfMatchRequest(t, "PATCH", rowURL, map[string]interface{}{"age": 32}, `W/"2"`)
+	result = parseResponse(t, resp)
+	if result["error"] != nil || resp.Header.Get("ETag") != `"3"` {
+		t.Errorf("PATCH with weak current tag: %v, ETag %s", result["error"], resp.Header.Get("ETag"))
+	}
+
+	// Without If-Match the last write wins as before
+	resp = makeIfMatchRequest(t, "PATCH", rowURL, map[string]interface{}{"age": 33}, "")
+	if result = parseResponse(t, resp); result["error"] != nil {
+		t.Errorf("PATCH without If-Match: %v", result["error"])
+	}
+}
+
+func TestHTTP_SaveIfMatch(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	nodeURL := strings.TrimSuffix(baseURL, "/db/mydb/tables/users") + "/root/services/api"
+
+	// A node that was never saved is at version 0
+	resp := makeIfMatchRequest(t, "POST", nodeURL+"/save", map[string]interface{}{"port": 8080}, `"0"`)
+	result := parseResponse(t, resp)
+	if result["error"] != nil || resp.Header.Get("ETag") != `"1"` {
+		t.Fatalf("first save: %v, ETag %s", result["error"], resp.Header.Get("ETag"))
+	}
+
+	resp = makeIfMatchRequest(t, "POST", nodeURL+"/save", map[string]interface{}{"port": 9090}, `"0"`)
+	parseResponse(t, resp)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("stale save: status %d, want 412", resp.StatusCode)
+	}
+	if port, _ := tr.GetValue("root/services/api/port"); port != "8080" {
+		t.Errorf("stale save overwrote port: %s", port)
+	}
+
+	resp = makeRequest(t, "GET", nodeURL+"/values", nil, "test-token")
+	resp.Body.Close()
+	tag := resp.Header.Get("ETag")
+	if tag != `"1"` {
+		t.Errorf("GET values ETag = %s, want \"1\"", tag)
+	}
+
+	// A write through another path between GET and save is a conflict
+	tr.SetValue("root/services/api/host", "a")
+	resp = makeIfMatchRequest(t, "POST", nodeURL+"/save", map[string]interface{}{"port": 9090}, tag)
+	parseResponse(t, resp)
+	if resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("save over SetValue: status %d, want 412", resp.StatusCode)
+	}
+	if port, _ := tr.GetValue("root/services/api/port"); port != "8080" {
+		t.Errorf("save over SetValue overwrote port: %s", port)
+	}
+}
+
+func TestHTTP_TrashRestore(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	serverURL := strings.TrimSuffix(baseURL, "/db/mydb/tables/users")
+
+	result := parseResponse(t, makeRequest(t, "DELETE", baseURL+"/rows/user1?soft=true", nil, "test-token"))
+	if result["error"] != nil {
+		t.Fatalf("soft delete row: %v", result["error"])
+	}
+	rowTrashID := result["result"].(map[string]interface{})["trash_id"].(string)
+
+	tr.SetValue("root/services/api/port", "8080")
+	result = parseResponse(t, makeRequest(t, "POST", serverURL+"/root/services/api/trash", nil, "test-token"))
+	if result["error"] != nil {
+		t.Fatalf("soft delete node: %v", result["error"])
+	}
+
+	result = parseResponse(t, makeRequest(t, "GET", serverURL+"/trash/list", nil, "test-token"))
+	if entries := result["result"].([]interface{}); len(entries) != 2 {
+		t.Fatalf("Expected 2 trash entries, got %v", entries)
+	}
+
+	result = parseResponse(t, makeRequest(t, "POST", serverURL+"/trash/"+rowTrashID+"/restore", nil, "test-token"))
+	if result["error"] != nil {
+		t.Fatalf("restore: %v", result["error"])
+	}
+	if row, err := tr.GetRow("root/mydb/users", "user1"); err != nil || row["name"].AsString() != "Alice" {
+		t.Errorf("restored row = %v, %v", row, err)
+	}
+
+	result = parseResponse(t, makeRequest(t, "POST", serverURL+"/trash/purge", nil, "test-token"))
+	if result["result"].(map[string]interface{})["purged"].(float64) != 1 {
+		t.Errorf("Expected 1 purged entry, got %v", result["result"])
+	}
+}
+
+func TestHTTP_CopyMoveNode(t *testing.T) {
+	tr, tmpfile, baseURL := setupDatabaseHTTPServer(t)
+	defer cleanupDatabaseHTTPServer(tr, tmpfile)
+
+	serverURL := strings.TrimSuffix(baseURL, "/db/mydb/tables/users")
+	tr.SetValue("root/services/api/port", "8080")
+
+	result := parseResponse(t, makeRequest(t, "POST", serverURL+"/root/services/api/copy?to=root/services/api2", nil, "test-token"))
+	if result["error"] != nil {
+		t.Fatalf("copy: %v", result["error"])
+	}
+	result = parseResponse(t, makeRequest(t, "POST", serverURL+"/root/services/api/copy?to=root/services/api2", nil, "test-token"))
+	if result["error"] == nil {
+		t.Error("expected error copying onto an existing node")
+	}
+
+	result = parseResponse(t, makeRequest(t, "POST", serverURL+"/root/services/api2/move?to=root/services/web", nil, "test-token"))
+	if result["error"] != nil {
+		t.Fatalf("move: %v", result["error"])
+	}
+	if v, _ := tr.GetValue("root/services/web/port"); v != "8080" {
+		t.Errorf("moved value = %q", v)
+	}
+	if v, _ := tr.GetValue("root/services/api2/port"); v != "" {
+		t.Error("moved node still exists at source")
+	}
+}
@@ -1,14 +1,20 @@
 package blueconfig
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/sfi2k7/blueconfig/models"
 	"github.com/sfi2k7/blueconfig/parser"
+	"go.etcd.io/bbolt"
 )
 
 // ============================================================================
@@ -3192,7 +3198,7 @@ func TestCountWhere(t *testing.T) {
 	})
 
 	// Count users with age > 26
-	count, err := tree.CountWhere("root/mydb/users", "age > 26")
+	count, err := tree.CountWhere("root/mydb/users", "age > 26", nil)
 	if err != nil {
 		t.Fatalf("CountWhere failed: %v", err)
 	}
@@ -3227,7 +3233,7 @@ func TestUpdateRowsWhere(t *testing.T) {
 	// Update all pending users to active
 	count, err := tree.UpdateRowsWhere("root/mydb/users", `status == "pending"`, map[string]interface{}{
 		"status": "active",
-	})
+	}, nil)
 
 	if err != nil {
 		t.Fatalf("UpdateRowsWhere failed: %v", err)
@@ -3264,7 +3270,7 @@ func TestDeleteRowsWhere(t *testing.T) {
 	})
 
 	// Delete users with age < 30
-	count, err := tree.DeleteRowsWhere("root/mydb/users", "age < 30")
+	count, err := tree.DeleteRowsWhere("root/mydb/users", "age < 30", nil)
 	if err != nil {
 		t.Fatalf("DeleteRowsWhere failed: %v", err)
 	}
@@ -3330,7 +3336,7 @@ func TestExistsWhere(t *testing.T) {
 	})
 
 	// Check if Alice exists
-	exists, err := tree.ExistsWhere("root/mydb/users", `name == "Alice"`)
+	exists, err := tree.ExistsWhere("root/mydb/users", `name == "Alice"`, nil)
 	if err != nil {
 		t.Fatalf("ExistsWhere failed: %v", err)
 	}
@@ -3340,12 +3346,234 @@ func TestExistsWhere(t *testing.T) {
 	}
 
 	// Check if Bob exists
-	exists, _ = tree.ExistsWhere("root/mydb/users", `name == "Bob"`)
+	exists, _ = tree.ExistsWhere("root/mydb/users", `name == "Bob"`, nil)
 	if exists {
 		t.Error("Expected Bob not to exist")
 	}
 }
 
+func TestQueryMethodsReturnParseError(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.InsertRowWithID("root/mydb/users", "user1", models.Row{
+		"age": models.NewValue(30),
+	})
+
+	badQuery := "age >"
+	checkErr := func(method string, err error) {
+		t.Helper()
+		var pe *parser.ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: expected *parser.ParseError, got %v", method, err)
+			return
+		}
+		if pe.Line != 1 || pe.Column != 6 {
+			t.Errorf("%s: expected position 1:6, got %d:%d", method, pe.Line, pe.Column)
+		}
+	}
+
+	_, err := tree.FindRows("root/mydb/users", badQuery, nil)
+	checkErr("FindRows", err)
+	_, err = tree.FindRowsCursor("root/mydb/users", badQuery, nil)
+	checkErr("FindRowsCursor", err)
+	_, err = tree.CountWhere("root/mydb/users", badQuery, nil)
+	checkErr("CountWhere", err)
+	_, err = tree.UpdateRowsWhere("root/mydb/users", badQuery, map[string]interface{}{"age": 1}, nil)
+	checkErr("UpdateRowsWhere", err)
+	_, err = tree.DeleteRowsWhere("root/mydb/users", badQuery, nil)
+	checkErr("DeleteRowsWhere", err)
+	_, err = tree.FirstRow("root/mydb/users", badQuery, nil)
+	checkErr("FirstRow", err)
+	_, err = tree.ExistsWhere("root/mydb/users", badQuery, nil)
+	checkErr("ExistsWhere", err)
+
+	// Row must be untouched
+	if exists, _ := tree.RowExists("root/mydb/users", "user1"); !exists {
+		t.Error("Expected user1 to survive failed DeleteRowsWhere")
+	}
+}
+
+func TestQueryVarsAndFunctions(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.InsertRowWithID("root/mydb/users", "user1", models.NewRow(map[string]interface{}{
+		"email": "alice@example.com", "age": 30,
+	}))
+	tree.InsertRowWithID("root/mydb/users", "user2", models.NewRow(map[string]interface{}{
+		"email": "bob@other.org", "age": 25,
+	}))
+	tree.InsertRowWithID("root/mydb/users", "user3", models.NewRow(map[string]interface{}{
+		"email": "carol@example.com", "age": 35,
+	}))
+
+	err := tree.RegisterFunction("domain", func(args ...any) (any, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("domain() expects 1 argument, got %d", len(args))
+		}
+		email := fmt.Sprintf("%v", args[0])
+		return email[strings.Index(email, "@")+1:], nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterFunction failed: %v", err)
+	}
+	if err := tree.RegisterFunction("", nil); err == nil {
+		t.Error("Expected error registering unnamed function")
+	}
+
+	vars := map[string]interface{}{"domain": "example.com", "minAge": 31}
+	query := "domain(email) == $domain && age >= $minAge"
+
+	rows, err := tree.FindRows("root/mydb/users", query, &QueryOptions{Vars: vars})
+	if err != nil {
+		t.Fatalf("FindRows failed: %v", err)
+	}
+	if len(rows) != 1 || rows[0]["email"].AsString() != "carol@example.com" {
+		t.Errorf("Expected only carol, got %v", rows)
+	}
+
+	cursor, err := tree.FindRowsCursor("root/mydb/users", "domain(email) == $domain", &QueryOptions{Vars: vars})
+	if err != nil {
+		t.Fatalf("FindRowsCursor failed: %v", err)
+	}
+	if cursor.Count() != 2 {
+		t.Errorf("Expected cursor count 2, got %d", cursor.Count())
+	}
+
+	count, err := tree.CountWhere("root/mydb/users", "domain(email) == $domain", vars)
+	if err != nil {
+		t.Fatalf("CountWhere failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected count 2, got %d", count)
+	}
+
+	updated, err := tree.UpdateRowsWhere("root/mydb/users", "domain(email) != $domain", map[string]interface{}{"external": true}, vars)
+	if err != nil {
+		t.Fatalf("UpdateRowsWhere failed: %v", err)
+	}
+	if updated != 1 {
+		t.Errorf("Expected 1 updated, got %d", updated)
+	}
+
+	deleted, err := tree.DeleteRowsWhere("root/mydb/users", "age < $minAge", vars)
+	if err != nil {
+		t.Fatalf("DeleteRowsWhere failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 deleted, got %d", deleted)
+	}
+
+	// Unregistered functions no longer match
+	tree.UnregisterFunction("domain")
+	count, _ = tree.CountWhere("root/mydb/users", "domain(email) == $domain", vars)
+	if count != 0 {
+		t.Errorf("Expected 0 matches after UnregisterFunction, got %d", count)
+	}
+}
+
+func TestExecuteStatement(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	for i := 1; i <= 6; i++ {
+		tree.InsertRowWithID("root/mydb/users", fmt.Sprintf("user%d", i), models.NewRow(map[string]interface{}{
+			"name": fmt.Sprintf("User%d", i),
+			"age":  20 + i*5,
+			"address": map[string]interface{}{
+				"city": fmt.Sprintf("City%d", i),
+			},
+		}))
+	}
+
+	rows, err := tree.ExecuteStatement("root/mydb", "USE users; SELECT name, address.city WHERE age > 30 ORDER BY name DESC LIMIT 2 OFFSET 1", nil)
+	if err != nil {
+		t.Fatalf("ExecuteStatement failed: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(rows))
+	}
+	if rows[0]["name"].AsString() != "User5" || rows[1]["name"].AsString() != "User4" {
+		t.Errorf("Expected User5, User4; got %s, %s", rows[0]["name"].AsString(), rows[1]["name"].AsString())
+	}
+	if rows[0]["address.city"].AsString() != "City5" {
+		t.Errorf("Expected projected address.city City5, got %v", rows[0]["address.city"])
+	}
+	if _, exists := rows[0]["age"]; exists {
+		t.Error("Expected age to be excluded by projection")
+	}
+
+	// SELECT * without WHERE returns full rows
+	rows, err = tree.ExecuteStatement("root/mydb/users", "SELECT * ORDER BY age LIMIT 1", nil)
+	if err != nil {
+		t.Fatalf("ExecuteStatement failed: %v", err)
+	}
+	if len(rows) != 1 || rows[0]["name"].AsString() != "User1" || rows[0]["age"] == nil {
+		t.Errorf("Expected full row for User1, got %v", rows)
+	}
+
+	// Variables are passed through to the WHERE clause
+	rows, _ = tree.ExecuteStatement("root/mydb", "USE users; SELECT name WHERE age >= $minAge", map[string]interface{}{"minAge": 45})
+	if len(rows) != 2 {
+		t.Errorf("Expected 2 rows with age >= 45, got %d", len(rows))
+	}
+
+	// Offset beyond the result set returns nothing
+	rows, _ = tree.ExecuteStatement("root/mydb", "USE users; SELECT name OFFSET 0", nil)
+	if len(rows) != 6 {
+		t.Errorf("Expected 6 rows, got %d", len(rows))
+	}
+	rows, _ = tree.ExecuteStatement("root/mydb", "USE users; SELECT name LIMIT 5 OFFSET 10", nil)
+	if len(rows) != 0 {
+		t.Errorf("Expected 0 rows past the end, got %d", len(rows))
+	}
+
+	if _, err := tree.ExecuteStatement("root/mydb", "USE orders; SELECT *", nil); err == nil {
+		t.Error("Expected error for unknown collection")
+	}
+	if _, err := tree.ExecuteStatement("root/mydb", "USE users; SELECT name WHERE", nil); err == nil {
+		t.Error("Expected parse error")
+	}
+}
+
+func TestFindRowsResolvesCollection(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateTable("root/mydb", "orders")
+	tree.InsertRowWithID("root/mydb/users", "user1", models.NewRow(map[string]interface{}{"age": 30}))
+
+	rows, err := tree.FindRows("root/mydb", "USE users; age == 30", nil)
+	if err != nil {
+		t.Fatalf("FindRows failed: %v", err)
+	}
+	if len(rows) != 1 {
+		t.Errorf("Expected 1 row, got %d", len(rows))
+	}
+
+	count, err := tree.CountWhere("root/mydb", "USE users; age > 0", nil)
+	if err != nil || count != 1 {
+		t.Errorf("Expected count 1, got %d (%v)", count, err)
+	}
+
+	// A table path with a matching USE is fine, a mismatched one is not
+	if _, err := tree.FindRows("root/mydb/users", "USE users; age == 30", nil); err != nil {
+		t.Errorf("Expected matching USE to succeed, got %v", err)
+	}
+	if _, err := tree.FindRows("root/mydb/orders", "USE users; age == 30", nil); err == nil {
+		t.Error("Expected error for USE naming a different table")
+	}
+}
+
 func TestFindRowsCursor(t *testing.T) {
 	tree := setupDatabaseTest(t)
 	defer teardownDatabaseTest(t, tree)
@@ -3713,6 +3941,127 @@ func TestTransactionIsActive(t *testing.T) {
 	}
 }
 
+func TestTransactionParity(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateIndex(table, "idx_email", []string{"email"}, true)
+
+	txn, err := tree.BeginTransaction()
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	defer txn.Rollback()
+
+	users := []struct {
+		id, name, email string
+		age             int
+	}{
+		{"u1", "Alice", "alice@x.com", 30},
+		{"u2", "Bob", "bob@x.com", 25},
+		{"u3", "Carol", "carol@x.com", 35},
+	}
+	for _, u := range users {
+		err := txn.InsertRowWithID(table, u.id, models.NewRow(map[string]interface{}{
+			"name": u.name, "email": u.email, "age": u.age,
+		}))
+		if err != nil {
+			t.Fatalf("insert %s: %v", u.id, err)
+		}
+	}
+
+	// Unique indexes are enforced against rows written earlier in the transaction
+	err = txn.InsertRowWithID(table, "u4", models.NewRow(map[string]interface{}{"email": "bob@x.com"}))
+	expectUniqueViolation(t, err, "u2")
+
+	if err := txn.UpdateRowFields(table, "u2", map[string]interface{}{"email": "robert@x.com"}); err != nil {
+		t.Fatalf("update in transaction: %v", err)
+	}
+
+	// Reads see the transaction's own writes
+	row, err := txn.GetRow(table, "u2")
+	if err != nil || row["email"].AsString() != "robert@x.com" {
+		t.Fatalf("txn.GetRow = %v, %v", row, err)
+	}
+
+	found, err := txn.FindRows(table, `email == "robert@x.com"`, nil)
+	if err != nil || len(found) != 1 || found[0]["name"].AsString() != "Bob" {
+		t.Fatalf("txn.FindRows by index = %v, %v", found, err)
+	}
+	if found, _ := txn.FindRows(table, `email == "bob@x.com"`, nil); len(found) != 0 {
+		t.Errorf("old index key still matches: %v", found)
+	}
+
+	found, err = txn.FindRows(table, "age > 26", &QueryOptions{
+		SortFields: []SortField{{FieldName: "age", Direction: SortDesc}},
+		Limit:      1,
+		Fields:     []string{"name"},
+	})
+	if err != nil || len(found) != 1 || found[0]["name"].AsString() != "Carol" || len(found[0]) != 1 {
+		t.Fatalf("txn.FindRows sorted = %v, %v", found, err)
+	}
+
+	var scanned []string
+	err = txn.ScanRows(table, func(rowID string, row models.Row) error {
+		scanned = append(scanned, rowID)
+		return nil
+	})
+	if err != nil || len(scanned) != 3 {
+		t.Fatalf("txn.ScanRows = %v, %v", scanned, err)
+	}
+
+	if err := txn.DeleteRow(table, "u3"); err != nil {
+		t.Fatalf("delete in transaction: %v", err)
+	}
+
+	if err := txn.Commit(); err != nil {
+		t.Fatalf("Failed to commit transaction: %v", err)
+	}
+
+	// Schema, counts and indexes match what Tree writes would have produced
+	if count, _ := tree.GetRowCount(table); count != 2 {
+		t.Errorf("row count = %d, want 2", count)
+	}
+	schema, _ := tree.GetTableSchema(table)
+	if schema == nil || schema.Fields["email"] == "" || schema.Fields["age"] == "" {
+		t.Errorf("schema not evolved by transaction writes: %+v", schema)
+	}
+	if ids, _ := tree.lookupIndex(table, "idx_email", "robert@x.com"); len(ids) != 1 || ids[0] != "u2" {
+		t.Errorf("index entry for u2 = %v", ids)
+	}
+	if ids, _ := tree.lookupIndex(table, "idx_email", "carol@x.com"); len(ids) != 0 {
+		t.Errorf("deleted row still indexed: %v", ids)
+	}
+	if found, _ := tree.FindRows(table, `email == "alice@x.com"`, nil); len(found) != 1 {
+		t.Errorf("Tree.FindRows misses transaction writes: %v", found)
+	}
+}
+
+func TestTransactionReadsAfterEnd(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.InsertRowWithID("root/mydb/users", "u1", models.NewRow(map[string]interface{}{"name": "Alice"}))
+
+	txn, _ := tree.BeginReadTransaction()
+	if row, err := txn.GetRow("root/mydb/users", "u1"); err != nil || row["name"].AsString() != "Alice" {
+		t.Fatalf("read transaction GetRow = %v, %v", row, err)
+	}
+	txn.Rollback()
+
+	if _, err := txn.GetRow("root/mydb/users", "u1"); err == nil {
+		t.Error("GetRow should fail after rollback")
+	}
+	if _, err := txn.FindRows("root/mydb/users", "", nil); err == nil {
+		t.Error("FindRows should fail after rollback")
+	}
+}
+
 // ============================================================================
 // Upsert Tests
 // ============================================================================
@@ -3850,6 +4199,71 @@ func TestUpsertMany(t *testing.T) {
 	}
 }
 
+func TestUpsertManyIsAtomic(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateIndex(table, "idx_email", []string{"email"}, true)
+	tree.InsertRowWithID(table, "user1", models.NewRow(map[string]interface{}{"name": "Alice", "email": "alice@example.com"}))
+
+	// user3 collides with user2, so nothing may be written
+	_, _, err := tree.UpsertMany(table, map[string]models.Row{
+		"user1": models.NewRow(map[string]interface{}{"name": "Alice Updated", "email": "alice@example.com"}),
+		"user2": models.NewRow(map[string]interface{}{"name": "Bob", "email": "bob@example.com"}),
+		"user3": models.NewRow(map[string]interface{}{"name": "Bobby", "email": "bob@example.com"}),
+	})
+	if err == nil {
+		t.Fatal("Expected UpsertMany to fail on a unique violation")
+	}
+
+	if count, _ := tree.CountRows(table); count != 1 {
+		t.Errorf("Expected 1 row after a failed UpsertMany, got %d", count)
+	}
+	if row, _ := tree.GetRow(table, "user1"); row["name"].AsString() != "Alice" {
+		t.Errorf("user1 was updated by a failed UpsertMany: %v", row["name"].AsString())
+	}
+}
+
+func TestConcurrentUpsert(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+
+	// Every upsert of the same ID succeeds and exactly one inserts
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	inserts := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inserted, err := tree.Upsert(table, "user1", models.NewRow(map[string]interface{}{"name": "Alice", "n": i}))
+			if err != nil {
+				t.Errorf("Upsert %d: %v", i, err)
+			}
+			if inserted {
+				mu.Lock()
+				inserts++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if inserts != 1 {
+		t.Errorf("Expected 1 insert, got %d", inserts)
+	}
+	if count, _ := tree.CountRows(table); count != 1 {
+		t.Errorf("Expected row count 1, got %d", count)
+	}
+}
+
 func TestUpsertFields(t *testing.T) {
 	tree := setupDatabaseTest(t)
 	defer teardownDatabaseTest(t, tree)
@@ -4335,68 +4749,326 @@ func TestSetFieldIfNotExists(t *testing.T) {
 	}
 }
 
-// ============================================================================
-// Join Operation Tests
-// ============================================================================
-
-func TestInnerJoin(t *testing.T) {
+func TestIncrementFieldConcurrent(t *testing.T) {
 	tree := setupDatabaseTest(t)
 	defer teardownDatabaseTest(t, tree)
 
 	tree.CreateDatabase("root/mydb", nil)
-	tree.CreateTable("root/mydb", "users")
-	tree.CreateTable("root/mydb", "orders")
+	tree.CreateTable("root/mydb", "counters")
+	tree.InsertRowWithID("root/mydb/counters", "c1", models.NewRow(map[string]interface{}{"count": 0}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 4; j++ {
+				if _, err := tree.IncrementField("root/mydb/counters", "c1", "count", 1); err != nil {
+					t.Errorf("IncrementField: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// No increment fails or is lost
+	row, _ := tree.GetRow("root/mydb/counters", "c1")
+	if count, _ := row["count"].AsInt64(); count != 200 {
+		t.Errorf("count = %d, want 200", count)
+	}
+}
 
-	// Insert users
-	tree.InsertRowWithID("root/mydb/users", "u1", models.NewRow(map[string]interface{}{"user_id": "1", "name": "Alice"}))
-	tree.InsertRowWithID("root/mydb/users", "u2", models.NewRow(map[string]interface{}{"user_id": "2", "name": "Bob"}))
-	tree.InsertRowWithID("root/mydb/users", "u3", models.NewRow(map[string]interface{}{"user_id": "3", "name": "Charlie"}))
+func TestModifyRowOptimisticRetriesConflicts(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
 
-	// Insert orders (only for users 1 and 2)
-	tree.InsertRowWithID("root/mydb/orders", "o1", models.NewRow(map[string]interface{}{"user_id": "1", "amount": 100}))
-	tree.InsertRowWithID("root/mydb/orders", "o2", models.NewRow(map[string]interface{}{"user_id": "1", "amount": 200}))
-	tree.InsertRowWithID("root/mydb/orders", "o3", models.NewRow(map[string]interface{}{"user_id": "2", "amount": 150}))
+	table := "root/mydb/accounts"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "accounts")
+	tree.InsertRowWithID(table, "a1", models.NewRow(map[string]interface{}{"balance": 100}))
 
-	// Inner join
-	results, err := tree.InnerJoin("root/mydb/users", "root/mydb/orders", "user_id", "user_id")
-	if err != nil {
-		t.Fatalf("InnerJoin failed: %v", err)
+	if v, _ := tree.RowVersion(table, "a1"); v != 1 {
+		t.Fatalf("version after insert = %d, want 1", v)
 	}
 
-	// Should return 3 results (user1 with 2 orders, user2 with 1 order)
-	// User3 has no orders, so not included
-	if len(results) != 3 {
-		t.Errorf("Expected 3 join results, got %d", len(results))
+	// A concurrent writer sneaks in after the first read
+	attempts := 0
+	version, err := tree.ModifyRowOptimistic(table, "a1", func(row models.Row) (map[string]interface{}, error) {
+		attempts++
+		if attempts == 1 {
+			tree.UpdateRowFields(table, "a1", map[string]interface{}{"balance": 50})
+		}
+		balance, _ := row["balance"].AsInt64()
+		return map[string]interface{}{"balance": balance + 10}, nil
+	})
+	if err != nil {
+		t.Fatalf("ModifyRowOptimistic: %v", err)
+	}
+	if attempts != 2 || version != 3 {
+		t.Errorf("attempts = %d, version = %d; want 2 and 3", attempts, version)
+	}
+	row, _ := tree.GetRow(table, "a1")
+	if balance, _ := row["balance"].AsInt64(); balance != 60 {
+		t.Errorf("balance = %d, want 60 (retry must see the concurrent write)", balance)
 	}
 
-	// Verify one of the results
-	found := false
-	for _, r := range results {
-		if r.LeftRow["name"].AsString() == "Alice" && r.RightRow["amount"].AsString() == "100" {
-			found = true
-			break
-		}
+	// A writer that always wins exhausts the retries
+	_, err = tree.ModifyRowOptimistic(table, "a1", func(row models.Row) (map[string]interface{}, error) {
+		tree.UpdateRowFields(table, "a1", map[string]interface{}{"balance": 0})
+		return map[string]interface{}{"balance": 1}, nil
+	}, TxnOptions{MaxRetries: 2})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("expected ErrVersionConflict, got %v", err)
 	}
-	if !found {
-		t.Error("Expected to find Alice with order amount 100")
+
+	err = tree.Update(func(txn *Transaction) error {
+		_, err := txn.UpdateRowFieldsIfVersion(table, "a1", 1, map[string]interface{}{"balance": 5})
+		return err
+	})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("stale version: expected ErrVersionConflict, got %v", err)
 	}
 }
 
-func TestLeftJoin(t *testing.T) {
+func TestUpdateRowExpectedVersion(t *testing.T) {
 	tree := setupDatabaseTest(t)
 	defer teardownDatabaseTest(t, tree)
 
+	table := "root/mydb/users"
 	tree.CreateDatabase("root/mydb", nil)
 	tree.CreateTable("root/mydb", "users")
-	tree.CreateTable("root/mydb", "orders")
+	tree.InsertRowWithID(table, "u1", models.NewRow(map[string]interface{}{"name": "Alice"}))
 
-	// Insert users
-	tree.InsertRowWithID("root/mydb/users", "u1", models.NewRow(map[string]interface{}{"user_id": "1", "name": "Alice"}))
-	tree.InsertRowWithID("root/mydb/users", "u2", models.NewRow(map[string]interface{}{"user_id": "2", "name": "Bob"}))
-	tree.InsertRowWithID("root/mydb/users", "u3", models.NewRow(map[string]interface{}{"user_id": "3", "name": "Charlie"}))
+	if err := tree.UpdateRowFields(table, "u1", map[string]interface{}{"name": "Alicia"}, 1); err != nil {
+		t.Fatalf("update at current version: %v", err)
+	}
 
-	// Insert orders (only for users 1 and 2)
-	tree.InsertRowWithID("root/mydb/orders", "o1", models.NewRow(map[string]interface{}{"user_id": "1", "amount": 100}))
+	err := tree.UpdateRow(table, "u1", models.NewRow(map[string]interface{}{"name": "Al"}), 1)
+	var conflict *VersionConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected VersionConflictError, got %v", err)
+	}
+	if conflict.Current != 2 || conflict.Expected != 1 {
+		t.Errorf("conflict = %+v, want current 2, expected 1", conflict)
+	}
+
+	row, _ := tree.GetRow(table, "u1")
+	if row["name"].AsString() != "Alicia" {
+		t.Errorf("conflicting update changed the row: %v", row["name"].Val())
+	}
+
+	// The version is metadata: reads leave it out, and writing it back
+	// neither sets it nor widens the schema
+	if _, exists := row[VersionField]; exists {
+		t.Errorf("GetRow returned %s", VersionField)
+	}
+	rows, _ := tree.FindRows(table, "name == 'Alicia'", nil)
+	if len(rows) != 1 || rows[0][VersionField] != nil {
+		t.Errorf("FindRows = %v", rows)
+	}
+	tree.Update(func(txn *Transaction) error {
+		if txnRow, _ := txn.GetRow(table, "u1"); txnRow[VersionField] != nil {
+			t.Errorf("Transaction.GetRow returned %s", VersionField)
+		}
+		return nil
+	})
+
+	row[VersionField] = models.NewValue(int64(99))
+	row["name"] = models.NewValue("Ali")
+	if err := tree.UpdateRow(table, "u1", row); err != nil {
+		t.Fatalf("update with read row: %v", err)
+	}
+	if v, _ := tree.RowVersion(table, "u1"); v != 3 {
+		t.Errorf("version = %d, want 3", v)
+	}
+	if schema, _ := tree.GetTableSchema(table); schema.Fields[VersionField] != "" {
+		t.Errorf("schema picked up %s", VersionField)
+	}
+}
+
+// ============================================================================
+// Managed Transaction Tests
+// ============================================================================
+
+func TestUpdateAndView(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	alice := models.NewRow(map[string]interface{}{"name": "Alice"})
+
+	// nil commits
+	err := tree.Update(func(txn *Transaction) error {
+		return txn.InsertRowWithID(table, "u1", alice)
+	})
+	if err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if exists, _ := tree.RowExists(table, "u1"); !exists {
+		t.Error("row not committed")
+	}
+
+	// An error rolls back and is returned as is
+	failed := errors.New("stop")
+	err = tree.Update(func(txn *Transaction) error {
+		txn.InsertRowWithID(table, "u2", alice)
+		return failed
+	})
+	if err != failed {
+		t.Errorf("Update error = %v, want %v", err, failed)
+	}
+	if exists, _ := tree.RowExists(table, "u2"); exists {
+		t.Error("row from failed Update was committed")
+	}
+
+	// A panic rolls back and is re-raised
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic was swallowed")
+			}
+		}()
+		tree.Update(func(txn *Transaction) error {
+			txn.InsertRowWithID(table, "u3", alice)
+			panic("boom")
+		})
+	}()
+	if exists, _ := tree.RowExists(table, "u3"); exists {
+		t.Error("row from panicking Update was committed")
+	}
+
+	// Managed transactions are finished by Update, not by the caller
+	err = tree.Update(func(txn *Transaction) error {
+		return txn.Commit()
+	})
+	if err == nil {
+		t.Error("manual Commit inside Update should fail")
+	}
+
+	var name string
+	err = tree.View(func(txn *Transaction) error {
+		row, err := txn.GetRow(table, "u1")
+		if err != nil {
+			return err
+		}
+		name = row["name"].AsString()
+		return txn.InsertRowWithID(table, "u4", alice)
+	})
+	if name != "Alice" || err == nil {
+		t.Errorf("View read %q, write error %v; want Alice and a read-only error", name, err)
+	}
+}
+
+func TestUpdateTimeout(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	alice := models.NewRow(map[string]interface{}{"name": "Alice"})
+
+	// Waiting for the write lock times out
+	held, err := tree.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tree.Update(func(txn *Transaction) error {
+		return txn.InsertRowWithID(table, "u1", alice)
+	}, TxnOptions{Timeout: 50 * time.Millisecond})
+	held.Rollback()
+	if !errors.Is(err, ErrTxnTimeout) {
+		t.Fatalf("expected ErrTxnTimeout while the lock is held, got %v", err)
+	}
+
+	// Work that finishes after the deadline is rolled back
+	err = tree.Update(func(txn *Transaction) error {
+		if err := txn.InsertRowWithID(table, "u2", alice); err != nil {
+			return err
+		}
+		time.Sleep(60 * time.Millisecond)
+		return nil
+	}, TxnOptions{Timeout: 20 * time.Millisecond})
+	if !errors.Is(err, ErrTxnTimeout) {
+		t.Errorf("expected ErrTxnTimeout for slow work, got %v", err)
+	}
+	if exists, _ := tree.RowExists(table, "u2"); exists {
+		t.Error("timed out Update was committed")
+	}
+
+	// The abandoned transaction is released once acquired
+	err = tree.Update(func(txn *Transaction) error {
+		return txn.InsertRowWithID(table, "u3", alice)
+	}, TxnOptions{Timeout: time.Second})
+	if err != nil {
+		t.Errorf("Update after timeouts: %v", err)
+	}
+}
+
+// ============================================================================
+// Join Operation Tests
+// ============================================================================
+
+func TestInnerJoin(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateTable("root/mydb", "orders")
+
+	// Insert users
+	tree.InsertRowWithID("root/mydb/users", "u1", models.NewRow(map[string]interface{}{"user_id": "1", "name": "Alice"}))
+	tree.InsertRowWithID("root/mydb/users", "u2", models.NewRow(map[string]interface{}{"user_id": "2", "name": "Bob"}))
+	tree.InsertRowWithID("root/mydb/users", "u3", models.NewRow(map[string]interface{}{"user_id": "3", "name": "Charlie"}))
+
+	// Insert orders (only for users 1 and 2)
+	tree.InsertRowWithID("root/mydb/orders", "o1", models.NewRow(map[string]interface{}{"user_id": "1", "amount": 100}))
+	tree.InsertRowWithID("root/mydb/orders", "o2", models.NewRow(map[string]interface{}{"user_id": "1", "amount": 200}))
+	tree.InsertRowWithID("root/mydb/orders", "o3", models.NewRow(map[string]interface{}{"user_id": "2", "amount": 150}))
+
+	// Inner join
+	results, err := tree.InnerJoin("root/mydb/users", "root/mydb/orders", "user_id", "user_id")
+	if err != nil {
+		t.Fatalf("InnerJoin failed: %v", err)
+	}
+
+	// Should return 3 results (user1 with 2 orders, user2 with 1 order)
+	// User3 has no orders, so not included
+	if len(results) != 3 {
+		t.Errorf("Expected 3 join results, got %d", len(results))
+	}
+
+	// Verify one of the results
+	found := false
+	for _, r := range results {
+		if r.LeftRow["name"].AsString() == "Alice" && r.RightRow["amount"].AsString() == "100" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("Expected to find Alice with order amount 100")
+	}
+}
+
+func TestLeftJoin(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateTable("root/mydb", "orders")
+
+	// Insert users
+	tree.InsertRowWithID("root/mydb/users", "u1", models.NewRow(map[string]interface{}{"user_id": "1", "name": "Alice"}))
+	tree.InsertRowWithID("root/mydb/users", "u2", models.NewRow(map[string]interface{}{"user_id": "2", "name": "Bob"}))
+	tree.InsertRowWithID("root/mydb/users", "u3", models.NewRow(map[string]interface{}{"user_id": "3", "name": "Charlie"}))
+
+	// Insert orders (only for users 1 and 2)
+	tree.InsertRowWithID("root/mydb/orders", "o1", models.NewRow(map[string]interface{}{"user_id": "1", "amount": 100}))
 	tree.InsertRowWithID("root/mydb/orders", "o2", models.NewRow(map[string]interface{}{"user_id": "2", "amount": 150}))
 
 	// Left join
@@ -4423,6 +5095,309 @@ func TestLeftJoin(t *testing.T) {
 	}
 }
 
+// setupJoinTables creates customers and orders keyed by (region, customer)
+func setupJoinTables(t *testing.T, tree *Tree) {
+	t.Helper()
+	tree.CreateDatabase("root/shop", nil)
+	tree.CreateTable("root/shop", "customers")
+	tree.CreateTable("root/shop", "orders")
+
+	customers := map[string]map[string]interface{}{
+		"c1": {"region": "eu", "cid": "1", "name": "Alice"},
+		"c2": {"region": "us", "cid": "1", "name": "Bob"},
+		"c3": {"region": "eu", "cid": "2", "name": "Carol"},
+		"c4": {"region": "eu", "name": "NoID"},
+	}
+	for id, data := range customers {
+		if err := tree.InsertRowWithID("root/shop/customers", id, models.NewRow(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	orders := map[string]map[string]interface{}{
+		"o1": {"region": "eu", "cid": "1", "amount": 100},
+		"o2": {"region": "eu", "cid": "1", "amount": 250},
+		"o3": {"region": "us", "cid": "1", "amount": 75},
+		"o4": {"region": "us", "cid": "9", "amount": 10},
+	}
+	for id, data := range orders {
+		if err := tree.InsertRowWithID("root/shop/orders", id, models.NewRow(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// joinPairs renders join results as sorted "left:right" pairs
+func joinPairs(results []JoinResult) string {
+	pairs := make([]string, len(results))
+	for i, r := range results {
+		pairs[i] = r.LeftID + ":" + r.RightID
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func TestJoinTypes(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupJoinTables(t, tree)
+
+	tests := []struct {
+		joinType JoinType
+		expected string
+	}{
+		{JoinInner, "c1:o1,c1:o2,c2:o3"},
+		{JoinLeft, "c1:o1,c1:o2,c2:o3,c3:,c4:"},
+		{JoinRight, ":o4,c1:o1,c1:o2,c2:o3"},
+		{JoinFull, ":o4,c1:o1,c1:o2,c2:o3,c3:,c4:"},
+		{JoinAnti, "c3:,c4:"},
+		{JoinSemi, "c1:,c2:"},
+	}
+
+	for _, tt := range tests {
+		results, err := tree.collectJoin(JoinSpec{
+			LeftTable:   "root/shop/customers",
+			RightTable:  "root/shop/orders",
+			LeftFields:  []string{"region", "cid"},
+			RightFields: []string{"region", "cid"},
+			Type:        tt.joinType,
+		})
+		if err != nil {
+			t.Fatalf("join type %d failed: %v", tt.joinType, err)
+		}
+		if got := joinPairs(results); got != tt.expected {
+			t.Errorf("join type %d: expected %s, got %s", tt.joinType, tt.expected, got)
+		}
+	}
+
+	// Right join results keep their original orientation
+	results, _ := tree.collectJoin(JoinSpec{
+		LeftTable:   "root/shop/customers",
+		RightTable:  "root/shop/orders",
+		LeftFields:  []string{"region", "cid"},
+		RightFields: []string{"region", "cid"},
+		Type:        JoinRight,
+	})
+	for _, r := range results {
+		if r.RightRow == nil || r.RightRow["amount"] == nil {
+			t.Errorf("Expected order on right side, got %+v", r)
+		}
+	}
+
+	if _, err := tree.collectJoin(JoinSpec{
+		LeftTable:   "root/shop/customers",
+		RightTable:  "root/shop/orders",
+		LeftFields:  []string{"region", "cid"},
+		RightFields: []string{"region"},
+	}); err == nil {
+		t.Error("Expected error for mismatched key fields")
+	}
+}
+
+func TestJoinFiltersAndProjection(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupJoinTables(t, tree)
+
+	results, err := tree.collectJoin(JoinSpec{
+		LeftTable:   "root/shop/customers",
+		RightTable:  "root/shop/orders",
+		LeftFields:  []string{"region", "cid"},
+		RightFields: []string{"region", "cid"},
+		LeftWhere:   "region == 'eu'",
+		RightWhere:  "amount > $min",
+		LeftSelect:  []string{"name"},
+		RightSelect: []string{"amount"},
+		Vars:        map[string]interface{}{"min": 150},
+	})
+	if err != nil {
+		t.Fatalf("Join failed: %v", err)
+	}
+
+	if joinPairs(results) != "c1:o2" {
+		t.Fatalf("Expected only c1:o2, got %s", joinPairs(results))
+	}
+	r := results[0]
+	if r.LeftRow["name"].AsString() != "Alice" || r.RightRow["amount"].AsString() != "250" {
+		t.Errorf("Unexpected projected rows: %v / %v", r.LeftRow, r.RightRow)
+	}
+	if _, exists := r.LeftRow["region"]; exists {
+		t.Error("Expected left projection to exclude region")
+	}
+}
+
+func TestJoinUsesIndexes(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupJoinTables(t, tree)
+
+	spec := JoinSpec{
+		LeftTable:   "root/shop/customers",
+		RightTable:  "root/shop/orders",
+		LeftFields:  []string{"region", "cid"},
+		RightFields: []string{"region", "cid"},
+	}
+
+	plan, _ := tree.PlanJoin(spec)
+	if plan.Strategy != JoinStrategyHash {
+		t.Errorf("Expected hash join without indexes, got %d", plan.Strategy)
+	}
+
+	tree.CreateIndex("root/shop/orders", "idx_region_cid", []string{"region", "cid"}, false)
+	plan, _ = tree.PlanJoin(spec)
+	if plan.Strategy != JoinStrategyIndex || plan.RightIndex != "idx_region_cid" {
+		t.Errorf("Expected index join on idx_region_cid, got %+v", plan)
+	}
+	results, _ := tree.collectJoin(spec)
+	if got := joinPairs(results); got != "c1:o1,c1:o2,c2:o3" {
+		t.Errorf("Index join: unexpected results %s", got)
+	}
+
+	tree.CreateIndex("root/shop/customers", "idx_cust_region_cid", []string{"region", "cid"}, false)
+	plan, _ = tree.PlanJoin(spec)
+	if plan.Strategy != JoinStrategyMerge || plan.LeftIndex != "idx_cust_region_cid" {
+		t.Errorf("Expected merge join, got %+v", plan)
+	}
+	results, _ = tree.collectJoin(spec)
+	if got := joinPairs(results); got != "c1:o1,c1:o2,c2:o3" {
+		t.Errorf("Merge join: unexpected results %s", got)
+	}
+
+	// Left joins can't merge (null keys are not indexed) but still use the right index
+	spec.Type = JoinLeft
+	plan, _ = tree.PlanJoin(spec)
+	if plan.Strategy != JoinStrategyIndex {
+		t.Errorf("Expected index join for left join, got %+v", plan)
+	}
+	results, _ = tree.collectJoin(spec)
+	if got := joinPairs(results); got != "c1:o1,c1:o2,c2:o3,c3:,c4:" {
+		t.Errorf("Indexed left join: unexpected results %s", got)
+	}
+
+	// Right joins swap sides, so the customers index becomes the lookup index
+	spec.Type = JoinRight
+	plan, _ = tree.PlanJoin(spec)
+	if plan.Strategy != JoinStrategyIndex || plan.LeftIndex != "idx_cust_region_cid" {
+		t.Errorf("Expected right join to look up customers index, got %+v", plan)
+	}
+	results, _ = tree.collectJoin(spec)
+	if got := joinPairs(results); got != ":o4,c1:o1,c1:o2,c2:o3" {
+		t.Errorf("Indexed right join: unexpected results %s", got)
+	}
+}
+
+func TestJoinStreaming(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupJoinTables(t, tree)
+
+	spec := JoinSpec{
+		LeftTable:   "root/shop/customers",
+		RightTable:  "root/shop/orders",
+		LeftFields:  []string{"region", "cid"},
+		RightFields: []string{"region", "cid"},
+	}
+
+	// Callback can stop the join early
+	count := 0
+	err := tree.Join(spec, func(r JoinResult) error {
+		count++
+		return ErrStopJoin
+	})
+	if err != nil || count != 1 {
+		t.Errorf("Expected 1 result and no error after ErrStopJoin, got %d (%v)", count, err)
+	}
+
+	// Cursor yields every result
+	cursor, err := tree.JoinCursor(spec)
+	if err != nil {
+		t.Fatalf("JoinCursor failed: %v", err)
+	}
+	var results []JoinResult
+	for cursor.Next() {
+		results = append(results, cursor.Result())
+	}
+	cursor.Close()
+	if cursor.Err() != nil {
+		t.Errorf("Unexpected cursor error: %v", cursor.Err())
+	}
+	if got := joinPairs(results); got != "c1:o1,c1:o2,c2:o3" {
+		t.Errorf("Cursor: unexpected results %s", got)
+	}
+
+	// Closing early stops the producer
+	cursor, _ = tree.JoinCursor(spec)
+	if !cursor.Next() {
+		t.Fatal("Expected at least one result")
+	}
+	cursor.Close()
+	for cursor.Next() {
+	}
+
+	// Filter errors surface through Err
+	spec.LeftWhere = "region =="
+	cursor, _ = tree.JoinCursor(spec)
+	for cursor.Next() {
+	}
+	if cursor.Err() == nil {
+		t.Error("Expected error from invalid left filter")
+	}
+	cursor.Close()
+
+	if _, err := tree.JoinCursor(JoinSpec{LeftTable: "root/shop/missing"}); err == nil {
+		t.Error("Expected error for invalid table")
+	}
+}
+
+func TestJoinSingleTransaction(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupJoinTables(t, tree)
+
+	spec := JoinSpec{
+		LeftTable:   "root/shop/customers",
+		RightTable:  "root/shop/orders",
+		LeftFields:  []string{"region", "cid"},
+		RightFields: []string{"region", "cid"},
+		Type:        JoinLeft,
+		RightWhere:  "amount > 0",
+	}
+
+	// Read transactions opened by one join must not grow with the row count
+	joinTxns := func() int {
+		before := tree.db.Stats().TxN
+		if _, err := tree.collectJoin(spec); err != nil {
+			t.Fatalf("Join failed: %v", err)
+		}
+		return tree.db.Stats().TxN - before
+	}
+
+	for _, step := range []struct {
+		name  string
+		setup func()
+	}{
+		{"hash", func() {}},
+		{"index", func() {
+			tree.CreateIndex("root/shop/orders", "idx_order_region_cid", []string{"region", "cid"}, false)
+		}},
+		{"merge", func() {
+			spec.Type = JoinInner
+			tree.CreateIndex("root/shop/customers", "idx_cust_region_cid", []string{"region", "cid"}, false)
+		}},
+	} {
+		step.setup()
+		small := joinTxns()
+		for i := 0; i < 5; i++ {
+			id := fmt.Sprintf("%s%d", step.name, i)
+			tree.InsertRowWithID("root/shop/customers", id, models.NewRow(map[string]interface{}{"region": "eu", "cid": id}))
+			tree.InsertRowWithID("root/shop/orders", id, models.NewRow(map[string]interface{}{"region": "eu", "cid": id, "amount": i + 1}))
+		}
+		if large := joinTxns(); large != small {
+			t.Errorf("%s join: %d read transactions with more rows, %d before", step.name, large, small)
+		}
+	}
+}
+
 // ============================================================================
 // Aggregation Tests
 // ============================================================================
@@ -4573,38 +5548,134 @@ func TestGroupBy(t *testing.T) {
 	}
 }
 
-// ============================================================================
-// Subquery Tests
-// ============================================================================
-
-func TestExistsInSubquery(t *testing.T) {
+func TestGroupByQuery(t *testing.T) {
 	tree := setupDatabaseTest(t)
 	defer teardownDatabaseTest(t, tree)
 
 	tree.CreateDatabase("root/mydb", nil)
-	tree.CreateTable("root/mydb", "customers")
-	tree.CreateTable("root/mydb", "orders")
-
-	// Insert customers
-	tree.InsertRowWithID("root/mydb/customers", "c1", models.NewRow(map[string]interface{}{"customer_id": "1", "name": "Alice"}))
-	tree.InsertRowWithID("root/mydb/customers", "c2", models.NewRow(map[string]interface{}{"customer_id": "2", "name": "Bob"}))
-	tree.InsertRowWithID("root/mydb/customers", "c3", models.NewRow(map[string]interface{}{"customer_id": "3", "name": "Charlie"}))
-
-	// Insert orders (only for customers 1 and 2)
-	tree.InsertRowWithID("root/mydb/orders", "o1", models.NewRow(map[string]interface{}{"customer_id": "1"}))
-	tree.InsertRowWithID("root/mydb/orders", "o2", models.NewRow(map[string]interface{}{"customer_id": "2"}))
-
-	// Check which customers have orders
-	results, err := tree.ExistsInSubquery("root/mydb/customers", "customer_id", "root/mydb/orders", "customer_id")
+	tree.CreateTable("root/mydb", "requests")
+
+	data := []map[string]interface{}{
+		{"region": "West", "status": "ok", "amount": 100, "latency": 10, "user": "a"},
+		{"region": "West", "status": "ok", "amount": 50, "latency": 30, "user": "b"},
+		{"region": "West", "status": "ok", "amount": 25, "latency": 20, "user": "a"},
+		{"region": "West", "status": "error", "amount": 5, "latency": 900, "user": "c"},
+		{"region": "East", "status": "ok", "amount": 200, "latency": 15, "user": "d"},
+		{"region": "East", "status": "error", "amount": 1, "latency": 500, "user": "d"},
+		{"region": "East", "status": "error", "amount": 2, "latency": 700, "user": "e"},
+	}
+	for i, d := range data {
+		tree.InsertRowWithID("root/mydb/requests", fmt.Sprintf("r%d", i), models.NewRow(d))
+	}
+
+	groups, err := tree.GroupByQuery("root/mydb/requests", GroupByOptions{
+		GroupBy: []string{"region", "status"},
+		Aggregates: []AggregateSpec{
+			{Func: AggCount},
+			{Func: AggSum, Field: "amount"},
+			{Func: AggAvg, Field: "latency"},
+			{Func: AggMin, Field: "latency"},
+			{Func: AggMax, Field: "latency", Alias: "slowest"},
+			{Func: AggCountDistinct, Field: "user"},
+		},
+	})
 	if err != nil {
-		t.Fatalf("ExistsInSubquery failed: %v", err)
+		t.Fatalf("GroupByQuery failed: %v", err)
 	}
 
-	if !results["c1"] {
-		t.Error("Customer c1 should exist in orders")
+	if len(groups) != 4 {
+		t.Fatalf("Expected 4 groups, got %d", len(groups))
 	}
 
-	if !results["c2"] {
+	// Groups are ordered by keys: East/error, East/ok, West/error, West/ok
+	westOK := groups[3]
+	if westOK.Keys["region"] != "West" || westOK.Keys["status"] != "ok" {
+		t.Fatalf("Expected West/ok last, got %v", westOK.Keys)
+	}
+	aggs := westOK.Aggregates
+	if aggs["count"] != 3 {
+		t.Errorf("Expected count 3, got %v", aggs["count"])
+	}
+	if aggs["sum_amount"] != float64(175) {
+		t.Errorf("Expected sum 175, got %v", aggs["sum_amount"])
+	}
+	if aggs["avg_latency"] != float64(20) {
+		t.Errorf("Expected avg 20, got %v", aggs["avg_latency"])
+	}
+	if fmt.Sprint(aggs["min_latency"]) != "10" || fmt.Sprint(aggs["slowest"]) != "30" {
+		t.Errorf("Expected min 10 / max 30, got %v / %v", aggs["min_latency"], aggs["slowest"])
+	}
+	if aggs["count_distinct_user"] != 2 {
+		t.Errorf("Expected 2 distinct users, got %v", aggs["count_distinct_user"])
+	}
+
+	// WHERE filters rows, HAVING filters groups
+	groups, err = tree.GroupByQuery("root/mydb/requests", GroupByOptions{
+		GroupBy:    []string{"region"},
+		Aggregates: []AggregateSpec{{Func: AggCount, Alias: "errors"}},
+		Where:      "status == 'error'",
+		Having:     "errors >= $min",
+		Vars:       map[string]interface{}{"min": 2},
+	})
+	if err != nil {
+		t.Fatalf("GroupByQuery with WHERE/HAVING failed: %v", err)
+	}
+	if len(groups) != 1 || groups[0].Keys["region"] != "East" || groups[0].Aggregates["errors"] != 2 {
+		t.Errorf("Expected only East with 2 errors, got %+v", groups)
+	}
+
+	// No group keys aggregates the whole table
+	groups, _ = tree.GroupByQuery("root/mydb/requests", GroupByOptions{
+		Aggregates: []AggregateSpec{{Func: AggCountDistinct, Field: "region"}},
+	})
+	if len(groups) != 1 || groups[0].Aggregates["count_distinct_region"] != 2 {
+		t.Errorf("Expected single group with 2 regions, got %+v", groups)
+	}
+
+	// Invalid specifications
+	if _, err := tree.GroupByQuery("root/mydb/requests", GroupByOptions{Aggregates: []AggregateSpec{{Func: "median", Field: "amount"}}}); err == nil {
+		t.Error("Expected error for unsupported aggregate")
+	}
+	if _, err := tree.GroupByQuery("root/mydb/requests", GroupByOptions{Aggregates: []AggregateSpec{{Func: AggSum}}}); err == nil {
+		t.Error("Expected error for sum without field")
+	}
+	if _, err := tree.GroupByQuery("root/mydb/requests", GroupByOptions{Where: "amount >"}); err == nil {
+		t.Error("Expected error for invalid WHERE")
+	}
+}
+
+// ============================================================================
+// Subquery Tests
+// ============================================================================
+
+func TestExistsInSubquery(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "customers")
+	tree.CreateTable("root/mydb", "orders")
+
+	// Insert customers
+	tree.InsertRowWithID("root/mydb/customers", "c1", models.NewRow(map[string]interface{}{"customer_id": "1", "name": "Alice"}))
+	tree.InsertRowWithID("root/mydb/customers", "c2", models.NewRow(map[string]interface{}{"customer_id": "2", "name": "Bob"}))
+	tree.InsertRowWithID("root/mydb/customers", "c3", models.NewRow(map[string]interface{}{"customer_id": "3", "name": "Charlie"}))
+
+	// Insert orders (only for customers 1 and 2)
+	tree.InsertRowWithID("root/mydb/orders", "o1", models.NewRow(map[string]interface{}{"customer_id": "1"}))
+	tree.InsertRowWithID("root/mydb/orders", "o2", models.NewRow(map[string]interface{}{"customer_id": "2"}))
+
+	// Check which customers have orders
+	results, err := tree.ExistsInSubquery("root/mydb/customers", "customer_id", "root/mydb/orders", "customer_id")
+	if err != nil {
+		t.Fatalf("ExistsInSubquery failed: %v", err)
+	}
+
+	if !results["c1"] {
+		t.Error("Customer c1 should exist in orders")
+	}
+
+	if !results["c2"] {
 		t.Error("Customer c2 should exist in orders")
 	}
 
@@ -4663,3 +5734,1145 @@ func TestInSubquery(t *testing.T) {
 	}
 }
 
+// ============================================================================
+// Foreign Key Tests
+// ============================================================================
+
+// setupForeignKeyTables creates authors, posts (author_id -> authors row ID) and
+// comments (post_slug -> posts.slug)
+func setupForeignKeyTables(t *testing.T, tree *Tree, postsOnDelete, commentsOnDelete ForeignKeyAction) {
+	t.Helper()
+	tree.CreateDatabase("root/blog", nil)
+	tree.CreateTable("root/blog", "authors")
+	tree.CreateTable("root/blog", "posts")
+	tree.CreateTable("root/blog", "comments")
+
+	if err := tree.AddForeignKey("root/blog/posts", "author_id", "root/blog/authors", "", postsOnDelete); err != nil {
+		t.Fatalf("AddForeignKey posts: %v", err)
+	}
+	if err := tree.AddForeignKey("root/blog/comments", "post_slug", "root/blog/posts", "slug", commentsOnDelete); err != nil {
+		t.Fatalf("AddForeignKey comments: %v", err)
+	}
+
+	rows := []struct {
+		table, id string
+		data      map[string]interface{}
+	}{
+		{"authors", "a1", map[string]interface{}{"name": "Alice"}},
+		{"authors", "a2", map[string]interface{}{"name": "Bob"}},
+		{"posts", "p1", map[string]interface{}{"slug": "hello", "author_id": "a1"}},
+		{"posts", "p2", map[string]interface{}{"slug": "world", "author_id": "a1"}},
+		{"posts", "p3", map[string]interface{}{"slug": "other", "author_id": "a2"}},
+		{"comments", "c1", map[string]interface{}{"post_slug": "hello", "text": "nice"}},
+		{"comments", "c2", map[string]interface{}{"post_slug": "other", "text": "meh"}},
+	}
+	for _, r := range rows {
+		if err := tree.InsertRowWithID("root/blog/"+r.table, r.id, models.NewRow(r.data)); err != nil {
+			t.Fatalf("insert %s/%s: %v", r.table, r.id, err)
+		}
+	}
+}
+
+func TestForeignKeyInsertAndUpdate(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupForeignKeyTables(t, tree, FKRestrict, FKRestrict)
+
+	fks, err := tree.GetForeignKeys("root/blog/posts")
+	if err != nil || len(fks) != 1 || fks[0].ParentTable != "root/blog/authors" || fks[0].OnDelete != FKRestrict {
+		t.Fatalf("GetForeignKeys = %+v, %v", fks, err)
+	}
+
+	_, err = tree.InsertRow("root/blog/posts", models.NewRow(map[string]interface{}{"slug": "x", "author_id": "nobody"}))
+	if !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("InsertRow with missing parent: got %v", err)
+	}
+
+	// Null references are allowed
+	if _, err := tree.InsertRow("root/blog/posts", models.NewRow(map[string]interface{}{"slug": "draft"})); err != nil {
+		t.Errorf("InsertRow without reference: %v", err)
+	}
+
+	if err := tree.UpdateRowFields("root/blog/comments", "c1", map[string]interface{}{"post_slug": "missing"}); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("UpdateRowFields with missing parent: got %v", err)
+	}
+	if err := tree.UpdateRowFields("root/blog/comments", "c1", map[string]interface{}{"post_slug": "world"}); err != nil {
+		t.Errorf("UpdateRowFields with valid parent: %v", err)
+	}
+
+	// A referenced parent key cannot change under its children
+	if err := tree.UpdateRowFields("root/blog/posts", "p3", map[string]interface{}{"slug": "renamed"}); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("changing referenced key: got %v", err)
+	}
+	if err := tree.UpdateRowFields("root/blog/posts", "p1", map[string]interface{}{"slug": "unused"}); err != nil {
+		t.Errorf("changing unreferenced key: %v", err)
+	}
+
+	// Bulk and transactional writes are checked too
+	_, err = tree.BulkInsert("root/blog/comments", map[string]models.Row{
+		"c9": models.NewRow(map[string]interface{}{"post_slug": "missing"}),
+	})
+	if !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("BulkInsert with missing parent: got %v", err)
+	}
+	if exists, _ := tree.RowExists("root/blog/comments", "c9"); exists {
+		t.Error("BulkInsert should not have stored c9")
+	}
+
+	// Existing orphans block a new constraint
+	tree.CreateTable("root/blog", "likes")
+	tree.InsertRowWithID("root/blog/likes", "l1", models.NewRow(map[string]interface{}{"author_id": "ghost"}))
+	if err := tree.AddForeignKey("root/blog/likes", "author_id", "root/blog/authors", "", FKCascade); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("AddForeignKey over orphan rows: got %v", err)
+	}
+
+	if err := tree.DropForeignKey("root/blog/comments", "post_slug"); err != nil {
+		t.Fatalf("DropForeignKey: %v", err)
+	}
+	if err := tree.UpdateRowFields("root/blog/comments", "c1", map[string]interface{}{"post_slug": "missing"}); err != nil {
+		t.Errorf("update after DropForeignKey: %v", err)
+	}
+}
+
+func TestForeignKeyParentIndex(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupForeignKeyTables(t, tree, FKRestrict, FKRestrict)
+
+	if err := tree.CreateIndex("root/blog/posts", "idx_slug", []string{"slug"}, false); err != nil {
+		t.Fatalf("CreateIndex: %v", err)
+	}
+	if err := tree.InsertRowWithID("root/blog/comments", "c3", models.NewRow(map[string]interface{}{"post_slug": "world"})); err != nil {
+		t.Errorf("insert with indexed parent: %v", err)
+	}
+	if err := tree.InsertRowWithID("root/blog/comments", "c4", models.NewRow(map[string]interface{}{"post_slug": "missing"})); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("insert with missing indexed parent: got %v", err)
+	}
+
+	// The check reads the index: a slug written around it is not found
+	tree.SetValue("root/blog/posts/p2/slug", "unindexed")
+	if err := tree.InsertRowWithID("root/blog/comments", "c5", models.NewRow(map[string]interface{}{"post_slug": "unindexed"})); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("insert with unindexed parent value: got %v", err)
+	}
+}
+
+func TestForeignKeyOnDelete(t *testing.T) {
+	tests := []struct {
+		name      string
+		posts     ForeignKeyAction
+		comments  ForeignKeyAction
+		expectErr bool
+		posts2    []string // remaining posts
+		comments2 []string // remaining comments
+		c1Slug    string   // post_slug of c1 afterwards
+	}{
+		{"restrict", FKRestrict, FKRestrict, true, []string{"p1", "p2", "p3"}, []string{"c1", "c2"}, "hello"},
+		{"cascade", FKCascade, FKCascade, false, []string{"p3"}, []string{"c2"}, ""},
+		{"cascade then set null", FKCascade, FKSetNull, false, []string{"p3"}, []string{"c1", "c2"}, "null"},
+		{"cascade then restrict", FKCascade, FKRestrict, true, []string{"p1", "p2", "p3"}, []string{"c1", "c2"}, "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tree := setupDatabaseTest(t)
+			defer teardownDatabaseTest(t, tree)
+			setupForeignKeyTables(t, tree, tt.posts, tt.comments)
+
+			err := tree.DeleteRow("root/blog/authors", "a1")
+			if tt.expectErr != errors.Is(err, ErrForeignKeyViolation) {
+				t.Fatalf("DeleteRow error = %v, expectErr %v", err, tt.expectErr)
+			}
+
+			posts, _ := tree.ListRows("root/blog/posts")
+			comments, _ := tree.ListRows("root/blog/comments")
+			sort.Strings(posts)
+			sort.Strings(comments)
+			if strings.Join(posts, ",") != strings.Join(tt.posts2, ",") {
+				t.Errorf("posts = %v, want %v", posts, tt.posts2)
+			}
+			if strings.Join(comments, ",") != strings.Join(tt.comments2, ",") {
+				t.Errorf("comments = %v, want %v", comments, tt.comments2)
+			}
+			if count, _ := tree.GetRowCount("root/blog/posts"); count != len(tt.posts2) {
+				t.Errorf("posts row count = %d, want %d", count, len(tt.posts2))
+			}
+
+			if tt.c1Slug != "" {
+				row, err := tree.GetRow("root/blog/comments", "c1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := "null"
+				if v, ok := row["post_slug"]; ok && !v.IsNull() {
+					got = fmt.Sprintf("%v", v.Val())
+				}
+				if got != tt.c1Slug {
+					t.Errorf("c1.post_slug = %s, want %s", got, tt.c1Slug)
+				}
+			}
+		})
+	}
+}
+
+func TestForeignKeyTransactionDelete(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupForeignKeyTables(t, tree, FKCascade, FKCascade)
+
+	txn, err := tree.BeginTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.DeleteRow("root/blog/authors", "a2"); err != nil {
+		t.Fatalf("txn.DeleteRow: %v", err)
+	}
+	if err := txn.InsertRowWithID("root/blog/posts", "p9", models.NewRow(map[string]interface{}{"author_id": "a2"})); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("insert referencing a row deleted in the transaction: got %v", err)
+	}
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"root/blog/authors/a2", "root/blog/posts/p3", "root/blog/comments/c2"} {
+		if _, err := tree.GetNodesInPath(path); err == nil {
+			t.Errorf("%s should have been deleted", path)
+		}
+	}
+
+	// BulkDelete restricts as a whole
+	tree.AddForeignKey("root/blog/comments", "author", "root/blog/authors", "", FKRestrict)
+	tree.UpdateRowFields("root/blog/comments", "c1", map[string]interface{}{"author": "a1"})
+	if _, err := tree.BulkDelete("root/blog/authors", []string{"a1"}); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("BulkDelete of restricted parent: got %v", err)
+	}
+	if _, err := tree.GetNodesInPath("root/blog/posts/p1"); err != nil {
+		t.Error("failed BulkDelete should have rolled back cascades")
+	}
+}
+
+// ============================================================================
+// Declared Schema Tests
+// ============================================================================
+
+func floatPtr(f float64) *float64 { return &f }
+
+// setupDeclaredSchema creates root/app/users with a declared schema
+func setupDeclaredSchema(t *testing.T, tree *Tree, strict bool) {
+	t.Helper()
+	tree.CreateDatabase("root/app", nil)
+	tree.CreateTable("root/app", "users")
+
+	err := tree.SetTableSchema("root/app/users", TableSchema{
+		Fields: map[string]string{"name": "string", "age": "int", "status": "string", "email": "string"},
+		Constraints: map[string]FieldConstraint{
+			"name":   {Required: true, Min: floatPtr(2)},
+			"age":    {Min: floatPtr(0), Max: floatPtr(150)},
+			"status": {Enum: []string{"active", "inactive"}, Default: "active"},
+			"email":  {Pattern: `^[^@]+@[^@]+$`},
+		},
+	}, strict)
+	if err != nil {
+		t.Fatalf("SetTableSchema: %v", err)
+	}
+}
+
+func TestSetTableSchemaStrict(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupDeclaredSchema(t, tree, true)
+
+	schema, err := tree.GetTableSchema("root/app/users")
+	if err != nil || schema == nil || !schema.Strict || !schema.Constraints["name"].Required {
+		t.Fatalf("GetTableSchema = %+v, %v", schema, err)
+	}
+
+	rowID, err := tree.InsertRow("root/app/users", models.NewRow(map[string]interface{}{"name": "Alice", "age": 30}))
+	if err != nil {
+		t.Fatalf("valid insert: %v", err)
+	}
+	row, _ := tree.GetRow("root/app/users", rowID)
+	if row["status"] == nil || row["status"].Val() != "active" {
+		t.Errorf("default status not applied: %v", row["status"])
+	}
+
+	// Every failing field is reported
+	_, err = tree.InsertRow("root/app/users", models.NewRow(map[string]interface{}{
+		"age": 200, "status": "banned", "email": "nope", "nickname": "x",
+	}))
+	var verr *SchemaValidationError
+	if !errors.As(err, &verr) {
+		t.Fatalf("expected SchemaValidationError, got %v", err)
+	}
+	var fields []string
+	for _, fe := range verr.Errors {
+		fields = append(fields, fe.Field)
+	}
+	if got := strings.Join(fields, ","); got != "age,email,nickname,status,name" {
+		t.Errorf("failed fields = %s\n%v", got, err)
+	}
+
+	// Unknown fields never widen a strict schema
+	schema, _ = tree.GetTableSchema("root/app/users")
+	if _, exists := schema.Fields["nickname"]; exists {
+		t.Error("strict schema should not have been widened")
+	}
+
+	// Partial updates skip required fields they do not touch
+	if err := tree.UpdateRowFields("root/app/users", rowID, map[string]interface{}{"age": 31}); err != nil {
+		t.Errorf("valid partial update: %v", err)
+	}
+	if err := tree.UpdateRowFields("root/app/users", rowID, map[string]interface{}{"name": "A"}); !errors.As(err, &verr) {
+		t.Errorf("name below min length: got %v", err)
+	}
+
+	// Transactional writes are validated as well
+	_, err = tree.BulkInsert("root/app/users", map[string]models.Row{
+		"u9": models.NewRow(map[string]interface{}{"age": 5}),
+	})
+	if !errors.As(err, &verr) || verr.Errors[0].Field != "name" {
+		t.Errorf("BulkInsert missing required field: got %v", err)
+	}
+}
+
+func TestSetTableSchemaNonStrict(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupDeclaredSchema(t, tree, false)
+
+	if _, err := tree.InsertRow("root/app/users", models.NewRow(map[string]interface{}{"name": "Bob", "nickname": "b"})); err != nil {
+		t.Fatalf("unknown field in non-strict schema: %v", err)
+	}
+	schema, _ := tree.GetTableSchema("root/app/users")
+	if _, exists := schema.Fields["nickname"]; !exists {
+		t.Error("non-strict schema should widen")
+	}
+	if !schema.Constraints["name"].Required {
+		t.Error("widening should keep declared constraints")
+	}
+
+	if _, err := tree.InsertRow("root/app/users", models.NewRow(map[string]interface{}{"name": "Bob", "status": "x"})); err == nil {
+		t.Error("enum should still be enforced")
+	}
+}
+
+func TestSetTableSchemaInvalid(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	tree.CreateDatabase("root/app", nil)
+	tree.CreateTable("root/app", "users")
+
+	tests := []struct {
+		name    string
+		schema  TableSchema
+		errPart string
+	}{
+		{"no fields", TableSchema{}, "at least one field"},
+		{"undeclared", TableSchema{
+			Fields:      map[string]string{"a": "string"},
+			Constraints: map[string]FieldConstraint{"b": {Required: true}},
+		}, "undeclared field 'b'"},
+		{"bad pattern", TableSchema{
+			Fields:      map[string]string{"a": "string"},
+			Constraints: map[string]FieldConstraint{"a": {Pattern: "("}},
+		}, "invalid pattern"},
+		{"min above max", TableSchema{
+			Fields:      map[string]string{"a": "int"},
+			Constraints: map[string]FieldConstraint{"a": {Min: floatPtr(5), Max: floatPtr(1)}},
+		}, "min greater than max"},
+		{"bad default", TableSchema{
+			Fields:      map[string]string{"a": "string"},
+			Constraints: map[string]FieldConstraint{"a": {Enum: []string{"x"}, Default: "y"}},
+		}, "invalid default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tree.SetTableSchema("root/app/users", tt.schema, true)
+			if err == nil || !strings.Contains(err.Error(), tt.errPart) {
+				t.Errorf("expected error containing %q, got %v", tt.errPart, err)
+			}
+		})
+	}
+}
+
+// ============================================================================
+// Migration Tests
+// ============================================================================
+
+// setupMigrationTable creates root/app/people with an index on city
+func setupMigrationTable(t *testing.T, tree *Tree) {
+	t.Helper()
+	tree.CreateDatabase("root/app", nil)
+	tree.CreateTable("root/app", "people")
+
+	people := map[string]map[string]interface{}{
+		"p1": {"full_name": "Ada Lovelace", "age": "36", "city": "London"},
+		"p2": {"full_name": "Alan Turing", "age": "41", "city": "Wilmslow"},
+		"p3": {"full_name": "Grace", "age": "85"},
+	}
+	for id, data := range people {
+		if err := tree.InsertRowWithID("root/app/people", id, models.NewRow(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tree.CreateIndex("root/app/people", "by_city", []string{"city"}, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reshapePeople renames city, converts age and splits full_name
+var reshapePeople = Migration{
+	Version: 1,
+	Name:    "reshape people",
+	Steps: []MigrationStep{
+		{Type: StepRenameField, Field: "city", To: "town"},
+		{Type: StepChangeType, Field: "age", To: "int"},
+		{Type: StepSplitField, Field: "full_name", Separator: " ", Into: []string{"first", "last"}},
+	},
+}
+
+func TestRunMigration(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupMigrationTable(t, tree)
+
+	// Dry run counts without writing
+	result, err := tree.RunMigration("root/app/people", reshapePeople, &MigrationOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if result.RowsScanned != 3 || result.RowsAffected != 3 || result.Batches != 0 {
+		t.Errorf("dry run result = %+v", result)
+	}
+	if row, _ := tree.GetRow("root/app/people", "p1"); row["full_name"] == nil {
+		t.Error("dry run should not rewrite rows")
+	}
+
+	result, err = tree.RunMigration("root/app/people", reshapePeople, &MigrationOptions{BatchSize: 2})
+	if err != nil {
+		t.Fatalf("RunMigration: %v", err)
+	}
+	if result.RowsAffected != 3 || result.Batches != 2 || strings.Join(result.IndexesRebuilt, ",") != "by_city" {
+		t.Errorf("result = %+v", result)
+	}
+
+	row, _ := tree.GetRow("root/app/people", "p1")
+	if row["first"].Val() != "Ada" || row["last"].Val() != "Lovelace" || row["town"].Val() != "London" || row["full_name"] != nil || row["city"] != nil {
+		t.Errorf("p1 after migration = %v", row)
+	}
+	if age, ok := row["age"].Val().(int64); !ok || age != 36 {
+		t.Errorf("age = %v (%T), want int64 36", row["age"].Val(), row["age"].Val())
+	}
+
+	schema, _ := tree.GetTableSchema("root/app/people")
+	if schema.Fields["age"] != "int" || schema.Fields["town"] == "" || schema.Fields["city"] != "" || schema.Fields["full_name"] != "" {
+		t.Errorf("schema after migration = %v", schema.Fields)
+	}
+
+	info, _ := tree.GetIndexInfo("root/app/people", "by_city")
+	ids, _ := tree.lookupIndex("root/app/people", "by_city", "London")
+	if strings.Join(info.Fields, ",") != "town" || strings.Join(ids, ",") != "p1" {
+		t.Errorf("index fields = %v, London -> %v", info.Fields, ids)
+	}
+
+	applied, _ := tree.AppliedMigrations("root/app/people")
+	if len(applied) != 1 || applied[0].Version != 1 || applied[0].RowsAffected != 3 || applied[0].PreviousFields["city"] == "" {
+		t.Errorf("applied = %+v", applied)
+	}
+	if _, err := tree.RunMigration("root/app/people", reshapePeople, nil); err == nil {
+		t.Error("re-running an applied version should fail")
+	}
+
+	// Backfill only fills missing values
+	backfill := Migration{Version: 2, Name: "initials", Steps: []MigrationStep{
+		{Type: StepBackfill, Field: "last", Expr: "'(unknown)'"},
+		{Type: StepBackfill, Field: "label", Expr: "concat(upper(first), ' from ', coalesce(town, '?'))"},
+	}}
+	result, err = tree.RunMigration("root/app/people", backfill, nil)
+	if err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+	row, _ = tree.GetRow("root/app/people", "p3")
+	if result.RowsAffected != 3 || row["last"].Val() != "(unknown)" || row["label"].Val() != "GRACE from ?" {
+		t.Errorf("backfill result = %+v, p3 = %v", result, row)
+	}
+
+	if _, err := tree.RollbackMigration("root/app/people", reshapePeople, nil); err == nil {
+		t.Error("only the latest migration can be rolled back")
+	}
+	if _, err := tree.RollbackMigration("root/app/people", backfill, nil); err == nil || !strings.Contains(err.Error(), "not reversible") {
+		t.Errorf("backfill rollback: got %v", err)
+	}
+}
+
+func TestRollbackMigration(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupMigrationTable(t, tree)
+
+	if _, err := tree.RunMigration("root/app/people", reshapePeople, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.RollbackMigration("root/app/people", reshapePeople, nil); err != nil {
+		t.Fatalf("RollbackMigration: %v", err)
+	}
+
+	row, _ := tree.GetRow("root/app/people", "p1")
+	if row["full_name"].Val() != "Ada Lovelace" || row["city"].Val() != "London" || row["first"] != nil || row["town"] != nil {
+		t.Errorf("p1 after rollback = %v", row)
+	}
+	row, _ = tree.GetRow("root/app/people", "p3")
+	if row["full_name"].Val() != "Grace" {
+		t.Errorf("p3 full_name = %v", row["full_name"].Val())
+	}
+
+	schema, _ := tree.GetTableSchema("root/app/people")
+	if schema.Fields["age"] != "string" || schema.Fields["city"] == "" || schema.Fields["town"] != "" {
+		t.Errorf("schema after rollback = %v", schema.Fields)
+	}
+	info, _ := tree.GetIndexInfo("root/app/people", "by_city")
+	if strings.Join(info.Fields, ",") != "city" {
+		t.Errorf("index fields after rollback = %v", info.Fields)
+	}
+	if applied, _ := tree.AppliedMigrations("root/app/people"); len(applied) != 0 {
+		t.Errorf("applied after rollback = %+v", applied)
+	}
+
+	// Separators are passed to the reverse expression as a variable
+	tree.CreateTable("root/app", "names")
+	tree.InsertRowWithID("root/app/names", "n1", models.NewRow(map[string]interface{}{"name": "O'Brien"}))
+	split := Migration{Version: 1, Steps: []MigrationStep{
+		{Type: StepSplitField, Field: "name", Separator: "'", Into: []string{"prefix", "rest"}},
+	}}
+	if _, err := tree.RunMigration("root/app/names", split, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.RollbackMigration("root/app/names", split, nil); err != nil {
+		t.Fatalf("RollbackMigration with a quote separator: %v", err)
+	}
+	if row, _ := tree.GetRow("root/app/names", "n1"); row["name"] == nil || row["name"].Val() != "O'Brien" {
+		t.Errorf("n1 after rollback = %v", row)
+	}
+}
+
+func TestRunMigrationResumesAfterFailedBatch(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupMigrationTable(t, tree)
+
+	// The validation pass converts all three ages; the write pass then
+	// fails on its second row
+	calls := 0
+	m := Migration{Version: 1, Steps: []MigrationStep{{
+		Type:  StepChangeType,
+		Field: "age",
+		To:    "string",
+		Convert: func(v interface{}) (interface{}, error) {
+			calls++
+			if calls == 5 {
+				return nil, errors.New("write failed")
+			}
+			return fmt.Sprintf("%v!", v), nil
+		},
+	}}}
+	if _, err := tree.RunMigration("root/app/people", m, &MigrationOptions{BatchSize: 1}); err == nil {
+		t.Fatal("expected the second batch to fail")
+	}
+	if applied, _ := tree.AppliedMigrations("root/app/people"); len(applied) != 0 {
+		t.Errorf("interrupted migration recorded: %+v", applied)
+	}
+	if _, err := tree.RunMigration("root/app/people", Migration{Version: 2}, nil); err == nil {
+		t.Error("another migration should wait for the interrupted one")
+	}
+
+	result, err := tree.RunMigration("root/app/people", m, &MigrationOptions{BatchSize: 1})
+	if err != nil {
+		t.Fatalf("resumed RunMigration: %v", err)
+	}
+	if result.RowsAffected != 3 || result.Batches != 3 {
+		t.Errorf("resumed result = %+v", result)
+	}
+	for id, age := range map[string]string{"p1": "36!", "p2": "41!", "p3": "85!"} {
+		if row, _ := tree.GetRow("root/app/people", id); fmt.Sprintf("%v", row["age"].Val()) != age {
+			t.Errorf("%s age = %v, want %s", id, row["age"].Val(), age)
+		}
+	}
+	if applied, _ := tree.AppliedMigrations("root/app/people"); len(applied) != 1 {
+		t.Errorf("applied = %+v", applied)
+	}
+}
+
+func TestRunMigrationFailsBeforeWriting(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupMigrationTable(t, tree)
+
+	m := Migration{Version: 1, Steps: []MigrationStep{
+		{Type: StepRenameField, Field: "age", To: "years"},
+		{Type: StepChangeType, Field: "full_name", To: "int"},
+	}}
+	if _, err := tree.RunMigration("root/app/people", m, &MigrationOptions{BatchSize: 1}); err == nil {
+		t.Fatal("expected conversion error")
+	}
+	if row, _ := tree.GetRow("root/app/people", "p1"); row["age"] == nil || row["years"] != nil {
+		t.Errorf("failed migration should not write rows: %v", row)
+	}
+
+	// A conversion func overrides the built-in cast
+	m.Steps[1].Convert = func(v interface{}) (interface{}, error) { return len(fmt.Sprintf("%v", v)), nil }
+	if _, err := tree.RunMigration("root/app/people", m, nil); err != nil {
+		t.Fatal(err)
+	}
+	if row, _ := tree.GetRow("root/app/people", "p3"); fmt.Sprintf("%v", row["full_name"].Val()) != "5" {
+		t.Errorf("converted full_name = %v", row["full_name"].Val())
+	}
+
+	bad := []MigrationStep{
+		{Type: StepRenameField, Field: "a"},
+		{Type: StepSplitField, Field: "a", Into: []string{"b"}},
+		{Type: StepBackfill, Field: "a", Expr: "1 +"},
+		{Type: "explode", Field: "a"},
+	}
+	for _, step := range bad {
+		if _, err := tree.RunMigration("root/app/people", Migration{Version: 9, Steps: []MigrationStep{step}}, nil); err == nil {
+			t.Errorf("expected error for step %+v", step)
+		}
+	}
+}
+
+// ============================================================================
+// Unique Constraint Tests
+// ============================================================================
+
+// expectUniqueViolation checks that err names the index and conflicting row
+func expectUniqueViolation(t *testing.T, err error, conflictingRowID string) {
+	t.Helper()
+	var uv *ErrUniqueViolation
+	if !errors.As(err, &uv) {
+		t.Fatalf("expected ErrUniqueViolation, got %v", err)
+	}
+	if uv.Index != "idx_email" || uv.ConflictingRowID != conflictingRowID {
+		t.Errorf("violation = %+v, want index idx_email held by %s", uv, conflictingRowID)
+	}
+}
+
+func TestUniqueViolation(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateIndex(table, "idx_email", []string{"email"}, true)
+	email := func(e string) models.Row { return models.NewRow(map[string]interface{}{"email": e}) }
+
+	if err := tree.InsertRowWithID(table, "u1", email("a@x.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.InsertRowWithID(table, "u2", email("b@x.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := tree.InsertRow(table, email("a@x.com"))
+	expectUniqueViolation(t, err, "u1")
+	if count, _ := tree.GetRowCount(table); count != 2 {
+		t.Errorf("row count after rejected insert = %d, want 2", count)
+	}
+	if rows, _ := tree.ListRows(table); len(rows) != 2 {
+		t.Errorf("rejected insert left rows behind: %v", rows)
+	}
+
+	expectUniqueViolation(t, tree.UpdateRow(table, "u2", email("a@x.com")), "u1")
+	expectUniqueViolation(t, tree.UpdateRowFields(table, "u2", map[string]interface{}{"email": "a@x.com"}), "u1")
+	if row, _ := tree.GetRow(table, "u2"); row["email"].Val() != "b@x.com" {
+		t.Errorf("rejected update changed the row: %v", row["email"].Val())
+	}
+
+	// Rewriting a row's own key is not a conflict
+	if err := tree.UpdateRow(table, "u1", email("a@x.com")); err != nil {
+		t.Errorf("update keeping own key: %v", err)
+	}
+
+	_, _, err = tree.UpsertMany(table, map[string]models.Row{"u3": email("b@x.com")})
+	expectUniqueViolation(t, err, "u2")
+
+	// Bulk inserts are all-or-nothing, including duplicates within the batch
+	_, err = tree.BulkInsert(table, map[string]models.Row{
+		"u4": email("c@x.com"),
+		"u5": email("c@x.com"),
+	})
+	var uv *ErrUniqueViolation
+	if !errors.As(err, &uv) || uv.Key != "c@x.com" {
+		t.Errorf("BulkInsert duplicate in batch: got %v", err)
+	}
+	if ids, _ := tree.lookupIndex(table, "idx_email", "c@x.com"); len(ids) != 0 {
+		t.Errorf("failed BulkInsert left index entries: %v", ids)
+	}
+
+	// Transactions see their own writes and can continue after a violation
+	txn, _ := tree.BeginTransaction()
+	defer txn.Rollback()
+	if err := txn.InsertRowWithID(table, "u6", email("d@x.com")); err != nil {
+		t.Fatal(err)
+	}
+	expectUniqueViolation(t, txn.InsertRowWithID(table, "u7", email("d@x.com")), "u6")
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := tree.lookupIndex(table, "idx_email", "d@x.com"); strings.Join(ids, ",") != "u6" {
+		t.Errorf("index after transaction = %v", ids)
+	}
+	if exists, _ := tree.RowExists(table, "u7"); exists {
+		t.Error("rejected transactional insert should not store the row")
+	}
+
+	// Deleting frees the key
+	if err := tree.DeleteRow(table, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.InsertRow(table, email("a@x.com")); err != nil {
+		t.Errorf("insert after delete: %v", err)
+	}
+}
+
+func TestUniqueIndexAllowsNulls(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateIndex(table, "idx_phone", []string{"phone"}, true)
+	phone := func(p interface{}) models.Row { return models.NewRow(map[string]interface{}{"name": "x", "phone": p}) }
+
+	if err := tree.InsertRowWithID(table, "u1", phone("555-1234")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.InsertRowWithID(table, "u2", phone(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.InsertRowWithID(table, "u3", phone(nil)); err != nil {
+		t.Errorf("second null under a unique index: %v", err)
+	}
+	if err := tree.UpdateRowFields(table, "u1", map[string]interface{}{"phone": nil}); err != nil {
+		t.Errorf("clearing a unique field to null: %v", err)
+	}
+	if ids, _ := tree.lookupIndex(table, "idx_phone", "null"); len(ids) != 0 {
+		t.Errorf("nulls were indexed: %v", ids)
+	}
+
+	// Rebuilding the index skips the stored nulls too
+	tree.DropIndex(table, "idx_phone")
+	if err := tree.CreateIndex(table, "idx_phone", []string{"phone"}, true); err != nil {
+		t.Errorf("CreateIndex over null values: %v", err)
+	}
+}
+
+func TestCreateUniqueIndexOverDuplicates(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.InsertRowWithID(table, "u1", models.NewRow(map[string]interface{}{"email": "a@example.com"}))
+	tree.InsertRowWithID(table, "u2", models.NewRow(map[string]interface{}{"email": "a@example.com"}))
+
+	var violation *ErrUniqueViolation
+	if err := tree.CreateIndex(table, "idx_email", []string{"email"}, true); !errors.As(err, &violation) {
+		t.Fatalf("CreateIndex over duplicates: got %v", err)
+	}
+
+	// The failed build leaves nothing behind, so the name is free again
+	if indexes, _ := tree.ListIndexes(table); len(indexes) != 0 {
+		t.Errorf("failed CreateIndex left indexes %v", indexes)
+	}
+	if err := tree.CreateIndex(table, "idx_email", []string{"email"}, false); err != nil {
+		t.Errorf("CreateIndex after a failed build: %v", err)
+	}
+}
+
+// snapshotBuckets flattens every bucket key and value under path
+func snapshotBuckets(t *testing.T, tree *Tree, path string) map[string]string {
+	t.Helper()
+	snap := make(map[string]string)
+	var walk func(prefix string, b *bbolt.Bucket)
+	walk = func(prefix string, b *bbolt.Bucket) {
+		b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				snap[prefix+"/"+string(k)+"/"] = ""
+				walk(prefix+"/"+string(k), b.Bucket(k))
+			} else {
+				snap[prefix+"/"+string(k)] = string(v)
+			}
+			return nil
+		})
+	}
+	err := tree.readTxn(func(txn *Transaction) error {
+		b, err := txn.bucketAt(path)
+		if err != nil {
+			return err
+		}
+		walk(path, b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("snapshot %s: %v", path, err)
+	}
+	return snap
+}
+
+func TestRowWriteFailpoints(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	setupForeignKeyTables(t, tree, FKCascade, FKSetNull)
+	tree.CreateIndex("root/blog/posts", "idx_slug", []string{"slug"}, true)
+
+	injected := errors.New("injected failure")
+	cases := []struct {
+		name  string
+		steps []string
+		op    func() error
+	}{
+		{"insert", []string{"schema", "indexes", "row", "count"}, func() error {
+			return tree.InsertRowWithID("root/blog/posts", "p9", models.NewRow(map[string]interface{}{
+				"slug": "new", "author_id": "a2", "draft": true,
+			}))
+		}},
+		{"update", []string{"schema", "indexes", "row"}, func() error {
+			return tree.UpdateRow("root/blog/posts", "p2", models.NewRow(map[string]interface{}{
+				"slug": "renamed", "author_id": "a1", "pinned": true,
+			}))
+		}},
+		{"update fields", []string{"schema", "indexes", "row"}, func() error {
+			return tree.UpdateRowFields("root/blog/posts", "p3", map[string]interface{}{"views": 10})
+		}},
+		{"delete with cascade", []string{"indexes", "row", "count"}, func() error {
+			return tree.DeleteRow("root/blog/authors", "a1")
+		}},
+	}
+
+	for _, tc := range cases {
+		for _, step := range tc.steps {
+			before := snapshotBuckets(t, tree, "root/blog")
+
+			hit := false
+			tree.rowWriteFailpoint = func(s string) error {
+				if s == step {
+					hit = true
+					return injected
+				}
+				return nil
+			}
+			err := tc.op()
+			tree.rowWriteFailpoint = nil
+
+			if !hit {
+				t.Errorf("%s: step %q was never reached", tc.name, step)
+				continue
+			}
+			if !errors.Is(err, injected) {
+				t.Errorf("%s failing at %q: got %v, want injected failure", tc.name, step, err)
+			}
+			if after := snapshotBuckets(t, tree, "root/blog"); !reflect.DeepEqual(before, after) {
+				t.Errorf("%s failing at %q left a partial write", tc.name, step)
+			}
+		}
+
+		// Without injected failures the same operation goes through
+		if err := tc.op(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+	}
+
+	if count, _ := tree.GetRowCount("root/blog/posts"); count != 2 {
+		t.Errorf("posts row count = %d, want 2 after cascade", count)
+	}
+	if row, _ := tree.GetRow("root/blog/comments", "c1"); row["post_slug"] != nil {
+		t.Errorf("comment c1 still references deleted post: %v", row["post_slug"].Val())
+	}
+}
+
+// ============================================================================
+// Trash Tests
+// ============================================================================
+
+func TestSoftDeleteNodeAndRestore(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.SetValue("root/services/api/port", "8080")
+	tree.SetValue("root/services/api/limits/rps", "100")
+
+	trashID, err := tree.SoftDeleteNode("/services/api")
+	if err != nil {
+		t.Fatalf("SoftDeleteNode: %v", err)
+	}
+	if _, err := tree.GetValue("root/services/api/port"); err == nil {
+		t.Error("node still present after soft delete")
+	}
+
+	entries, err := tree.ListTrash()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ListTrash = %v, %v", entries, err)
+	}
+	if e := entries[0]; e.ID != trashID || e.OriginalPath != "root/services/api" || e.Kind != TrashKindNode || time.Since(e.DeletedAt) > time.Minute {
+		t.Errorf("trash entry = %+v", e)
+	}
+
+	if _, err := tree.SoftDeleteNode("root/" + TrashNode); err == nil {
+		t.Error("soft deleting the trash should fail")
+	}
+
+	if err := tree.Restore(trashID); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if rps, _ := tree.GetValue("root/services/api/limits/rps"); rps != "100" {
+		t.Errorf("restored subtree rps = %q, want 100", rps)
+	}
+	if entries, _ := tree.ListTrash(); len(entries) != 0 {
+		t.Errorf("restored entry still in trash: %v", entries)
+	}
+
+	// A path reused after the delete blocks the restore
+	trashID, _ = tree.SoftDeleteNode("root/services/api")
+	tree.SetValue("root/services/api/port", "9090")
+	if err := tree.Restore(trashID); !errors.Is(err, ErrPathInUse) {
+		t.Errorf("Restore over reused path: expected ErrPathInUse, got %v", err)
+	}
+	if port, _ := tree.GetValue("root/services/api/port"); port != "9090" {
+		t.Errorf("failed restore changed the new node: port %s", port)
+	}
+}
+
+func TestSoftDeleteRow(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	table := "root/mydb/users"
+	tree.CreateDatabase("root/mydb", nil)
+	tree.CreateTable("root/mydb", "users")
+	tree.CreateIndex(table, "idx_email", []string{"email"}, true)
+	tree.InsertRowWithID(table, "u1", models.NewRow(map[string]interface{}{"email": "a@x.com"}))
+	tree.InsertRowWithID(table, "u2", models.NewRow(map[string]interface{}{"email": "b@x.com"}))
+	tree.UpdateRowFields(table, "u1", map[string]interface{}{"name": "Alice"})
+
+	trashID, err := tree.SoftDeleteRow(table, "u1")
+	if err != nil {
+		t.Fatalf("SoftDeleteRow: %v", err)
+	}
+	if count, _ := tree.GetRowCount(table); count != 1 {
+		t.Errorf("row count after soft delete = %d, want 1", count)
+	}
+	if ids, _ := tree.lookupIndex(table, "idx_email", "a@x.com"); len(ids) != 0 {
+		t.Errorf("soft deleted row still indexed: %v", ids)
+	}
+
+	// Restoring needs the unique key to be free again
+	tree.UpdateRowFields(table, "u2", map[string]interface{}{"email": "a@x.com"})
+	var uv *ErrUniqueViolation
+	if err := tree.Restore(trashID); !errors.As(err, &uv) {
+		t.Fatalf("Restore with taken key: expected ErrUniqueViolation, got %v", err)
+	}
+	tree.UpdateRowFields(table, "u2", map[string]interface{}{"email": "b@x.com"})
+
+	if err := tree.Restore(trashID); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	row, err := tree.GetRow(table, "u1")
+	if err != nil || row["name"].AsString() != "Alice" {
+		t.Fatalf("restored row = %v, %v", row, err)
+	}
+	if count, _ := tree.GetRowCount(table); count != 2 {
+		t.Errorf("row count after restore = %d, want 2", count)
+	}
+	if ids, _ := tree.lookupIndex(table, "idx_email", "a@x.com"); len(ids) != 1 || ids[0] != "u1" {
+		t.Errorf("restored row index entries = %v", ids)
+	}
+	if v, _ := tree.RowVersion(table, "u1"); v != 3 {
+		t.Errorf("restored version = %d, want 3", v)
+	}
+
+	// Row paths given to SoftDeleteNode go through the table as well
+	if _, err := tree.SoftDeleteNode(table + "/u2"); err != nil {
+		t.Fatalf("SoftDeleteNode on a row: %v", err)
+	}
+	if count, _ := tree.GetRowCount(table); count != 1 {
+		t.Errorf("row count after SoftDeleteNode on a row = %d, want 1", count)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.CreatePath("root/a")
+	tree.CreatePath("root/b")
+	oldID, _ := tree.SoftDeleteNode("root/a")
+	newID, _ := tree.SoftDeleteNode("root/b")
+
+	// Age the first entry by two days
+	twoDaysAgo := strconv.FormatInt(time.Now().Add(-48*time.Hour).Unix(), 10)
+	tree.SetValue("root/"+TrashNode+"/"+oldID+"/deleted_at", twoDaysAgo)
+
+	purged, err := tree.PurgeTrash(24 * time.Hour)
+	if err != nil || purged != 1 {
+		t.Fatalf("PurgeTrash(24h) = %d, %v; want 1", purged, err)
+	}
+	if err := tree.Restore(oldID); err == nil {
+		t.Error("purged entry should not be restorable")
+	}
+
+	entries, _ := tree.ListTrash()
+	if len(entries) != 1 || entries[0].ID != newID {
+		t.Errorf("remaining trash = %v", entries)
+	}
+
+	if purged, _ := tree.PurgeTrash(0); purged != 1 {
+		t.Errorf("PurgeTrash(0) = %d, want 1", purged)
+	}
+}
+
+func TestCopyNode(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+
+	tree.SetValue("root/services/api/port", "8080")
+	tree.SetValue("root/services/api/tls/enabled", "true")
+	if err := tree.CopyNode("root/services/api", "root/services/api2", false); err != nil {
+		t.Fatalf("CopyNode: %v", err)
+	}
+	if v, _ := tree.GetValue("root/services/api2/tls/enabled"); v != "true" {
+		t.Errorf("copied nested value = %q", v)
+	}
+	if v, _ := tree.GetValue("root/services/api/port"); v != "8080" {
+		t.Errorf("source value after copy = %q", v)
+	}
+
+	tree.SetValue("root/services/api/port", "9090")
+	tree.SetValue("root/services/api2/host", "a")
+	tree.SetValue("root/services/api2/host", "b")
+	replaced, _ := tree.NodeVersion("root/services/api2")
+	if err := tree.CopyNode("root/services/api", "root/services/api2", false); !errors.Is(err, ErrPathInUse) {
+		t.Errorf("CopyNode onto existing node: got %v", err)
+	}
+	if err := tree.CopyNode("root/services/api", "root/services/api2", true); err != nil {
+		t.Fatalf("CopyNode with overwrite: %v", err)
+	}
+	if v, _ := tree.GetValue("root/services/api2/port"); v != "9090" {
+		t.Errorf("overwritten value = %q", v)
+	}
+	if version, _ := tree.NodeVersion("root/services/api2"); version <= replaced {
+		t.Errorf("overwritten node version = %d, want above %d", version, replaced)
+	}
+	if err := tree.CopyNode("root/services", "root/services/api/inner", false); err == nil {
+		t.Error("expected error copying a node into itself")
+	}
+
+	// Copied tables keep rows, indexes and their references to outside parents
+	setupForeignKeyTables(t, tree, FKRestrict, FKRestrict)
+	tree.CreateIndex("root/blog/posts", "idx_slug", []string{"slug"}, true)
+	if err := tree.CopyNode("root/blog/posts", "root/archive/posts", false); err != nil {
+		t.Fatalf("CopyNode table: %v", err)
+	}
+	row, err := tree.GetRow("root/archive/posts", "p2")
+	if err != nil || row["slug"].AsString() != "world" {
+		t.Fatalf("copied row = %v, %v", row, err)
+	}
+	if count, _ := tree.GetRowCount("root/archive/posts"); count != 3 {
+		t.Errorf("copied row count = %d, want 3", count)
+	}
+	if ids, _ := tree.lookupIndex("root/archive/posts", "idx_slug", "hello"); len(ids) != 1 || ids[0] != "p1" {
+		t.Errorf("copied index lookup = %v", ids)
+	}
+	fks, _ := tree.GetForeignKeys("root/archive/posts")
+	if len(fks) != 1 || fks[0].ChildTable != "root/archive/posts" || fks[0].ParentTable != "root/blog/authors" {
+		t.Errorf("copied foreign keys = %+v", fks)
+	}
+	if _, err := tree.InsertRow("root/archive/posts", models.NewRow(map[string]interface{}{"slug": "x", "author_id": "nobody"})); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("insert into copy with missing parent: got %v", err)
+	}
+
+	// Comments still reference the original posts only
+	if err := tree.DeleteRow("root/archive/posts", "p1"); err != nil {
+		t.Errorf("deleting from the copy: %v", err)
+	}
+	if err := tree.DeleteRow("root/blog/posts", "p1"); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("deleting referenced original: got %v", err)
+	}
+
+	// The copy blocks deleting its parent rows just like the original
+	tree.DeleteRow("root/blog/posts", "p3")
+	tree.DeleteRow("root/blog/comments", "c2")
+	if err := tree.DeleteRow("root/blog/authors", "a2"); !errors.Is(err, ErrForeignKeyViolation) {
+		t.Errorf("deleting author referenced by the copy: got %v", err)
+	}
+}
+
+func TestMoveNode(t *testing.T) {
+	tree := setupDatabaseTest(t)
+	defer teardownDatabaseTest(t, tree)
+	setupForeignKeyTables(t, tree, FKCascade, FKCascade)
+	tree.CreateIndex("root/blog/posts", "idx_slug", []string{"slug"}, true)
+
+	if err := tree.RenameTable("root/blog", "posts", "articles"); err != nil {
+		t.Fatalf("RenameTable: %v", err)
+	}
+	if isTable, _ := tree.IsTable("root/blog/posts"); isTable {
+		t.Error("old table still exists")
+	}
+	if name, _ := tree.GetValue("root/blog/articles/__name"); name != "articles" {
+		t.Errorf("__name = %q, want articles", name)
+	}
+	if count, _ := tree.GetRowCount("root/blog/articles"); count != 3 {
+		t.Errorf("moved row count = %d, want 3", count)
+	}
+	if ids, _ := tree.lookupIndex("root/blog/articles", "idx_slug", "world"); len(ids) != 1 || ids[0] != "p2" {
+		t.Errorf("moved index lookup = %v", ids)
+	}
+
+	fks, _ := tree.GetForeignKeys("root/blog/articles")
+	if len(fks) != 1 || fks[0].ChildTable != "root/blog/articles" || fks[0].ParentTable != "root/blog/authors" {
+		t.Errorf("moved table foreign keys = %+v", fks)
+	}
+	fks, _ = tree.GetForeignKeys("root/blog/comments")
+	if len(fks) != 1 || fks[0].ParentTable != "root/blog/articles" {
+		t.Errorf("child foreign keys after move = %+v", fks)
+	}
+	if err := tree.UpdateRowFields("root/blog/comments", "c1", map[string]interface{}{"post_slug": "world"}); err != nil {
+		t.Errorf("child update against moved parent: %v", err)
+	}
+
+	// Cascades follow the new paths
+	if err := tree.DeleteRow("root/blog/authors", "a1"); err != nil {
+		t.Fatalf("DeleteRow: %v", err)
+	}
+	articles, _ := tree.ListRows("root/blog/articles")
+	comments, _ := tree.ListRows("root/blog/comments")
+	if len(articles) != 1 || len(comments) != 1 {
+		t.Errorf("after cascade articles = %v, comments = %v", articles, comments)
+	}
+
+	// Moving the whole database keeps references inside it
+	if err := tree.MoveNode("root/blog", "root/archive/blog"); err != nil {
+		t.Fatalf("MoveNode database: %v", err)
+	}
+	fks, _ = tree.GetForeignKeys("root/archive/blog/comments")
+	if len(fks) != 1 || fks[0].ParentTable != "root/archive/blog/articles" {
+		t.Errorf("foreign keys after database move = %+v", fks)
+	}
+	if err := tree.DeleteRow("root/archive/blog/authors", "a2"); err != nil {
+		t.Fatalf("DeleteRow after database move: %v", err)
+	}
+	if comments, _ := tree.ListRows("root/archive/blog/comments"); len(comments) != 0 {
+		t.Errorf("cascade after database move left comments %v", comments)
+	}
+
+	if err := tree.MoveNode("root/archive/blog/articles", "root/archive/blog/authors"); !errors.Is(err, ErrPathInUse) {
+		t.Errorf("MoveNode onto existing node: got %v", err)
+	}
+	if err := tree.MoveNode("root/archive/blog/authors/a1", "root/archive/a1"); err == nil {
+		t.Error("expected error moving a row as a node")
+	}
+}
@@ -1,16 +1,24 @@
 package blueconfig
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sfi2k7/blueconfig/models"
+	"github.com/sfi2k7/blueconfig/parser"
 	"github.com/sfi2k7/microweb"
 	"go.etcd.io/bbolt"
 )
@@ -65,13 +73,37 @@ type TreeOptions struct {
 	StorageLocationOnDisk string
 	Port                  int
 	Token                 string
+	KeyProvider           KeyProvider   // master keys for secrets; see SetSecret
+	SessionTTL            time.Duration // lifetime of Login sessions; DefaultSessionTTL if 0
+	APIKeyRateLimit       int           // requests per minute per API key; DefaultAPIKeyRateLimit if 0, unlimited if negative
+
+	// HTTPS: Serve uses TLS when a certificate and key are set, and requires
+	// client certificates signed by TLSClientCAFile when that is set. The
+	// files are reloaded when they change.
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	ClientCertUsers map[string]string // client certificate CN or SAN -> user; names are taken as users if nil
 }
 
 type Tree struct {
-	db       *bbolt.DB
-	diskpath string
-	port     int
-	token    string
+	db         *bbolt.DB
+	diskpath   string
+	port       int
+	token      string
+	functions  map[string]models.MethodFunc // custom query functions (see RegisterFunction)
+	funcMu     sync.RWMutex
+	keys       KeyProvider // master keys for secrets (see SetSecret)
+	sessions   sessionStore
+	sessionTTL time.Duration
+	keyLimiter *rateLimiter // per API key request rate
+	tls        *certReloader
+	certUsers  map[string]string
+
+	// rowWriteFailpoint is called after each step of a row write ("schema",
+	// "indexes", "row", "count"). Tests set it to inject a failure mid-write;
+	// a non-nil error aborts the whole transaction.
+	rowWriteFailpoint func(step string) error
 }
 
 type Packet struct {
@@ -81,8 +113,9 @@ type Packet struct {
 }
 
 type response struct {
-	Error  string      `json:"error,omitempty"`
-	Result interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
 }
 
 // ============================================================================
@@ -157,6 +190,17 @@ func sanitizeBucketName(s string) string {
 // ============================================================================
 
 func NewOrOpenTree(options TreeOptions) (*Tree, error) {
+	var reloader *certReloader
+	if options.TLSCertFile != "" || options.TLSKeyFile != "" {
+		var err error
+		reloader, err = newCertReloader(options.TLSCertFile, options.TLSKeyFile, options.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if options.TLSClientCAFile != "" {
+		return nil, fmt.Errorf("TLSClientCAFile needs TLSCertFile and TLSKeyFile")
+	}
+
 	os.MkdirAll(filepath.Dir(options.StorageLocationOnDisk), 0600)
 
 	db, err := bbolt.Open(options.StorageLocationOnDisk, 0600, nil)
@@ -164,10 +208,24 @@ func NewOrOpenTree(options TreeOptions) (*Tree, error) {
 		return nil, err
 	}
 
+	sessionTTL := options.SessionTTL
+	if sessionTTL <= 0 {
+		sessionTTL = DefaultSessionTTL
+	}
+	rateLimit := options.APIKeyRateLimit
+	if rateLimit == 0 {
+		rateLimit = DefaultAPIKeyRateLimit
+	}
+
 	return &Tree{
-		db:    db,
-		port:  options.Port,
-		token: options.Token,
+		db:         db,
+		port:       options.Port,
+		token:      options.Token,
+		keys:       options.KeyProvider,
+		sessionTTL: sessionTTL,
+		keyLimiter: newRateLimiter(rateLimit),
+		tls:        reloader,
+		certUsers:  options.ClientCertUsers,
 	}, nil
 }
 
@@ -267,7 +325,10 @@ func (t *Tree) rwbucket(path string, fn func(b *bbolt.Bucket) error) error {
 			}
 		}
 
-		return fn(b)
+		if err := fn(b); err != nil {
+			return err
+		}
+		return (&Transaction{tree: t, tx: tx}).searchProps(path, false)
 	})
 }
 
@@ -294,14 +355,18 @@ func (t *Tree) DeleteNode(p string, force bool) error {
 		return errors.New("can not delete root node")
 	}
 
-	return t.rwbucket(parentPath, func(b *bbolt.Bucket) error {
+	return t.writeTxn(func(txn *Transaction) error {
+		b, err := txn.createBucketAt(parentPath)
+		if err != nil {
+			return err
+		}
 		innerBucket := b.Bucket([]byte(nodeToDelete))
 		if innerBucket == nil {
 			return errors.New("node does not exist")
 		}
 
 		// Check if bucket has nested buckets
-		err := innerBucket.ForEachBucket(func(k []byte) error {
+		err = innerBucket.ForEachBucket(func(k []byte) error {
 			return errors.New("node has nested nodes - must force to delete")
 		})
 
@@ -309,7 +374,10 @@ func (t *Tree) DeleteNode(p string, force bool) error {
 			return err
 		}
 
-		return b.DeleteBucket([]byte(nodeToDelete))
+		if err := b.DeleteBucket([]byte(nodeToDelete)); err != nil {
+			return err
+		}
+		return txn.searchProps(p, true)
 	})
 }
 
@@ -336,20 +404,77 @@ func (t *Tree) GetChildren(p string) ([]string, error) {
 func (t *Tree) SetValue(p, value string) error {
 	nodePath, prop, _, _ := parsePath(p, 1)
 	return t.rwbucket(nodePath, func(b *bbolt.Bucket) error {
-		return b.Put([]byte(prop), []byte(value))
+		return putNodeProps(nodePath, b, map[string]interface{}{prop: value})
 	})
 }
 
 func (t *Tree) SetValues(p string, values map[string]interface{}) error {
 	return t.rwbucket(p, func(b *bbolt.Bucket) error {
+		return putNodeProps(p, b, values)
+	})
+}
+
+// putNodeProps writes props to the node bucket b at p and bumps its
+// __version when a user prop changes. __version itself is skipped, it is
+// maintained by bumpVersion.
+func putNodeProps(p string, b *bbolt.Bucket, values map[string]interface{}) error {
+	changed := false
+	for k, v := range values {
+		if k == VersionField {
+			continue
+		}
+		if err := b.Put([]byte(k), []byte(fmt.Sprintf("%v", v))); err != nil {
+			return err
+		}
+		changed = changed || !strings.HasPrefix(k, "__")
+	}
+	return touchNode(p, b, changed)
+}
+
+// touchNode bumps the __version of the node bucket b at p after a write that
+// changed user props. Internal nodes and "__" metadata props are maintained
+// by the tree and do not move versions.
+func touchNode(p string, b *bbolt.Bucket, changed bool) error {
+	if !changed || slices.ContainsFunc(strings.Split(fixpath(p), "/"), func(s string) bool { return strings.HasPrefix(s, "__") }) {
+		return nil
+	}
+	_, err := bumpVersion(b)
+	return err
+}
+
+// SaveNode sets several properties of a node and bumps its __version in a
+// single transaction, creating the node if needed. With an expected version
+// the save fails with ErrVersionConflict unless the node is still at that
+// version; a node that was never written is at version 0.
+func (t *Tree) SaveNode(p string, values map[string]interface{}, expectedVersion ...int64) (int64, error) {
+	var version int64
+	err := t.rwbucket(p, func(b *bbolt.Bucket) error {
+		if err := checkVersion(fixpath(p), b, expectedVersion); err != nil {
+			return err
+		}
 		for k, v := range values {
-			err := b.Put([]byte(k), []byte(fmt.Sprintf("%v", v)))
-			if err != nil {
+			if k == VersionField {
+				continue // Maintained by bumpVersion
+			}
+			if err := b.Put([]byte(k), []byte(fmt.Sprintf("%v", v))); err != nil {
 				return err
 			}
 		}
+		var err error
+		version, err = bumpVersion(b)
+		return err
+	})
+	return version, err
+}
+
+// NodeVersion returns the version of a node; 0 if it was never written
+func (t *Tree) NodeVersion(p string) (int64, error) {
+	var version int64
+	err := t.rbucket(p, 0, func(b *bbolt.Bucket) error {
+		version = bucketVersion(b)
 		return nil
 	})
+	return version, err
 }
 
 // CreateNodeWithProps creates a node at the given path and sets its properties in a single transaction
@@ -357,13 +482,7 @@ func (t *Tree) SetValues(p string, values map[string]interface{}) error {
 // Example: CreateNodeWithProps("/users/123", map[string]interface{}{"name": "John", "age": 30})
 func (t *Tree) CreateNodeWithProps(p string, properties map[string]interface{}) error {
 	return t.rwbucket(p, func(b *bbolt.Bucket) error {
-		for k, v := range properties {
-			err := b.Put([]byte(k), []byte(fmt.Sprintf("%v", v)))
-			if err != nil {
-				return err
-			}
-		}
-		return nil
+		return putNodeProps(p, b, properties)
 	})
 }
 
@@ -405,11 +524,12 @@ func (t *Tree) BatchCreateNodes(nodes map[string]map[string]interface{}) error {
 			}
 
 			// Set properties
-			for k, v := range properties {
-				err := b.Put([]byte(k), []byte(fmt.Sprintf("%v", v)))
-				if err != nil {
-					return err
-				}
+			if err := putNodeProps(path, b, properties); err != nil {
+				return err
+			}
+
+			if err := (&Transaction{tree: t, tx: tx}).searchProps(path, false); err != nil {
+				return err
 			}
 		}
 		return nil
@@ -431,7 +551,7 @@ func (t *Tree) GetAllProps(p string) ([]string, error) {
 	var props []string
 	err := t.rbucket(p, 0, func(b *bbolt.Bucket) error {
 		return b.ForEach(func(k, v []byte) error {
-			if v == nil { // Skip buckets, only get key-value pairs
+			if v == nil || string(k) == VersionField { // Skip buckets and the node version
 				return nil
 			}
 			props = append(props, string(k))
@@ -441,23 +561,51 @@ func (t *Tree) GetAllProps(p string) ([]string, error) {
 	return props, err
 }
 
+// GetAllPropsWithValues returns the props of a node with secrets written by
+// SetSecret masked; use GetSecret to read one
 func (t *Tree) GetAllPropsWithValues(p string) (map[string]string, error) {
-	props := make(map[string]string)
+	var props map[string]string
 	err := t.rbucket(p, 0, func(b *bbolt.Bucket) error {
-		return b.ForEach(func(k, v []byte) error {
-			if v == nil { // Skip buckets, only get key-value pairs
-				return nil
-			}
-			props[string(k)] = string(v)
-			return nil
-		})
+		props = nodeProps(b)
+		maskSecretProps(b, props)
+		return nil
+	})
+	return props, err
+}
+
+// rawProps returns the props of a node as stored, secrets included, for
+// internal metadata reads
+func (t *Tree) rawProps(p string) (map[string]string, error) {
+	var props map[string]string
+	err := t.rbucket(p, 0, func(b *bbolt.Bucket) error {
+		props = nodeProps(b)
+		return nil
 	})
 	return props, err
 }
 
+// nodeProps reads the props of a node bucket without its __version
+func nodeProps(b *bbolt.Bucket) map[string]string {
+	props := make(map[string]string)
+	b.ForEach(func(k, v []byte) error {
+		if v != nil && string(k) != VersionField { // Skip buckets and the node version
+			props[string(k)] = string(v)
+		}
+		return nil
+	})
+	return props
+}
+
 func (t *Tree) DeleteValue(p, prop string) error {
 	return t.rwbucket(p, func(b *bbolt.Bucket) error {
-		return b.Delete([]byte(prop))
+		if prop == VersionField {
+			return nil
+		}
+		existed := b.Get([]byte(prop)) != nil
+		if err := b.Delete([]byte(prop)); err != nil {
+			return err
+		}
+		return touchNode(p, b, existed && !strings.HasPrefix(prop, "__"))
 	})
 }
 
@@ -496,7 +644,7 @@ func (t *Tree) ScanNodes(p string, callback NodeScanCallback) error {
 			childBucket := b.Bucket(k)
 			if childBucket != nil {
 				childBucket.ForEach(func(propKey, propVal []byte) error {
-					if propVal != nil { // Skip nested buckets
+					if propVal != nil && string(propKey) != VersionField { // Skip nested buckets and the node version
 						nodeInfo.Props[string(propKey)] = string(propVal)
 					}
 					return nil
@@ -510,21 +658,373 @@ func (t *Tree) ScanNodes(p string, callback NodeScanCallback) error {
 	return err
 }
 
+// ============================================================================
+// Glob Matching
+// ============================================================================
+
+// Glob returns the paths of nodes matching pattern, sorted. Segments match
+// with `*` (any run within a segment), `?`, `[...]` and `{a,b}` alternatives;
+// a `**` segment matches any number of nodes. Wildcards skip internal nodes
+// such as __schema and __trash unless the segment names them literally.
+// Example: Glob("services/*/http")
+func (t *Tree) Glob(pattern string) ([]string, error) {
+	segments, err := compileGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make(map[string]bool)
+	err = t.db.View(func(tx *bbolt.Tx) error {
+		walkGlob(tx.Bucket([]byte("root")), "root", segments[1:], func(p string, b *bbolt.Bucket) {
+			matches[p] = true
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(matches))
+	for p := range matches {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// GlobProps returns path -> prop -> value for the nodes matching pattern and
+// their properties matching propPattern, a single segment pattern.
+// Nodes without matching properties are left out.
+// Example: GlobProps("services/*/http", "timeout")
+func (t *Tree) GlobProps(pattern, propPattern string) (map[string]map[string]string, error) {
+	segments, err := compileGlob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if propPattern == "" {
+		propPattern = "*"
+	}
+	prop, err := compileGlobSegment(propPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]map[string]string)
+	err = t.db.View(func(tx *bbolt.Tx) error {
+		walkGlob(tx.Bucket([]byte("root")), "root", segments[1:], func(p string, b *bbolt.Bucket) {
+			if _, seen := result[p]; seen {
+				return
+			}
+			props := make(map[string]string)
+			b.ForEach(func(k, v []byte) error {
+				if v != nil && prop.match(string(k)) {
+					props[string(k)] = string(v)
+				}
+				return nil
+			})
+			if len(props) > 0 {
+				result[p] = props
+			}
+		})
+		return nil
+	})
+	return result, err
+}
+
+// globSegment is one compiled path segment of a glob pattern
+type globSegment struct {
+	any          bool     // ** matches zero or more segments
+	alternatives []string // path.Match patterns after brace expansion
+	literal      bool     // no wildcards, the bucket can be looked up directly
+}
+
+// match reports whether a node or property name matches the segment
+func (s globSegment) match(name string) bool {
+	for _, alt := range s.alternatives {
+		// Wildcards do not reach internal nodes and props
+		if strings.HasPrefix(name, "__") && !strings.HasPrefix(alt, "__") {
+			continue
+		}
+		if ok, _ := path.Match(alt, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// compileGlob splits a pattern into segments below and including root
+func compileGlob(pattern string) ([]globSegment, error) {
+	var segments []globSegment
+	for _, part := range strings.Split(fixpath(pattern), "/") {
+		segment, err := compileGlobSegment(part)
+		if err != nil {
+			return nil, err
+		}
+		// Consecutive ** match the same paths as one
+		if segment.any && len(segments) > 0 && segments[len(segments)-1].any {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// compileGlobSegment expands braces and validates a single segment
+func compileGlobSegment(part string) (globSegment, error) {
+	if part == "**" {
+		return globSegment{any: true}, nil
+	}
+
+	alternatives, err := expandBraces(part)
+	if err != nil {
+		return globSegment{}, err
+	}
+
+	literal := true
+	for _, alt := range alternatives {
+		if _, err := path.Match(alt, ""); err != nil {
+			return globSegment{}, fmt.Errorf("invalid glob segment %q: %v", part, err)
+		}
+		if strings.ContainsAny(alt, `*?[\`) {
+			literal = false
+		}
+	}
+	return globSegment{alternatives: alternatives, literal: literal}, nil
+}
+
+// expandBraces expands {a,b} groups, including nested ones, into alternatives
+func expandBraces(s string) ([]string, error) {
+	open := strings.IndexByte(s, '{')
+	if open < 0 {
+		if strings.IndexByte(s, '}') >= 0 {
+			return nil, fmt.Errorf("unbalanced braces in %q", s)
+		}
+		return []string{s}, nil
+	}
+
+	// Find the matching close and split on top level commas
+	depth, start := 0, open+1
+	var options []string
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				options = append(options, s[start:i])
+				start = i + 1
+			}
+		case '}':
+			depth--
+			if depth == 0 {
+				options = append(options, s[start:i])
+				var expanded []string
+				for _, option := range options {
+					alts, err := expandBraces(s[:open] + option + s[i+1:])
+					if err != nil {
+						return nil, err
+					}
+					expanded = append(expanded, alts...)
+				}
+				return expanded, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unbalanced braces in %q", s)
+}
+
+// walkGlob calls fn for every bucket below b whose path matches segments.
+// Literal segments are looked up directly so only wildcard levels are scanned.
+func walkGlob(b *bbolt.Bucket, p string, segments []globSegment, fn func(p string, b *bbolt.Bucket)) {
+	if b == nil {
+		return
+	}
+	if len(segments) == 0 {
+		fn(p, b)
+		return
+	}
+
+	segment := segments[0]
+	if segment.any {
+		walkGlob(b, p, segments[1:], fn)
+		b.ForEachBucket(func(k []byte) error {
+			if !strings.HasPrefix(string(k), "__") {
+				walkGlob(b.Bucket(k), p+"/"+string(k), segments, fn)
+			}
+			return nil
+		})
+		return
+	}
+
+	if segment.literal {
+		for _, name := range segment.alternatives {
+			name = sanitizeBucketName(name)
+			walkGlob(b.Bucket([]byte(name)), p+"/"+name, segments[1:], fn)
+		}
+		return
+	}
+
+	b.ForEachBucket(func(k []byte) error {
+		if segment.match(string(k)) {
+			walkGlob(b.Bucket(k), p+"/"+string(k), segments[1:], fn)
+		}
+		return nil
+	})
+}
+
+// matchGlob reports whether the segments of a path match a compiled pattern,
+// following the same rules as walkGlob without touching the database
+func matchGlob(segments []globSegment, parts []string) bool {
+	if len(segments) == 0 {
+		return len(parts) == 0
+	}
+	if segments[0].any {
+		if matchGlob(segments[1:], parts) {
+			return true
+		}
+		return len(parts) > 0 && !strings.HasPrefix(parts[0], "__") && matchGlob(segments, parts[1:])
+	}
+	return len(parts) > 0 && segments[0].match(parts[0]) && matchGlob(segments[1:], parts[1:])
+}
+
+// ============================================================================
+// Node Queries
+// ============================================================================
+
+// NodeMatch is a node found by FindNodes
+type NodeMatch struct {
+	Path  string            `json:"path"`
+	Props map[string]string `json:"props"`
+}
+
+// FindNodes evaluates queryStr against the props of each child of p, or of
+// every node below p when recursive, and returns the matching nodes in path
+// order. An empty query matches every node. Internal nodes are skipped and
+// tables are matched as nodes without descending into their rows.
+// Limit, Skip, SortFields, Vars and Fields of opts apply as in FindRows.
+// Example: FindNodes("sensors", "__type == 'sensor' && __unit == 'ms'", true)
+func (t *Tree) FindNodes(p, queryStr string, recursive bool, opts ...QueryOptions) ([]NodeMatch, error) {
+	var query *parser.Query
+	if strings.TrimSpace(queryStr) != "" {
+		q, err := parser.Parse(queryStr)
+		if err != nil {
+			return nil, fmt.Errorf("query parse failed: %w", err)
+		}
+		query = &q
+	}
+
+	var opt QueryOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	functions := t.queryFunctions()
+
+	var matches []NodeMatch
+	var rows []models.Row
+	err := t.rbucket(p, 0, func(b *bbolt.Bucket) error {
+		var walk func(p string, b *bbolt.Bucket) error
+		walk = func(p string, b *bbolt.Bucket) error {
+			return b.ForEachBucket(func(k []byte) error {
+				if t.isSpecialNode(string(k)) {
+					return nil
+				}
+				child := b.Bucket(k)
+				childPath := p + "/" + string(k)
+
+				row := rowFromBucket(child)
+				matched := query == nil
+				if !matched {
+					obj := models.NewObjectWithContext(row, nil, functions, opt.Vars)
+					matched, _ = obj.Match(*query)
+				}
+				if matched {
+					matches = append(matches, NodeMatch{Path: childPath})
+					rows = append(rows, row)
+				}
+
+				if !recursive || string(child.Get([]byte("__type"))) == TypeTable {
+					return nil
+				}
+				return walk(childPath, child)
+			})
+		}
+		return walk(fixpath(p), b)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply sorting if requested
+	order := make([]int, len(matches))
+	for i := range order {
+		order[i] = i
+	}
+	if len(opt.SortFields) > 0 {
+		sort.SliceStable(order, func(i, j int) bool {
+			return compareSortFields(rows[order[i]], rows[order[j]], opt.SortFields) < 0
+		})
+	}
+
+	// Apply pagination (skip/limit)
+	if opt.Skip >= len(order) {
+		order = nil
+	} else if opt.Skip > 0 {
+		order = order[opt.Skip:]
+	}
+	if opt.Limit > 0 && opt.Limit < len(order) {
+		order = order[:opt.Limit]
+	}
+
+	results := make([]NodeMatch, 0, len(order))
+	for _, i := range order {
+		match := matches[i]
+		match.Props = make(map[string]string)
+		for key, val := range rows[i] {
+			if len(opt.Fields) == 0 || slices.Contains(opt.Fields, key) {
+				match.Props[key] = val.AsString()
+			}
+		}
+		results = append(results, match)
+	}
+	return results, nil
+}
+
 // ============================================================================
 // HTTP Server and Handlers
 // ============================================================================
 
-func (t *Tree) Serve() {
+// Serve listens on the configured port, over TLS when certificates are set,
+// and returns the error that stopped the server
+func (t *Tree) Serve() error {
 	if t.port == 0 {
-		panic("http port not set")
+		return errors.New("http port not set")
 	}
 
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", t.port),
+		Handler: t.routes(),
+	}
+	if t.tls == nil {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = t.tls.tlsConfig()
+	return server.ListenAndServeTLS("", "")
+}
+
+// routes builds the router with every endpoint Serve exposes
+func (t *Tree) routes() *microweb.Router {
 	web := microweb.New()
 	web.Use(t.authMiddleware)
 
+	// Session endpoints
+	web.Post("/login", t.handleLogin)
+	web.Post("/logout", t.handleLogout)
+
 	// Core API endpoints
 	web.Get("/", t.handleGetRequest)
 	web.Post("/", t.handlePostRequest)
+	web.Get("/glob", t.handleGlob)
+	web.Get("/search", t.handleSearch)
 
 	// Timeseries group endpoints
 	tsGroup := web.Group("/timeseries")
@@ -534,26 +1034,178 @@ func (t *Tree) Serve() {
 	dbGroup := web.Group("/db")
 	t.registerDatabaseRoutes(dbGroup)
 
-	web.Listen(t.port)
+	// Trash endpoints
+	trashGroup := web.Group("/trash")
+	t.registerTrashRoutes(trashGroup)
+
+	return web
 }
 
-// authMiddleware validates the authentication token
+// authMiddleware authenticates the caller and attaches their Identity to the
+// request for the permission checks of the handlers. API keys are accepted
+// in the X-API-Key header and are rate limited per key. Session tokens from
+// /login and the static token are accepted as "Authorization: Bearer". Over
+// mTLS a client certificate mapped to a user identifies the caller. Trees
+// without credentials of any kind are open, see hasCredentials.
 func (t *Tree) authMiddleware(c *microweb.Context) bool {
-	if strings.HasPrefix(c.R.URL.Path, "/public") {
+	if strings.HasPrefix(c.R.URL.Path, "/public") || c.R.URL.Path == "/login" {
 		return true
 	}
 
-	if t.token != "" && c.Query("token") != t.token {
-		c.Json(response{Error: "Invalid token"})
+	id, ok := t.authenticate(c)
+	if !ok {
+		writeStatusJSON(c, http.StatusUnauthorized, response{Error: "Invalid token"})
 		return false
 	}
+	if id.APIKey != "" && !t.keyLimiter.allow(id.APIKey) {
+		writeStatusJSON(c, http.StatusTooManyRequests, response{Error: "rate limit exceeded"})
+		return false
+	}
+	withIdentity(c, id)
 	return true
 }
 
+// authenticate resolves the credentials of a request to an identity
+func (t *Tree) authenticate(c *microweb.Context) (Identity, bool) {
+	if key := c.R.Header.Get(APIKeyHeader); key != "" {
+		info, err := t.VerifyAPIKey(key)
+		if err != nil {
+			return Identity{}, false
+		}
+		return Identity{APIKey: info.ID, Scopes: info.Scopes}, true
+	}
+
+	if bearer := bearerToken(c.R.Header.Get("Authorization")); bearer != "" {
+		if id, ok := t.sessionIdentity(bearer); ok {
+			return id, true
+		}
+		if t.token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(t.token)) == 1 {
+			return Identity{Admin: true}, true
+		}
+		return Identity{}, false
+	}
+
+	if id, ok := t.certIdentity(c); ok {
+		return id, true
+	}
+
+	return Identity{Admin: true}, !t.hasCredentials()
+}
+
+// hasCredentials reports whether the tree has a static token, a password,
+// users, roles or API keys; only trees with none of them are open
+func (t *Tree) hasCredentials() bool {
+	if t.token != "" || t.HasPassword() {
+		return true
+	}
+	found := false
+	t.readTxn(func(txn *Transaction) error {
+		for _, p := range []string{ACLPath + "/" + aclUsersNode, ACLPath + "/" + aclRolesNode, APIKeysPath} {
+			if b, err := txn.bucketAt(p); err == nil {
+				if k, _ := b.Cursor().First(); k != nil {
+					found = true
+				}
+			}
+		}
+		return nil
+	})
+	return found
+}
+
+// handleLogin exchanges a user's password, or without a user the tree
+// password, for a session token
+func (t *Tree) handleLogin(c *microweb.Context) {
+	var req struct {
+		User     string `json:"user"`
+		Password string `json:"password"`
+	}
+	body, err := c.Body()
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeStatusJSON(c, http.StatusBadRequest, response{Error: "invalid request: " + err.Error()})
+		return
+	}
+
+	var token string
+	var expires time.Time
+	if req.User != "" {
+		token, expires, err = t.LoginUser(req.User, req.Password)
+	} else {
+		token, expires, err = t.Login(req.Password)
+	}
+	if err != nil {
+		writeStatusJSON(c, http.StatusUnauthorized, response{Error: err.Error()})
+		return
+	}
+	c.Json(response{Result: map[string]interface{}{
+		"token":      token,
+		"expires_at": expires.Unix(),
+	}})
+}
+
+// handleLogout ends the session of the bearer token
+func (t *Tree) handleLogout(c *microweb.Context) {
+	t.Logout(bearerToken(c.R.Header.Get("Authorization")))
+	c.Json(response{Result: true})
+}
+
+// etag formats a row or node version as an entity tag
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// ifMatchVersion parses the If-Match header into the version a write
+// expects. An absent header or "*" expects nothing.
+func ifMatchVersion(c *microweb.Context) ([]int64, error) {
+	tag := strings.TrimSpace(c.R.Header.Get("If-Match"))
+	if tag == "" || tag == "*" {
+		return nil, nil
+	}
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+	version, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid If-Match header: %s", c.R.Header.Get("If-Match"))
+	}
+	return []int64{version}, nil
+}
+
+// writeStatusJSON writes a JSON response with an HTTP status other than 200
+func writeStatusJSON(c *microweb.Context, status int, resp response) {
+	c.W.Header().Set("Content-Type", "application/json")
+	c.W.WriteHeader(status)
+	json.NewEncoder(c.W).Encode(resp)
+}
+
+// writeSaveError reports a failed write; a version conflict answers 412 with
+// the current version as ETag
+func writeSaveError(c *microweb.Context, err error) {
+	var conflict *VersionConflictError
+	if errors.As(err, &conflict) {
+		c.W.Header().Set("ETag", etag(conflict.Current))
+		writeStatusJSON(c, http.StatusPreconditionFailed, response{
+			Error:   err.Error(),
+			Details: map[string]int64{"current_version": conflict.Current},
+		})
+		return
+	}
+	c.Json(response{Error: err.Error()})
+}
+
 // handleGetRequest handles all GET requests
 func (t *Tree) handleGetRequest(c *microweb.Context) {
 	path := c.R.URL.Path
 
+	// A /value path ends in a property, the permission is on its node
+	target := strings.TrimSuffix(strings.TrimSuffix(path, "/props"), "/values")
+	if strings.HasSuffix(path, "/value") {
+		target, _, _, _ = parsePath(strings.TrimSuffix(path, "/value"), 1)
+	}
+	if !t.authorize(c, target, PermRead) {
+		return
+	}
+
 	if strings.HasSuffix(path, "/props") {
 		props, err := t.GetAllProps(strings.TrimSuffix(path, "/props"))
 		if err != nil {
@@ -564,65 +1216,227 @@ func (t *Tree) handleGetRequest(c *microweb.Context) {
 		return
 	}
 
-	if strings.HasSuffix(path, "/values") {
-		propsvals, err := t.GetAllPropsWithValues(strings.TrimSuffix(path, "/values"))
+	if strings.HasSuffix(path, "/values") {
+		var propsvals map[string]string
+		var version int64
+		err := t.rbucket(strings.TrimSuffix(path, "/values"), 0, func(b *bbolt.Bucket) error {
+			propsvals, version = nodeProps(b), bucketVersion(b)
+			maskSecretProps(b, propsvals)
+			return nil
+		})
+		if err != nil {
+			c.Json(response{Error: err.Error()})
+			return
+		}
+		c.W.Header().Set("ETag", etag(version))
+		c.Json(response{Result: propsvals})
+		return
+	}
+
+	if strings.HasSuffix(path, "/value") {
+		value, err := t.GetValue(strings.TrimSuffix(path, "/value"))
+		if err != nil {
+			c.Json(response{Error: err.Error()})
+			return
+		}
+		nodePath, prop, _, _ := parsePath(strings.TrimSuffix(path, "/value"), 1)
+		props := map[string]string{prop: value}
+		t.maskSecrets(nodePath, props)
+		c.Json(response{Result: props[prop]})
+		return
+	}
+
+	nodes, err := t.GetNodesInPath(path)
+	if err != nil {
+		c.Json(response{Error: err.Error()})
+		return
+	}
+	c.Json(response{Result: nodes})
+}
+
+// handleGlob returns the node paths matching ?p=, or with ?prop= their
+// matching properties
+func (t *Tree) handleGlob(c *microweb.Context) {
+	pattern := c.Query("p")
+	if pattern == "" {
+		c.Json(response{Error: "p is required"})
+		return
+	}
+
+	// Matches the caller may not read are left out
+	if prop := c.Query("prop"); prop != "" {
+		props, err := t.GlobProps(pattern, prop)
+		if err != nil {
+			c.Json(response{Error: err.Error()})
+			return
+		}
+		for p := range props {
+			if !t.permitted(c, p, PermRead) {
+				delete(props, p)
+				continue
+			}
+			t.maskSecrets(p, props[p])
+		}
+		c.Json(response{Result: props})
+		return
+	}
+
+	paths, err := t.Glob(pattern)
+	if err != nil {
+		c.Json(response{Error: err.Error()})
+		return
+	}
+	paths = slices.DeleteFunc(paths, func(p string) bool { return !t.permitted(c, p, PermRead) })
+	c.Json(response{Result: paths})
+}
+
+// handleSearch runs a full-text search for ?q= within ?scope= (default root)
+func (t *Tree) handleSearch(c *microweb.Context) {
+	text := c.Query("q")
+	if text == "" {
+		c.Json(response{Error: "q is required"})
+		return
+	}
+
+	limit := 0
+	if l := c.Query("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			c.Json(response{Error: "invalid limit: " + l})
+			return
+		}
+	}
+
+	// The limit applies to the hits the caller may read
+	hits, err := t.Search(c.Query("scope"), text, 0)
+	if err != nil {
+		c.Json(response{Error: err.Error()})
+		return
+	}
+	hits = slices.DeleteFunc(hits, func(hit SearchHit) bool { return !t.permitted(c, hit.Path, PermRead) })
+	if limit > 0 && limit < len(hits) {
+		hits = hits[:limit]
+	}
+	c.Json(response{Result: hits})
+}
+
+// handlePostRequest handles all POST requests
+func (t *Tree) handlePostRequest(c *microweb.Context) {
+	path := c.R.URL.Path
+
+	if strings.HasSuffix(path, "/save") {
+		if !t.authorize(c, strings.TrimSuffix(path, "/save"), PermWrite) {
+			return
+		}
+
+		body, err := c.Body()
+		if err != nil {
+			c.Json(response{Error: err.Error()})
+			return
+		}
+
+		var m = make(map[string]any)
+		err = json.Unmarshal(body, &m)
+		if err != nil {
+			c.Json(response{Error: err.Error()})
+			return
+		}
+
+		expected, err := ifMatchVersion(c)
+		if err != nil {
+			writeStatusJSON(c, http.StatusBadRequest, response{Error: err.Error()})
+			return
+		}
+
+		version, err := t.SaveNode(strings.TrimSuffix(path, "/save"), m, expected...)
+		if err != nil {
+			writeSaveError(c, err)
+			return
+		}
+		c.W.Header().Set("ETag", etag(version))
+		c.Json(response{Result: true})
+		return
+	}
+
+	if strings.HasSuffix(path, "/set") {
+		nodePath, prop, val, err := parsePath(strings.TrimSuffix(path, "/set"), 2)
+		fmt.Println("path:", nodePath, "prop:", prop, "val:", val, "err:", err)
+		if !t.authorize(c, nodePath, PermWrite) {
+			return
+		}
+
+		restored, _ := url.JoinPath(nodePath, prop)
+		fmt.Println("restored", restored)
+
+		err = t.SetValue(restored, val)
 		if err != nil {
 			c.Json(response{Error: err.Error()})
 			return
 		}
-		c.Json(response{Result: propsvals})
+		c.Json(response{Result: true})
 		return
 	}
 
-	if strings.HasSuffix(path, "/value") {
-		value, err := t.GetValue(strings.TrimSuffix(path, "/value"))
+	if strings.HasSuffix(path, "/trash") {
+		if !t.authorize(c, strings.TrimSuffix(path, "/trash"), PermWrite) {
+			return
+		}
+		trashID, err := t.SoftDeleteNode(strings.TrimSuffix(path, "/trash"))
 		if err != nil {
 			c.Json(response{Error: err.Error()})
 			return
 		}
-		c.Json(response{Result: value})
-		return
-	}
-
-	nodes, err := t.GetNodesInPath(path)
-	if err != nil {
-		c.Json(response{Error: err.Error()})
+		c.Json(response{Result: map[string]string{"trash_id": trashID}})
 		return
 	}
-	c.Json(response{Result: nodes})
-}
-
-// handlePostRequest handles all POST requests
-func (t *Tree) handlePostRequest(c *microweb.Context) {
-	path := c.R.URL.Path
 
-	if strings.HasSuffix(path, "/save") {
-		body, err := c.Body()
-		if err != nil {
-			c.Json(response{Error: err.Error()})
+	if strings.HasSuffix(path, "/find") {
+		if !t.authorize(c, strings.TrimSuffix(path, "/find"), PermRead) {
+			return
+		}
+		req, ok := readQueryRequest(c, false)
+		if !ok {
 			return
 		}
 
-		var m = make(map[string]any)
-		err = json.Unmarshal(body, &m)
+		opts := req.toQueryOptions()
+		opts.Fields = req.Fields
+		nodes, err := t.FindNodes(strings.TrimSuffix(path, "/find"), req.Query, c.Query("recursive") == "true", *opts)
 		if err != nil {
-			c.Json(response{Error: err.Error()})
+			queryErrorResponse(c, "execution_error", err, req.Query)
 			return
 		}
-
-		t.SetValues(strings.TrimSuffix(path, "/save"), m)
-		c.Json(response{Result: true})
+		nodes = slices.DeleteFunc(nodes, func(n NodeMatch) bool { return !t.permitted(c, n.Path, PermRead) })
+		for _, n := range nodes {
+			t.maskSecrets(n.Path, n.Props)
+		}
+		c.Json(response{Result: nodes})
 		return
 	}
 
-	if strings.HasSuffix(path, "/set") {
-		nodePath, prop, val, err := parsePath(strings.TrimSuffix(path, "/set"), 2)
-		fmt.Println("path:", nodePath, "prop:", prop, "val:", val, "err:", err)
+	if strings.HasSuffix(path, "/copy") || strings.HasSuffix(path, "/move") {
+		dst := c.R.URL.Query().Get("to")
+		if dst == "" {
+			c.Json(response{Error: "to is required"})
+			return
+		}
 
-		restored, _ := url.JoinPath(nodePath, prop)
-		fmt.Println("restored", restored)
+		// Copying reads the source, moving also removes it
+		src := strings.TrimSuffix(strings.TrimSuffix(path, "/copy"), "/move")
+		srcPerm := PermRead
+		if strings.HasSuffix(path, "/move") {
+			srcPerm = PermWrite
+		}
+		if !t.authorize(c, src, srcPerm) || !t.authorize(c, dst, PermWrite) {
+			return
+		}
 
-		err = t.SetValue(restored, val)
+		var err error
+		if strings.HasSuffix(path, "/copy") {
+			err = t.CopyNode(strings.TrimSuffix(path, "/copy"), dst, c.R.URL.Query().Get("overwrite") == "true")
+		} else {
+			err = t.MoveNode(strings.TrimSuffix(path, "/move"), dst)
+		}
 		if err != nil {
 			c.Json(response{Error: err.Error()})
 			return
@@ -632,6 +1446,9 @@ func (t *Tree) handlePostRequest(c *microweb.Context) {
 	}
 
 	if strings.HasSuffix(path, "/create") {
+		if !t.authorize(c, strings.TrimSuffix(path, "/create"), PermWrite) {
+			return
+		}
 		err := t.CreatePath(strings.TrimSuffix(path, "/create"))
 		if err != nil {
 			c.Json(response{Error: err.Error()})
@@ -648,6 +1465,10 @@ func (t *Tree) handlePostRequest(c *microweb.Context) {
 			/ create path
 			/ set setvalue
 			/ save multiple set values
+			/ trash soft delete (restore via /trash endpoints)
+			/ copy?to=<dst>&overwrite=true copy node
+			/ move?to=<dst> move node
+			/ find?recursive=true query child nodes by their props
 	*/
 }
 
@@ -658,22 +1479,22 @@ func (t *Tree) handlePostRequest(c *microweb.Context) {
 // registerTimeseriesRoutes registers all timeseries endpoints in a group
 func (t *Tree) registerTimeseriesRoutes(g *microweb.Group) {
 	// Initialization
-	g.Post("/init", t.handleInitTimeseries)
+	g.Post("/init", t.guard(PermWrite, fixedTarget(TimeseriesBasePath), t.handleInitTimeseries))
 
 	// Sensor management
-	g.Post("/sensors/create", t.handleCreateSensor)
-	g.Get("/sensors", t.handleListSensors)
-	g.Get("/sensors/{sensor}/info", t.handleGetSensorInfo)
-	g.Delete("/sensors/{sensor}", t.handleDeleteSensor)
+	g.Post("/sensors/create", t.guard(PermWrite, fixedTarget(SensorsPath), t.handleCreateSensor))
+	g.Get("/sensors", t.guard(PermRead, fixedTarget(SensorsPath), t.handleListSensors))
+	g.Get("/sensors/{sensor}/info", t.guard(PermRead, sensorTarget, t.handleGetSensorInfo))
+	g.Delete("/sensors/{sensor}", t.guard(PermWrite, sensorTarget, t.handleDeleteSensor))
 
 	// Event management
-	g.Post("/sensors/{sensor}/event", t.handlePostEvent)
-	g.Get("/sensors/{sensor}/events", t.handleGetAllEvents)
-	g.Get("/sensors/{sensor}/latest", t.handleGetLatestValue)
-	g.Post("/sensors/{sensor}/cleanup", t.handleDeleteOldEvents)
+	g.Post("/sensors/{sensor}/event", t.guard(PermWrite, sensorTarget, t.handlePostEvent))
+	g.Get("/sensors/{sensor}/events", t.guard(PermRead, sensorTarget, t.handleGetAllEvents))
+	g.Get("/sensors/{sensor}/latest", t.guard(PermRead, sensorTarget, t.handleGetLatestValue))
+	g.Post("/sensors/{sensor}/cleanup", t.guard(PermWrite, sensorTarget, t.handleDeleteOldEvents))
 
 	// Query
-	g.Get("/sensors/{sensor}/data", t.handleGetSensorData)
+	g.Get("/sensors/{sensor}/data", t.guard(PermRead, sensorTarget, t.handleGetSensorData))
 }
 
 // handleInitTimeseries initializes the timeseries system
@@ -838,25 +1659,114 @@ func (t *Tree) handleDeleteSensor(c *microweb.Context) {
 // registerDatabaseRoutes registers all database CRUD endpoints
 func (t *Tree) registerDatabaseRoutes(g *microweb.Group) {
 	// Database operations
-	g.Post("/:dbPath/create", t.handleCreateDatabase)
-	g.Get("/:dbPath/info", t.handleGetDatabaseInfo)
-	g.Delete("/:dbPath", t.handleDeleteDatabase)
-	g.Get("/list", t.handleListDatabases)
+	g.Post("/:dbPath/create", t.guard(PermWrite, databaseTarget, t.handleCreateDatabase))
+	g.Get("/:dbPath/info", t.guard(PermRead, databaseTarget, t.handleGetDatabaseInfo))
+	g.Delete("/:dbPath", t.guard(PermWrite, databaseTarget, t.handleDeleteDatabase))
+	g.Get("/list", t.guard(PermRead, func(c *microweb.Context) string { return c.Query("path") }, t.handleListDatabases))
 
 	// Table operations
-	g.Post("/:dbPath/tables/:tableName/create", t.handleCreateTable)
-	g.Get("/:dbPath/tables", t.handleListTables)
-	g.Get("/:dbPath/tables/:tableName/info", t.handleGetTableInfo)
-	g.Delete("/:dbPath/tables/:tableName", t.handleDeleteTable)
+	g.Post("/:dbPath/tables/:tableName/create", t.guard(PermWrite, tableTarget, t.handleCreateTable))
+	g.Get("/:dbPath/tables", t.guard(PermRead, databaseTarget, t.handleListTables))
+	g.Get("/:dbPath/tables/:tableName/info", t.guard(PermRead, tableTarget, t.handleGetTableInfo))
+	g.Delete("/:dbPath/tables/:tableName", t.guard(PermWrite, tableTarget, t.handleDeleteTable))
 
 	// Row operations
-	g.Post("/:dbPath/tables/:tableName/rows", t.handleInsertRow)
-	g.Get("/:dbPath/tables/:tableName/rows", t.handleListRows)
-	g.Get("/:dbPath/tables/:tableName/rows/:rowID", t.handleGetRow)
-	g.Put("/:dbPath/tables/:tableName/rows/:rowID", t.handleUpdateRow)
-	g.Patch("/:dbPath/tables/:tableName/rows/:rowID", t.handleUpdateRowFields)
-	g.Delete("/:dbPath/tables/:tableName/rows/:rowID", t.handleDeleteRow)
-	g.Get("/:dbPath/tables/:tableName/rows/count", t.handleCountRows)
+	g.Post("/:dbPath/tables/:tableName/rows", t.guard(PermWrite, tableTarget, t.handleInsertRow))
+	g.Get("/:dbPath/tables/:tableName/rows", t.guard(PermRead, tableTarget, t.handleListRows))
+	g.Get("/:dbPath/tables/:tableName/rows/:rowID", t.guard(PermRead, rowTarget, t.handleGetRow))
+	g.Put("/:dbPath/tables/:tableName/rows/:rowID", t.guard(PermWrite, rowTarget, t.handleUpdateRow))
+	g.Patch("/:dbPath/tables/:tableName/rows/:rowID", t.guard(PermWrite, rowTarget, t.handleUpdateRowFields))
+	g.Delete("/:dbPath/tables/:tableName/rows/:rowID", t.guard(PermWrite, rowTarget, t.handleDeleteRow))
+	g.Get("/:dbPath/tables/:tableName/rows/count", t.guard(PermRead, tableTarget, t.handleCountRows))
+
+	// Query operations
+	g.Post("/:dbPath/tables/:tableName/query", t.guard(PermRead, tableTarget, t.handleQueryRows))
+	g.Post("/:dbPath/tables/:tableName/count", t.guard(PermRead, tableTarget, t.handleCountWhere))
+	g.Post("/:dbPath/tables/:tableName/update-where", t.guard(PermWrite, tableTarget, t.handleUpdateRowsWhere))
+	g.Post("/:dbPath/tables/:tableName/delete-where", t.guard(PermWrite, tableTarget, t.handleDeleteRowsWhere))
+	g.Get("/:dbPath/tables/:tableName/distinct", t.guard(PermRead, tableTarget, t.handleDistinctValues))
+	g.Get("/:dbPath/tables/:tableName/aggregate", t.guard(PermRead, tableTarget, t.handleAggregate))
+}
+
+// Route targets: the tree path a request operates on, for permission checks
+
+func fixedTarget(p string) func(c *microweb.Context) string {
+	return func(c *microweb.Context) string { return p }
+}
+
+func sensorTarget(c *microweb.Context) string {
+	return SensorsPath + "/" + c.Param("sensor")
+}
+
+func databaseTarget(c *microweb.Context) string {
+	return "root/" + c.Param("dbPath")
+}
+
+func tableTarget(c *microweb.Context) string {
+	return databaseTarget(c) + "/" + c.Param("tableName")
+}
+
+func rowTarget(c *microweb.Context) string {
+	return tableTarget(c) + "/" + c.Param("rowID")
+}
+
+// registerTrashRoutes registers the soft delete trash endpoints
+func (t *Tree) registerTrashRoutes(g *microweb.Group) {
+	// Listing and restoring check the original path of each entry
+	g.Get("/list", t.handleListTrash)
+	g.Post("/purge", t.guard(PermWrite, fixedTarget("root/"+TrashNode), t.handlePurgeTrash))
+	g.Post("/:trashID/restore", t.handleRestoreTrash)
+}
+
+// Trash handlers
+
+func (t *Tree) handleListTrash(c *microweb.Context) {
+	entries, err := t.ListTrash()
+	if err != nil {
+		c.Json(response{Error: err.Error()})
+		return
+	}
+	entries = slices.DeleteFunc(entries, func(e TrashEntry) bool { return !t.permitted(c, e.OriginalPath, PermRead) })
+	c.Json(response{Result: entries})
+}
+
+func (t *Tree) handleRestoreTrash(c *microweb.Context) {
+	entries, err := t.ListTrash()
+	if err != nil {
+		c.Json(response{Error: err.Error()})
+		return
+	}
+	for _, e := range entries {
+		if e.ID == c.Param("trashID") && !t.authorize(c, e.OriginalPath, PermWrite) {
+			return
+		}
+	}
+
+	if err := t.Restore(c.Param("trashID")); err != nil {
+		c.Json(response{Error: err.Error()})
+		return
+	}
+	c.Json(response{Result: true})
+}
+
+func (t *Tree) handlePurgeTrash(c *microweb.Context) {
+	// older_than is a duration such as 720h; empty purges everything
+	var olderThan time.Duration
+	if s := c.Query("older_than"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			c.Json(response{Error: "invalid older_than: " + err.Error()})
+			return
+		}
+		olderThan = d
+	}
+
+	purged, err := t.PurgeTrash(olderThan)
+	if err != nil {
+		c.Json(response{Error: err.Error()})
+		return
+	}
+	c.Json(response{Result: map[string]int{"purged": purged}})
 }
 
 // Database handlers
@@ -1066,7 +1976,16 @@ func (t *Tree) handleGetRow(c *microweb.Context) {
 	rowID := c.Param("rowID")
 	tablePath := dbPath + "/" + tableName
 
-	row, err := t.GetRow(tablePath, rowID)
+	var row models.Row
+	var version int64
+	err := t.readTxn(func(txn *Transaction) error {
+		var err error
+		if row, err = txn.GetRow(tablePath, rowID); err != nil {
+			return err
+		}
+		version, err = txn.RowVersion(tablePath, rowID)
+		return err
+	})
 	if err != nil {
 		c.Json(response{Error: err.Error()})
 		return
@@ -1078,6 +1997,7 @@ func (t *Tree) handleGetRow(c *microweb.Context) {
 		rowData[key] = val.Val()
 	}
 
+	c.W.Header().Set("ETag", etag(version))
 	c.Json(response{Result: rowData})
 }
 
@@ -1100,15 +2020,30 @@ func (t *Tree) handleUpdateRow(c *microweb.Context) {
 		return
 	}
 
+	expected, err := ifMatchVersion(c)
+	if err != nil {
+		writeStatusJSON(c, http.StatusBadRequest, response{Error: err.Error()})
+		return
+	}
+
 	// Convert to Row
 	row := models.NewRow(data)
 
-	err = t.UpdateRow(tablePath, rowID, row)
+	// Update and read the new version in one transaction
+	var version int64
+	err = t.Update(func(txn *Transaction) error {
+		if err := txn.UpdateRow(tablePath, rowID, row, expected...); err != nil {
+			return err
+		}
+		version, err = txn.RowVersion(tablePath, rowID)
+		return err
+	})
 	if err != nil {
-		c.Json(response{Error: err.Error()})
+		writeSaveError(c, err)
 		return
 	}
 
+	c.W.Header().Set("ETag", etag(version))
 	c.Json(response{Result: true})
 }
 
@@ -1131,12 +2066,27 @@ func (t *Tree) handleUpdateRowFields(c *microweb.Context) {
 		return
 	}
 
-	err = t.UpdateRowFields(tablePath, rowID, fields)
+	expected, err := ifMatchVersion(c)
 	if err != nil {
-		c.Json(response{Error: err.Error()})
+		writeStatusJSON(c, http.StatusBadRequest, response{Error: err.Error()})
+		return
+	}
+
+	// Update and read the new version in one transaction
+	var version int64
+	err = t.Update(func(txn *Transaction) error {
+		if err := txn.UpdateRowFields(tablePath, rowID, fields, expected...); err != nil {
+			return err
+		}
+		version, err = txn.RowVersion(tablePath, rowID)
+		return err
+	})
+	if err != nil {
+		writeSaveError(c, err)
 		return
 	}
 
+	c.W.Header().Set("ETag", etag(version))
 	c.Json(response{Result: true})
 }
 
@@ -1146,6 +2096,17 @@ func (t *Tree) handleDeleteRow(c *microweb.Context) {
 	rowID := c.Param("rowID")
 	tablePath := dbPath + "/" + tableName
 
+	// Soft deletes move the row to the trash and return its trash ID
+	if c.Query("soft") == "true" {
+		trashID, err := t.SoftDeleteRow(tablePath, rowID)
+		if err != nil {
+			c.Json(response{Error: err.Error()})
+			return
+		}
+		c.Json(response{Result: map[string]string{"trash_id": trashID}})
+		return
+	}
+
 	err := t.DeleteRow(tablePath, rowID)
 	if err != nil {
 		c.Json(response{Error: err.Error()})
@@ -1168,3 +2129,267 @@ func (t *Tree) handleCountRows(c *microweb.Context) {
 
 	c.Json(response{Result: map[string]int{"count": count}})
 }
+
+// ============================================================================
+// Query HTTP Handlers
+// ============================================================================
+
+// queryError is the structured error returned by the query endpoints
+type queryError struct {
+	Type     string   `json:"type"` // "invalid_request", "parse_error" or "execution_error"
+	Message  string   `json:"message"`
+	Query    string   `json:"query,omitempty"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Expected []string `json:"expected,omitempty"`
+}
+
+// querySortField is the JSON form of a SortField
+type querySortField struct {
+	Field     string `json:"field"`
+	Direction string `json:"direction"` // "asc" (default) or "desc"
+}
+
+// queryRequest is the request body accepted by the query endpoints
+type queryRequest struct {
+	Query   string                 `json:"query"`
+	Vars    map[string]interface{} `json:"vars"`
+	Limit   int                    `json:"limit"`
+	Skip    int                    `json:"skip"`
+	Sort    []querySortField       `json:"sort"`
+	Fields  []string               `json:"fields"`
+	Updates map[string]interface{} `json:"updates"`
+}
+
+// queryResultRow is a single row returned by the query endpoint
+type queryResultRow struct {
+	ID   string                 `json:"id"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// queryErrorResponse writes a structured query error
+// Parse errors are reported as "parse_error" with their position details
+func queryErrorResponse(c *microweb.Context, errType string, err error, queryStr string) {
+	details := queryError{
+		Type:    errType,
+		Message: err.Error(),
+		Query:   queryStr,
+	}
+
+	var pe *parser.ParseError
+	if errors.As(err, &pe) {
+		details.Type = "parse_error"
+		details.Message = pe.Message
+		details.Line = pe.Line
+		details.Column = pe.Column
+		details.Token = pe.Token
+		details.Expected = pe.Expected
+	}
+
+	c.Json(response{
+		Error:   err.Error(),
+		Details: details,
+	})
+}
+
+// readQueryRequest decodes and validates the query request body
+// Writes the error response and returns false if the request is unusable
+func readQueryRequest(c *microweb.Context, requireQuery bool) (*queryRequest, bool) {
+	body, err := c.Body()
+	if err != nil {
+		queryErrorResponse(c, "invalid_request", err, "")
+		return nil, false
+	}
+
+	req := &queryRequest{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, req); err != nil {
+			queryErrorResponse(c, "invalid_request", err, "")
+			return nil, false
+		}
+	}
+
+	if req.Query == "" {
+		if requireQuery {
+			queryErrorResponse(c, "invalid_request", errors.New("query is required"), "")
+			return nil, false
+		}
+		return req, true
+	}
+
+	if _, err := parser.Parse(req.Query); err != nil {
+		queryErrorResponse(c, "parse_error", err, req.Query)
+		return nil, false
+	}
+
+	return req, true
+}
+
+// toQueryOptions converts the request pagination and sorting into QueryOptions
+func (req *queryRequest) toQueryOptions() *QueryOptions {
+	opts := &QueryOptions{
+		Limit: req.Limit,
+		Skip:  req.Skip,
+		Vars:  req.Vars,
+	}
+
+	for _, sf := range req.Sort {
+		direction := SortAsc
+		if strings.EqualFold(sf.Direction, "desc") {
+			direction = SortDesc
+		}
+		opts.SortFields = append(opts.SortFields, SortField{FieldName: sf.Field, Direction: direction})
+	}
+
+	return opts
+}
+
+// handleQueryRows runs a query with pagination, sorting and field projection
+func (t *Tree) handleQueryRows(c *microweb.Context) {
+	dbPath := "root/" + c.Param("dbPath")
+	tableName := c.Param("tableName")
+	tablePath := dbPath + "/" + tableName
+
+	req, ok := readQueryRequest(c, true)
+	if !ok {
+		return
+	}
+
+	cursor, err := t.FindRowsCursor(tablePath, req.Query, req.toQueryOptions())
+	if err != nil {
+		queryErrorResponse(c, "execution_error", err, req.Query)
+		return
+	}
+
+	rows := make([]queryResultRow, 0)
+	for ok := cursor.CurrentID() != ""; ok; ok = cursor.Next() {
+		var row models.Row
+		if len(req.Fields) > 0 {
+			row, err = cursor.LoadFields(req.Fields)
+		} else {
+			row, err = cursor.LoadFullRow()
+		}
+		if err != nil {
+			continue // Skip rows that can't be loaded
+		}
+
+		rowData := make(map[string]interface{})
+		for key, val := range row {
+			rowData[key] = val.Val()
+		}
+		rows = append(rows, queryResultRow{ID: cursor.CurrentID(), Data: rowData})
+	}
+
+	c.Json(response{Result: map[string]interface{}{
+		"rows":  rows,
+		"total": cursor.Count(),
+	}})
+}
+
+// handleCountWhere counts rows matching a query
+func (t *Tree) handleCountWhere(c *microweb.Context) {
+	dbPath := "root/" + c.Param("dbPath")
+	tableName := c.Param("tableName")
+	tablePath := dbPath + "/" + tableName
+
+	req, ok := readQueryRequest(c, true)
+	if !ok {
+		return
+	}
+
+	count, err := t.CountWhere(tablePath, req.Query, req.Vars)
+	if err != nil {
+		queryErrorResponse(c, "execution_error", err, req.Query)
+		return
+	}
+
+	c.Json(response{Result: map[string]int{"count": count}})
+}
+
+// handleUpdateRowsWhere applies field updates to all rows matching a query
+func (t *Tree) handleUpdateRowsWhere(c *microweb.Context) {
+	dbPath := "root/" + c.Param("dbPath")
+	tableName := c.Param("tableName")
+	tablePath := dbPath + "/" + tableName
+
+	req, ok := readQueryRequest(c, true)
+	if !ok {
+		return
+	}
+
+	if len(req.Updates) == 0 {
+		queryErrorResponse(c, "invalid_request", errors.New("updates are required"), req.Query)
+		return
+	}
+
+	updated, err := t.UpdateRowsWhere(tablePath, req.Query, req.Updates, req.Vars)
+	if err != nil {
+		queryErrorResponse(c, "execution_error", err, req.Query)
+		return
+	}
+
+	c.Json(response{Result: map[string]int{"updated": updated}})
+}
+
+// handleDeleteRowsWhere deletes all rows matching a query
+func (t *Tree) handleDeleteRowsWhere(c *microweb.Context) {
+	dbPath := "root/" + c.Param("dbPath")
+	tableName := c.Param("tableName")
+	tablePath := dbPath + "/" + tableName
+
+	req, ok := readQueryRequest(c, true)
+	if !ok {
+		return
+	}
+
+	deleted, err := t.DeleteRowsWhere(tablePath, req.Query, req.Vars)
+	if err != nil {
+		queryErrorResponse(c, "execution_error", err, req.Query)
+		return
+	}
+
+	c.Json(response{Result: map[string]int{"deleted": deleted}})
+}
+
+// handleDistinctValues returns the distinct values of ?field=
+func (t *Tree) handleDistinctValues(c *microweb.Context) {
+	dbPath := "root/" + c.Param("dbPath")
+	tableName := c.Param("tableName")
+	tablePath := dbPath + "/" + tableName
+
+	field := c.Query("field")
+	if field == "" {
+		queryErrorResponse(c, "invalid_request", errors.New("field is required"), "")
+		return
+	}
+
+	values, err := t.GetDistinctValues(tablePath, field)
+	if err != nil {
+		queryErrorResponse(c, "execution_error", err, "")
+		return
+	}
+
+	c.Json(response{Result: values})
+}
+
+// handleAggregate returns count/sum/avg/min/max of ?field=
+func (t *Tree) handleAggregate(c *microweb.Context) {
+	dbPath := "root/" + c.Param("dbPath")
+	tableName := c.Param("tableName")
+	tablePath := dbPath + "/" + tableName
+
+	field := c.Query("field")
+	if field == "" {
+		queryErrorResponse(c, "invalid_request", errors.New("field is required"), "")
+		return
+	}
+
+	result, err := t.Aggregate(tablePath, field)
+	if err != nil {
+		queryErrorResponse(c, "execution_error", err, "")
+		return
+	}
+
+	c.Json(response{Result: result})
+}
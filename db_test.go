@@ -1,10 +1,12 @@
 package blueconfig
 
 import (
+	"errors"
 	"fmt"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -460,6 +462,59 @@ func TestSetValues(t *testing.T) {
 	}
 }
 
+func TestSaveNode(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	version, err := tr.SaveNode("/services/api", map[string]interface{}{"port": 8080}, 0)
+	if err != nil || version != 1 {
+		t.Fatalf("SaveNode new node = %d, %v; want 1", version, err)
+	}
+
+	version, err = tr.SaveNode("/services/api", map[string]interface{}{"port": 9090, "host": "a"})
+	if err != nil || version != 2 {
+		t.Fatalf("SaveNode without expected version = %d, %v; want 2", version, err)
+	}
+
+	_, err = tr.SaveNode("/services/api", map[string]interface{}{"port": 1}, 1)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("stale SaveNode: expected ErrVersionConflict, got %v", err)
+	}
+	if port, _ := tr.GetValue("/services/api/port"); port != "9090" {
+		t.Errorf("stale SaveNode wrote port %s", port)
+	}
+
+	// Every write of a user prop moves the version
+	writes := []struct {
+		name  string
+		write func() error
+	}{
+		{"SetValue", func() error { return tr.SetValue("/services/api/host", "b") }},
+		{"SetValues", func() error { return tr.SetValues("/services/api", map[string]interface{}{"host": "c"}) }},
+		{"CreateNodeWithProps", func() error { return tr.CreateNodeWithProps("/services/api", map[string]interface{}{"host": "d"}) }},
+		{"BatchCreateNodes", func() error {
+			return tr.BatchCreateNodes(map[string]map[string]interface{}{"/services/api": {"host": "e"}})
+		}},
+		{"DeleteValue", func() error { return tr.DeleteValue("/services/api", "host") }},
+	}
+	for i, w := range writes {
+		if err := w.write(); err != nil {
+			t.Fatalf("%s: %v", w.name, err)
+		}
+		if version, _ := tr.NodeVersion("/services/api"); version != int64(3+i) {
+			t.Errorf("NodeVersion after %s = %d, want %d", w.name, version, 3+i)
+		}
+	}
+
+	// Metadata props and __version itself do not
+	tr.SetValue("/services/api/__lastupdated", "1")
+	tr.SetValue("/services/api/"+VersionField, "1")
+	tr.DeleteValue("/services/api", "missing")
+	if version, _ := tr.NodeVersion("/services/api"); version != 7 {
+		t.Errorf("NodeVersion after metadata writes = %d, want 7", version)
+	}
+}
+
 func TestCreateNodeWithProps(t *testing.T) {
 	tr, _ := createTestTree(t)
 	defer cleanup(t, tr)
@@ -715,6 +770,185 @@ func TestHasValue(t *testing.T) {
 	}
 }
 
+func TestGlob(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetValue("/services/api/http/timeout", "30")
+	tr.SetValue("/services/web/http/timeout", "10")
+	tr.SetValue("/services/web/grpc/timeout", "5")
+	tr.SetValue("/services/worker/queue/http/timeout", "60")
+	tr.SetValue("/services/__trash/http/timeout", "1")
+	tr.CreatePath("/other/http")
+
+	tests := []struct {
+		name     string
+		pattern  string
+		expected []string
+	}{
+		{"single star", "/services/*/http", []string{"root/services/api/http", "root/services/web/http"}},
+		{"double star", "services/**/http", []string{"root/services/api/http", "root/services/web/http", "root/services/worker/queue/http"}},
+		{"braces", "services/{api,worker}/*", []string{"root/services/api/http", "root/services/worker/queue"}},
+		{"braces with wildcards", "services/web/{h*,g*}", []string{"root/services/web/grpc", "root/services/web/http"}},
+		{"partial star", "services/w*", []string{"root/services/web", "root/services/worker"}},
+		{"literal internal node", "services/__trash/http", []string{"root/services/__trash/http"}},
+		{"missing literal", "services/nope/*", []string{}},
+		{"leading double star", "**/http", []string{"root/other/http", "root/services/api/http", "root/services/web/http", "root/services/worker/queue/http"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := tr.Glob(tt.pattern)
+			if err != nil {
+				t.Fatalf("Glob(%q) returned error: %v", tt.pattern, err)
+			}
+			if fmt.Sprint(paths) != fmt.Sprint(tt.expected) {
+				t.Errorf("Glob(%q) = %v, want %v", tt.pattern, paths, tt.expected)
+			}
+		})
+	}
+
+	for _, pattern := range []string{"services/{api", "services/[a"} {
+		if _, err := tr.Glob(pattern); err == nil {
+			t.Errorf("Glob(%q) expected error", pattern)
+		}
+	}
+}
+
+func TestGlobProps(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetValues("/services/api/http", map[string]interface{}{"timeout": 30, "retries": 3, "host": "api"})
+	tr.SetValues("/services/web/http", map[string]interface{}{"timeout": 10})
+	tr.SaveNode("/services/web/http", map[string]interface{}{"host": "web"})
+	tr.CreatePath("/services/empty/http")
+
+	props, err := tr.GlobProps("services/*/http", "timeout")
+	if err != nil {
+		t.Fatalf("GlobProps returned error: %v", err)
+	}
+	if len(props) != 2 || props["root/services/api/http"]["timeout"] != "30" || props["root/services/web/http"]["timeout"] != "10" {
+		t.Errorf("GlobProps timeout = %v", props)
+	}
+
+	props, _ = tr.GlobProps("services/api/http", "{host,re*}")
+	if len(props["root/services/api/http"]) != 2 || props["root/services/api/http"]["retries"] != "3" {
+		t.Errorf("GlobProps braces = %v", props)
+	}
+
+	// Wildcards leave out internal props such as __version
+	props, _ = tr.GlobProps("services/web/http", "*")
+	if _, ok := props["root/services/web/http"][VersionField]; ok || len(props["root/services/web/http"]) != 2 {
+		t.Errorf("GlobProps * = %v", props)
+	}
+}
+
+func TestHandleGlob(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetValue("/services/api/http/timeout", "30")
+	tr.SetValue("/services/web/http/timeout", "10")
+
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{"paths", "?p=services/*/http", `"result":["root/services/api/http","root/services/web/http"]`},
+		{"props", "?p=services/api/*&prop=timeout", `"result":{"root/services/api/http":{"timeout":"30"}}`},
+		{"missing pattern", "", `"error":"p is required"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tr.handleGlob(adminContext(httptest.NewRequest("GET", "/glob"+tt.query, nil), w))
+			if !strings.Contains(w.Body.String(), tt.expected) {
+				t.Errorf("GET /glob%s = %s, want %s", tt.query, w.Body.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestFindNodes(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetValues("/sensors/cpu", map[string]interface{}{"__type": "sensor", "__unit": "ms", "rate": 50})
+	tr.SetValues("/sensors/disk", map[string]interface{}{"__type": "sensor", "__unit": "mb", "rate": 5})
+	tr.SetValues("/sensors/rack1/fan", map[string]interface{}{"__type": "sensor", "__unit": "ms", "rate": 20})
+	tr.SetValues("/sensors/rack1/temp", map[string]interface{}{"__type": "sensor", "__unit": "ms", "rate": 80})
+	tr.SetValues("/sensors/__trash/old", map[string]interface{}{"__type": "sensor", "__unit": "ms"})
+
+	paths := func(nodes []NodeMatch) []string {
+		var result []string
+		for _, n := range nodes {
+			result = append(result, n.Path)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name      string
+		query     string
+		recursive bool
+		opts      []QueryOptions
+		expected  []string
+	}{
+		{"children only", "__type == 'sensor' && __unit == 'ms'", false, nil, []string{"root/sensors/cpu"}},
+		{"recursive", "__type == 'sensor' && __unit == 'ms'", true, nil, []string{"root/sensors/cpu", "root/sensors/rack1/fan", "root/sensors/rack1/temp"}},
+		{"numeric comparison", "rate > 10", true, nil, []string{"root/sensors/cpu", "root/sensors/rack1/fan", "root/sensors/rack1/temp"}},
+		{"empty query", "", false, nil, []string{"root/sensors/cpu", "root/sensors/disk", "root/sensors/rack1"}},
+		{"sort desc", "__unit == 'ms'", true, []QueryOptions{{SortFields: []SortField{{FieldName: "rate", Direction: SortDesc}}}}, []string{"root/sensors/rack1/temp", "root/sensors/cpu", "root/sensors/rack1/fan"}},
+		{"skip and limit", "__unit == 'ms'", true, []QueryOptions{{Skip: 1, Limit: 1}}, []string{"root/sensors/rack1/fan"}},
+		{"skip past end", "__unit == 'ms'", true, []QueryOptions{{Skip: 5}}, nil},
+		{"variables", "__unit == $unit", true, []QueryOptions{{Vars: map[string]interface{}{"unit": "mb"}}}, []string{"root/sensors/disk"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodes, err := tr.FindNodes("/sensors", tt.query, tt.recursive, tt.opts...)
+			if err != nil {
+				t.Fatalf("FindNodes returned error: %v", err)
+			}
+			if fmt.Sprint(paths(nodes)) != fmt.Sprint(tt.expected) {
+				t.Errorf("FindNodes(%q) = %v, want %v", tt.query, paths(nodes), tt.expected)
+			}
+		})
+	}
+
+	nodes, _ := tr.FindNodes("/sensors", "rate == 50", false, QueryOptions{Fields: []string{"rate"}})
+	if len(nodes) != 1 || len(nodes[0].Props) != 1 || nodes[0].Props["rate"] != "50" {
+		t.Errorf("FindNodes with fields = %+v", nodes)
+	}
+
+	if _, err := tr.FindNodes("/sensors", "rate >", false); err == nil {
+		t.Error("expected parse error")
+	}
+	if _, err := tr.FindNodes("/missing", "", false); err == nil {
+		t.Error("expected error for missing path")
+	}
+}
+
+func TestHandleFindNodes(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetValues("/services/api", map[string]interface{}{"port": 8080})
+	tr.SetValues("/services/web", map[string]interface{}{"port": 80})
+
+	body := strings.NewReader(`{"query": "port > 1000", "fields": ["port"]}`)
+	w := httptest.NewRecorder()
+	tr.handlePostRequest(adminContext(httptest.NewRequest("POST", "/root/services/find", body), w))
+
+	expected := `"result":[{"path":"root/services/api","props":{"port":"8080"}}]`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("POST /find = %s, want %s", w.Body.String(), expected)
+	}
+}
+
 // ============================================================================
 // HTTP Handler Tests
 // ============================================================================
@@ -738,6 +972,15 @@ func setupTestServer(t *testing.T) (*Tree, *microweb.Router) {
 	return tr, web
 }
 
+func TestServeWithoutPort(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	if err := tr.Serve(); err == nil {
+		t.Error("expected error serving without a port")
+	}
+}
+
 func TestAuthMiddleware(t *testing.T) {
 	tr, _ := createTestTree(t)
 	defer cleanup(t, tr)
@@ -757,7 +1000,10 @@ func TestAuthMiddleware(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("GET", tt.path+"?token="+tt.token, nil)
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
 			w := httptest.NewRecorder()
 
 			c := &microweb.Context{
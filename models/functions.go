@@ -0,0 +1,817 @@
+package models
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// builtinFunc is the signature of a built-in expression function.
+// Arguments have already been evaluated.
+type builtinFunc func(args []any) (any, error)
+
+// builtinFunctions holds the built-in functions beyond upper/lower/len.
+// Unless noted otherwise, a function returns nil when its first argument is null
+// so that results can be combined with coalesce/ifnull.
+var builtinFunctions = map[string]builtinFunc{
+	// String functions
+	"trim":        fnTrim,
+	"substr":      fnSubstr,
+	"starts_with": fnStartsWith,
+	"ends_with":   fnEndsWith,
+	"replace":     fnReplace,
+	"concat":      fnConcat,
+	"concat_ws":   fnConcatWS,
+	"regex_match": fnRegexMatch,
+	"split":       fnSplit,
+
+	// Math functions
+	"abs":   fnAbs,
+	"round": fnRound,
+	"floor": fnFloor,
+	"ceil":  fnCeil,
+	"min":   fnMin,
+	"max":   fnMax,
+
+	// Date functions
+	"date_add":    fnDateAdd,
+	"date_diff":   fnDateDiff,
+	"year":        fnYear,
+	"month":       fnMonth,
+	"day":         fnDay,
+	"format_date": fnFormatDate,
+
+	// Null handling
+	"coalesce": fnCoalesce,
+	"ifnull":   fnIfNull,
+
+	// JSON array helpers (arrays are stored as JSON strings by flattenMap)
+	"array_length":   fnArrayLength,
+	"array_contains": fnArrayContains,
+	"array_get":      fnArrayGet,
+	"array_join":     fnArrayJoin,
+}
+
+// Date layouts accepted when parsing date strings, most specific first
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// dateOnlyLayout is used for TODAY() and for results derived from date-only inputs
+const dateOnlyLayout = "2006-01-02"
+
+// regexCacheSize bounds the number of compiled regex_match patterns kept
+const regexCacheSize = 64
+
+// regexCache avoids recompiling the same regex_match pattern for every row.
+// Patterns come from user queries, so it keeps only the most recently used.
+var regexCache = newRegexLRU(regexCacheSize)
+
+// ============================================================================
+// Argument Helpers
+// ============================================================================
+
+// checkArgCount validates the number of arguments (max < 0 means unbounded)
+func checkArgCount(name string, args []any, min, max int) error {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		switch {
+		case min == max:
+			return fmt.Errorf("%s() expects %d argument(s), got %d", name, min, len(args))
+		case max < 0:
+			return fmt.Errorf("%s() expects at least %d argument(s), got %d", name, min, len(args))
+		default:
+			return fmt.Errorf("%s() expects %d to %d arguments, got %d", name, min, max, len(args))
+		}
+	}
+	return nil
+}
+
+// stringArg returns argument i as a string; numbers and bools are formatted
+func stringArg(name string, args []any, i int) (string, error) {
+	switch v := args[i].(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", fmt.Errorf("%s() argument %d must not be null", name, i+1)
+	case []any, map[string]any:
+		return "", fmt.Errorf("%s() argument %d must be a string, got %T", name, i+1, v)
+	default:
+		return toString(v), nil
+	}
+}
+
+// numberArg returns argument i as a float64
+func numberArg(name string, args []any, i int) (float64, error) {
+	f, err := toFloat64(args[i])
+	if err != nil {
+		return 0, fmt.Errorf("%s() argument %d must be a number, got %v", name, i+1, args[i])
+	}
+	return f, nil
+}
+
+// intArg returns argument i as an int, rejecting fractional values
+func intArg(name string, args []any, i int) (int, error) {
+	f, err := numberArg(name, args, i)
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("%s() argument %d must be an integer, got %v", name, i+1, f)
+	}
+	return int(f), nil
+}
+
+// dateArg returns argument i as a time plus the layout it was written in
+func dateArg(name string, args []any, i int) (time.Time, string, error) {
+	t, layout, err := toTime(args[i])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("%s() argument %d: %v", name, i+1, err)
+	}
+	return t, layout, nil
+}
+
+// toTime converts a time.Time, date string or unix timestamp (seconds) to a time
+func toTime(val any) (time.Time, string, error) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, time.RFC3339, nil
+	case string:
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, layout, nil
+			}
+		}
+		return time.Time{}, "", fmt.Errorf("cannot parse %q as a date", v)
+	case nil:
+		return time.Time{}, "", fmt.Errorf("date must not be null")
+	default:
+		secs, err := toFloat64(v)
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("cannot convert %T to a date", val)
+		}
+		return time.Unix(int64(secs), 0).UTC(), time.RFC3339, nil
+	}
+}
+
+// toArray converts a []any or a JSON array string to a []any
+func toArray(name string, val any) ([]any, error) {
+	switch v := val.(type) {
+	case []any:
+		return v, nil
+	case string:
+		var arr []any
+		if err := json.Unmarshal([]byte(v), &arr); err != nil {
+			return nil, fmt.Errorf("%s() expects an array, got %q", name, v)
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("%s() expects an array, got %T", name, val)
+	}
+}
+
+// ============================================================================
+// String Functions
+// ============================================================================
+
+// trim(s) or trim(s, cutset)
+func fnTrim(args []any) (any, error) {
+	if err := checkArgCount("trim", args, 1, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, err := stringArg("trim", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		return strings.TrimSpace(s), nil
+	}
+	cutset, err := stringArg("trim", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Trim(s, cutset), nil
+}
+
+// substr(s, start) or substr(s, start, length); positions are 0-based characters
+func fnSubstr(args []any) (any, error) {
+	if err := checkArgCount("substr", args, 2, 3); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, err := stringArg("substr", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	start, err := intArg("substr", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("substr() start must not be negative, got %d", start)
+	}
+
+	runes := []rune(s)
+	if start >= len(runes) {
+		return "", nil
+	}
+	end := len(runes)
+	if len(args) == 3 {
+		length, err := intArg("substr", args, 2)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, fmt.Errorf("substr() length must not be negative, got %d", length)
+		}
+		if start+length < end {
+			end = start + length
+		}
+	}
+	return string(runes[start:end]), nil
+}
+
+// starts_with(s, prefix)
+func fnStartsWith(args []any) (any, error) {
+	if err := checkArgCount("starts_with", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return false, nil
+	}
+	s, err := stringArg("starts_with", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := stringArg("starts_with", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return strings.HasPrefix(s, prefix), nil
+}
+
+// ends_with(s, suffix)
+func fnEndsWith(args []any) (any, error) {
+	if err := checkArgCount("ends_with", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return false, nil
+	}
+	s, err := stringArg("ends_with", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	suffix, err := stringArg("ends_with", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return strings.HasSuffix(s, suffix), nil
+}
+
+// replace(s, old, new) replaces all occurrences
+func fnReplace(args []any) (any, error) {
+	if err := checkArgCount("replace", args, 3, 3); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, err := stringArg("replace", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	old, err := stringArg("replace", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	repl, err := stringArg("replace", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	return strings.ReplaceAll(s, old, repl), nil
+}
+
+// concat(a, b, ...) joins its arguments as strings; null arguments are skipped
+func fnConcat(args []any) (any, error) {
+	if err := checkArgCount("concat", args, 1, -1); err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	for i := range args {
+		if args[i] == nil {
+			continue
+		}
+		s, err := stringArg("concat", args, i)
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(s)
+	}
+	return sb.String(), nil
+}
+
+// concat_ws(sep, a, b, ...) joins the non-null arguments with a separator
+func fnConcatWS(args []any) (any, error) {
+	if err := checkArgCount("concat_ws", args, 2, -1); err != nil {
+		return nil, err
+	}
+	sep, err := stringArg("concat_ws", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	var parts []string
+	for i := 1; i < len(args); i++ {
+		if args[i] == nil {
+			continue
+		}
+		s, err := stringArg("concat_ws", args, i)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// regex_match(s, pattern) uses Go regexp syntax
+func fnRegexMatch(args []any) (any, error) {
+	if err := checkArgCount("regex_match", args, 2, 2); err != nil {
+		return nil, err
+	}
+	pattern, err := stringArg("regex_match", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexCache.compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("regex_match() invalid pattern %q: %v", pattern, err)
+	}
+
+	if args[0] == nil {
+		return false, nil
+	}
+	s, err := stringArg("regex_match", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(s), nil
+}
+
+// split(s, sep) returns an array usable with len(), CONTAINS and the array helpers
+func fnSplit(args []any) (any, error) {
+	if err := checkArgCount("split", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, err := stringArg("split", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	sep, err := stringArg("split", args, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(s, sep)
+	result := make([]any, len(parts))
+	for i, p := range parts {
+		result[i] = p
+	}
+	return result, nil
+}
+
+// ============================================================================
+// Math Functions
+// ============================================================================
+
+// unaryMath builds a single-argument math function
+func unaryMath(name string, op func(float64) float64) builtinFunc {
+	return func(args []any) (any, error) {
+		if err := checkArgCount(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		f, err := numberArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return op(f), nil
+	}
+}
+
+var (
+	fnAbs   = unaryMath("abs", math.Abs)
+	fnFloor = unaryMath("floor", math.Floor)
+	fnCeil  = unaryMath("ceil", math.Ceil)
+)
+
+// round(x) or round(x, digits)
+func fnRound(args []any) (any, error) {
+	if err := checkArgCount("round", args, 1, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	f, err := numberArg("round", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		return math.Round(f), nil
+	}
+	digits, err := intArg("round", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	scale := math.Pow(10, float64(digits))
+	return math.Round(f*scale) / scale, nil
+}
+
+// extremum builds min/max over one or more arguments, ignoring nulls
+func extremum(name string, better func(a, b float64) bool) builtinFunc {
+	return func(args []any) (any, error) {
+		if err := checkArgCount(name, args, 1, -1); err != nil {
+			return nil, err
+		}
+		var result any
+		var best float64
+		for i := range args {
+			if args[i] == nil {
+				continue
+			}
+			f, err := numberArg(name, args, i)
+			if err != nil {
+				return nil, err
+			}
+			if result == nil || better(f, best) {
+				best = f
+				result = f
+			}
+		}
+		return result, nil
+	}
+}
+
+var (
+	fnMin = extremum("min", func(a, b float64) bool { return a < b })
+	fnMax = extremum("max", func(a, b float64) bool { return a > b })
+)
+
+// ============================================================================
+// Date Functions
+// ============================================================================
+
+// addToDate adds amount of unit to t
+func addToDate(t time.Time, amount int, unit string) (time.Time, error) {
+	switch strings.TrimSuffix(strings.ToLower(unit), "s") {
+	case "second":
+		return t.Add(time.Duration(amount) * time.Second), nil
+	case "minute":
+		return t.Add(time.Duration(amount) * time.Minute), nil
+	case "hour":
+		return t.Add(time.Duration(amount) * time.Hour), nil
+	case "day":
+		return t.AddDate(0, 0, amount), nil
+	case "week":
+		return t.AddDate(0, 0, 7*amount), nil
+	case "month":
+		return t.AddDate(0, amount, 0), nil
+	case "year":
+		return t.AddDate(amount, 0, 0), nil
+	default:
+		return t, fmt.Errorf("unknown date unit %q", unit)
+	}
+}
+
+// calendarUnit reports whether unit counts whole days or more
+func calendarUnit(unit string) bool {
+	switch strings.TrimSuffix(strings.ToLower(unit), "s") {
+	case "day", "week", "month", "year":
+		return true
+	}
+	return false
+}
+
+// date_add(date, amount, unit) returns the date in the layout it was given
+// in; date-only inputs shifted by hours, minutes or seconds come back as RFC3339
+func fnDateAdd(args []any) (any, error) {
+	if err := checkArgCount("date_add", args, 3, 3); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	t, layout, err := dateArg("date_add", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	amount, err := intArg("date_add", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	unit, err := stringArg("date_add", args, 2)
+	if err != nil {
+		return nil, err
+	}
+	result, err := addToDate(t, amount, unit)
+	if err != nil {
+		return nil, fmt.Errorf("date_add() %v", err)
+	}
+	if layout == dateOnlyLayout && !calendarUnit(unit) {
+		layout = time.RFC3339
+	}
+	return result.Format(layout), nil
+}
+
+// date_diff(a, b) or date_diff(a, b, unit) returns a - b, in days by default
+func fnDateDiff(args []any) (any, error) {
+	if err := checkArgCount("date_diff", args, 2, 3); err != nil {
+		return nil, err
+	}
+	if args[0] == nil || args[1] == nil {
+		return nil, nil
+	}
+	a, _, err := dateArg("date_diff", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	b, _, err := dateArg("date_diff", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	unit := "day"
+	if len(args) == 3 {
+		if unit, err = stringArg("date_diff", args, 2); err != nil {
+			return nil, err
+		}
+	}
+
+	d := a.Sub(b)
+	switch strings.TrimSuffix(strings.ToLower(unit), "s") {
+	case "second":
+		return math.Trunc(d.Seconds()), nil
+	case "minute":
+		return math.Trunc(d.Minutes()), nil
+	case "hour":
+		return math.Trunc(d.Hours()), nil
+	case "day":
+		return math.Trunc(d.Hours() / 24), nil
+	case "week":
+		return math.Trunc(d.Hours() / (24 * 7)), nil
+	case "month", "year":
+		months := (a.Year()-b.Year())*12 + int(a.Month()) - int(b.Month())
+		// Only count whole months
+		if months > 0 && a.AddDate(0, -months, 0).Before(b) {
+			months--
+		} else if months < 0 && a.AddDate(0, -months, 0).After(b) {
+			months++
+		}
+		if strings.HasPrefix(strings.ToLower(unit), "year") {
+			return float64(months / 12), nil
+		}
+		return float64(months), nil
+	default:
+		return nil, fmt.Errorf("date_diff() unknown date unit %q", unit)
+	}
+}
+
+// datePart builds year/month/day extractors
+func datePart(name string, part func(time.Time) int) builtinFunc {
+	return func(args []any) (any, error) {
+		if err := checkArgCount(name, args, 1, 1); err != nil {
+			return nil, err
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		t, _, err := dateArg(name, args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return float64(part(t)), nil
+	}
+}
+
+var (
+	fnYear  = datePart("year", func(t time.Time) int { return t.Year() })
+	fnMonth = datePart("month", func(t time.Time) int { return int(t.Month()) })
+	fnDay   = datePart("day", func(t time.Time) int { return t.Day() })
+)
+
+// dateFormatTokens maps the YYYY/MM/DD/HH/mm/ss tokens to Go layout elements.
+// Layouts without tokens are used as Go layouts directly.
+var dateFormatTokens = strings.NewReplacer(
+	"YYYY", "2006",
+	"MM", "01",
+	"DD", "02",
+	"HH", "15",
+	"mm", "04",
+	"ss", "05",
+)
+
+// format_date(date, layout)
+func fnFormatDate(args []any) (any, error) {
+	if err := checkArgCount("format_date", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	t, _, err := dateArg("format_date", args, 0)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := stringArg("format_date", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	return t.Format(dateFormatTokens.Replace(layout)), nil
+}
+
+// ============================================================================
+// Null Handling
+// ============================================================================
+
+// coalesce(a, b, ...) returns the first non-null argument
+func fnCoalesce(args []any) (any, error) {
+	if err := checkArgCount("coalesce", args, 1, -1); err != nil {
+		return nil, err
+	}
+	for _, arg := range args {
+		if arg != nil {
+			return arg, nil
+		}
+	}
+	return nil, nil
+}
+
+// ifnull(value, fallback)
+func fnIfNull(args []any) (any, error) {
+	if err := checkArgCount("ifnull", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return args[1], nil
+	}
+	return args[0], nil
+}
+
+// ============================================================================
+// JSON Array Helpers
+// ============================================================================
+
+// array_length(arr)
+func fnArrayLength(args []any) (any, error) {
+	if err := checkArgCount("array_length", args, 1, 1); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	arr, err := toArray("array_length", args[0])
+	if err != nil {
+		return nil, err
+	}
+	return float64(len(arr)), nil
+}
+
+// array_contains(arr, value)
+func fnArrayContains(args []any) (any, error) {
+	if err := checkArgCount("array_contains", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return false, nil
+	}
+	arr, err := toArray("array_contains", args[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range arr {
+		if equals(item, args[1]) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// array_get(arr, index) returns nil when the index is out of range;
+// negative indexes count from the end
+func fnArrayGet(args []any) (any, error) {
+	if err := checkArgCount("array_get", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	arr, err := toArray("array_get", args[0])
+	if err != nil {
+		return nil, err
+	}
+	idx, err := intArg("array_get", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	if idx < 0 {
+		idx += len(arr)
+	}
+	if idx < 0 || idx >= len(arr) {
+		return nil, nil
+	}
+	return arr[idx], nil
+}
+
+// array_join(arr, sep)
+func fnArrayJoin(args []any) (any, error) {
+	if err := checkArgCount("array_join", args, 2, 2); err != nil {
+		return nil, err
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	arr, err := toArray("array_join", args[0])
+	if err != nil {
+		return nil, err
+	}
+	sep, err := stringArg("array_join", args, 1)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]string, len(arr))
+	for i, item := range arr {
+		parts[i] = toString(item)
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// ============================================================================
+// Regex Cache
+// ============================================================================
+
+// regexLRU is a small least recently used cache of compiled patterns
+type regexLRU struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is most recently used; values are *regexEntry
+	entries map[string]*list.Element
+}
+
+type regexEntry struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func newRegexLRU(size int) *regexLRU {
+	return &regexLRU{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// compile returns the cached regexp for pattern, compiling and caching it on
+// a miss and evicting the least recently used pattern when full
+func (c *regexLRU) compile(pattern string) (*regexp.Regexp, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(el)
+		c.mu.Unlock()
+		return el.Value.(*regexEntry).re, nil
+	}
+	c.mu.Unlock()
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[pattern]; ok {
+		c.order.MoveToFront(el)
+		return el.Value.(*regexEntry).re, nil
+	}
+	c.entries[pattern] = c.order.PushFront(&regexEntry{pattern: pattern, re: re})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*regexEntry).pattern)
+	}
+	return re, nil
+}
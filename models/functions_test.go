@@ -0,0 +1,219 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	parser "github.com/sfi2k7/blueconfig/parser"
+)
+
+// matchAll runs each query against obj and checks the expected result
+func matchAll(t *testing.T, obj *Object, tests []struct {
+	query    string
+	expected bool
+}) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			match, err := obj.Match(parser.ParseExprQuery(tt.query))
+			if err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+			if match != tt.expected {
+				t.Errorf("Match(%s) = %v, want %v", tt.query, match, tt.expected)
+			}
+		})
+	}
+}
+
+// TestStringFunctions tests trim, substr, starts_with, ends_with, replace, regex_match, split and concat
+func TestStringFunctions(t *testing.T) {
+	obj := NewObject(NewRow(map[string]any{
+		"name":  "  Alice Smith  ",
+		"email": "alice@example.com",
+		"tags":  "go,rust,zig",
+		"zip":   90210,
+	}))
+
+	matchAll(t, obj, []struct {
+		query    string
+		expected bool
+	}{
+		{"trim(name) == 'Alice Smith'", true},
+		{"trim(email, 'a') == 'lice@example.com'", true},
+		{"substr(email, 0, 5) == 'alice'", true},
+		{"substr(email, 6) == 'example.com'", true},
+		{"substr(email, 100) == ''", true},
+		{"substr(zip, 0, 3) == '902'", true},
+		{"starts_with(email, 'alice') == true", true},
+		{"starts_with(email, 'bob') == true", false},
+		{"ends_with(email, '.com') == true", true},
+		{"replace(email, 'example', 'test') == 'alice@test.com'", true},
+		{"regex_match(email, '^[a-z]+@[a-z]+[.]com$') == true", true},
+		{"regex_match(name, '^[0-9]+$') == true", false},
+		{"len(split(tags, ',')) == 3", true},
+		{"split(tags, ',') CONTAINS 'rust'", true},
+		{"concat(trim(name), ' <', email, '>', missing) == 'Alice Smith <alice@example.com>'", true},
+		{"concat_ws('-', zip, missing, 'x') == '90210-x'", true},
+		{"starts_with(missing, 'a') == true", false},
+	})
+}
+
+// TestMathFunctions tests abs, round, floor, ceil, min and max
+func TestMathFunctions(t *testing.T) {
+	obj := NewObject(NewRow(map[string]any{
+		"balance": -42.5,
+		"price":   19.456,
+		"a":       3,
+		"b":       7,
+	}))
+
+	matchAll(t, obj, []struct {
+		query    string
+		expected bool
+	}{
+		{"abs(balance) == 42.5", true},
+		{"round(price) == 19", true},
+		{"round(price, 2) == 19.46", true},
+		{"floor(price) == 19", true},
+		{"ceil(price) == 20", true},
+		{"min(a, b) == 3", true},
+		{"max(a, b, 10) == 10", true},
+		{"max(a, missing) == 3", true},
+	})
+}
+
+// TestDateFunctions tests date_add, date_diff, year, month, day and format_date
+func TestDateFunctions(t *testing.T) {
+	now := time.Now().UTC()
+	obj := NewObject(NewRow(map[string]any{
+		"created":  "2024-01-15T10:30:00Z",
+		"birthday": "1990-06-20",
+		"expires":  now.AddDate(0, 0, 10).Format("2006-01-02"),
+	}))
+
+	matchAll(t, obj, []struct {
+		query    string
+		expected bool
+	}{
+		{"year(created) == 2024", true},
+		{"month(created) == 1", true},
+		{"day(birthday) == 20", true},
+		{"date_add(birthday, 10, 'days') == '1990-06-30'", true},
+		{"date_add(birthday, 5, 'hour') == '1990-06-20T05:00:00Z'", true},
+		{"date_add('2024-01-01', 90, 'minutes') == '2024-01-01T01:30:00Z'", true},
+		{"date_add('2024-01-01', 1, 'week') == '2024-01-08'", true},
+		{"date_add(created, 1, 'month') == '2024-02-15T10:30:00Z'", true},
+		{"date_diff('2024-03-01', birthday, 'years') == 33", true},
+		{"date_diff('2024-01-20', '2024-01-15') == 5", true},
+		{"date_diff(created, '2024-01-15T09:30:00Z', 'minutes') == 60", true},
+		{"format_date(created, 'DD/MM/YYYY') == '15/01/2024'", true},
+		{"expires > TODAY()", true},
+		{"date_diff(expires, TODAY()) == 10", true},
+		{"created < NOW()", true},
+		{"date_add(TODAY(), 10, 'day') == expires", true},
+	})
+}
+
+// TestNullFunctions tests coalesce and ifnull
+func TestNullFunctions(t *testing.T) {
+	obj := NewObject(NewRow(map[string]any{
+		"nickname": nil,
+		"name":     "Alice",
+	}))
+
+	matchAll(t, obj, []struct {
+		query    string
+		expected bool
+	}{
+		{"coalesce(nickname, missing, name) == 'Alice'", true},
+		{"coalesce(name, 'x') == 'Alice'", true},
+		{"ifnull(nickname, 'none') == 'none'", true},
+		{"ifnull(upper(name), 'none') == 'ALICE'", true},
+		{"coalesce(trim(nickname), 'blank') == 'blank'", true},
+	})
+}
+
+// TestArrayFunctions tests the JSON array helpers on flattened slices
+func TestArrayFunctions(t *testing.T) {
+	obj := NewObject(NewRow(map[string]any{
+		"tags":   []string{"admin", "editor"},
+		"scores": []int{10, 20, 30},
+	}))
+
+	matchAll(t, obj, []struct {
+		query    string
+		expected bool
+	}{
+		{"array_length(tags) == 2", true},
+		{"array_contains(tags, 'admin') == true", true},
+		{"array_contains(tags, 'guest') == true", false},
+		{"array_contains(scores, 20) == true", true},
+		{"array_get(scores, 0) == 10", true},
+		{"array_get(scores, 2) == 30", true},
+		{"array_get(scores, 5) IS NULL", true},
+		{"array_join(tags, '|') == 'admin|editor'", true},
+	})
+}
+
+// TestBuiltinFunctionArgumentValidation tests error reporting for bad arguments
+func TestBuiltinFunctionArgumentValidation(t *testing.T) {
+	obj := NewObject(NewRow(map[string]any{
+		"name": "Alice",
+		"age":  30,
+	}))
+
+	tests := []struct {
+		query   string
+		errPart string
+	}{
+		{"trim() == ''", "trim() expects 1 to 2 arguments, got 0"},
+		{"substr(name) == ''", "substr() expects 2 to 3 arguments"},
+		{"substr(name, 1.5) == ''", "must be an integer"},
+		{"substr(name, 'x') == ''", "must be a number"},
+		{"replace(name, 'a') == ''", "replace() expects 3 argument(s), got 2"},
+		{"regex_match(name, '[') == true", "invalid pattern"},
+		{"abs(name) == 1", "abs() argument 1 must be a number"},
+		{"min() == 1", "min() expects at least 1 argument(s), got 0"},
+		{"year(name) == 2024", "cannot parse \"Alice\" as a date"},
+		{"date_add('2024-01-01', 1, 'fortnight') == ''", "unknown date unit"},
+		{"array_length(name) == 1", "array_length() expects an array"},
+		{"ifnull(name) == 'x'", "ifnull() expects 2 argument(s), got 1"},
+		{"nosuchfn(name) == 1", "unknown function: nosuchfn"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := obj.Match(parser.ParseExprQuery(tt.query))
+			if err == nil {
+				t.Fatalf("Expected error for %s", tt.query)
+			}
+			if !strings.Contains(err.Error(), tt.errPart) {
+				t.Errorf("Expected error containing %q, got %q", tt.errPart, err.Error())
+			}
+		})
+	}
+}
+
+// TestRegexCacheBounded checks that user supplied patterns cannot grow the cache without limit
+func TestRegexCacheBounded(t *testing.T) {
+	cache := newRegexLRU(2)
+	for _, pattern := range []string{"^a", "^b", "^a", "^c"} {
+		if _, err := cache.compile(pattern); err != nil {
+			t.Fatalf("compile(%s) error = %v", pattern, err)
+		}
+	}
+	if cache.order.Len() != 2 {
+		t.Errorf("cache holds %d patterns, want 2", cache.order.Len())
+	}
+	if _, ok := cache.entries["^b"]; ok {
+		t.Error("least recently used pattern ^b should have been evicted")
+	}
+	if _, ok := cache.entries["^a"]; !ok {
+		t.Error("recently used pattern ^a should be kept")
+	}
+	if _, err := cache.compile("["); err == nil || cache.order.Len() != 2 {
+		t.Errorf("invalid pattern: err = %v, len = %d", err, cache.order.Len())
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	parser "github.com/sfi2k7/blueconfig/parser"
 )
@@ -364,6 +365,11 @@ func (o *Object) evaluateTerm(term *parser.ConditionTerm) (any, error) {
 	return nil, fmt.Errorf("unable to evaluate term")
 }
 
+// Evaluate computes the value of a term (see parser.ParseValue) against the object
+func (o *Object) Evaluate(term *parser.ConditionTerm) (any, error) {
+	return o.evaluateTerm(term)
+}
+
 // evaluateFunction calls a user-defined or built-in function
 func (o *Object) evaluateFunction(fn *parser.FunctionCall) (any, error) {
 	// Evaluate arguments
@@ -422,6 +428,9 @@ func (o *Object) evaluateBuiltinFunction(name string, args []any) (any, error) {
 		}
 
 	default:
+		if fn, ok := builtinFunctions[name]; ok {
+			return fn(args)
+		}
 		return nil, fmt.Errorf("unknown function: %s", name)
 	}
 }
@@ -493,14 +502,15 @@ func (o *Object) evaluateCast(cast *parser.TypeCast) (any, error) {
 }
 
 // evaluateDateTime evaluates a date/time expression
+// NOW() yields an RFC3339 UTC timestamp and TODAY() a YYYY-MM-DD date, so both
+// compare correctly against dates stored as strings and feed the date functions
 func (o *Object) evaluateDateTime(dt *parser.DateTimeValue) (any, error) {
-	// This is a placeholder - in a real implementation, you'd use time.Now(), etc.
-	// For now, we'll return string representations
+	now := time.Now().UTC()
 	switch dt.Type {
 	case "NOW":
-		return "NOW()", nil // Placeholder
+		return now.Format(time.RFC3339), nil
 	case "TODAY":
-		return "TODAY()", nil // Placeholder
+		return now.Format(dateOnlyLayout), nil
 	default:
 		return nil, fmt.Errorf("unsupported datetime type: %s", dt.Type)
 	}
@@ -759,3 +759,38 @@ func TestObjectPseudocodeExample(t *testing.T) {
 
 
 */
+
+// TestObjectEvaluate tests evaluating value expressions against an object
+func TestObjectEvaluate(t *testing.T) {
+	obj := NewObject(NewRow(map[string]any{
+		"price": 2.5,
+		"qty":   4,
+		"first": "ada",
+	}))
+
+	tests := []struct {
+		expr     string
+		expected any
+	}{
+		{"price * qty", 10.0},
+		{"upper(first)", "ADA"},
+		{"coalesce(missing, 'none')", "none"},
+		{"missing", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			term, err := parser.ParseValue(tt.expr)
+			if err != nil {
+				t.Fatalf("ParseValue() error = %v", err)
+			}
+			got, err := obj.Evaluate(term)
+			if err != nil {
+				t.Fatalf("Evaluate() error = %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("Evaluate(%s) = %v (%T), want %v", tt.expr, got, got, tt.expected)
+			}
+		})
+	}
+}
@@ -6,6 +6,34 @@ type QueryAST struct {
 	Expr *Expr         `@@`
 }
 
+// StatementAST represents a full query statement:
+// USE users; SELECT name, address.city WHERE age > 30 ORDER BY name DESC LIMIT 10 OFFSET 20
+type StatementAST struct {
+	Use     *UseStatement    `@@?`
+	Select  *SelectClause    `"SELECT" @@`
+	Where   *Expr            `( "WHERE" @@ )?`
+	OrderBy []*OrderByClause `( "ORDER" "BY" @@ ( "," @@ )* )?`
+	Limit   *int             `( "LIMIT" @Int )?`
+	Offset  *int             `( "OFFSET" @Int )?`
+}
+
+// ValueAST represents a standalone value expression such as "price * qty"
+type ValueAST struct {
+	Expr *ArithExpr `@@`
+}
+
+// SelectClause represents the projection list ("*" or field names)
+type SelectClause struct {
+	All    bool     `  @"*"`
+	Fields []string `| @Ident ( "," @Ident )*`
+}
+
+// OrderByClause represents a single ORDER BY field with optional direction
+type OrderByClause struct {
+	Field     string `@Ident`
+	Direction string `@( "ASC" | "DESC" )?`
+}
+
 // UseStatement represents "USE collection_name;" syntax
 type UseStatement struct {
 	Collection string `"USE" @Ident ";"`
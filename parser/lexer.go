@@ -5,26 +5,35 @@ import (
 )
 
 // queryLexer defines the lexer rules for tokenizing query strings
-var queryLexer = lexer.MustSimple([]lexer.SimpleRule{
-	{Name: "String", Pattern: `'[^']*'|"[^"]*"`},
-	{Name: "Keyword", Pattern: `\b(IN|NOT|IS|NULL|LIKE|BETWEEN|AND|CONTAINS|ANY_OF|CAST|AS|NOW|TODAY)\b`},
-	{Name: "Ident", Pattern: `[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*`},
-	{Name: "Float", Pattern: `\d+\.\d+`},
-	{Name: "Int", Pattern: `\d+`},
-	{Name: "GTE", Pattern: `>=`},
-	{Name: "LTE", Pattern: `<=`},
-	{Name: "EQ", Pattern: `==`},
-	{Name: "NEQ", Pattern: `!=`},
-	{Name: "Punct", Pattern: `[(){}[\],;$]`},
-	{Name: "Plus", Pattern: `\+`},
-	{Name: "Minus", Pattern: `-`},
-	{Name: "Multiply", Pattern: `\*`},
-	{Name: "Divide", Pattern: `/`},
-	{Name: "Modulo", Pattern: `%`},
-	{Name: "GT", Pattern: `>`},
-	{Name: "LT", Pattern: `<`},
-	{Name: "And", Pattern: `&&`},
-	{Name: "Or", Pattern: `\|\|`},
-	{Name: "Not", Pattern: `!`},
-	{Name: "whitespace", Pattern: `\s+`},
-})
+var queryLexer = newQueryLexer(`IN|NOT|IS|NULL|LIKE|BETWEEN|AND|CONTAINS|ANY_OF|CAST|AS|NOW|TODAY`)
+
+// statementLexer additionally reserves the SELECT clause keywords. Plain
+// expressions keep using queryLexer, so fields named ORDER or LIMIT still parse.
+var statementLexer = newQueryLexer(`IN|NOT|IS|NULL|LIKE|BETWEEN|AND|CONTAINS|ANY_OF|CAST|AS|NOW|TODAY|SELECT|WHERE|ORDER|BY|LIMIT|OFFSET|ASC|DESC`)
+
+// newQueryLexer builds the query lexer with the given keyword alternation
+func newQueryLexer(keywords string) *lexer.StatefulDefinition {
+	return lexer.MustSimple([]lexer.SimpleRule{
+		{Name: "String", Pattern: `'[^']*'|"[^"]*"`},
+		{Name: "Keyword", Pattern: `\b(` + keywords + `)\b`},
+		{Name: "Ident", Pattern: `[a-zA-Z_][a-zA-Z0-9_]*(\.[a-zA-Z_][a-zA-Z0-9_]*)*`},
+		{Name: "Float", Pattern: `\d+\.\d+`},
+		{Name: "Int", Pattern: `\d+`},
+		{Name: "GTE", Pattern: `>=`},
+		{Name: "LTE", Pattern: `<=`},
+		{Name: "EQ", Pattern: `==`},
+		{Name: "NEQ", Pattern: `!=`},
+		{Name: "Punct", Pattern: `[(){}[\],;$]`},
+		{Name: "Plus", Pattern: `\+`},
+		{Name: "Minus", Pattern: `-`},
+		{Name: "Multiply", Pattern: `\*`},
+		{Name: "Divide", Pattern: `/`},
+		{Name: "Modulo", Pattern: `%`},
+		{Name: "GT", Pattern: `>`},
+		{Name: "LT", Pattern: `<`},
+		{Name: "And", Pattern: `&&`},
+		{Name: "Or", Pattern: `\|\|`},
+		{Name: "Not", Pattern: `!`},
+		{Name: "whitespace", Pattern: `\s+`},
+	})
+}
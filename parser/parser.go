@@ -1,9 +1,12 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
 )
 
 // parser is the participle parser instance configured with the query lexer
@@ -13,16 +16,148 @@ var parser = participle.MustBuild[QueryAST](
 	participle.UseLookahead(2), // For better parsing
 )
 
-// ParseExprQuery parses an expression string into a Query structure
-// Panics on parse or validation errors
-func ParseExprQuery(exprStr string) Query {
+// statementParser parses full SELECT statements
+var statementParser = participle.MustBuild[StatementAST](
+	participle.Lexer(statementLexer),
+	participle.Unquote("String"),
+	participle.UseLookahead(2),
+)
+
+// valueParser parses standalone value expressions
+var valueParser = participle.MustBuild[ValueAST](
+	participle.Lexer(queryLexer),
+	participle.Unquote("String"),
+	participle.UseLookahead(2),
+)
+
+// ParseError describes why a query string could not be parsed.
+// Line and Column are 1-based; they are zero for validation errors
+// that are not tied to a source position.
+type ParseError struct {
+	Message  string   `json:"message"`
+	Line     int      `json:"line,omitempty"`
+	Column   int      `json:"column,omitempty"`
+	Offset   int      `json:"offset,omitempty"`
+	Token    string   `json:"token,omitempty"`
+	Expected []string `json:"expected,omitempty"`
+}
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Parse parses an expression string into a Query structure.
+// Syntax and validation failures are returned as *ParseError.
+func Parse(exprStr string) (Query, error) {
 	ast, err := parser.ParseString("", exprStr)
 	if err != nil {
-		panic(fmt.Sprintf("Parse error: %v", err))
+		return Query{}, newParseError(err)
 	}
 	q := traverseAST(ast)
 	if err := validateQuery(q); err != nil {
-		panic(fmt.Sprintf("Invalid query: %v", err))
+		return Query{}, &ParseError{Message: "invalid query: " + err.Error()}
+	}
+	return q, nil
+}
+
+// ParseStatement parses a SELECT statement such as
+// "USE users; SELECT name, address.city WHERE age > 30 ORDER BY name DESC LIMIT 10 OFFSET 20".
+// Errors are returned as *ParseError.
+func ParseStatement(stmtStr string) (*Statement, error) {
+	ast, err := statementParser.ParseString("", stmtStr)
+	if err != nil {
+		return nil, newParseError(err)
+	}
+	stmt := traverseStatement(ast)
+	if stmt.Where != nil {
+		if err := validateQuery(*stmt.Where); err != nil {
+			return nil, &ParseError{Message: "invalid query: " + err.Error()}
+		}
+	}
+	return stmt, nil
+}
+
+// ParseValue parses a value expression such as "upper(first) + ' ' + last"
+// into a term that evaluates to a value rather than a match.
+// Errors are returned as *ParseError.
+func ParseValue(exprStr string) (*ConditionTerm, error) {
+	ast, err := valueParser.ParseString("", exprStr)
+	if err != nil {
+		return nil, newParseError(err)
+	}
+	return traverseArithExpr(ast.Expr), nil
+}
+
+// newParseError converts a participle or lexer error into a ParseError
+func newParseError(err error) *ParseError {
+	pe := &ParseError{Message: err.Error()}
+
+	var perr participle.Error
+	if !errors.As(err, &perr) {
+		return pe
+	}
+
+	pos := perr.Position()
+	pe.Message = perr.Message()
+	pe.Line = pos.Line
+	pe.Column = pos.Column
+	pe.Offset = pos.Offset
+
+	var unexpected *participle.UnexpectedTokenError
+	var lexErr *lexer.Error
+	switch {
+	case errors.As(err, &unexpected):
+		if unexpected.Unexpected.EOF() {
+			pe.Token = "<EOF>"
+		} else {
+			pe.Token = unexpected.Unexpected.Value
+		}
+		pe.Expected = parseExpected(unexpected.Message())
+	case errors.As(err, &lexErr):
+		// Lexer errors only carry the remaining input; report its first rune
+		if rest := quotedInput(lexErr.Msg); rest != "" {
+			pe.Token = rest[:1]
+		}
+	}
+	return pe
+}
+
+// parseExpected extracts the alternatives from a participle
+// "unexpected token ... (expected A | B)" message
+func parseExpected(msg string) []string {
+	idx := strings.Index(msg, "(expected ")
+	if idx < 0 || !strings.HasSuffix(msg, ")") {
+		return nil
+	}
+	expect := msg[idx+len("(expected ") : len(msg)-1]
+	var out []string
+	for _, alt := range strings.Split(expect, " | ") {
+		if alt = strings.TrimSpace(alt); alt != "" {
+			out = append(out, alt)
+		}
+	}
+	return out
+}
+
+// quotedInput returns the quoted input from a lexer "invalid input text" message
+func quotedInput(msg string) string {
+	start := strings.Index(msg, `"`)
+	end := strings.LastIndex(msg, `"`)
+	if start < 0 || end <= start {
+		return ""
+	}
+	return msg[start+1 : end]
+}
+
+// ParseExprQuery parses an expression string into a Query structure
+// Panics on parse or validation errors; use Parse to get an error instead
+func ParseExprQuery(exprStr string) Query {
+	q, err := Parse(exprStr)
+	if err != nil {
+		panic(fmt.Sprintf("Parse error: %v", err))
 	}
 	return q
 }
@@ -31,21 +166,13 @@ func ParseExprQuery(exprStr string) Query {
 // Returns the parsed Query and the collection name
 // Panics on parse or validation errors
 func ParseExprQueryWithCollection(exprStr string) (Query, string) {
-	ast, err := parser.ParseString("", exprStr)
+	q, err := Parse(exprStr)
 	if err != nil {
 		panic(fmt.Sprintf("Parse error: %v", err))
 	}
 
-	collection := "default" // Default collection if no USE statement
-	if ast.Use != nil {
-		collection = ast.Use.Collection
-	}
-
-	q := traverseAST(ast)
-	q.Collection = collection
-
-	if err := validateQuery(q); err != nil {
-		panic(fmt.Sprintf("Invalid query: %v", err))
+	if q.Collection == "" {
+		q.Collection = "default" // Default collection if no USE statement
 	}
-	return q, collection
+	return q, q.Collection
 }
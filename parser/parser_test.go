@@ -799,6 +799,169 @@ func TestParseErrors(t *testing.T) {
 	}
 }
 
+// TestParseReturnsParseError tests that Parse reports position and token details
+func TestParseReturnsParseError(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		line     int
+		column   int
+		token    string
+		expected bool
+	}{
+		{name: "incomplete comparison", query: "age >", line: 1, column: 6, token: "<EOF>", expected: true},
+		{name: "unbalanced parentheses", query: "(age > 18", line: 1, column: 10, token: "<EOF>", expected: true},
+		{name: "second line", query: "age\n  == == 3", line: 2, column: 6, token: "==", expected: true},
+		{name: "invalid character", query: "age @ 18", line: 1, column: 5, token: "@"},
+		{name: "unterminated string", query: "name == 'bob", line: 1, column: 9, token: "'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			if err == nil {
+				t.Fatalf("Expected error for invalid query: %s", tt.query)
+			}
+			pe, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("Expected *ParseError, got %T", err)
+			}
+			if pe.Line != tt.line || pe.Column != tt.column {
+				t.Errorf("Expected position %d:%d, got %d:%d", tt.line, tt.column, pe.Line, pe.Column)
+			}
+			if pe.Token != tt.token {
+				t.Errorf("Expected token %q, got %q", tt.token, pe.Token)
+			}
+			if tt.expected && len(pe.Expected) == 0 {
+				t.Errorf("Expected list of expected tokens, got none (%s)", pe.Message)
+			}
+		})
+	}
+}
+
+// TestParseValid tests that Parse matches ParseExprQuery for valid queries
+func TestParseValid(t *testing.T) {
+	q, err := Parse("USE users; age > 18")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if q.Collection != "users" {
+		t.Errorf("Expected collection users, got %q", q.Collection)
+	}
+	queriesEqual(t, ParseExprQuery("USE users; age > 18"), q)
+}
+
+// TestParseStatement tests full SELECT statements
+func TestParseStatement(t *testing.T) {
+	stmt, err := ParseStatement("USE users; SELECT name, address.city WHERE age > 30 ORDER BY name DESC, age LIMIT 10 OFFSET 20")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if stmt.Collection != "users" {
+		t.Errorf("Expected collection users, got %q", stmt.Collection)
+	}
+	if len(stmt.Fields) != 2 || stmt.Fields[0] != "name" || stmt.Fields[1] != "address.city" {
+		t.Errorf("Unexpected fields: %v", stmt.Fields)
+	}
+	if stmt.Where == nil {
+		t.Fatal("Expected WHERE clause")
+	}
+	queriesEqual(t, Query{
+		Conditions: []Condition{{
+			Op:    ">",
+			Left:  &ConditionTerm{Property: "age"},
+			Right: &ConditionTerm{Value: float64(30)},
+		}},
+		Collection: "users",
+	}, *stmt.Where)
+
+	expectedOrder := []OrderBy{{Field: "name", Desc: true}, {Field: "age"}}
+	if len(stmt.OrderBy) != len(expectedOrder) {
+		t.Fatalf("Expected %d ORDER BY fields, got %d", len(expectedOrder), len(stmt.OrderBy))
+	}
+	for i, ob := range expectedOrder {
+		if stmt.OrderBy[i] != ob {
+			t.Errorf("ORDER BY %d: expected %+v, got %+v", i, ob, stmt.OrderBy[i])
+		}
+	}
+	if stmt.Limit != 10 || stmt.Offset != 20 {
+		t.Errorf("Expected LIMIT 10 OFFSET 20, got %d/%d", stmt.Limit, stmt.Offset)
+	}
+}
+
+// TestParseStatementMinimal tests SELECT * without optional clauses
+func TestParseStatementMinimal(t *testing.T) {
+	stmt, err := ParseStatement("SELECT *")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stmt.Collection != "" || stmt.Fields != nil || stmt.Where != nil || stmt.OrderBy != nil {
+		t.Errorf("Expected empty statement, got %+v", stmt)
+	}
+	if stmt.Limit != 0 || stmt.Offset != 0 {
+		t.Errorf("Expected no pagination, got %d/%d", stmt.Limit, stmt.Offset)
+	}
+}
+
+// TestParseStatementErrors tests that malformed statements return ParseError
+func TestParseStatementErrors(t *testing.T) {
+	tests := []string{
+		"USE users; name, age",
+		"SELECT name WHERE",
+		"SELECT name ORDER name",
+		"SELECT name LIMIT ten",
+		"SELECT name OFFSET 5 LIMIT 2",
+	}
+	for _, stmtStr := range tests {
+		t.Run(stmtStr, func(t *testing.T) {
+			_, err := ParseStatement(stmtStr)
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("Expected *ParseError, got %v", err)
+			}
+		})
+	}
+}
+
+// TestParseClauseKeywordsAsFields tests that SELECT clause keywords are only
+// reserved inside statements, not in plain expressions
+func TestParseClauseKeywordsAsFields(t *testing.T) {
+	q, err := Parse("ORDER == 5 && BY == 'x' && LIMIT > 1")
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(q.Conditions) != 3 || q.Conditions[0].Left.Property != "ORDER" || q.Conditions[1].Left.Property != "BY" {
+		t.Errorf("unexpected conditions: %+v", q.Conditions)
+	}
+
+	stmt, err := ParseStatement("SELECT name WHERE age > 1 ORDER BY name")
+	if err != nil || len(stmt.OrderBy) != 1 {
+		t.Errorf("ParseStatement() = %+v, %v", stmt, err)
+	}
+}
+
+// TestParseValue tests standalone value expressions
+func TestParseValue(t *testing.T) {
+	term, err := ParseValue("price * qty")
+	if err != nil {
+		t.Fatalf("ParseValue() error = %v", err)
+	}
+	if term.Arithmetic == nil || term.Arithmetic.Op != "*" || term.Arithmetic.Left.Property != "price" {
+		t.Errorf("unexpected term: %+v", term)
+	}
+
+	term, err = ParseValue("upper(name)")
+	if err != nil || term.Function == nil || term.Function.Name != "upper" {
+		t.Errorf("ParseValue(upper(name)) = %+v, %v", term, err)
+	}
+
+	if _, err := ParseValue("price >"); err == nil {
+		t.Error("Expected error for trailing operator")
+	} else if _, ok := err.(*ParseError); !ok {
+		t.Errorf("Expected *ParseError, got %T", err)
+	}
+}
+
 // TestFunctionWithVariables tests functions that use variables in arguments
 func TestFunctionWithVariables(t *testing.T) {
 	query := "len(name) > $maxLength"
@@ -8,6 +8,22 @@ type Query struct {
 	Collection string      `json:"collection"` // Collection name from USE statement
 }
 
+// Statement represents a parsed SELECT statement for execution
+type Statement struct {
+	Collection string    `json:"collection,omitempty"` // Table name from USE statement
+	Fields     []string  `json:"fields,omitempty"`     // Projected fields (empty selects all)
+	Where      *Query    `json:"where,omitempty"`      // Filter (nil matches all rows)
+	OrderBy    []OrderBy `json:"orderBy,omitempty"`    // Sort order
+	Limit      int       `json:"limit,omitempty"`      // Maximum rows (0 = no limit)
+	Offset     int       `json:"offset,omitempty"`     // Rows to skip
+}
+
+// OrderBy represents a single ORDER BY field
+type OrderBy struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
+}
+
 // Condition represents a single condition in a query
 type Condition struct {
 	Op       string           `json:"op"`                 // Operator: ==, !=, >, <, >=, <=, func_predicate, IN, NOT_IN, IS_NULL, IS_NOT_NULL, LIKE, BETWEEN, CONTAINS, ANY_OF
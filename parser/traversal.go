@@ -12,6 +12,32 @@ func traverseAST(ast *QueryAST) Query {
 	return q
 }
 
+// traverseStatement converts a parsed statement AST into a Statement
+func traverseStatement(ast *StatementAST) *Statement {
+	stmt := &Statement{}
+	if ast.Use != nil {
+		stmt.Collection = ast.Use.Collection
+	}
+	if ast.Select != nil && !ast.Select.All {
+		stmt.Fields = ast.Select.Fields
+	}
+	if ast.Where != nil {
+		q := traverseExpr(ast.Where)
+		q.Collection = stmt.Collection
+		stmt.Where = &q
+	}
+	for _, ob := range ast.OrderBy {
+		stmt.OrderBy = append(stmt.OrderBy, OrderBy{Field: ob.Field, Desc: ob.Direction == "DESC"})
+	}
+	if ast.Limit != nil {
+		stmt.Limit = *ast.Limit
+	}
+	if ast.Offset != nil {
+		stmt.Offset = *ast.Offset
+	}
+	return stmt
+}
+
 // traverseExpr processes the top-level expression
 func traverseExpr(expr *Expr) Query {
 	return traverseOr(expr.Or)
@@ -0,0 +1,503 @@
+package blueconfig
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/sfi2k7/blueconfig/models"
+	"go.etcd.io/bbolt"
+)
+
+// ============================================================================
+// Constants
+// ============================================================================
+
+const (
+	SearchNode      = "__search" // full-text index of a table, or of plain props under root
+	SearchPropsPath = "root/" + SearchNode
+)
+
+const (
+	searchTermsNode = "terms" // term -> doc -> term frequency
+	searchDocsNode  = "docs"  // doc -> indexed terms, used to unindex
+	searchDocSep    = "\x00"  // separates the row ID or node path from the field in a doc key
+	maxTermLength   = 64      // longer tokens are not indexed
+	prefixWeight    = 0.5     // score weight of a prefix match against an exact one
+)
+
+// ============================================================================
+// Types
+// ============================================================================
+
+// SearchHit is a node or row matching every term of a search
+type SearchHit struct {
+	Path   string   `json:"path"`   // node path, or table path plus row ID
+	Fields []string `json:"fields"` // props or row fields that matched
+	Score  float64  `json:"score"`
+}
+
+// searchIndex is a __search bucket loaded inside a transaction
+type searchIndex struct {
+	bucket *bbolt.Bucket
+}
+
+// ============================================================================
+// Tokenizer
+// ============================================================================
+
+// tokenize lowercases text and splits it into letter and digit runs
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := words[:0]
+	for _, word := range words {
+		if len(word) <= maxTermLength {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// ============================================================================
+// Index Management
+// ============================================================================
+
+// CreateSearchIndex indexes the text of fields in a table, or of every field
+// when fields is empty, and indexes the existing rows. Row writes keep it
+// current from then on. Calling it again replaces the field list.
+func (t *Tree) CreateSearchIndex(tablePath string, fields []string) error {
+	if err := t.ValidateTablePath(tablePath); err != nil {
+		return err
+	}
+
+	return t.writeTxn(func(txn *Transaction) error {
+		table, err := txn.bucketAt(tablePath)
+		if err != nil {
+			return err
+		}
+		if table.Bucket([]byte(SearchNode)) != nil {
+			if err := table.DeleteBucket([]byte(SearchNode)); err != nil {
+				return err
+			}
+		}
+		b, err := table.CreateBucket([]byte(SearchNode))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("__fields"), []byte(strings.Join(fields, ","))); err != nil {
+			return err
+		}
+
+		rowIDs, err := txn.rowIDs(tablePath)
+		if err != nil {
+			return err
+		}
+		for _, rowID := range rowIDs {
+			row, _ := txn.bucketAt(tablePath + "/" + rowID)
+			if err := txn.searchRow(tablePath, rowID, rowFromBucket(row)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DropSearchIndex removes the full-text index of a table
+func (t *Tree) DropSearchIndex(tablePath string) error {
+	return t.writeTxn(func(txn *Transaction) error {
+		table, err := txn.bucketAt(tablePath)
+		if err != nil {
+			return err
+		}
+		if table.Bucket([]byte(SearchNode)) == nil {
+			return fmt.Errorf("table %s has no search index", tablePath)
+		}
+		return table.DeleteBucket([]byte(SearchNode))
+	})
+}
+
+// SetPropSearch turns full-text indexing of plain tree props on or off.
+// Turning it on indexes the whole tree; internal nodes, internal props and
+// table rows are left out.
+func (t *Tree) SetPropSearch(enabled bool) error {
+	return t.writeTxn(func(txn *Transaction) error {
+		root, err := txn.createBucketAt("root")
+		if err != nil {
+			return err
+		}
+		if root.Bucket([]byte(SearchNode)) != nil {
+			if err := root.DeleteBucket([]byte(SearchNode)); err != nil {
+				return err
+			}
+		}
+		if !enabled {
+			return nil
+		}
+		if _, err := root.CreateBucket([]byte(SearchNode)); err != nil {
+			return err
+		}
+		return txn.searchProps("root", true)
+	})
+}
+
+// ============================================================================
+// Index Maintenance
+// ============================================================================
+
+// searchRow re-indexes a row of a table with a search index; a nil row
+// only removes it. Called from indexRow so every row write keeps it current.
+func (txn *Transaction) searchRow(tablePath, rowID string, row models.Row) error {
+	b, err := txn.bucketAt(tablePath + "/" + SearchNode)
+	if err != nil {
+		return nil // No search index
+	}
+	idx := searchIndex{bucket: b}
+
+	if err := idx.removePrefix(rowID + searchDocSep); err != nil {
+		return err
+	}
+
+	var fields []string
+	if list := string(b.Get([]byte("__fields"))); list != "" {
+		fields = strings.Split(list, ",")
+	}
+	for field, val := range row {
+		if txn.tree.isSpecialNode(field) || val == nil || val.IsNull() {
+			continue
+		}
+		if len(fields) > 0 && !slices.Contains(fields, field) {
+			continue
+		}
+		if err := idx.add(rowID+searchDocSep+field, val.AsString()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchProps re-indexes the props of the node at p, and of every node
+// below it when recursive, if prop search is on. Nodes that no longer exist
+// are only removed.
+func (txn *Transaction) searchProps(p string, recursive bool) error {
+	b, err := txn.bucketAt(SearchPropsPath)
+	if err != nil {
+		return nil // Prop search is off
+	}
+	idx := searchIndex{bucket: b}
+
+	p = storedPath(p)
+	if err := idx.removePrefix(p + searchDocSep); err != nil {
+		return err
+	}
+	if recursive {
+		if err := idx.removePrefix(p + "/"); err != nil {
+			return err
+		}
+	}
+
+	node, err := txn.bucketAt(p)
+	if err != nil || !txn.propsSearchable(p) {
+		return nil
+	}
+
+	var index func(p string, node *bbolt.Bucket) error
+	index = func(p string, node *bbolt.Bucket) error {
+		var props [][2]string
+		var children []string
+		node.ForEach(func(k, v []byte) error {
+			if txn.tree.isSpecialNode(string(k)) {
+				return nil
+			}
+			if v == nil {
+				children = append(children, string(k))
+			} else if !isSecretProp(node, string(k), string(v)) {
+				props = append(props, [2]string{string(k), string(v)})
+			}
+			return nil
+		})
+
+		for _, prop := range props {
+			if err := idx.add(p+searchDocSep+prop[0], prop[1]); err != nil {
+				return err
+			}
+		}
+
+		// Rows are indexed by their table's own search index
+		if !recursive || string(node.Get([]byte("__type"))) == TypeTable {
+			return nil
+		}
+		for _, child := range children {
+			if err := index(p+"/"+child, node.Bucket([]byte(child))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return index(p, node)
+}
+
+// propsSearchable reports whether the props of the node at p are plain
+// props: not internal and not the fields of a table row
+func (txn *Transaction) propsSearchable(p string) bool {
+	segments := strings.Split(p, "/")
+	for i := range segments[1:] {
+		if txn.tree.isSpecialNode(segments[i+1]) {
+			return false
+		}
+		if b, err := txn.getBucket(segments[:i+1]); err == nil && string(b.Get([]byte("__type"))) == TypeTable {
+			return false
+		}
+	}
+	return true
+}
+
+// storedPath returns p the way its buckets are named
+func storedPath(p string) string {
+	segments := strings.Split(fixpath(p), "/")
+	for i, segment := range segments {
+		segments[i] = sanitizeBucketName(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// add indexes the terms of text under doc
+func (idx searchIndex) add(doc, text string) error {
+	counts := make(map[string]int)
+	for _, token := range tokenize(text) {
+		counts[token]++
+	}
+	if len(counts) == 0 {
+		return nil
+	}
+
+	terms, err := idx.bucket.CreateBucketIfNotExists([]byte(searchTermsNode))
+	if err != nil {
+		return err
+	}
+	docs, err := idx.bucket.CreateBucketIfNotExists([]byte(searchDocsNode))
+	if err != nil {
+		return err
+	}
+
+	list := make([]string, 0, len(counts))
+	for term, count := range counts {
+		termBucket, err := terms.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return err
+		}
+		if err := termBucket.Put([]byte(doc), []byte(strconv.Itoa(count))); err != nil {
+			return err
+		}
+		list = append(list, term)
+	}
+	if err := docs.Put([]byte(doc), []byte(strings.Join(list, " "))); err != nil {
+		return err
+	}
+	return idx.adjustDocCount(1)
+}
+
+// removePrefix unindexes every doc whose key starts with prefix
+func (idx searchIndex) removePrefix(prefix string) error {
+	docs := idx.bucket.Bucket([]byte(searchDocsNode))
+	if docs == nil {
+		return nil
+	}
+
+	// Collect first; deleting while a cursor walks the bucket skips keys
+	type indexedDoc struct{ key, terms string }
+	var stale []indexedDoc
+	c := docs.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+		stale = append(stale, indexedDoc{key: string(k), terms: string(v)})
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	terms := idx.bucket.Bucket([]byte(searchTermsNode))
+	for _, doc := range stale {
+		for _, term := range strings.Fields(doc.terms) {
+			termBucket := terms.Bucket([]byte(term))
+			if termBucket == nil {
+				continue
+			}
+			if err := termBucket.Delete([]byte(doc.key)); err != nil {
+				return err
+			}
+			if k, _ := termBucket.Cursor().First(); k == nil {
+				if err := terms.DeleteBucket([]byte(term)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := docs.Delete([]byte(doc.key)); err != nil {
+			return err
+		}
+	}
+	return idx.adjustDocCount(-len(stale))
+}
+
+// adjustDocCount updates the __doc_count metadata
+func (idx searchIndex) adjustDocCount(delta int) error {
+	count, _ := strconv.Atoi(string(idx.bucket.Get([]byte("__doc_count"))))
+	return idx.bucket.Put([]byte("__doc_count"), []byte(strconv.Itoa(max(count+delta, 0))))
+}
+
+// ============================================================================
+// Search
+// ============================================================================
+
+// Search finds nodes and rows under scope whose text contains every word of
+// text, each word matching a whole term or a term prefix. Plain props are
+// searched when prop search is on, rows in tables with a search index.
+// Hits are ranked by TF-IDF summed over their matching fields, exact terms
+// weighing more than prefixes; limit 0 returns all.
+// Example: Search("root/services", "time", 10)
+func (t *Tree) Search(scope, text string, limit int) ([]SearchHit, error) {
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return nil, errors.New("search text has no terms")
+	}
+	scope = storedPath(scope)
+
+	hits := []SearchHit{}
+	err := t.readTxn(func(txn *Transaction) error {
+		if b, err := txn.bucketAt(SearchPropsPath); err == nil {
+			hits = append(hits, searchIndex{bucket: b}.search(tokens, "", scope)...)
+		}
+
+		// A scope inside a table searches that table only
+		tables := txn.searchTables(scope)
+		for p := scope; strings.Contains(p, "/"); p = p[:strings.LastIndex(p, "/")] {
+			if txn.validateTable(p) == nil {
+				tables = txn.searchTables(p)
+				break
+			}
+		}
+		for _, table := range tables {
+			if b, err := txn.bucketAt(table + "/" + SearchNode); err == nil {
+				hits = append(hits, searchIndex{bucket: b}.search(tokens, table+"/", scope)...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Path < hits[j].Path
+	})
+	if limit > 0 && limit < len(hits) {
+		hits = hits[:limit]
+	}
+	return hits, nil
+}
+
+// searchTables lists the tables with a search index at or below p
+func (txn *Transaction) searchTables(p string) []string {
+	var tables []string
+	for _, table := range txn.tablesUnder(p) {
+		if b, err := txn.bucketAt(table); err == nil && b.Bucket([]byte(SearchNode)) != nil {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// search scores the docs matching every token. Doc keys are prefixed with
+// pathPrefix to form hit paths; hits outside scope are dropped.
+func (idx searchIndex) search(tokens []string, pathPrefix, scope string) []SearchHit {
+	terms := idx.bucket.Bucket([]byte(searchTermsNode))
+	if terms == nil {
+		return nil
+	}
+	total, _ := strconv.Atoi(string(idx.bucket.Get([]byte("__doc_count"))))
+
+	type pathScore struct {
+		score  float64
+		fields map[string]bool
+		tokens int // tokens matched so far
+	}
+	scores := make(map[string]*pathScore)
+
+	for i, token := range tokens {
+		// Score of each path for this token, summed over its fields
+		tokenScores := make(map[string]float64)
+		fields := make(map[string][]string)
+
+		c := terms.Cursor()
+		for k, v := c.Seek([]byte(token)); k != nil && strings.HasPrefix(string(k), token); k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			termBucket := terms.Bucket(k)
+			weight := prefixWeight
+			if string(k) == token {
+				weight = 1
+			}
+
+			var docs [][2]string
+			termBucket.ForEach(func(doc, tf []byte) error {
+				docs = append(docs, [2]string{string(doc), string(tf)})
+				return nil
+			})
+			idf := math.Log(1 + float64(max(total, len(docs)))/float64(len(docs)))
+
+			for _, doc := range docs {
+				docPath, field, _ := strings.Cut(doc[0], searchDocSep)
+				p := pathPrefix + docPath
+				if !within(p, scope) {
+					continue
+				}
+				if i > 0 && scores[p] == nil {
+					continue // Missed an earlier token
+				}
+				tf, _ := strconv.Atoi(doc[1])
+				tokenScores[p] += float64(tf) * weight * idf
+				fields[p] = append(fields[p], field)
+			}
+		}
+
+		for p, score := range tokenScores {
+			ps := scores[p]
+			if ps == nil {
+				ps = &pathScore{fields: make(map[string]bool)}
+				scores[p] = ps
+			}
+			if ps.tokens != i {
+				continue
+			}
+			ps.score += score
+			ps.tokens++
+			for _, field := range fields[p] {
+				ps.fields[field] = true
+			}
+		}
+	}
+
+	var hits []SearchHit
+	for p, ps := range scores {
+		if ps.tokens != len(tokens) {
+			continue
+		}
+		hit := SearchHit{Path: p, Score: ps.score}
+		for field := range ps.fields {
+			hit.Fields = append(hit.Fields, field)
+		}
+		sort.Strings(hit.Fields)
+		hits = append(hits, hit)
+	}
+	return hits
+}
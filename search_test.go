@@ -0,0 +1,245 @@
+package blueconfig
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/sfi2k7/blueconfig/models"
+	"github.com/sfi2k7/microweb"
+)
+
+// hitPaths returns the paths of hits in rank order
+func hitPaths(hits []SearchHit) []string {
+	paths := []string{}
+	for _, hit := range hits {
+		paths = append(paths, hit.Path)
+	}
+	return paths
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"Hello, World!", []string{"hello", "world"}},
+		{"api-gateway.timeout_ms=30", []string{"api", "gateway", "timeout", "ms", "30"}},
+		{"Größe ÜBER", []string{"größe", "über"}},
+		{"  ", []string{}},
+		{strings.Repeat("x", maxTermLength+1) + " short", []string{"short"}},
+	}
+
+	for _, tt := range tests {
+		if got := tokenize(tt.text); fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("tokenize(%q) = %v, want %v", tt.text, got, tt.expected)
+		}
+	}
+}
+
+func TestPropSearch(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetValue("/services/api/description", "Public gateway for orders")
+	if err := tr.SetPropSearch(true); err != nil {
+		t.Fatalf("SetPropSearch: %v", err)
+	}
+	tr.SetValues("/services/web", map[string]interface{}{"description": "Gateway frontend", "owner": "web team"})
+	tr.SaveNode("/services/worker", map[string]interface{}{"description": "Order gateways and queues"})
+
+	tests := []struct {
+		name     string
+		scope    string
+		text     string
+		expected []string
+	}{
+		{"existing props indexed", "", "orders", []string{"root/services/api"}},
+		{"prefix", "", "gate", []string{"root/services/api", "root/services/web", "root/services/worker"}},
+		{"exact ranks above prefix", "", "gateway", []string{"root/services/api", "root/services/web", "root/services/worker"}},
+		{"all words must match", "", "gateway order", []string{"root/services/api", "root/services/worker"}},
+		{"words across props", "", "frontend team", []string{"root/services/web"}},
+		{"scope", "services/web", "gateway", []string{"root/services/web"}},
+		{"case insensitive", "", "PUBLIC", []string{"root/services/api"}},
+		{"no match", "", "missing", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hits, err := tr.Search(tt.scope, tt.text, 0)
+			if err != nil {
+				t.Fatalf("Search returned error: %v", err)
+			}
+			got := hitPaths(hits)
+			if tt.name != "exact ranks above prefix" {
+				// Equal scores fall back to path order
+				got = slices.Sorted(slices.Values(got))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+				t.Errorf("Search(%q, %q) = %v, want %v", tt.scope, tt.text, got, tt.expected)
+			}
+		})
+	}
+
+	hits, _ := tr.Search("", "gateway", 1)
+	if len(hits) != 1 || hits[0].Fields[0] != "description" || hits[0].Score <= 0 {
+		t.Errorf("Search with limit = %+v", hits)
+	}
+	if hits, _ := tr.Search("", "1", 0); len(hits) != 0 {
+		t.Errorf("internal props were indexed: %+v", hits)
+	}
+	if _, err := tr.Search("", " ,. ", 0); err == nil {
+		t.Error("expected error for text without terms")
+	}
+
+	// Write paths keep the index current
+	tr.SetValue("/services/api/description", "Internal billing")
+	tr.DeleteValue("/services/web", "owner")
+	tr.MoveNode("/services/worker", "/jobs/worker")
+	for text, expected := range map[string][]string{
+		"orders":  {},
+		"billing": {"root/services/api"},
+		"team":    {},
+		"queues":  {"root/jobs/worker"},
+	} {
+		if hits, _ := tr.Search("", text, 0); fmt.Sprint(hitPaths(hits)) != fmt.Sprint(expected) {
+			t.Errorf("after writes Search(%q) = %v, want %v", text, hitPaths(hits), expected)
+		}
+	}
+
+	trashID, _ := tr.SoftDeleteNode("/jobs")
+	if hits, _ := tr.Search("", "queues", 0); len(hits) != 0 {
+		t.Errorf("trashed node still searchable: %v", hitPaths(hits))
+	}
+	tr.Restore(trashID)
+	if hits, _ := tr.Search("", "queues", 0); len(hits) != 1 {
+		t.Errorf("restored node not searchable: %v", hitPaths(hits))
+	}
+
+	tr.DeleteNode("/services", true)
+	if hits, _ := tr.Search("", "billing", 0); len(hits) != 0 {
+		t.Errorf("deleted node still searchable: %v", hitPaths(hits))
+	}
+
+	tr.SetPropSearch(false)
+	if hits, _ := tr.Search("", "queues", 0); len(hits) != 0 {
+		t.Errorf("Search with prop search off = %v", hitPaths(hits))
+	}
+}
+
+func TestTableSearch(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	table := "root/blog/posts"
+	tr.CreateDatabase("root/blog", nil)
+	tr.CreateTable("root/blog", "posts")
+	tr.InsertRowWithID(table, "p1", models.NewRow(map[string]interface{}{"title": "Bolt internals", "body": "Buckets all the way down", "author": "buckets fan"}))
+	tr.InsertRowWithID(table, "p2", models.NewRow(map[string]interface{}{"title": "Query planning", "body": "Indexes and buckets"}))
+
+	if err := tr.CreateSearchIndex(table, []string{"title", "body"}); err != nil {
+		t.Fatalf("CreateSearchIndex: %v", err)
+	}
+	tr.InsertRowWithID(table, "p3", models.NewRow(map[string]interface{}{"title": "Planning buckets", "body": "More buckets"}))
+
+	hits, err := tr.Search("", "bucket", 0)
+	if err != nil {
+		t.Fatalf("Search: %v", err)
+	}
+	if paths := slices.Sorted(slices.Values(hitPaths(hits))); fmt.Sprint(paths) != "[root/blog/posts/p1 root/blog/posts/p2 root/blog/posts/p3]" {
+		t.Errorf("Search bucket = %v", paths)
+	}
+	if hits[0].Path != "root/blog/posts/p3" || fmt.Sprint(hits[0].Fields) != "[body title]" {
+		t.Errorf("top hit = %+v", hits[0])
+	}
+	if hits, _ := tr.Search("", "fan", 0); len(hits) != 0 {
+		t.Errorf("unindexed field was searched: %v", hitPaths(hits))
+	}
+	if hits, _ := tr.Search(table+"/p2", "buckets", 0); fmt.Sprint(hitPaths(hits)) != "[root/blog/posts/p2]" {
+		t.Errorf("Search scoped to a row = %v", hitPaths(hits))
+	}
+	if hits, _ := tr.Search("root/other", "buckets", 0); len(hits) != 0 {
+		t.Errorf("Search outside scope = %v", hitPaths(hits))
+	}
+
+	// Row writes keep the index current
+	tr.UpdateRowFields(table, "p2", map[string]interface{}{"title": "Cost models"})
+	tr.DeleteRow(table, "p3")
+	for text, expected := range map[string][]string{
+		"planning": {},
+		"cost":     {"root/blog/posts/p2"},
+		"more":     {},
+	} {
+		if hits, _ := tr.Search("", text, 0); fmt.Sprint(hitPaths(hits)) != fmt.Sprint(expected) {
+			t.Errorf("after writes Search(%q) = %v, want %v", text, hitPaths(hits), expected)
+		}
+	}
+
+	// The index moves with its table
+	if err := tr.RenameTable("root/blog", "posts", "articles"); err != nil {
+		t.Fatalf("RenameTable: %v", err)
+	}
+	if hits, _ := tr.Search("", "cost", 0); fmt.Sprint(hitPaths(hits)) != "[root/blog/articles/p2]" {
+		t.Errorf("Search after rename = %v", hitPaths(hits))
+	}
+
+	if err := tr.DropSearchIndex("root/blog/articles"); err != nil {
+		t.Fatalf("DropSearchIndex: %v", err)
+	}
+	if hits, _ := tr.Search("", "cost", 0); len(hits) != 0 {
+		t.Errorf("Search after DropSearchIndex = %v", hitPaths(hits))
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetPropSearch(true)
+	tr.SetValue("/services/api/description", "Public gateway")
+
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{"hits", "?q=gate&scope=services", `"result":[{"path":"root/services/api","fields":["description"]`},
+		{"no hits", "?q=nothing", `"result":[]`},
+		{"missing text", "", `"error":"q is required"`},
+		{"bad limit", "?q=gate&limit=x", `"error":"invalid limit: x"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tr.handleSearch(adminContext(httptest.NewRequest("GET", "/search"+tt.query, nil), w))
+			if !strings.Contains(w.Body.String(), tt.expected) {
+				t.Errorf("GET /search%s = %s, want %s", tt.query, w.Body.String(), tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleSearchLimitAfterACL(t *testing.T) {
+	fastPasswordHashing(t)
+
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetPropSearch(true)
+	tr.SetValue("/admin/api/description", "Private gateway")
+	tr.SetValue("/services/api/description", "Public gateway")
+	tr.SetRole("services-read", []ACLRule{{Path: "root/services/**", Permissions: []string{PermRead}}})
+	tr.CreateUser("alice", "pw", []string{"services-read"})
+
+	// The unreadable hit ranks first and must not use up the limit
+	w := httptest.NewRecorder()
+	c := &microweb.Context{R: httptest.NewRequest("GET", "/search?q=gateway&limit=1", nil), W: w}
+	withIdentity(c, Identity{User: "alice"})
+	tr.handleSearch(c)
+	if body := w.Body.String(); !strings.Contains(body, `"path":"root/services/api"`) || strings.Contains(body, "root/admin") {
+		t.Errorf("GET /search as alice = %s", body)
+	}
+}
@@ -0,0 +1,443 @@
+package blueconfig
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+// ============================================================================
+// Constants
+// ============================================================================
+
+const (
+	SecretsNode  = "__secrets" // data keys, wrapped by the provider's master keys
+	SecretsPath  = "root/" + SecretsNode
+	SecretPrefix = "enc:v1:" // stored secrets are enc:v1:<data key id>:<base64 nonce+ciphertext>
+	SecretMask   = "********"
+	SecretKeyLen = 32 // AES-256
+)
+
+const secretDataKeysNode = "keys"
+
+var (
+	ErrNoKeyProvider = errors.New("no key provider configured")
+	ErrNotSecret     = errors.New("value is not a secret")
+)
+
+// ============================================================================
+// Key Providers
+// ============================================================================
+
+// KeyProvider supplies the master keys that wrap the data keys of secrets.
+// Keys are 32 bytes. Older keys must stay available until RotateSecretKey
+// has re-wrapped everything under the current one.
+type KeyProvider interface {
+	// CurrentKey returns the key used to wrap new data keys
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeyProvider holds a fixed set of master keys
+type StaticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewStaticKeyProvider creates a provider from "id:base64key" entries;
+// the first entry is the current key
+func NewStaticKeyProvider(entries []string) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{keys: make(map[string][]byte)}
+	for _, entry := range entries {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid key entry, expected id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", id, err)
+		}
+		if len(key) != SecretKeyLen {
+			return nil, fmt.Errorf("key %s: must be %d bytes, got %d", id, SecretKeyLen, len(key))
+		}
+		if _, exists := p.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate key id: %s", id)
+		}
+		if p.current == "" {
+			p.current = id
+		}
+		p.keys[id] = key
+	}
+	if p.current == "" {
+		return nil, errors.New("no keys given")
+	}
+	return p, nil
+}
+
+// NewFileKeyProvider reads "id:base64key" lines from a file, the first one
+// being the current key. Blank lines and lines starting with # are skipped.
+func NewFileKeyProvider(path string) (*StaticKeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open key file: %v", err)
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read key file: %v", err)
+	}
+
+	p, err := NewStaticKeyProvider(entries)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// NewEnvKeyProvider reads comma separated "id:base64key" entries from an
+// environment variable, the first one being the current key
+func NewEnvKeyProvider(name string) (*StaticKeyProvider, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+
+	p, err := NewStaticKeyProvider(strings.Split(value, ","))
+	if err != nil {
+		return nil, fmt.Errorf("environment variable %s: %v", name, err)
+	}
+	return p, nil
+}
+
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key: %s", id)
+	}
+	return key, nil
+}
+
+// ============================================================================
+// Secret Values
+// ============================================================================
+
+// SetKeyProvider sets the provider of the master keys used for secrets
+func (t *Tree) SetKeyProvider(p KeyProvider) {
+	t.keys = p
+}
+
+// SetSecret encrypts value with AES-GCM under the tree's data key and stores
+// it as a property, marking the property as a secret in its node. The data
+// key is created on first use.
+// Example: SetSecret("services/db/password", "s3cret")
+func (t *Tree) SetSecret(p, value string) error {
+	if t.keys == nil {
+		return ErrNoKeyProvider
+	}
+	nodePath, prop, _, err := parsePath(fixpath(p), 1)
+	if err != nil {
+		return err
+	}
+
+	return t.writeTxn(func(txn *Transaction) error {
+		keyID, key, err := txn.activeDataKey(true)
+		if err != nil {
+			return err
+		}
+		sealed, err := sealSecret(keyID, key, value)
+		if err != nil {
+			return err
+		}
+
+		b, err := txn.createBucketAt(nodePath)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(prop), []byte(sealed)); err != nil {
+			return err
+		}
+		if err := b.Put([]byte(secretMarker(prop)), []byte("true")); err != nil {
+			return err
+		}
+		if err := touchNode(nodePath, b, !strings.HasPrefix(prop, "__")); err != nil {
+			return err
+		}
+		return txn.searchProps(nodePath, false)
+	})
+}
+
+// GetSecret decrypts a property stored by SetSecret. Plain values fail
+// with ErrNotSecret.
+func (t *Tree) GetSecret(p string) (string, error) {
+	if t.keys == nil {
+		return "", ErrNoKeyProvider
+	}
+	nodePath, prop, _, err := parsePath(fixpath(p), 1)
+	if err != nil {
+		return "", err
+	}
+
+	var value string
+	err = t.readTxn(func(txn *Transaction) error {
+		b, err := txn.bucketAt(nodePath)
+		if err != nil {
+			return err
+		}
+		stored := b.Get([]byte(prop))
+		if !isSecretProp(b, prop, string(stored)) {
+			return ErrNotSecret
+		}
+		value, err = txn.openSecret(string(stored))
+		return err
+	})
+	return value, err
+}
+
+// IsSecretValue reports whether a stored property value has the form of an
+// encrypted secret. Only props written by SetSecret are treated as secrets.
+func IsSecretValue(v string) bool {
+	return strings.HasPrefix(v, SecretPrefix)
+}
+
+// secretMarker is the node prop that records prop as written by SetSecret
+func secretMarker(prop string) string {
+	return "__secret:" + prop
+}
+
+// isSecretProp reports whether prop of node b holds a secret written by
+// SetSecret; a marked prop later overwritten with a plain value does not
+func isSecretProp(b *bbolt.Bucket, prop, v string) bool {
+	return IsSecretValue(v) && b.Get([]byte(secretMarker(prop))) != nil
+}
+
+// maskSecrets replaces the secrets among props, read from the node at p,
+// with SecretMask. Handlers apply it to reads that return stored values.
+func (t *Tree) maskSecrets(p string, props map[string]string) {
+	t.readTxn(func(txn *Transaction) error {
+		if b, err := txn.bucketAt(fixpath(p)); err == nil {
+			maskSecretProps(b, props)
+		}
+		return nil
+	})
+}
+
+// maskSecretProps replaces the secrets among props read from node bucket b
+func maskSecretProps(b *bbolt.Bucket, props map[string]string) {
+	for prop, v := range props {
+		if isSecretProp(b, prop, v) {
+			props[prop] = SecretMask
+		}
+	}
+}
+
+// RotateSecretKey creates a new data key wrapped by the provider's current
+// key, re-encrypts every secret in the tree under it and drops the old data
+// keys, all in one transaction. It returns the number of secrets rewritten.
+func (t *Tree) RotateSecretKey() (int, error) {
+	if t.keys == nil {
+		return 0, ErrNoKeyProvider
+	}
+
+	count := 0
+	err := t.writeTxn(func(txn *Transaction) error {
+		secrets, err := txn.createBucketAt(SecretsPath)
+		if err != nil {
+			return err
+		}
+		if secrets.Bucket([]byte(secretDataKeysNode)) == nil {
+			return nil // Nothing encrypted yet
+		}
+
+		// Decrypt with the old keys before they are dropped
+		type secretProp struct {
+			bucket      *bbolt.Bucket
+			prop, value string
+		}
+		var found []secretProp
+		root, err := txn.bucketAt("root")
+		if err != nil {
+			return err
+		}
+		var walk func(b *bbolt.Bucket)
+		walk = func(b *bbolt.Bucket) {
+			b.ForEach(func(k, v []byte) error {
+				if v == nil {
+					if b != root || string(k) != SecretsNode {
+						walk(b.Bucket(k))
+					}
+				} else if isSecretProp(b, string(k), string(v)) {
+					found = append(found, secretProp{bucket: b, prop: string(k), value: string(v)})
+				}
+				return nil
+			})
+		}
+		walk(root)
+
+		for i, s := range found {
+			if found[i].value, err = txn.openSecret(s.value); err != nil {
+				return fmt.Errorf("failed to decrypt %s: %v", s.prop, err)
+			}
+		}
+
+		if err := secrets.DeleteBucket([]byte(secretDataKeysNode)); err != nil {
+			return err
+		}
+		keyID, key, err := txn.activeDataKey(true)
+		if err != nil {
+			return err
+		}
+		for _, s := range found {
+			sealed, err := sealSecret(keyID, key, s.value)
+			if err != nil {
+				return err
+			}
+			if err := s.bucket.Put([]byte(s.prop), []byte(sealed)); err != nil {
+				return err
+			}
+		}
+		count = len(found)
+		return nil
+	})
+	return count, err
+}
+
+// activeDataKey returns the data key new secrets are sealed with, creating
+// and wrapping a fresh one when there is none and create is set
+func (txn *Transaction) activeDataKey(create bool) (string, []byte, error) {
+	if secrets, err := txn.bucketAt(SecretsPath); err == nil {
+		if id := string(secrets.Get([]byte("active"))); id != "" {
+			if key, err := txn.dataKey(id); err == nil || !create {
+				return id, key, err
+			}
+		}
+	}
+	if !create {
+		return "", nil, errors.New("no data key")
+	}
+
+	masterID, master, err := txn.tree.keys.CurrentKey()
+	if err != nil {
+		return "", nil, fmt.Errorf("key provider: %v", err)
+	}
+
+	raw := make([]byte, SecretKeyLen+8)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	key, id := raw[:SecretKeyLen], "dk_"+hex.EncodeToString(raw[SecretKeyLen:])
+
+	wrapped, err := sealSecret(masterID, master, string(key))
+	if err != nil {
+		return "", nil, err
+	}
+	keys, err := txn.createBucketAt(SecretsPath + "/" + secretDataKeysNode)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := keys.Put([]byte(id), []byte(wrapped)); err != nil {
+		return "", nil, err
+	}
+	secrets, _ := txn.bucketAt(SecretsPath)
+	if err := secrets.Put([]byte("active"), []byte(id)); err != nil {
+		return "", nil, err
+	}
+	return id, key, nil
+}
+
+// dataKey unwraps a stored data key with the provider's master key
+func (txn *Transaction) dataKey(id string) ([]byte, error) {
+	keys, err := txn.bucketAt(SecretsPath + "/" + secretDataKeysNode)
+	if err != nil {
+		return nil, fmt.Errorf("unknown data key: %s", id)
+	}
+	wrapped := keys.Get([]byte(id))
+	if wrapped == nil {
+		return nil, fmt.Errorf("unknown data key: %s", id)
+	}
+
+	key, err := openWith(string(wrapped), txn.tree.keys.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key %s: %v", id, err)
+	}
+	return []byte(key), nil
+}
+
+// openSecret decrypts a stored secret with its data key
+func (txn *Transaction) openSecret(stored string) (string, error) {
+	return openWith(stored, txn.dataKey)
+}
+
+// sealSecret encrypts plaintext with key; keyID is bound as additional data
+func sealSecret(keyID string, key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(keyID))
+	return SecretPrefix + keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openWith decrypts a sealed value with the key that lookup returns for its key ID
+func openWith(stored string, lookup func(id string) ([]byte, error)) (string, error) {
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(stored, SecretPrefix), ":")
+	if !IsSecretValue(stored) || !ok {
+		return "", ErrNotSecret
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("corrupt secret: %v", err)
+	}
+
+	key, err := lookup(keyID)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("corrupt secret: too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(keyID))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// newGCM creates an AES-GCM cipher for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,204 @@
+package blueconfig
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sfi2k7/blueconfig/models"
+	"github.com/sfi2k7/microweb"
+)
+
+// testKeyEntry returns an "id:base64key" entry with a key filled with b
+func testKeyEntry(id string, b byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), SecretKeyLen)))
+}
+
+func testKeyProvider(t *testing.T, entries ...string) *StaticKeyProvider {
+	t.Helper()
+	p, err := NewStaticKeyProvider(entries)
+	if err != nil {
+		t.Fatalf("NewStaticKeyProvider: %v", err)
+	}
+	return p
+}
+
+func TestKeyProviders(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	os.WriteFile(keyFile, []byte("# master keys\n"+testKeyEntry("k2", 'b')+"\n\n"+testKeyEntry("k1", 'a')+"\n"), 0600)
+
+	fp, err := NewFileKeyProvider(keyFile)
+	if err != nil {
+		t.Fatalf("NewFileKeyProvider: %v", err)
+	}
+	if id, key, _ := fp.CurrentKey(); id != "k2" || key[0] != 'b' {
+		t.Errorf("file provider current key = %s %q", id, key)
+	}
+	if key, err := fp.Key("k1"); err != nil || key[0] != 'a' {
+		t.Errorf("file provider Key(k1) = %q, %v", key, err)
+	}
+	if _, err := fp.Key("k3"); err == nil {
+		t.Error("expected error for unknown key")
+	}
+
+	t.Setenv("TEST_SECRET_KEYS", testKeyEntry("env", 'c')+","+testKeyEntry("old", 'd'))
+	ep, err := NewEnvKeyProvider("TEST_SECRET_KEYS")
+	if err != nil {
+		t.Fatalf("NewEnvKeyProvider: %v", err)
+	}
+	if id, _, _ := ep.CurrentKey(); id != "env" {
+		t.Errorf("env provider current key = %s", id)
+	}
+
+	invalid := [][]string{
+		{},
+		{"nokey"},
+		{"short:" + base64.StdEncoding.EncodeToString([]byte("too short"))},
+		{"bad:!!!"},
+		{testKeyEntry("k", 'a'), testKeyEntry("k", 'b')},
+	}
+	for _, entries := range invalid {
+		if _, err := NewStaticKeyProvider(entries); err == nil {
+			t.Errorf("NewStaticKeyProvider(%v) expected error", entries)
+		}
+	}
+	if _, err := NewEnvKeyProvider("TEST_SECRET_KEYS_UNSET"); err == nil {
+		t.Error("expected error for unset variable")
+	}
+}
+
+func TestSetAndGetSecret(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	if err := tr.SetSecret("/services/db/password", "s3cret"); !errors.Is(err, ErrNoKeyProvider) {
+		t.Errorf("SetSecret without provider: got %v", err)
+	}
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k1", 'a')))
+
+	if err := tr.SetSecret("/services/db/password", "s3cret"); err != nil {
+		t.Fatalf("SetSecret: %v", err)
+	}
+	tr.SetValue("/services/db/host", "db.local")
+
+	if v, err := tr.GetSecret("/services/db/password"); err != nil || v != "s3cret" {
+		t.Errorf("GetSecret = %q, %v", v, err)
+	}
+	if _, err := tr.GetSecret("/services/db/host"); !errors.Is(err, ErrNotSecret) {
+		t.Errorf("GetSecret on a plain value: got %v", err)
+	}
+
+	stored, _ := tr.GetValue("/services/db/password")
+	if !IsSecretValue(stored) || strings.Contains(stored, "s3cret") {
+		t.Errorf("stored secret = %q", stored)
+	}
+
+	// Props reads mask secrets; internal reads see the stored form
+	props, _ := tr.GetAllPropsWithValues("/services/db")
+	if props["password"] != SecretMask || props["host"] != "db.local" {
+		t.Errorf("GetAllPropsWithValues = %v", props)
+	}
+	if raw, _ := tr.rawProps("/services/db"); raw["password"] != stored {
+		t.Errorf("rawProps = %v", raw)
+	}
+
+	// Values that only look like secrets are plain values
+	tr.SetValue("/services/db/note", SecretPrefix+"hello")
+	if _, err := tr.GetSecret("/services/db/note"); !errors.Is(err, ErrNotSecret) {
+		t.Errorf("GetSecret on a lookalike value: got %v", err)
+	}
+	if props, _ := tr.GetAllPropsWithValues("/services/db"); props["note"] != SecretPrefix+"hello" {
+		t.Errorf("GetAllPropsWithValues masked a lookalike value: %v", props)
+	}
+	tr.CreateDatabase("root/app", nil)
+	tr.CreateTable("root/app", "notes")
+	tr.InsertRowWithID("root/app/notes", "n1", models.NewRow(map[string]interface{}{"note": SecretPrefix + "hello"}))
+	if row, _ := tr.GetRow("root/app/notes", "n1"); row["note"] == nil || row["note"].AsString() != SecretPrefix+"hello" {
+		t.Errorf("GetRow of a lookalike value = %v", row)
+	}
+
+	// A tampered secret fails to decrypt
+	tr.SetValue("/services/db/password", stored[:len(stored)-4]+"AAA=")
+	if _, err := tr.GetSecret("/services/db/password"); err == nil {
+		t.Error("expected error for tampered secret")
+	}
+
+	// Another master key can not unwrap the data key
+	tr.SetSecret("/services/db/password", "s3cret")
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k1", 'z')))
+	if _, err := tr.GetSecret("/services/db/password"); err == nil {
+		t.Error("expected error with the wrong master key")
+	}
+}
+
+func TestRotateSecretKey(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k1", 'a')))
+	tr.SetSecret("/services/db/password", "s3cret")
+	tr.SetSecret("/services/api/token", "tok")
+	before, _ := tr.GetValue("/services/db/password")
+
+	// The new master key becomes current while the old one still unwraps
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k2", 'b'), testKeyEntry("k1", 'a')))
+	count, err := tr.RotateSecretKey()
+	if err != nil || count != 2 {
+		t.Fatalf("RotateSecretKey = %d, %v", count, err)
+	}
+	if after, _ := tr.GetValue("/services/db/password"); after == before {
+		t.Error("secret was not re-encrypted")
+	}
+
+	// Only the new master key is needed afterwards
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k2", 'b')))
+	if v, err := tr.GetSecret("/services/db/password"); err != nil || v != "s3cret" {
+		t.Errorf("GetSecret after rotation = %q, %v", v, err)
+	}
+	if v, err := tr.GetSecret("/services/api/token"); err != nil || v != "tok" {
+		t.Errorf("GetSecret after rotation = %q, %v", v, err)
+	}
+
+	// Rotation fails as a whole when an old key is missing
+	tr.SetSecret("/services/web/key", "k")
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k3", 'c')))
+	if _, err := tr.RotateSecretKey(); err == nil {
+		t.Error("expected error rotating without the old master key")
+	}
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k2", 'b')))
+	if v, err := tr.GetSecret("/services/web/key"); err != nil || v != "k" {
+		t.Errorf("GetSecret after failed rotation = %q, %v", v, err)
+	}
+}
+
+func TestSecretsMaskedOverHTTP(t *testing.T) {
+	tr, _ := createTestTree(t)
+	defer cleanup(t, tr)
+
+	tr.SetKeyProvider(testKeyProvider(t, testKeyEntry("k1", 'a')))
+	tr.SetSecret("/services/db/password", "s3cret")
+
+	get := func(handler func(*microweb.Context), p string) string {
+		w := httptest.NewRecorder()
+		handler(adminContext(httptest.NewRequest("GET", p, nil), w))
+		return w.Body.String()
+	}
+	for _, p := range []string{"/root/services/db/password/value", "/root/services/db/values"} {
+		if body := get(tr.handleGetRequest, p); !strings.Contains(body, SecretMask) || strings.Contains(body, SecretPrefix) {
+			t.Errorf("GET %s = %s", p, body)
+		}
+	}
+	if body := get(tr.handleGlob, "/glob?p=services/*&prop=password"); !strings.Contains(body, SecretMask) || strings.Contains(body, SecretPrefix) {
+		t.Errorf("GET /glob = %s", body)
+	}
+
+	// Only props written by SetSecret are masked
+	tr.SetValue("/services/db/note", SecretPrefix+"hello")
+	if body := get(tr.handleGetRequest, "/root/services/db/note/value"); !strings.Contains(body, SecretPrefix+"hello") {
+		t.Errorf("GET lookalike value = %s", body)
+	}
+}
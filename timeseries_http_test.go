@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
@@ -16,10 +16,8 @@ import (
 
 func setupTestHTTPServer(t *testing.T) (*Tree, string, string) {
 	tmpfile := fmt.Sprintf("/tmp/test_http_ts_%d.db", time.Now().UnixNano())
-	port := 9000 + rand.Intn(1000) // Random port between 9000-9999
 	tr, err := NewOrOpenTree(TreeOptions{
 		StorageLocationOnDisk: tmpfile,
-		Port:                  port,
 		Token:                 "test-token",
 	})
 	if err != nil {
@@ -32,12 +30,10 @@ func setupTestHTTPServer(t *testing.T) (*Tree, string, string) {
 		t.Fatal(err)
 	}
 
-	// Start server in background
-	go tr.Serve()
-	time.Sleep(200 * time.Millisecond) // Wait for server to start
+	srv := httptest.NewServer(tr.routes())
+	t.Cleanup(srv.Close)
 
-	baseURL := fmt.Sprintf("http://localhost:%d", port)
-	return tr, tmpfile, baseURL
+	return tr, tmpfile, srv.URL
 }
 
 func makeRequest(t *testing.T, method, url string, body interface{}, token string) *http.Response {
@@ -57,9 +53,7 @@ func makeRequest(t *testing.T, method, url string, body interface{}, token strin
 	}
 
 	if token != "" {
-		q := req.URL.Query()
-		q.Add("token", token)
-		req.URL.RawQuery = q.Encode()
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -93,8 +87,8 @@ func TestHTTP_InitTimeseries(t *testing.T) {
 	tr, tmpfile, baseURL := setupTestHTTPServer(t)
 	defer cleanupTimeseriesTree(tr, tmpfile)
 
-	url := baseURL + "/timeseries/init?token=test-token"
-	resp := makeRequest(t, "POST", url, nil, "")
+	url := baseURL + "/timeseries/init"
+	resp := makeRequest(t, "POST", url, nil, "test-token")
 
 	result := parseResponse(t, resp)
 	if result["error"] != nil {
@@ -0,0 +1,183 @@
+package blueconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sfi2k7/microweb"
+)
+
+// ============================================================================
+// Types
+// ============================================================================
+
+// certReloader serves the certificate and client CAs from files, reloading
+// them when the files change so certificates can be renewed in place
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string // client CA bundle; mTLS when set
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time // newest mod time of certFile and keyFile at load
+	pool    *x509.CertPool
+	caMod   time.Time
+}
+
+// ============================================================================
+// Certificate Loading
+// ============================================================================
+
+// newCertReloader loads the files once so bad paths fail at startup
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("TLS needs both a certificate and a key file")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := r.certificate(); err != nil {
+		return nil, err
+	}
+	if caFile != "" {
+		if _, err := r.clientCAs(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// certificate returns the server certificate, reloading it when the cert or
+// key file changed. A failed reload, such as a half written renewal, keeps
+// serving the previous certificate.
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mod, err := newestModTime(r.certFile, r.keyFile)
+	if err != nil || !mod.After(r.certMod) {
+		if r.cert == nil {
+			return nil, fmt.Errorf("load certificate: %v", err)
+		}
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert == nil {
+			return nil, fmt.Errorf("load certificate: %v", err)
+		}
+		return r.cert, nil
+	}
+	r.cert, r.certMod = &cert, mod
+	return r.cert, nil
+}
+
+// clientCAs returns the pool client certificates are verified against,
+// reloading it when the CA file changed
+func (r *certReloader) clientCAs() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mod, err := newestModTime(r.caFile)
+	if err != nil || !mod.After(r.caMod) {
+		if r.pool == nil {
+			return nil, fmt.Errorf("load client CA: %v", err)
+		}
+		return r.pool, nil
+	}
+
+	pem, err := os.ReadFile(r.caFile)
+	pool := x509.NewCertPool()
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = fmt.Errorf("no certificates in %s", r.caFile)
+	}
+	if err != nil {
+		if r.pool == nil {
+			return nil, fmt.Errorf("load client CA: %v", err)
+		}
+		return r.pool, nil
+	}
+	r.pool, r.caMod = pool, mod
+	return r.pool, nil
+}
+
+// tlsConfig builds a config that picks up reloaded files on each handshake
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, err := r.certificate()
+			if err != nil {
+				return nil, err
+			}
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if r.caFile != "" {
+				pool, err := r.clientCAs()
+				if err != nil {
+					return nil, err
+				}
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = pool
+			}
+			return config, nil
+		},
+	}
+}
+
+func newestModTime(files ...string) (time.Time, error) {
+	var newest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// ============================================================================
+// Client Certificate Identity
+// ============================================================================
+
+// certIdentity maps the verified client certificate of a request to a user.
+// The CN and then the DNS, email and URI SANs are tried in turn, through
+// TreeOptions.ClientCertUsers when it is set and otherwise as user names.
+func (t *Tree) certIdentity(c *microweb.Context) (Identity, bool) {
+	if c.R.TLS == nil || len(c.R.TLS.VerifiedChains) == 0 || len(c.R.TLS.VerifiedChains[0]) == 0 {
+		return Identity{}, false
+	}
+	cert := c.R.TLS.VerifiedChains[0][0]
+
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if t.certUsers != nil {
+			if user, ok := t.certUsers[name]; ok {
+				return Identity{User: user}, true
+			}
+			continue
+		}
+		if t.userExists(name) {
+			return Identity{User: name}, true
+		}
+	}
+	return Identity{}, false
+}
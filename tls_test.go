@@ -0,0 +1,258 @@
+package blueconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns PEM encoded certificate and key for cn; server certificates
+// are valid for 127.0.0.1, client ones carry dnsNames as SANs
+func (ca *testCA) issue(t *testing.T, cn string, server bool, dnsNames ...string) ([]byte, []byte) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCert issues a client certificate for cn with dnsNames as SANs
+func (ca *testCA) clientCert(t *testing.T, cn string, dnsNames ...string) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair(ca.issue(t, cn, false, dnsNames...))
+	if err != nil {
+		t.Fatalf("X509KeyPair: %v", err)
+	}
+	return cert
+}
+
+// writeServerCert writes a server certificate and key into dir, dating the
+// files mod so a reload can tell them apart
+func writeServerCert(t *testing.T, ca *testCA, dir, cn string, mod time.Time) (string, string) {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, cn, true)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	os.WriteFile(certFile, certPEM, 0600)
+	os.WriteFile(keyFile, keyPEM, 0600)
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+	return certFile, keyFile
+}
+
+// startTLSServer serves the tree's routes with its TLS config
+func startTLSServer(t *testing.T, tr *Tree) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(tr.routes())
+	srv.TLS = tr.tls.tlsConfig()
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // refused handshakes are expected
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// tlsClient trusts ca and presents the given client certificates
+func tlsClient(ca *testCA, certs ...tls.Certificate) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool, Certificates: certs}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+func TestTLSServe(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeServerCert(t, ca, dir, "server-1", time.Now().Add(-time.Minute))
+
+	tr, err := NewOrOpenTree(TreeOptions{
+		StorageLocationOnDisk: filepath.Join(dir, "test.db"),
+		Token:                 "test-token",
+		TLSCertFile:           certFile,
+		TLSKeyFile:            keyFile,
+	})
+	if err != nil {
+		t.Fatalf("NewOrOpenTree: %v", err)
+	}
+	defer tr.Close()
+
+	srv := startTLSServer(t, tr)
+	client := tlsClient(ca)
+
+	servedBy := func() string {
+		req, _ := http.NewRequest("GET", srv.URL+"/root", nil)
+		req.Header.Set("Authorization", "Bearer test-token")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET over TLS: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET over TLS = %d", resp.StatusCode)
+		}
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if cn := servedBy(); cn != "server-1" {
+		t.Errorf("served certificate = %s", cn)
+	}
+
+	// A renewed certificate is picked up without a restart
+	writeServerCert(t, ca, dir, "server-2", time.Now())
+	if cn := servedBy(); cn != "server-2" {
+		t.Errorf("served certificate after renewal = %s", cn)
+	}
+
+	// A broken renewal keeps the last good certificate
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if cn := servedBy(); cn != "server-2" {
+		t.Errorf("served certificate after bad renewal = %s", cn)
+	}
+
+	invalid := []TreeOptions{
+		{TLSCertFile: certFile},
+		{TLSCertFile: filepath.Join(dir, "missing.crt"), TLSKeyFile: keyFile},
+		{TLSClientCAFile: filepath.Join(dir, "ca.crt")},
+	}
+	for _, options := range invalid {
+		options.StorageLocationOnDisk = filepath.Join(t.TempDir(), "test.db")
+		if tr, err := NewOrOpenTree(options); err == nil {
+			tr.Close()
+			t.Errorf("NewOrOpenTree(%+v) expected error", options)
+		}
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	fastPasswordHashing(t)
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeServerCert(t, ca, dir, "server", time.Now())
+	caFile := filepath.Join(dir, "ca.crt")
+	os.WriteFile(caFile, ca.pem, 0600)
+
+	tr, err := NewOrOpenTree(TreeOptions{
+		StorageLocationOnDisk: filepath.Join(dir, "test.db"),
+		TLSCertFile:           certFile,
+		TLSKeyFile:            keyFile,
+		TLSClientCAFile:       caFile,
+	})
+	if err != nil {
+		t.Fatalf("NewOrOpenTree: %v", err)
+	}
+	defer tr.Close()
+
+	tr.SetValue("/services/a/port", "80")
+	tr.SetValue("/other/port", "81")
+	tr.SetRole("services-read", []ACLRule{{Path: "root/services/**", Permissions: []string{PermRead}}})
+	tr.CreateUser("alice", "pw", []string{"services-read"})
+
+	srv := startTLSServer(t, tr)
+	get := func(client *http.Client, p string) (int, error) {
+		resp, err := client.Get(srv.URL + p)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	alice := tlsClient(ca, ca.clientCert(t, "alice"))
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/root/services/a/port/value", http.StatusOK},
+		{"/root/other/port/value", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if status, err := get(alice, tt.path); err != nil || status != tt.status {
+			t.Errorf("GET %s as alice = %d, %v; want %d", tt.path, status, err, tt.status)
+		}
+	}
+
+	if status, err := get(tlsClient(ca), "/root"); err == nil {
+		t.Errorf("request without client certificate = %d", status)
+	}
+
+	// Verified certificates that map to no user carry no identity
+	mallory := tlsClient(ca, ca.clientCert(t, "mallory"))
+	if status, err := get(mallory, "/root/services/a/port/value"); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("GET with unmapped certificate = %d, %v", status, err)
+	}
+
+	// Certificates from another CA are refused
+	other := newTestCA(t)
+	stranger := tlsClient(ca, other.clientCert(t, "alice"))
+	if _, err := get(stranger, "/root"); err == nil {
+		t.Error("expected handshake failure for a certificate from another CA")
+	}
+
+	// With ClientCertUsers only mapped names count, here a DNS SAN
+	tr.certUsers = map[string]string{"svc.example.com": "alice"}
+	service := tlsClient(ca, ca.clientCert(t, "deployer", "svc.example.com"))
+	if status, err := get(service, "/root/services/a/port/value"); err != nil || status != http.StatusOK {
+		t.Errorf("GET with mapped SAN = %d, %v", status, err)
+	}
+	if status, err := get(alice, "/root/services/a/port/value"); err != nil || status != http.StatusUnauthorized {
+		t.Errorf("GET with unmapped CN = %d, %v", status, err)
+	}
+}